@@ -3,6 +3,7 @@ package app
 import (
 	"bytes"
 	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -30,6 +31,10 @@ import (
 // - URL: The URL where this server can be contacted externally.
 // - WebSocketTLSCertificate: TLS certificate for the WebSocket
 // - WebSocketTLSCertificateKey: TLS certificate key for the WebSocket
+// - WebSocketTLSRequireClientCert: if true, the WebSocket only accepts clients
+// with a certificate signed by WebSocketTLSClientCA. The handlers find the
+// verified certificate in the TLS state of the http.Request.
+// - WebSocketTLSClientCA: certificates of the CAs accepted for the clients
 type CothorityConfig struct {
 	Suite                      string
 	Public                     string
@@ -41,6 +46,9 @@ type CothorityConfig struct {
 	URL                        string
 	WebSocketTLSCertificate    CertificateURL
 	WebSocketTLSCertificateKey CertificateURL
+
+	WebSocketTLSRequireClientCert bool
+	WebSocketTLSClientCA          CertificateURL
 }
 
 // ServiceConfig is the configuration of a specific service to override
@@ -183,6 +191,25 @@ func ParseCothority(file string) (*CothorityConfig, *onet.Server, error) {
 			server.WebSocket.Unlock()
 		}
 	}
+
+	if hc.WebSocketTLSRequireClientCert {
+		if server.WebSocket.TLSConfig == nil {
+			return nil, nil, xerrors.New("client certificates need a TLS certificate for the WebSocket")
+		}
+		ca, err := hc.WebSocketTLSClientCA.Content()
+		if err != nil {
+			return nil, nil, xerrors.Errorf("getting WebSocketTLSClientCA content: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, nil, xerrors.New("no certificate found in WebSocketTLSClientCA")
+		}
+
+		server.WebSocket.Lock()
+		server.WebSocket.TLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		server.WebSocket.TLSConfig.ClientCAs = pool
+		server.WebSocket.Unlock()
+	}
 	return hc, server, nil
 }
 
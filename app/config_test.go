@@ -2,16 +2,29 @@ package app
 
 import (
 	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
 	"fmt"
 	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
 	"os"
 	"path"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 	"go.dedis.ch/kyber/v3/pairing"
 	"go.dedis.ch/kyber/v3/suites"
+	"go.dedis.ch/kyber/v3/util/encoding"
+	"go.dedis.ch/kyber/v3/util/key"
 	"go.dedis.ch/onet/v3"
 	"go.dedis.ch/onet/v3/log"
 	"go.dedis.ch/onet/v3/network"
@@ -321,3 +334,121 @@ f9Oeos0UUothgiDktdQHxdNEwLjQf7lJJBzV+5OtwswCWA==
 		require.Nil(t, err)
 	}
 }
+
+// clientCertService returns the common name of the verified client
+// certificate.
+type clientCertService struct {
+	*onet.ServiceProcessor
+}
+
+func (s *clientCertService) ProcessClientRequest(req *http.Request, path string, buf []byte) ([]byte, *onet.StreamingTunnel, error) {
+	cn, err := onet.ClientCertCN(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	return []byte(cn), nil, nil
+}
+
+func (s *clientCertService) IsStreaming(path string) (bool, error) {
+	return false, nil
+}
+
+// generateCert returns a self-signed certificate for 127.0.0.1 which can be
+// used by a server and by a client, and its key.
+func generateCert(org string) ([]byte, []byte, error) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{Organization: []string{org}, CommonName: org},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth,
+			x509.ExtKeyUsageClientAuth},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &priv.PublicKey, priv)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: key}), nil
+}
+
+func TestParseCothorityWithClientCert(t *testing.T) {
+	serviceName := "ClientCertService"
+	_, err := onet.RegisterNewService(serviceName, func(c *onet.Context) (onet.Service, error) {
+		return &clientCertService{onet.NewServiceProcessor(c)}, nil
+	})
+	require.NoError(t, err)
+	defer onet.UnregisterService(serviceName)
+
+	serverCert, serverKey, err := generateCert("server")
+	require.NoError(t, err)
+	clientCert, clientKey, err := generateCert("client")
+	require.NoError(t, err)
+	otherCert, otherKey, err := generateCert("other")
+	require.NoError(t, err)
+
+	// The websocket listens on the port following the one of the address.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	port := l.Addr().(*net.TCPAddr).Port
+	require.NoError(t, l.Close())
+
+	suite := suites.MustFind("Ed25519")
+	kp := key.NewKeyPair(suite)
+	pub, err := encoding.PointToStringHex(suite, kp.Public)
+	require.NoError(t, err)
+	priv, err := encoding.ScalarToStringHex(suite, kp.Private)
+	require.NoError(t, err)
+	config := fmt.Sprintf(`Suite = "Ed25519"
+            Public = "%s"
+            Private = "%s"
+            Address = "tls://127.0.0.1:%d"
+            ListenAddress = "127.0.0.1:0"
+            WebSocketTLSCertificate = """string://%s"""
+            WebSocketTLSCertificateKey = """string://%s"""
+            WebSocketTLSRequireClientCert = true
+            WebSocketTLSClientCA = """string://%s"""`,
+		pub, priv, port-1, serverCert, serverKey, clientCert)
+	privateToml, err := ioutil.TempFile("", "temp_private.toml")
+	require.NoError(t, err)
+	defer os.Remove(privateToml.Name())
+	privateToml.WriteString(config)
+	privateToml.Close()
+
+	_, srv, err := ParseCothority(privateToml.Name())
+	require.NoError(t, err)
+	require.Equal(t, tls.RequireAndVerifyClientCert, srv.WebSocket.TLSConfig.ClientAuth)
+	srv.StartInBackground()
+	defer srv.Close()
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(serverCert)
+	send := func(cert, key []byte) ([]byte, error) {
+		cl := onet.NewClient(suite, serviceName)
+		cl.TLSClientConfig = &tls.Config{RootCAs: roots}
+		if cert != nil {
+			c, err := tls.X509KeyPair(cert, key)
+			require.NoError(t, err)
+			cl.TLSClientConfig.Certificates = []tls.Certificate{c}
+		}
+		return cl.Send(srv.ServerIdentity, "path", nil)
+	}
+
+	_, err = send(nil, nil)
+	require.Error(t, err)
+	_, err = send(otherCert, otherKey)
+	require.Error(t, err)
+	reply, err := send(clientCert, clientKey)
+	require.NoError(t, err)
+	require.Equal(t, "client", string(reply))
+}
@@ -0,0 +1,80 @@
+package onet
+
+import (
+	"net/http"
+	"sync"
+
+	"go.dedis.ch/protobuf"
+	"golang.org/x/xerrors"
+)
+
+// CodecHeader is the http header of the websocket handshake with the name of
+// the codec the client uses for its messages. Without it, ProtobufCodec is
+// used.
+const CodecHeader = "Onet-Codec"
+
+// Codec encodes and decodes the messages exchanged between a Client and the
+// services. The services know the codecs registered with RegisterCodec, and
+// a Client chooses one with its Codec field.
+type Codec interface {
+	// Name identifies the codec in the CodecHeader.
+	Name() string
+	// Marshal encodes msg.
+	Marshal(msg interface{}) ([]byte, error)
+	// Unmarshal decodes buf into msg, which is a pointer to a struct. The
+	// constructors create the interfaces found in msg, like the kyber
+	// points and scalars.
+	Unmarshal(buf []byte, msg interface{}, cons protobuf.Constructors) error
+}
+
+// ProtobufCodec is the default codec, encoding the messages with protobuf.
+var ProtobufCodec Codec = protobufCodec{}
+
+type protobufCodec struct{}
+
+func (protobufCodec) Name() string {
+	return "protobuf"
+}
+
+func (protobufCodec) Marshal(msg interface{}) ([]byte, error) {
+	return protobuf.Encode(msg)
+}
+
+func (protobufCodec) Unmarshal(buf []byte, msg interface{}, cons protobuf.Constructors) error {
+	return protobuf.DecodeWithConstructors(buf, msg, cons)
+}
+
+var codecs = struct {
+	sync.Mutex
+	byName map[string]Codec
+}{byName: map[string]Codec{ProtobufCodec.Name(): ProtobufCodec}}
+
+// RegisterCodec makes the services accept the clients using c. It returns
+// an error if another codec with the same name is already registered.
+func RegisterCodec(c Codec) error {
+	codecs.Lock()
+	defer codecs.Unlock()
+	if _, exists := codecs.byName[c.Name()]; exists {
+		return xerrors.Errorf("codec %s is already registered", c.Name())
+	}
+	codecs.byName[c.Name()] = c
+	return nil
+}
+
+// requestCodec returns the codec asked for by the CodecHeader of req.
+func requestCodec(req *http.Request) (Codec, error) {
+	if req == nil {
+		return ProtobufCodec, nil
+	}
+	name := req.Header.Get(CodecHeader)
+	if name == "" {
+		return ProtobufCodec, nil
+	}
+	codecs.Lock()
+	defer codecs.Unlock()
+	c, ok := codecs.byName[name]
+	if !ok {
+		return nil, xerrors.Errorf("unknown codec %s", name)
+	}
+	return c, nil
+}
@@ -2,9 +2,13 @@ package onet
 
 import (
 	"bytes"
+	"compress/gzip"
 	"crypto/sha256"
 	"encoding/binary"
+	"io/ioutil"
+	"reflect"
 	"sync"
+	"time"
 
 	"go.dedis.ch/onet/v3/log"
 	"go.dedis.ch/onet/v3/network"
@@ -118,6 +122,25 @@ func (c *Context) ReportStatus() map[string]*Status {
 	return c.server.statusReporterStruct.ReportStatus()
 }
 
+// OnRosterChange registers fn to be called when a roster including this node
+// is replaced by another one, e.g. for the service to invalidate the state
+// derived from the old roster. Only the leader of the old roster can change it
+// using ChangeRoster, which is verified by its signature. The nodes only in the
+// new roster are notified too, even if they don't know the old one. fn is
+// called for the changes of all rosters, so it has to check if it uses old,
+// and must not block.
+func (c *Context) OnRosterChange(fn func(old, new *Roster)) {
+	c.overlay.onRosterChange(fn)
+}
+
+// ChangeRoster tells all members of old and new that old is replaced by new,
+// which calls their callbacks registered with OnRosterChange, including the
+// ones of this node. It has to be called on the leader of old, the first
+// node of its list. An error is returned if some nodes couldn't be reached.
+func (c *Context) ChangeRoster(old, new *Roster) error {
+	return c.overlay.changeRoster(old, new)
+}
+
 // RegisterStatusReporter registers a new StatusReporter.
 func (c *Context) RegisterStatusReporter(name string, s StatusReporter) {
 	c.server.statusReporterStruct.RegisterStatusReporter(name, s)
@@ -146,6 +169,92 @@ func (c *Context) Service(name string) Service {
 	return c.manager.service(name)
 }
 
+// CallLocalService calls the handler that the service with the given name
+// registered for msg, which must be a pointer to the request struct. The
+// handler is called directly, without encoding the message or sending it over
+// the network, and its reply is returned. The handler gets a shallow copy of
+// msg, so the slices, maps and pointers of msg are shared with the service
+// and must not be modified before the handler returns. The reply can also
+// share memory with the service.
+//
+// Only the services using a ServiceProcessor can be called this way. Use
+// CallService for the others, or for the services of another server.
+func (c *Context) CallLocalService(name string, msg interface{}) (network.Message, error) {
+	mh, err := c.localHandler(name, msg)
+	if err != nil {
+		return nil, err
+	}
+	reply, _, err := callInterfaceFunc(mh.handler, msg, false)
+	if err != nil {
+		return nil, xerrors.Errorf("calling handler: %v", err)
+	}
+	return reply, nil
+}
+
+// CallService sends msg to the service with the given name of si, and
+// decodes its reply in reply, if it is not nil, like Client.SendProtobuf. If
+// si is this server and the service has a handler for msg in its
+// ServiceProcessor, the handler is called directly with CallLocalService and
+// its reply is copied in reply. Otherwise msg goes over the network.
+func (c *Context) CallService(si *network.ServerIdentity, name string,
+	msg, reply interface{}) error {
+	if si.Equal(c.ServerIdentity()) {
+		if _, err := c.localHandler(name, msg); err == nil {
+			ret, err := c.CallLocalService(name, msg)
+			if err != nil {
+				return err
+			}
+			if reply == nil {
+				return nil
+			}
+			retVal := reflect.ValueOf(ret)
+			replyVal := reflect.ValueOf(reply)
+			if retVal.Type() != replyVal.Type() || replyVal.IsNil() {
+				return xerrors.Errorf("reply is a %T, not a %T", ret, reply)
+			}
+			replyVal.Elem().Set(retVal.Elem())
+			return nil
+		}
+	}
+
+	client := NewClient(c.Suite(), name)
+	defer client.Close()
+	if err := client.SendProtobuf(si, msg, reply); err != nil {
+		return xerrors.Errorf("sending request: %v", err)
+	}
+	return nil
+}
+
+// localHandler returns the handler that the service with the given name
+// registered for msg in its ServiceProcessor.
+func (c *Context) localHandler(name string, msg interface{}) (serviceHandler, error) {
+	s := c.Service(name)
+	if s == nil {
+		return serviceHandler{}, xerrors.Errorf("unknown service %s", name)
+	}
+	t := reflect.TypeOf(msg)
+	if t == nil || t.Kind() != reflect.Ptr || t.Elem().Kind() != reflect.Struct {
+		return serviceHandler{}, xerrors.New("message must be a pointer to a struct")
+	}
+	path := t.Elem().Name()
+
+	hp, ok := s.(handlerProvider)
+	if !ok {
+		return serviceHandler{}, xerrors.Errorf("service %s doesn't use a ServiceProcessor", name)
+	}
+	mh, ok := hp.getHandler(path)
+	if !ok {
+		return serviceHandler{}, xerrors.Errorf("service %s has no handler for %s", name, path)
+	}
+	if mh.streaming {
+		return serviceHandler{}, xerrors.New("streaming handlers can't be called locally")
+	}
+	if mh.msgType != t.Elem() {
+		return serviceHandler{}, xerrors.Errorf("handler for %s takes a %v", path, mh.msgType)
+	}
+	return mh, nil
+}
+
 // String returns the host it's running on.
 func (c *Context) String() string {
 	return c.server.ServerIdentity.String()
@@ -213,6 +322,64 @@ func (c *Context) Load(key []byte) (interface{}, error) {
 	return ret, nil
 }
 
+// compressedHeader prefixes the values stored by SaveCompressed, followed by
+// the gzip magic number, to tell them apart from the values stored by Save.
+const compressedHeader = 0x01
+
+// SaveCompressed is like Save but compresses the marshaled data with gzip,
+// for big values. The data has to be loaded with LoadCompressed.
+func (c *Context) SaveCompressed(key []byte, data interface{}) error {
+	buf, err := network.Marshal(data)
+	if err != nil {
+		return xerrors.Errorf("marshaling: %v", err)
+	}
+	var out bytes.Buffer
+	out.WriteByte(compressedHeader)
+	zw := gzip.NewWriter(&out)
+	if _, err := zw.Write(buf); err != nil {
+		return xerrors.Errorf("compressing: %v", err)
+	}
+	if err := zw.Close(); err != nil {
+		return xerrors.Errorf("compressing: %v", err)
+	}
+	err = c.manager.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(c.bucketName).Put(key, out.Bytes())
+	})
+	if err != nil {
+		return xerrors.Errorf("tx error: %v", err)
+	}
+	return nil
+}
+
+// LoadCompressed takes a key and returns the data stored by SaveCompressed,
+// or by Save, so that services can switch to SaveCompressed without
+// migrating their data. Returns a nil value if the key does not exist.
+func (c *Context) LoadCompressed(key []byte) (interface{}, error) {
+	buf, err := c.LoadRaw(key)
+	if err != nil {
+		return nil, xerrors.Errorf("loading: %v", err)
+	}
+	if buf == nil {
+		return nil, nil
+	}
+
+	if len(buf) > 3 && buf[0] == compressedHeader && buf[1] == 0x1f && buf[2] == 0x8b {
+		zr, err := gzip.NewReader(bytes.NewReader(buf[1:]))
+		if err == nil {
+			buf, err = ioutil.ReadAll(zr)
+		}
+		if err != nil {
+			return nil, xerrors.Errorf("decompressing: %v", err)
+		}
+	}
+
+	_, ret, err := network.Unmarshal(buf, c.server.suite)
+	if err != nil {
+		return nil, xerrors.Errorf("unmarshaling: %v", err)
+	}
+	return ret, nil
+}
+
 // LoadRaw takes a key and returns the raw, unmarshalled data.
 // Returns a nil value if the key does not exist.
 func (c *Context) LoadRaw(key []byte) ([]byte, error) {
@@ -282,6 +449,34 @@ func (c *Context) SaveVersion(version int) error {
 	return nil
 }
 
+// RunMigration calls fn to migrate the database of the service, unless a
+// migration with the same name has already been applied. The applied
+// migrations are recorded in the same transaction as the changes of fn, so
+// that a failing migration is run again the next time. Services should call
+// it when they are created, before handling any request.
+func (c *Context) RunMigration(name string, fn func(*bbolt.Tx) error) error {
+	key := []byte("migration_" + name)
+	applied := false
+	err := c.manager.db.Update(func(tx *bbolt.Tx) error {
+		if tx.Bucket(c.bucketVersionName).Get(key) != nil {
+			applied = true
+			return nil
+		}
+		if err := fn(tx); err != nil {
+			return xerrors.Errorf("migration %s: %v", name, err)
+		}
+		now := []byte(time.Now().UTC().Format(time.RFC3339))
+		return tx.Bucket(c.bucketVersionName).Put(key, now)
+	})
+	if err != nil {
+		return xerrors.Errorf("tx error: %v", err)
+	}
+	if !applied {
+		log.Lvlf2("%s: applied migration %s", c, name)
+	}
+	return nil
+}
+
 // GetAdditionalBucket makes sure that a bucket with the given name
 // exists, by eventually creating it, and returns the created bucket name,
 // which is the servicename + "_" + the given name.
@@ -308,6 +503,19 @@ func (c *Context) GetAdditionalBucket(name []byte) (*bbolt.DB, []byte) {
 	return c.manager.db, fullName
 }
 
+// GetServiceDB returns a database of the service stored in its own file
+// next to the database of the server, so that it can be backed up or
+// protected separately. Every name gives another file. The database is closed
+// together with the server, and its file is removed if the database of the
+// server is removed on close.
+func (c *Context) GetServiceDB(name string) (*bbolt.DB, error) {
+	db, err := c.manager.serviceDB(ServiceFactory.Name(c.serviceID), name)
+	if err != nil {
+		return nil, xerrors.Errorf("getting db: %v", err)
+	}
+	return db, nil
+}
+
 // SetValidPeers sets the set of peers with which the server underlying this
 // context can communicate.
 func (c *Context) SetValidPeers(peerID network.PeerSetID,
@@ -335,3 +543,31 @@ func (c *Context) NewPeerSetID(data []byte) network.PeerSetID {
 
 	return network.NewPeerSetID(h.Sum(nil))
 }
+
+// ForEachKey calls fn for every key/value pair stored in the given bucket, in
+// the byte-order of the keys. If bucket is nil, the main bucket of the service
+// is used, else it must be a bucket returned by GetAdditionalBucket. The
+// slices given to fn are only valid during the call. Iteration stops at the
+// first error returned by fn.
+//
+// This is meant for services implementing debug or admin endpoints.
+func (c *Context) ForEachKey(bucket []byte, fn func(k, v []byte) error) error {
+	if bucket == nil {
+		bucket = c.bucketName
+	}
+	prefix := append(append([]byte{}, c.bucketName...), byte('_'))
+	if !bytes.Equal(bucket, c.bucketName) && !bytes.HasPrefix(bucket, prefix) {
+		return xerrors.Errorf("bucket %s is not in the namespace of the service", bucket)
+	}
+	err := c.manager.db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(bucket)
+		if b == nil {
+			return xerrors.Errorf("bucket %s does not exist", bucket)
+		}
+		return b.ForEach(fn)
+	})
+	if err != nil {
+		return xerrors.Errorf("tx error: %v", err)
+	}
+	return nil
+}
@@ -9,8 +9,10 @@ import (
 	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
+	"go.dedis.ch/kyber/v3/sign/schnorr"
 	"go.dedis.ch/kyber/v3/util/key"
 	"go.dedis.ch/onet/v3/log"
 	"go.dedis.ch/onet/v3/network"
@@ -91,6 +93,37 @@ func testLoadSave(t *testing.T, c *Context) {
 	}
 }
 
+func TestContext_SaveCompressed(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "conode")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmp)
+	c := createContext(t, tmp)
+	network.RegisterMessage(ContextData{})
+
+	key := []byte("compressed")
+	cd := &ContextData{42, strings.Repeat("meaning of life ", 1000)}
+	require.NoError(t, c.SaveCompressed(key, cd))
+	stored, err := c.LoadRaw(key)
+	require.NoError(t, err)
+	plain, err := network.Marshal(cd)
+	require.NoError(t, err)
+	require.True(t, len(stored) < len(plain)/10)
+
+	cdInt, err := c.LoadCompressed(key)
+	require.NoError(t, err)
+	require.Equal(t, cd, cdInt)
+
+	// The values stored by Save can still be loaded.
+	require.NoError(t, c.Save(key, cd))
+	cdInt, err = c.LoadCompressed(key)
+	require.NoError(t, err)
+	require.Equal(t, cd, cdInt)
+
+	cdInt, err = c.LoadCompressed([]byte("unknown"))
+	require.NoError(t, err)
+	require.Nil(t, cdInt)
+}
+
 func testSaveFailure(t *testing.T, c *Context) {
 	key := []byte("test")
 	cd := &ContextData{42, "meaning of life"}
@@ -115,6 +148,108 @@ func TestContext_GetAdditionalBucket(t *testing.T) {
 	require.Equal(t, "testService_new", string(name))
 }
 
+func TestContext_ForEachKey(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "conode")
+	log.ErrFatal(err)
+	defer os.RemoveAll(tmp)
+
+	c := createContext(t, tmp)
+	network.RegisterMessage(ContextData{})
+	keys := []string{"c", "a", "d", "b"}
+	for i, k := range keys {
+		require.NoError(t, c.Save([]byte(k), &ContextData{I: int64(i)}))
+	}
+
+	var visited []string
+	err = c.ForEachKey(nil, func(k, v []byte) error {
+		visited = append(visited, string(k))
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{"a", "b", "c", "d"}, visited)
+
+	// The error of the callback must stop the iteration.
+	visited = nil
+	err = c.ForEachKey(nil, func(k, v []byte) error {
+		visited = append(visited, string(k))
+		return xerrors.New("stop")
+	})
+	require.Error(t, err)
+	require.Equal(t, []string{"a"}, visited)
+
+	db, name := c.GetAdditionalBucket([]byte("extra"))
+	err = db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(name).Put([]byte("x"), []byte("y"))
+	})
+	require.NoError(t, err)
+	visited = nil
+	err = c.ForEachKey(name, func(k, v []byte) error {
+		visited = append(visited, string(k)+"="+string(v))
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{"x=y"}, visited)
+
+	// Buckets of other services are not accessible.
+	err = c.ForEachKey([]byte("otherService"), func(k, v []byte) error {
+		return nil
+	})
+	require.Error(t, err)
+}
+
+func TestContext_CallLocalService(t *testing.T) {
+	callerName := "localCallerService"
+	_, err := RegisterNewService(callerName, func(c *Context) (Service, error) {
+		return &DummyService{c: c}, nil
+	})
+	require.NoError(t, err)
+	defer UnregisterService(callerName)
+
+	local := NewTCPTest(tSuite)
+	defer local.CloseAll()
+	servers, _, _ := local.GenTree(2, false)
+
+	caller := servers[0].serviceManager.service(callerName).(*DummyService)
+	callee := servers[0].serviceManager.service(testServiceName).(*testService)
+	tx := servers[0].Router.Tx()
+
+	reply, err := caller.c.CallLocalService(testServiceName, &testMsg{I: 3})
+	require.NoError(t, err)
+	require.Equal(t, int64(3), reply.(*testMsg).I)
+	require.Equal(t, int64(3), callee.Msg.(*testMsg).I)
+	require.Equal(t, tx, servers[0].Router.Tx())
+
+	// CallService stays local for this server, and goes over the network
+	// for the others.
+	ret := &testMsg{}
+	require.NoError(t, caller.c.CallService(servers[0].ServerIdentity,
+		testServiceName, &testMsg{I: 4}, ret))
+	require.Equal(t, int64(4), ret.I)
+	require.Equal(t, int64(4), callee.Msg.(*testMsg).I)
+	require.Equal(t, tx, servers[0].Router.Tx())
+	remote := servers[1].serviceManager.service(testServiceName).(*testService)
+	require.NoError(t, caller.c.CallService(servers[1].ServerIdentity,
+		testServiceName, &testMsg{I: 5}, ret))
+	require.Equal(t, int64(5), ret.I)
+	require.Equal(t, int64(5), remote.Msg.(*testMsg).I)
+	require.Error(t, caller.c.CallService(servers[0].ServerIdentity,
+		testServiceName, &testMsg{I: 6}, &ContextData{}))
+
+	// Services without a ServiceProcessor can only be called through the
+	// network.
+	_, err = caller.c.CallLocalService(callerName, &testMsg{})
+	require.Error(t, err)
+
+	_, err = caller.c.CallLocalService("unknownService", &testMsg{})
+	require.Error(t, err)
+	_, err = caller.c.CallLocalService(testServiceName, testMsg{})
+	require.Error(t, err)
+	_, err = caller.c.CallLocalService(testServiceName, &ContextData{})
+	require.Error(t, err)
+	_, err = caller.c.CallLocalService(testServiceName, &testPanicMsg{})
+	require.Error(t, err)
+}
+
 func TestContext_Path(t *testing.T) {
 	tmp, err := ioutil.TempDir("", "conode")
 	log.ErrFatal(err)
@@ -146,7 +281,187 @@ func TestContext_Path(t *testing.T) {
 	log.ErrFatal(err)
 }
 
+func TestContext_GetServiceDB(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "conode")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmp)
+
+	c1 := createContext(t, tmp)
+	name := "testServiceDB"
+	_, err = RegisterNewService(name, func(c *Context) (Service, error) {
+		return nil, nil
+	})
+	require.NoError(t, err)
+	defer UnregisterService(name)
+	c2 := newContext(c1.server, nil, ServiceFactory.ServiceID(name), c1.manager)
+
+	_, err = c1.GetServiceDB("a/b")
+	require.Error(t, err)
+
+	// Both services get their own file and keep their data.
+	var paths []string
+	for i, c := range []*Context{c1, c2} {
+		db, err := c.GetServiceDB("data")
+		require.NoError(t, err)
+		same, err := c.GetServiceDB("data")
+		require.NoError(t, err)
+		require.Equal(t, db, same)
+		paths = append(paths, db.Path())
+		require.NoError(t, db.Update(func(tx *bbolt.Tx) error {
+			b, err := tx.CreateBucketIfNotExists([]byte("bucket"))
+			if err != nil {
+				return err
+			}
+			return b.Put([]byte("key"), []byte{byte(i)})
+		}))
+	}
+	require.NotEqual(t, paths[0], paths[1])
+	require.NoError(t, c1.manager.closeDatabase())
+
+	sm := &serviceManager{server: c1.server, dbPath: tmp, delDb: true}
+	sm.db, err = openDb(sm.dbFileName())
+	require.NoError(t, err)
+	for i, c := range []*Context{c1, c2} {
+		c.manager = sm
+		db, err := c.GetServiceDB("data")
+		require.NoError(t, err)
+		require.Equal(t, paths[i], db.Path())
+		require.NoError(t, db.View(func(tx *bbolt.Tx) error {
+			require.Equal(t, []byte{byte(i)}, tx.Bucket([]byte("bucket")).Get([]byte("key")))
+			return nil
+		}))
+	}
+
+	// The files are removed together with the database of the server.
+	require.NoError(t, sm.closeDatabase())
+	for _, p := range paths {
+		_, err := os.Stat(p)
+		require.True(t, os.IsNotExist(err))
+	}
+}
+
 // createContext creates the minimum number of things required for the test
+func TestContext_OnRosterChange(t *testing.T) {
+	local := NewLocalTest(tSuite)
+	defer local.CloseAll()
+	servers := local.GenServers(3)
+	old := local.GenRosterFromHost(servers[:2]...)
+	new := local.GenRosterFromHost(servers...)
+
+	type change struct {
+		node     int
+		old, new *Roster
+	}
+	changes := make(chan change, 10)
+	ctxs := make([]*Context, len(servers))
+	for i, s := range servers {
+		i := i
+		ctxs[i] = newContext(s, s.overlay, ServiceFactory.ServiceID(testServiceName), s.serviceManager)
+		ctxs[i].OnRosterChange(func(old, new *Roster) {
+			changes <- change{i, old, new}
+		})
+	}
+
+	require.Error(t, ctxs[1].ChangeRoster(old, new))
+
+	// signedChange returns a change signed by the leader of old.
+	signedChange := func(old, new *Roster, epoch uint64) *RosterChange {
+		hash, err := rosterChangeHash(old, new, epoch)
+		require.NoError(t, err)
+		leader := local.Servers[old.List[0].ID]
+		sig, err := schnorr.Sign(tSuite, leader.private, hash)
+		require.NoError(t, err)
+		return &RosterChange{Old: old, New: new, Epoch: epoch, Signature: sig}
+	}
+
+	// servers[2] is only in new and doesn't know old.
+	for _, s := range servers[:2] {
+		s.overlay.RegisterTree(old.GenerateBinaryTree())
+	}
+
+	// An unknown roster can't pass for another one.
+	tampered := local.GenRosterFromHost(servers[0], servers[2])
+	tampered.ID = old.ID
+	_, err := servers[0].Send(servers[2].ServerIdentity, signedChange(tampered, new, 1))
+	require.NoError(t, err)
+
+	// A change not signed by the leader is ignored.
+	_, err = servers[0].Send(servers[2].ServerIdentity,
+		&RosterChange{Old: old, New: new, Epoch: 1, Signature: []byte("forged")})
+	require.NoError(t, err)
+	// A change not sent by the leader is ignored.
+	_, err = servers[1].Send(servers[2].ServerIdentity, signedChange(old, new, 1))
+	require.NoError(t, err)
+	// A node can't forge a roster with itself as leader.
+	forged := local.GenRosterFromHost(servers[2], servers[1])
+	forged.ID = old.ID
+	_, err = servers[2].Send(servers[1].ServerIdentity, signedChange(forged, new, 1))
+	require.NoError(t, err)
+
+	// All nodes are notified, including servers[2].
+	require.NoError(t, ctxs[0].ChangeRoster(old, new))
+	notified := make(map[int]bool)
+	for range servers {
+		select {
+		case c := <-changes:
+			notified[c.node] = true
+			require.Equal(t, old.ID, c.old.ID)
+			require.Equal(t, new.ID, c.new.ID)
+			require.Equal(t, len(new.List), len(c.new.List))
+		case <-time.After(time.Second):
+			require.Fail(t, "callback not called")
+		}
+	}
+	require.Equal(t, len(servers), len(notified))
+	// An older change can't be replayed.
+	_, err = servers[0].Send(servers[1].ServerIdentity, signedChange(old, new, 1))
+	require.NoError(t, err)
+	select {
+	case <-changes:
+		require.Fail(t, "callback called too often")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestContext_RunMigration(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "conode")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmp)
+
+	c := createContext(t, tmp)
+	defer c.manager.closeDatabase()
+
+	runs := 0
+	migrate := func(tx *bbolt.Tx) error {
+		runs++
+		b, err := tx.CreateBucketIfNotExists([]byte("migrated"))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte("key"), []byte("new format"))
+	}
+	require.NoError(t, c.RunMigration("v2", migrate))
+	require.NoError(t, c.RunMigration("v2", migrate))
+	require.Equal(t, 1, runs)
+
+	// A failing migration is not recorded and its changes are discarded.
+	fail := func(tx *bbolt.Tx) error {
+		runs++
+		if _, err := tx.CreateBucket([]byte("failed")); err != nil {
+			return err
+		}
+		return xerrors.New("wrong data")
+	}
+	require.Error(t, c.RunMigration("v3", fail))
+	require.Error(t, c.RunMigration("v3", fail))
+	require.Equal(t, 3, runs)
+	require.NoError(t, c.manager.db.View(func(tx *bbolt.Tx) error {
+		require.NotNil(t, tx.Bucket([]byte("migrated")))
+		require.Nil(t, tx.Bucket([]byte("failed")))
+		return nil
+	}))
+}
+
 func createContext(t *testing.T, dbPath string) *Context {
 	kp := key.NewKeyPair(tSuite)
 	si := network.NewServerIdentity(kp.Public,
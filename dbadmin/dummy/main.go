@@ -82,7 +82,12 @@ func newService(name string, a action) onet.NewServiceFunc {
 						return err
 					}
 				}
-				return nil
+				nested, err := tx.Bucket([]byte(bName)).CreateBucketIfNotExists(
+					[]byte("nested"))
+				if err != nil {
+					return err
+				}
+				return nested.Put([]byte("key_"+name), []byte("data_"+name))
 			})
 			if err != nil {
 				return nil, xerrors.Errorf("couldn't update db: %+v", err)
@@ -1,7 +1,11 @@
 package main
 
 import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
 	"os"
+	"path/filepath"
 	"regexp"
 
 	"go.etcd.io/bbolt"
@@ -62,6 +66,51 @@ func main() {
 				},
 			},
 		},
+		{
+			Name:   "merge",
+			Usage:  "merge all buckets of several dbs into one",
+			Action: merge,
+			Flags: cli.FlagsByName{
+				cli.StringSliceFlag{
+					Name:      "source,src",
+					Usage:     "Indicate a source database - can be repeated",
+					Required:  true,
+					TakesFile: true,
+				},
+				cli.StringFlag{
+					Name:      "destination,dst",
+					Usage:     "Indicate destination database",
+					Required:  true,
+					TakesFile: true,
+				},
+				cli.BoolFlag{
+					Name: "overwrite",
+					Usage: "allow overwriting of existing buckets - the" +
+						" later sources win",
+					Required: false,
+				},
+			},
+		},
+		{
+			Name:      "export-json",
+			Usage:     "write the key/value pairs of a bucket as hex to a json file",
+			Action:    exportJSON,
+			ArgsUsage: "bucket",
+			Flags: cli.FlagsByName{
+				cli.StringFlag{
+					Name:      "source,src",
+					Usage:     "Indicate source database",
+					Required:  true,
+					TakesFile: true,
+				},
+				cli.StringFlag{
+					Name:      "out,o",
+					Usage:     "Indicate the json file to write",
+					Required:  true,
+					TakesFile: true,
+				},
+			},
+		},
 	}
 	cliApp.Flags = []cli.Flag{
 		cli.IntFlag{
@@ -167,9 +216,7 @@ func extract(c *cli.Context) error {
 					if err != nil {
 						return xerrors.Errorf("couldn't create bucket: %v", err)
 					}
-					return bSrc.ForEach(func(k, v []byte) error {
-						return bDst.Put(k, v)
-					})
+					return copyBucket(bSrc, bDst)
 				}
 				return nil
 			})
@@ -186,3 +233,184 @@ func extract(c *cli.Context) error {
 	}
 	return nil
 }
+
+func merge(c *cli.Context) error {
+	overwrite := c.Bool("overwrite")
+	srcNames := c.StringSlice("source")
+	dstName := c.String("destination")
+	dstAbs, err := filepath.Abs(dstName)
+	if err != nil {
+		return xerrors.Errorf("couldn't get path of '%s': %v", dstName, err)
+	}
+	dstStat, dstErr := os.Stat(dstName)
+	for _, srcName := range srcNames {
+		srcStat, err := os.Stat(srcName)
+		if err != nil {
+			return xerrors.Errorf("cannot read '%s': %v", srcName, err)
+		}
+		srcAbs, err := filepath.Abs(srcName)
+		if err != nil {
+			return xerrors.Errorf("couldn't get path of '%s': %v", srcName, err)
+		}
+		if srcAbs == dstAbs || (dstErr == nil && os.SameFile(srcStat, dstStat)) {
+			return xerrors.Errorf("source '%s' is the destination", srcName)
+		}
+	}
+
+	dbDst, err := bbolt.Open(dstName, 0600, nil)
+	if err != nil {
+		return xerrors.Errorf("couldn't open destination-DB: %v", err)
+	}
+
+	// All sources are copied in one transaction, so that nothing is written
+	// if a bucket collides.
+	err = dbDst.Update(func(txDest *bbolt.Tx) error {
+		for _, srcName := range srcNames {
+			if err := mergeSource(srcName, txDest, overwrite); err != nil {
+				return xerrors.Errorf("merging '%s': %v", srcName, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		dbDst.Close()
+		return xerrors.Errorf("error while copying: %v", err)
+	}
+	if err := dbDst.Close(); err != nil {
+		return xerrors.Errorf("couldn't close destination DB: %v", err)
+	}
+	return nil
+}
+
+// mergeSource copies all buckets of the db srcName into txDest, replacing the
+// existing ones only if overwrite is true.
+func mergeSource(srcName string, txDest *bbolt.Tx, overwrite bool) error {
+	dbSrc, err := bbolt.Open(srcName, 0600, nil)
+	if err != nil {
+		return xerrors.Errorf("couldn't open source-DB: %v", err)
+	}
+	err = dbSrc.View(func(txSrc *bbolt.Tx) error {
+		return txSrc.ForEach(func(name []byte, bSrc *bbolt.Bucket) error {
+			if txDest.Bucket(name) != nil {
+				if !overwrite {
+					return xerrors.Errorf("bucket '%s' already exists",
+						string(name))
+				}
+				if err := txDest.DeleteBucket(name); err != nil {
+					return xerrors.Errorf("couldn't delete bucket: %v", err)
+				}
+			}
+			log.Info("Merging bucket:", string(name))
+			bDst, err := txDest.CreateBucket(name)
+			if err != nil {
+				return xerrors.Errorf("couldn't create bucket: %v", err)
+			}
+			return copyBucket(bSrc, bDst)
+		})
+	})
+	if err != nil {
+		dbSrc.Close()
+		return err
+	}
+	if err := dbSrc.Close(); err != nil {
+		return xerrors.Errorf("couldn't close source DB: %v", err)
+	}
+	return nil
+}
+
+// copyBucket copies all keys of bSrc to bDst, including the nested buckets.
+// The keys and values are copied, as the ones of bSrc are only valid as long
+// as its transaction is open.
+func copyBucket(bSrc, bDst *bbolt.Bucket) error {
+	return bSrc.ForEach(func(k, v []byte) error {
+		k = append([]byte{}, k...)
+		if v != nil {
+			return bDst.Put(k, append([]byte{}, v...))
+		}
+		// ForEach gives a nil value for the nested buckets.
+		nDst, err := bDst.CreateBucket(k)
+		if err != nil {
+			return xerrors.Errorf("couldn't create nested bucket '%s': %v",
+				string(k), err)
+		}
+		return copyBucket(bSrc.Bucket(k), nDst)
+	})
+}
+
+// jsonEntry is a key/value pair written by export-json.
+type jsonEntry struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+func exportJSON(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return xerrors.New("Please give the following arguments: bucket")
+	}
+	bucket := c.Args().First()
+	srcName := c.String("source")
+	if _, err := os.Stat(srcName); err != nil {
+		return xerrors.Errorf("cannot read '%s': %v", srcName, err)
+	}
+	dbSrc, err := bbolt.Open(srcName, 0600, &bbolt.Options{ReadOnly: true})
+	if err != nil {
+		return xerrors.Errorf("couldn't open source-DB: %v", err)
+	}
+	defer dbSrc.Close()
+
+	var out *os.File
+	var w *bufio.Writer
+	n := 0
+	err = dbSrc.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return xerrors.Errorf("bucket '%s' doesn't exist", bucket)
+		}
+		out, err = os.Create(c.String("out"))
+		if err != nil {
+			return xerrors.Errorf("couldn't create output file: %v", err)
+		}
+		// The entries are written one by one, so that big buckets don't
+		// have to fit in memory.
+		w = bufio.NewWriter(out)
+		if _, err := w.WriteString("["); err != nil {
+			return err
+		}
+		cur := b.Cursor()
+		for k, v := cur.First(); k != nil; k, v = cur.Next() {
+			buf, err := json.Marshal(jsonEntry{
+				Key:   hex.EncodeToString(k),
+				Value: hex.EncodeToString(v),
+			})
+			if err != nil {
+				return xerrors.Errorf("encoding: %v", err)
+			}
+			if n > 0 {
+				if _, err := w.WriteString(",\n"); err != nil {
+					return err
+				}
+			}
+			if _, err := w.Write(buf); err != nil {
+				return err
+			}
+			n++
+		}
+		_, err := w.WriteString("]\n")
+		return err
+	})
+	if err != nil {
+		if out != nil {
+			out.Close()
+		}
+		return xerrors.Errorf("error while exporting: %v", err)
+	}
+	if err := w.Flush(); err != nil {
+		out.Close()
+		return xerrors.Errorf("couldn't write output file: %v", err)
+	}
+	if err := out.Close(); err != nil {
+		return xerrors.Errorf("couldn't close output file: %v", err)
+	}
+	log.Infof("Exported %d entries of bucket %s", n, bucket)
+	return nil
+}
@@ -21,6 +21,8 @@ main(){
     run testInspect
     run testExtract
     run testMerge
+    run testMergeDBs
+    run testExportJSON
     stopTest
 }
 
@@ -71,6 +73,38 @@ testMerge(){
   testReGrep Fooversion
 }
 
+testMergeDBs(){
+  BARDB="bar.db"
+  FOODB="foo.db"
+  MERGEDB="merge.db"
+  rm -f ${BARDB} ${FOODB} ${MERGEDB}
+
+  testOK runDA extract --source ${DUMMY_DB} --destination ${BARDB} Bar.*
+  testOK runDA extract --source ${DUMMY_DB} --destination ${FOODB} Foo.*
+  testFail runDA merge --source ${BARDB} --source ${FOODB} \
+      --destination ${BARDB}
+  testOK runDA merge --source ${BARDB} --source ${FOODB} \
+      --destination ${MERGEDB}
+  testGrep Bar_barDB runDA inspect ${MERGEDB}
+  testReGrep Foo_fooDB
+  # 10 keys, the nested bucket and its key
+  testGrep "Has 12 entries" runDA inspect --verbose ${MERGEDB}
+
+  testFail runDA merge --source ${DUMMY_DB} --destination ${MERGEDB}
+  testOK runDA merge --source ${DUMMY_DB} --destination ${MERGEDB} \
+      --overwrite
+}
+
+testExportJSON(){
+  JSON="bar.json"
+  rm -f ${JSON}
+
+  testFail runDA export-json --source ${DUMMY_DB} --out ${JSON}
+  testFail runDA export-json --source ${DUMMY_DB} --out ${JSON} Unknown
+  testOK runDA export-json --source ${DUMMY_DB} --out ${JSON} Bar_barDB
+  testGrep '"key"' cat ${JSON}
+}
+
 runDA(){
     ./dbadmin --debug ${DBG_DA} "$@"
 }
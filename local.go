@@ -6,6 +6,7 @@ import (
 	"io/ioutil"
 	"net"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -171,6 +172,65 @@ func (l *LocalTest) CreateProtocol(name string, t *Tree) (ProtocolInstance, erro
 	return nil, xerrors.New("Didn't find server for tree-root")
 }
 
+// SimulateTimeout is how long SimulateProtocol waits for all protocol
+// instances to be done.
+var SimulateTimeout = 10 * time.Second
+
+// SimulateProtocol runs the protocol 'name' on a tree of 'nodes' servers using
+// the Local transport. Once the root instance is created, setup is called with
+// it, so that it can be configured before it is started. SimulateProtocol
+// returns when all instances are done, or with an error if this doesn't happen
+// within SimulateTimeout. All servers are closed before returning.
+func SimulateProtocol(suite network.Suite, nodes int, name string,
+	setup func(ProtocolInstance)) error {
+	return SimulateProtocolWithDelays(suite, nodes, name, setup, nil)
+}
+
+// SimulateProtocolWithDelays is like SimulateProtocol, but every message
+// received by the server at index i of the roster is delayed by delays[i].
+func SimulateProtocolWithDelays(suite network.Suite, nodes int, name string,
+	setup func(ProtocolInstance), delays map[int]time.Duration) (err error) {
+	local := NewLocalTest(suite)
+	defer func() {
+		if err != nil {
+			// Don't abort on the leftovers of a failed protocol, the
+			// error is returned to the caller.
+			local.Check = CheckNone
+		}
+		local.CloseAll()
+	}()
+
+	_, roster, tree := local.GenTree(nodes, true)
+	for i, d := range delays {
+		if i < 0 || i >= len(roster.List) {
+			return xerrors.Errorf("no node with index %d", i)
+		}
+		local.SetDelay(roster.List[i], d)
+	}
+
+	pi, err := local.CreateProtocol(name, tree)
+	if err != nil {
+		return xerrors.Errorf("creating protocol: %v", err)
+	}
+	if setup != nil {
+		setup(pi)
+	}
+	if err := pi.Start(); err != nil {
+		return xerrors.Errorf("starting protocol: %v", err)
+	}
+	// Poll often, as WaitDone only checks every tenth of its timeout.
+	deadline := time.Now().Add(SimulateTimeout)
+	for {
+		err := local.WaitDone(100 * time.Millisecond)
+		if err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return xerrors.Errorf("waiting for protocol: %v", err)
+		}
+	}
+}
+
 // GenServers returns n Servers with a localRouter
 func (l *LocalTest) GenServers(n int) []*Server {
 	l.panicClosed()
@@ -233,6 +293,30 @@ func (l *LocalTest) GenRosterFromHost(servers ...*Server) *Roster {
 	return NewRoster(entities)
 }
 
+// SetDelay holds back all messages sent to the given server for d before
+// they are delivered. It only has an effect with the Local transport.
+func (l *LocalTest) SetDelay(si *network.ServerIdentity, d time.Duration) {
+	l.panicClosed()
+	if l.mode != Local {
+		log.Warn("Delays are only supported by the Local transport")
+		return
+	}
+	l.ctx.SetDelay(si.Address, d)
+}
+
+// SimulateAuthentication makes the connections of the Local transport carry
+// the public key of the server dialing them, which the server accepting
+// them checks against the ServerIdentity it receives, like over TLS. It only
+// has an effect with the Local transport.
+func (l *LocalTest) SimulateAuthentication(enable bool) {
+	l.panicClosed()
+	if l.mode != Local {
+		log.Warn("Simulated authentication is only supported by the Local transport")
+		return
+	}
+	l.ctx.SimulateAuthentication(enable)
+}
+
 func (l *LocalTest) panicClosed() {
 	if l.closed {
 		panic("attempt to use LocalTest after CloseAll")
@@ -255,9 +339,14 @@ func (l *LocalTest) WaitDone(t time.Duration) error {
 			o.instancesLock.Unlock()
 		}
 		for _, s := range l.Servers {
-			disp, ok := s.serviceManager.Dispatcher.(*network.RoutineDispatcher)
-			if ok && disp.GetRoutines() > 0 {
-				lingering = append(lingering, fmt.Sprintf("RoutineDispatcher has %v routines running on %s", disp.GetRoutines(), s.ServerIdentity))
+			disp := s.serviceManager.getDispatcher()
+			if r, ok := disp.(interface{ GetRoutines() int }); ok && r.GetRoutines() > 0 {
+				lingering = append(lingering, fmt.Sprintf("%T has %v routines running on %s",
+					disp, r.GetRoutines(), s.ServerIdentity))
+			}
+			if q, ok := disp.(interface{ GetQueued() int }); ok && q.GetQueued() > 0 {
+				lingering = append(lingering, fmt.Sprintf("%T has %v messages queued on %s",
+					disp, q.GetQueued(), s.ServerIdentity))
 			}
 		}
 		if len(lingering) == 0 {
@@ -268,6 +357,37 @@ func (l *LocalTest) WaitDone(t time.Duration) error {
 	return xerrors.New("still have things lingering: " + strings.Join(lingering, "\n"))
 }
 
+// CheckLeaks returns an error listing the protocol instances still known to
+// the overlays, and the connections still open in the routers. Called after
+// CloseAll, it makes sure the test didn't leave anything behind. It returns nil
+// if nothing is leaking.
+func (l *LocalTest) CheckLeaks() error {
+	var leaks []string
+	for _, o := range l.Overlays {
+		o.instancesLock.Lock()
+		for tok, pi := range o.protocolInstances {
+			leaks = append(leaks, fmt.Sprintf("ProtocolInstance type %T on %s with id %s",
+				pi, o.ServerIdentity(), tok))
+		}
+		for tok := range o.instances {
+			if o.protocolInstances[tok] == nil {
+				leaks = append(leaks, fmt.Sprintf("TreeNodeInstance on %s with id %s",
+					o.ServerIdentity(), tok))
+			}
+		}
+		o.instancesLock.Unlock()
+		for _, peer := range o.server.ConnectedPeers() {
+			leaks = append(leaks, fmt.Sprintf("Connection from %s to %s",
+				o.ServerIdentity(), peer))
+		}
+	}
+	if len(leaks) == 0 {
+		return nil
+	}
+	sort.Strings(leaks)
+	return xerrors.New("leaking resources: " + strings.Join(leaks, "\n"))
+}
+
 // CloseAll closes all the servers.
 func (l *LocalTest) CloseAll() {
 	log.Lvl3("Stopping all")
@@ -147,6 +147,90 @@ func TestWaitDone(t *testing.T) {
 	}
 }
 
+func TestSimulateProtocol(t *testing.T) {
+	name := "SimulateBackForth"
+	_, err := GlobalProtocolRegister(name, func(n *TreeNodeInstance) (ProtocolInstance, error) {
+		return newBackForthProtocol(n)
+	})
+	require.NoError(t, err)
+
+	result := make(chan int, 1)
+	setup := func(pi ProtocolInstance) {
+		p := pi.(*BackForthProtocol)
+		p.Val = 42
+		p.handler = func(val int) { result <- val }
+	}
+	require.NoError(t, SimulateProtocol(tSuite, 5, name, setup))
+	require.Equal(t, 42, <-result)
+
+	// A slow node holds back the whole round trip.
+	delay := 200 * time.Millisecond
+	start := time.Now()
+	require.NoError(t, SimulateProtocolWithDelays(tSuite, 5, name, setup,
+		map[int]time.Duration{4: delay}))
+	require.Equal(t, 42, <-result)
+	require.True(t, time.Since(start) >= delay)
+
+	require.Error(t, SimulateProtocolWithDelays(tSuite, 5, name, setup,
+		map[int]time.Duration{5: delay}))
+}
+
+type authTestMsg struct {
+	I int
+}
+
+func TestLocalTest_SimulateAuthentication(t *testing.T) {
+	l := NewLocalTest(tSuite)
+	defer l.CloseAll()
+	l.SimulateAuthentication(true)
+	servers := l.GenServers(3)
+
+	received := make(chan *network.ServerIdentity, 2)
+	servers[2].RegisterProcessorFunc(network.RegisterMessage(authTestMsg{}),
+		func(env *network.Envelope) error {
+			received <- env.ServerIdentity
+			return nil
+		})
+
+	_, err := servers[0].Send(servers[2].ServerIdentity, &authTestMsg{1})
+	require.NoError(t, err)
+	require.True(t, (<-received).Equal(servers[0].ServerIdentity))
+
+	// servers[1] proves another key than the one of its ServerIdentity, so
+	// servers[2] refuses the connection.
+	l.ctx.SetCertificate(servers[1].ServerIdentity.Address,
+		servers[0].ServerIdentity.Public)
+	log.OutputToBuf()
+	defer log.OutputToOs()
+	servers[1].Send(servers[2].ServerIdentity, &authTestMsg{2})
+	select {
+	case si := <-received:
+		t.Fatalf("message from %v accepted", si)
+	case <-time.After(200 * time.Millisecond):
+	}
+	require.Contains(t, log.GetStdErr(), "mismatch between certificate")
+	require.Equal(t, 1, len(servers[2].ConnectedPeers()))
+}
+
+func TestLocalTest_CheckLeaks(t *testing.T) {
+	l := NewLocalTest(tSuite)
+	servers, _, tree := l.GenTree(2, true)
+
+	// A protocol which is never done and an open connection.
+	pi, err := l.CreateProtocol(spawnName, tree)
+	require.NoError(t, err)
+	_, err = servers[0].Send(servers[1].ServerIdentity, &SimpleMessage{})
+	require.NoError(t, err)
+	err = l.CheckLeaks()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "ProtocolInstance type *onet.spawnProto")
+	require.Contains(t, err.Error(), "Connection from "+servers[0].ServerIdentity.String())
+
+	pi.(*spawnProto).Done()
+	l.CloseAll()
+	require.NoError(t, l.CheckLeaks())
+}
+
 type clientService struct {
 	*ServiceProcessor
 	cl     *Client
@@ -42,6 +42,32 @@ type Logger interface {
 	GetLoggerInfo() *LoggerInfo
 }
 
+// Backend is the interface of an external logging library receiving the
+// messages of the standard logger, e.g. when onet is embedded in an
+// application having its own logging.
+type Backend interface {
+	Log(level int, msg string)
+}
+
+// Levels given to Logger.Log and Backend.Log for the messages of Info,
+// Print, Warn, Error, Fatal and Panic. Lvl1 to Lvl5 use the levels 1 to 5,
+// and LLvl1 to LLvl5 use the levels -1 to -5.
+const (
+	LevelWarning = lvlWarning
+	LevelError   = lvlError
+	LevelFatal   = lvlFatal
+	LevelPanic   = lvlPanic
+	LevelInfo    = lvlInfo
+	LevelPrint   = lvlPrint
+)
+
+// StdLimited is an additional interface of the loggers that must not get
+// more messages than the standard logger shows, taking the levels of
+// SetDebugVisiblePackage into account, even if their DebugLvl is higher.
+type StdLimited interface {
+	LimitedToStd() bool
+}
+
 // Tracer is an additional interface that specifies a tracer extension to
 //onet/log.
 type Tracer interface {
@@ -65,8 +91,19 @@ var (
 	// concurrent access is protected by debugMut
 	loggers        = make(map[int]Logger)
 	loggersCounter int
+	backend        Backend
 )
 
+// SetBackend sends all messages of the standard logger to b instead of
+// writing them to the standard output and error. Which messages are sent is
+// still decided by the debug-level of the standard logger. Setting a nil
+// Backend writes the messages to the standard output and error again.
+func SetBackend(b Backend) {
+	debugMut.Lock()
+	defer debugMut.Unlock()
+	backend = b
+}
+
 // RegisterLogger will register a callback that will receive a copy of every
 // message, fully formatted. It returns the key assigned to the logger (used
 // to unregister the logger).
@@ -130,6 +167,20 @@ type stdLogger struct {
 }
 
 func (sl *stdLogger) Log(lvl int, msg string) {
+	if backend != nil {
+		backend.Log(lvl, msg)
+		return
+	}
+
+	if outputFormat == OutputJSON {
+		if lvl < lvlInfo {
+			fmt.Fprintln(stdErr, msg)
+		} else {
+			fmt.Fprintln(stdOut, msg)
+		}
+		return
+	}
+
 	// If the DEBUG_LVL is 0 or -1, don't print any colors or line-info,
 	// but just print plain text.
 	// 0 is the default level
@@ -105,3 +105,41 @@ func TestStdLoggerZero(t *testing.T) {
 	str = GetStdOut()
 	assert.Equal(t, 2, len(strings.Split(str, "\n")), str)
 }
+
+type captureBackend struct {
+	levels []int
+	msgs   []string
+}
+
+func (c *captureBackend) Log(lvl int, msg string) {
+	c.levels = append(c.levels, lvl)
+	c.msgs = append(c.msgs, msg)
+}
+
+func TestSetBackend(t *testing.T) {
+	defer SetDebugVisible(DebugVisible())
+	SetDebugVisible(2)
+	GetStdOut()
+	GetStdErr()
+
+	c := &captureBackend{}
+	SetBackend(c)
+	Lvl1("one")
+	Lvl2("two")
+	Lvl3("three")
+	Info("info")
+	Warn("warn")
+	Error("error")
+	SetBackend(nil)
+
+	require.Equal(t, []int{1, 2, LevelInfo, LevelWarning, LevelError}, c.levels)
+	for i, m := range []string{"one", "two", "info", "warn", "error"} {
+		require.Contains(t, c.msgs[i], m)
+	}
+	require.Equal(t, "", GetStdOut())
+	require.Equal(t, "", GetStdErr())
+
+	Lvl1("console")
+	require.Contains(t, GetStdOut(), "console")
+	require.Equal(t, 5, len(c.levels))
+}
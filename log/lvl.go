@@ -1,6 +1,7 @@
 package log
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"os"
@@ -9,6 +10,7 @@ import (
 	"runtime"
 	"runtime/pprof"
 	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -33,6 +35,20 @@ const (
 	FormatNone = 0
 )
 
+// OutputFormat is the format of the log lines, as set by SetOutputFormat.
+type OutputFormat int
+
+const (
+	// OutputText writes human-readable lines, which is the default.
+	OutputText OutputFormat = iota
+	// OutputJSON writes one JSON object per line, with the level, the time,
+	// the caller and the message, for log aggregation pipelines.
+	OutputJSON
+)
+
+// outputFormat of the log lines, protected by debugMut
+var outputFormat OutputFormat
+
 // defaultMainTest indicates what debug-level should be used when `go test -v`
 // is called.
 const defaultMainTest = 2
@@ -62,6 +78,10 @@ var outputLines = true
 
 var debugMut sync.RWMutex
 
+// debug-levels of the standard logger for some packages, protected by
+// debugMut
+var packageLevels = make(map[string]int)
+
 var regexpPaths, _ = regexp.Compile(".*/")
 
 func init() {
@@ -79,11 +99,19 @@ func init() {
 func lvl(lvl, skip int, args ...interface{}) {
 	debugMut.Lock()
 	defer debugMut.Unlock()
-	for _, l := range loggers {
+	stdLvl := stdDebugLvl(skip)
+	for key, l := range loggers {
 		// Get the *LoggerInfo that contains how the formatting should be done.
 		lInfo := l.GetLoggerInfo()
 
-		if lvl > lInfo.DebugLvl {
+		debugLvl := lInfo.DebugLvl
+		if key == 0 {
+			debugLvl = stdLvl
+		} else if sl, ok := l.(StdLimited); ok && sl.LimitedToStd() &&
+			debugLvl > stdLvl {
+			debugLvl = stdLvl
+		}
+		if lvl > debugLvl {
 			continue
 		}
 
@@ -92,6 +120,10 @@ func lvl(lvl, skip int, args ...interface{}) {
 		// strings. So the trailing "\n" needs to be removed.
 		message := fmt.Sprintln(args...)
 		message = message[:len(message)-1]
+		if outputFormat == OutputJSON {
+			l.Log(lvl, jsonLine(lInfo, lvl, skip+1, message))
+			continue
+		}
 		if lInfo.RawMessage {
 			l.Log(lvl, message)
 			continue
@@ -162,12 +194,64 @@ func lvl(lvl, skip int, args ...interface{}) {
 	}
 }
 
+// jsonLine returns the message as a JSON object, with the caller at the given
+// depth.
+func jsonLine(lInfo *LoggerInfo, lvl, skip int, message string) string {
+	_, fn, line, _ := runtime.Caller(skip)
+	name := fn
+	if !lInfo.AbsoluteFilePath {
+		name = filepath.Base(fn)
+	}
+	if !outputLines {
+		line = 0
+		name = "fake_name.go"
+	}
+	buf, err := json.Marshal(struct {
+		Level  string `json:"level"`
+		Time   string `json:"time"`
+		Caller string `json:"caller"`
+		Msg    string `json:"msg"`
+	}{
+		Level:  levelName(lvl),
+		Time:   time.Now().Format(time.RFC3339Nano),
+		Caller: fmt.Sprintf("%s:%d", name, line),
+		Msg:    message,
+	})
+	if err != nil {
+		// Only strings are encoded, so it doesn't happen.
+		return message
+	}
+	return string(buf)
+}
+
+// levelName returns the name of the level in the JSON lines.
+func levelName(lvl int) string {
+	switch lvl {
+	case lvlPrint:
+		return "print"
+	case lvlInfo:
+		return "info"
+	case lvlWarning:
+		return "warning"
+	case lvlError:
+		return "error"
+	case lvlFatal:
+		return "fatal"
+	case lvlPanic:
+		return "panic"
+	}
+	if lvl < 0 {
+		return strconv.Itoa(-lvl) + "!"
+	}
+	return strconv.Itoa(lvl)
+}
+
 // Needs two functions to keep the caller-depth the same and find who calls us
 // Lvlf1 -> Lvlf -> lvl
 // or
 // Lvl1 -> lvld -> lvl
 func lvlf(l int, f string, args ...interface{}) {
-	if !isVisible(l) {
+	if !isVisible(l, 3) {
 		return
 	}
 	lvl(l, 3, fmt.Sprintf(f, args...))
@@ -289,10 +373,14 @@ func DebugVisible() int {
 	return loggers[0].GetLoggerInfo().DebugLvl
 }
 
-// isVisible returns true if at least one logger wants to use the message
-func isVisible(lvl int) bool {
+// isVisible returns true if at least one logger wants to use the message of
+// the caller at the given depth.
+func isVisible(lvl, skip int) bool {
 	debugMut.RLock()
 	defer debugMut.RUnlock()
+	if lvl <= stdDebugLvl(skip) {
+		return true
+	}
 	for _, logger := range loggers {
 		if lvl <= logger.GetLoggerInfo().DebugLvl {
 			return true
@@ -301,6 +389,71 @@ func isVisible(lvl int) bool {
 	return false
 }
 
+// stdDebugLvl returns the debug-level of the standard logger for the package
+// of the caller at the given depth, as set by SetDebugVisiblePackage, or the
+// global one. debugMut must be held.
+func stdDebugLvl(skip int) int {
+	lvl := loggers[0].GetLoggerInfo().DebugLvl
+	if len(packageLevels) == 0 {
+		return lvl
+	}
+	pc, _, _, ok := runtime.Caller(skip + 1)
+	if !ok {
+		return lvl
+	}
+	pkg := funcPackage(runtime.FuncForPC(pc).Name())
+	// The longest matching package wins.
+	match := ""
+	for p, l := range packageLevels {
+		if (pkg == p || strings.HasSuffix(pkg, "/"+p)) && len(p) > len(match) {
+			match = p
+			lvl = l
+		}
+	}
+	return lvl
+}
+
+// funcPackage returns the package of a function name as given by
+// runtime.Func, like "go.dedis.ch/onet/v3/network.(*Router).Start".
+func funcPackage(name string) string {
+	slash := strings.LastIndex(name, "/")
+	dot := strings.Index(name[slash+1:], ".")
+	if dot < 0 {
+		return name
+	}
+	return name[:slash+1+dot]
+}
+
+// SetDebugVisiblePackage overrides the debug-level of the standard logger
+// for the messages of the given package, e.g. to debug a single subsystem.
+// The package is matched by suffix on whole path elements, so "network"
+// matches "go.dedis.ch/onet/v3/network", but "work" doesn't. If more than one
+// override matches, the longest wins. The other packages use the level of
+// SetDebugVisible.
+func SetDebugVisiblePackage(pkg string, level int) {
+	debugMut.Lock()
+	defer debugMut.Unlock()
+	packageLevels[pkg] = level
+}
+
+// UnsetDebugVisiblePackage removes the override of SetDebugVisiblePackage
+// for the package.
+func UnsetDebugVisiblePackage(pkg string) {
+	debugMut.Lock()
+	defer debugMut.Unlock()
+	delete(packageLevels, pkg)
+}
+
+// SetOutputFormat sets the format of the log lines for all loggers. In OutputJSON,
+// the loggers asking for the raw message get the JSON lines too, and the
+// standard output is neither colored nor padded. The lines are still filtered
+// by the debug-level.
+func SetOutputFormat(f OutputFormat) {
+	debugMut.Lock()
+	defer debugMut.Unlock()
+	outputFormat = f
+}
+
 // SetShowTime allows for turning on the flag that adds the current
 // time to the debug-output
 func SetShowTime(show bool) {
@@ -1,6 +1,7 @@
 package log
 
 import (
+	"encoding/json"
 	"flag"
 	"os"
 	"strings"
@@ -39,6 +40,87 @@ func TestTime(t *testing.T) {
 	}
 }
 
+func TestOutputJSON(t *testing.T) {
+	SetDebugVisible(1)
+	GetStdOut()
+	GetStdErr()
+	SetOutputFormat(OutputJSON)
+	defer SetOutputFormat(OutputText)
+
+	Lvl1("json", "line")
+	Lvl2("not visible")
+	Error("json error")
+
+	var line struct {
+		Level  string
+		Time   string
+		Caller string
+		Msg    string
+	}
+	out := GetStdOut()
+	require.Equal(t, 1, strings.Count(out, "\n"))
+	require.NoError(t, json.Unmarshal([]byte(out), &line))
+	require.Equal(t, "1", line.Level)
+	require.Equal(t, "fake_name.go:0", line.Caller)
+	require.Equal(t, "json line", line.Msg)
+	_, err := time.Parse(time.RFC3339Nano, line.Time)
+	require.NoError(t, err)
+
+	require.NoError(t, json.Unmarshal([]byte(GetStdErr()), &line))
+	require.Equal(t, "error", line.Level)
+	require.Equal(t, "json error", line.Msg)
+
+	// The level 0 doesn't change the format.
+	SetDebugVisible(0)
+	defer SetDebugVisible(1)
+	Info("json info")
+	require.NoError(t, json.Unmarshal([]byte(GetStdOut()), &line))
+	require.Equal(t, "info", line.Level)
+
+	SetOutputFormat(OutputText)
+	Info("text info")
+	require.Equal(t, "text info\n", GetStdOut())
+}
+
+func TestSetDebugVisiblePackage(t *testing.T) {
+	SetDebugVisible(1)
+	GetStdOut()
+
+	SetDebugVisiblePackage("network", 3)
+	Lvl3("not visible")
+	require.Equal(t, "", GetStdOut())
+
+	SetDebugVisiblePackage("onet/v3/log", 3)
+	defer UnsetDebugVisiblePackage("onet/v3/log")
+	Lvl3("visible")
+	Lvlf3("visible %d", 3)
+	Lvl4("not visible")
+	out := GetStdOut()
+	require.Contains(t, out, "visible\n")
+	require.Contains(t, out, "visible 3\n")
+	require.NotContains(t, out, "not visible")
+
+	// The longest match wins, and "og" isn't a package.
+	SetDebugVisiblePackage("log", 0)
+	SetDebugVisiblePackage("og", 5)
+	defer UnsetDebugVisiblePackage("log")
+	defer UnsetDebugVisiblePackage("og")
+	Lvl3("visible")
+	require.Contains(t, GetStdOut(), "visible")
+	UnsetDebugVisiblePackage("onet/v3/log")
+	Lvl1("not visible")
+	require.Equal(t, "", GetStdOut())
+
+	UnsetDebugVisiblePackage("log")
+	UnsetDebugVisiblePackage("network")
+	Lvl1("visible")
+	Lvl2("not visible")
+	require.Equal(t, "1 : fake_name.go:0 (log.TestSetDebugVisiblePackage) - visible\n", GetStdOut())
+
+	require.Equal(t, "go.dedis.ch/onet/v3/network", funcPackage("go.dedis.ch/onet/v3/network.(*Router).Start"))
+	require.Equal(t, "main", funcPackage("main.main"))
+}
+
 func TestFlags(t *testing.T) {
 	lvl := DebugVisible()
 	time := ShowTime()
@@ -6,7 +6,7 @@ import (
 )
 
 func lvlUI(l int, args ...interface{}) {
-	if isVisible(l) {
+	if isVisible(l, 3) {
 		lvl(l, 3, args...)
 	}
 }
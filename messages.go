@@ -30,6 +30,12 @@ var SendRosterMsgID = RosterTypeID
 // ConfigMsgID of the generic config message
 var ConfigMsgID = network.RegisterMessage(ConfigMsg{})
 
+// DeadlineMsgID of the deadline message
+var DeadlineMsgID = network.RegisterMessage(DeadlineMsg{})
+
+// RosterChangeMsgID of RosterChange message as registered in network
+var RosterChangeMsgID = network.RegisterMessage(RosterChange{})
+
 // ProtocolMsg is to be embedded in every message that is made for a
 // ProtocolInstance
 type ProtocolMsg struct {
@@ -58,6 +64,14 @@ type ConfigMsg struct {
 	Dest   TokenID
 }
 
+// DeadlineMsg is sent by the overlay like ConfigMsg, before the first message
+// to a protocol instance with a deadline. The Deadline is in nanoseconds
+// since the Unix epoch.
+type DeadlineMsg struct {
+	Deadline int64
+	Dest     TokenID
+}
+
 // RoundID uniquely identifies a round of a protocol run
 type RoundID uuid.UUID
 
@@ -171,12 +185,60 @@ type RequestTree struct {
 	TreeID TreeID
 	// Version of the request tree
 	Version uint32
+	// RosterID of the roster the requester already knows. When it matches
+	// the roster of the tree, the roster is left out of the response.
+	RosterID RosterID
 }
 
 // ResponseTree contains the information to build a tree
 type ResponseTree struct {
 	TreeMarshal *TreeMarshal
-	Roster      *Roster
+	// Roster is nil if the requester announced it already knows it
+	Roster *Roster
+	// View is the optional secondary roster of the tree
+	View *Roster
+}
+
+// VerifyRoster asks a conode if it knows the roster with the given ID and if
+// its list of servers is the same as the one of the client.
+type VerifyRoster struct {
+	RosterID RosterID
+	// ListID is the result of GetID on the roster of the client
+	ListID RosterID
+}
+
+// VerifyRosterReply tells if the roster is known by the conode and if the
+// lists of servers match.
+type VerifyRosterReply struct {
+	Known    bool
+	Matching bool
+}
+
+// LogStream asks a conode to stream its log lines up to the given level. The
+// token must be the one given to WebSocket.SetLogStream.
+type LogStream struct {
+	Token string
+	Level int
+}
+
+// LogStreamReply holds one log line, as formatted by the log package, with
+// its level.
+type LogStreamReply struct {
+	Level int
+	Msg   string
+}
+
+// RosterChange tells the nodes of the rosters that Old is replaced by New. It
+// is sent and signed by the leader of Old, which is the only node allowed to
+// change it.
+type RosterChange struct {
+	Old *Roster
+	New *Roster
+	// Epoch orders the changes of Old: a node only accepts a change with a
+	// higher epoch than the last one it accepted, so a change can't be
+	// replayed.
+	Epoch     uint64
+	Signature []byte
 }
 
 // RosterUnknown is used in case the entity list is unknown
@@ -143,6 +143,99 @@ func (d *RoutineDispatcher) GetRoutines() int {
 	return d.routines
 }
 
+// maxBoundedQueue is how many messages a BoundedRoutineDispatcher keeps while
+// all its go routines are busy. Further messages are dropped.
+const maxBoundedQueue = 1000
+
+// BoundedRoutineDispatcher dispatches messages to the Processors in go
+// routines, like RoutineDispatcher, but never runs more than a fixed number
+// of them. Messages arriving while all go routines are busy are queued, and
+// dropped if the queue is full.
+type BoundedRoutineDispatcher struct {
+	*BlockingDispatcher
+	workers int
+	// routines counts how many routines are running and queue holds the
+	// messages waiting for one of them
+	routines   int
+	queue      []dispatchJob
+	queueMutex sync.Mutex
+}
+
+type dispatchJob struct {
+	p      Processor
+	packet *Envelope
+}
+
+// NewBoundedRoutineDispatcher returns a fresh BoundedRoutineDispatcher
+// running at most the given number of go routines, which must be at least 1.
+func NewBoundedRoutineDispatcher(workers int) *BoundedRoutineDispatcher {
+	if workers < 1 {
+		workers = 1
+	}
+	return &BoundedRoutineDispatcher{
+		BlockingDispatcher: NewBlockingDispatcher(),
+		workers:            workers,
+	}
+}
+
+// Dispatch implements the Dispatcher interface. It will give the packet to the
+// right Processor in a go routine, or queue it if all go routines are busy.
+func (d *BoundedRoutineDispatcher) Dispatch(packet *Envelope) error {
+	d.Lock()
+	var p = d.procs[packet.MsgType]
+	d.Unlock()
+	if p == nil {
+		return xerrors.New("no Processor attached to this message type")
+	}
+
+	d.queueMutex.Lock()
+	defer d.queueMutex.Unlock()
+	job := dispatchJob{p, packet}
+	if d.routines < d.workers {
+		d.routines++
+		go d.work(job)
+		return nil
+	}
+	if len(d.queue) >= maxBoundedQueue {
+		log.Warnf("dropping message of type %v from %v: dispatch queue is full",
+			packet.MsgType, packet.ServerIdentity)
+		return xerrors.New("dispatch queue is full")
+	}
+	d.queue = append(d.queue, job)
+	return nil
+}
+
+// work processes the given job, then the queued ones until there is none left.
+func (d *BoundedRoutineDispatcher) work(job dispatchJob) {
+	for {
+		job.p.Process(job.packet)
+
+		d.queueMutex.Lock()
+		if len(d.queue) == 0 {
+			d.routines--
+			d.queueMutex.Unlock()
+			return
+		}
+		job = d.queue[0]
+		d.queue = d.queue[1:]
+		d.queueMutex.Unlock()
+	}
+}
+
+// GetRoutines returns how many routines are running.
+func (d *BoundedRoutineDispatcher) GetRoutines() int {
+	d.queueMutex.Lock()
+	defer d.queueMutex.Unlock()
+	return d.routines
+}
+
+// GetQueued returns how many messages are waiting for a routine.
+func (d *BoundedRoutineDispatcher) GetQueued() int {
+	d.queueMutex.Lock()
+	defer d.queueMutex.Unlock()
+	return len(d.queue)
+}
+
 type defaultProcessor struct {
 	fn func(*Envelope) error
 }
@@ -1,10 +1,13 @@
 package network
 
 import (
+	"runtime"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 type basicProcessor struct {
@@ -94,6 +97,49 @@ func TestRoutineDispatcher(t *testing.T) {
 	}
 }
 
+func TestBoundedRoutineDispatcher(t *testing.T) {
+	workers := 4
+	dispatcher := NewBoundedRoutineDispatcher(workers)
+	require.Error(t, dispatcher.Dispatch(&Envelope{
+		Msg:     basicMessage{10},
+		MsgType: basicMessageType}))
+
+	var mut sync.Mutex
+	var running, maxRunning int
+	var wg sync.WaitGroup
+	dispatcher.RegisterProcessorFunc(basicMessageType, func(e *Envelope) error {
+		mut.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		mut.Unlock()
+		time.Sleep(time.Millisecond)
+		mut.Lock()
+		running--
+		mut.Unlock()
+		wg.Done()
+		return nil
+	})
+
+	nbrMsgs := 200
+	before := runtime.NumGoroutine()
+	wg.Add(nbrMsgs)
+	for i := 0; i < nbrMsgs; i++ {
+		require.NoError(t, dispatcher.Dispatch(&Envelope{
+			Msg:     basicMessage{i},
+			MsgType: basicMessageType}))
+		require.True(t, dispatcher.GetRoutines() <= workers)
+		require.True(t, runtime.NumGoroutine() <= before+workers)
+	}
+	wg.Wait()
+	require.Equal(t, 0, dispatcher.GetQueued())
+
+	mut.Lock()
+	require.Equal(t, workers, maxRunning)
+	mut.Unlock()
+}
+
 func TestDefaultProcessor(t *testing.T) {
 	var okCh = make(chan bool, 1)
 	pr := defaultProcessor{func(e *Envelope) error {
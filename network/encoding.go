@@ -4,7 +4,9 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"io"
 	"reflect"
+	"sort"
 	"sync"
 
 	"go.dedis.ch/kyber/v3/pairing/bn256"
@@ -131,28 +133,58 @@ func MessageType(msg Message) MessageTypeID {
 // struct encoded by protobuf.  That slice of bytes can be then decoded with
 // Unmarshal. msg must be a pointer to the message.
 func Marshal(msg Message) ([]byte, error) {
+	msgType, buf, err := encodeMessage(msg)
+	if err != nil {
+		return nil, xerrors.Errorf("encoding: %v", err)
+	}
+	b := bytes.NewBuffer(make([]byte, 0, len(msgType)+len(buf)))
+	b.Write(msgType[:])
+	b.Write(buf)
+	return b.Bytes(), nil
+}
+
+// MarshalTo writes the same bytes as Marshal to w. The message is still
+// encoded in memory by protobuf, but the type and the encoded message are
+// written one after the other instead of being copied to a second buffer,
+// which saves one copy of big messages.
+func MarshalTo(w io.Writer, msg Message) error {
+	msgType, buf, err := encodeMessage(msg)
+	if err != nil {
+		return xerrors.Errorf("encoding: %v", err)
+	}
+	if err := writeMessage(w, msgType, buf); err != nil {
+		return xerrors.Errorf("writing: %v", err)
+	}
+	return nil
+}
+
+// writeMessage writes the type of a message, then the message encoded by
+// encodeMessage, to w.
+func writeMessage(w io.Writer, msgType MessageTypeID, buf []byte) error {
+	if _, err := w.Write(msgType[:]); err != nil {
+		return xerrors.Errorf("writing type: %w", err)
+	}
+	if _, err := w.Write(buf); err != nil {
+		return xerrors.Errorf("writing message: %w", err)
+	}
+	return nil
+}
+
+// encodeMessage returns the type of msg and its protobuf encoding.
+func encodeMessage(msg Message) (MessageTypeID, []byte, error) {
 	var msgType MessageTypeID
 	if msgType = MessageType(msg); msgType == ErrorType {
-		return nil, xerrors.Errorf("type of message %s not registered to the network library", reflect.TypeOf(msg))
+		return ErrorType, nil, xerrors.Errorf("type of message %s not registered to the network library", reflect.TypeOf(msg))
 	}
-	b := new(bytes.Buffer)
-	if err := binary.Write(b, globalOrder, msgType); err != nil {
-		return nil, xerrors.Errorf("buffer write: %v", err)
-	}
-	var buf []byte
-	var err error
-	if buf, err = protobuf.Encode(msg); err != nil {
+	buf, err := protobuf.Encode(msg)
+	if err != nil {
 		log.Errorf("Error for protobuf encoding: %s %+v", msg, err)
 		if log.DebugVisible() > 0 {
 			log.Error(log.Stack())
 		}
-		return nil, xerrors.Errorf("encoding: %v", err)
+		return ErrorType, nil, xerrors.Errorf("encoding: %v", err)
 	}
-	_, err = b.Write(buf)
-	if err != nil {
-		return nil, xerrors.Errorf("buffer write: %v", err)
-	}
-	return b.Bytes(), nil
+	return msgType, buf, nil
 }
 
 // Unmarshal returns the type and the message out of a buffer. One can cast the
@@ -179,13 +211,47 @@ func Unmarshal(buf []byte, suite Suite) (MessageTypeID, Message, error) {
 	return tID, ptrVal.Interface(), nil
 }
 
-// DumpTypes is used for debugging - it prints out all known types
+// DumpTypes is used for debugging - it prints out all known types to the
+// log. To compare the types of two binaries, use DumpTypesTo instead.
 func DumpTypes() {
-	for t, m := range registry.types {
+	for m, t := range RegisteredTypes() {
 		log.Print("Type", t, "has message", m)
 	}
 }
 
+// RegisteredTypes returns the name of every registered message with its
+// MessageTypeID. As the IDs are derived from the names, comparing the result
+// of two binaries shows which messages they don't agree on.
+func RegisteredTypes() map[string]MessageTypeID {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+	types := make(map[string]MessageTypeID, len(registry.types))
+	for id, t := range registry.types {
+		types[t.String()] = id
+	}
+	return types
+}
+
+// DumpTypesTo writes one line per registered message with its name and its
+// MessageTypeID, sorted by name, so that the output of two binaries can be
+// compared with diff. It is DumpTypes writing to w, which keeps its own
+// signature for the existing callers.
+func DumpTypesTo(w io.Writer) error {
+	types := RegisteredTypes()
+	names := make([]string, 0, len(types))
+	for name := range types {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		id := types[name]
+		if _, err := fmt.Fprintf(w, "%s %s\n", name, uuid.UUID(id)); err != nil {
+			return xerrors.Errorf("writing: %v", err)
+		}
+	}
+	return nil
+}
+
 // DefaultConstructors gives a default constructor for protobuf out of the global suite
 func DefaultConstructors(suite Suite) protobuf.Constructors {
 	constructors := make(protobuf.Constructors)
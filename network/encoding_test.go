@@ -1,7 +1,9 @@
 package network
 
 import (
+	"bytes"
 	"crypto/rand"
+	"fmt"
 	"github.com/google/uuid"
 	"go.dedis.ch/kyber/v3/pairing"
 	"go.dedis.ch/kyber/v3/pairing/bn256"
@@ -65,6 +67,28 @@ func TestRegisterMessages(t *testing.T) {
 	registry = oldRegistry
 }
 
+func TestRegisteredTypes(t *testing.T) {
+	oldRegistry := registry
+	registry = newTypeRegistry()
+	defer func() { registry = oldRegistry }()
+	ids := RegisterMessages(&TestRegisterS2{}, &TestRegisterS1{}, &TestContainer1{})
+
+	types := RegisteredTypes()
+	require.Equal(t, 3, len(types))
+	require.Equal(t, ids[0], types["network.TestRegisterS2"])
+	require.Equal(t, ids[1], types["network.TestRegisterS1"])
+	require.Equal(t, ids[2], types["network.TestContainer1"])
+	// The IDs only depend on the names, so they don't change between builds.
+	require.Equal(t, "0adebfe7-37c3-59c0-b25d-5121ff58b08a",
+		uuid.UUID(types["network.TestRegisterS1"]).String())
+
+	var buf bytes.Buffer
+	require.NoError(t, DumpTypesTo(&buf))
+	require.Equal(t, fmt.Sprintf("network.TestContainer1 %s\n"+
+		"network.TestRegisterS1 %s\nnetwork.TestRegisterS2 %s\n",
+		uuid.UUID(ids[2]), uuid.UUID(ids[1]), uuid.UUID(ids[0])), buf.String())
+}
+
 func TestUnmarshalRegister(t *testing.T) {
 	trType := RegisterMessage(&TestRegisterS1{})
 	buff, err := Marshal(&TestRegisterS1{10})
@@ -83,6 +107,19 @@ func TestUnmarshalRegister(t *testing.T) {
 	assert.Equal(t, ErrorType, ty)
 }
 
+func TestMarshalTo(t *testing.T) {
+	msg := &BigMsg{Array: make([]byte, 4*StreamThreshold)}
+	rand.Read(msg.Array)
+	buf, err := Marshal(msg)
+	require.NoError(t, err)
+
+	var w bytes.Buffer
+	require.NoError(t, MarshalTo(&w, msg))
+	require.Equal(t, buf, w.Bytes())
+
+	require.Error(t, MarshalTo(&w, &struct{ I int64 }{}))
+}
+
 func TestMarshalKyberTypes(t *testing.T) {
 	RegisterMessages(&TestRegisterS3{})
 	testMKT(t, pairing.NewSuiteBn256())
@@ -4,6 +4,7 @@ import (
 	"sync"
 	"time"
 
+	"go.dedis.ch/kyber/v3"
 	"golang.org/x/xerrors"
 )
 
@@ -27,6 +28,7 @@ func NewLocalRouterWithManager(lm *LocalManager, sid *ServerIdentity, s Suite) (
 	if err != nil {
 		return nil, xerrors.Errorf("local router: %v", err)
 	}
+	lm.SetCertificate(sid.Address, sid.Public)
 	r := NewRouter(sid, h)
 	r.UnauthOk = true
 	return r, nil
@@ -41,6 +43,12 @@ type LocalManager struct {
 	sync.Mutex
 	// The listening-functions used when a new connection-request arrives.
 	listening map[Address]func(Conn)
+	// delays holds how long messages to an address are held back.
+	delays map[Address]time.Duration
+	// certificates holds the public key proven by the host at an address,
+	// used if authenticate is true.
+	certificates map[Address]kyber.Point
+	authenticate bool
 
 	// connection-counter for giving unique IDs to each connection.
 	counter uint64
@@ -57,7 +65,10 @@ func NewLocalManager() *LocalManager {
 	return &LocalManager{
 		conns:     make(map[endpoint]*LocalConn),
 		listening: make(map[Address]func(Conn)),
+		delays:    make(map[Address]time.Duration),
 		stopping:  make(chan bool),
+
+		certificates: make(map[Address]kyber.Point),
 	}
 }
 
@@ -105,6 +116,45 @@ func (lm *LocalManager) unsetListening(addr Address) {
 	delete(lm.listening, addr)
 }
 
+// SetDelay holds back every message received by addr for the given duration
+// before it is delivered, which allows to simulate slow nodes. The order of
+// the messages on a connection is kept. A duration of 0 removes the delay.
+func (lm *LocalManager) SetDelay(addr Address, d time.Duration) {
+	lm.Lock()
+	defer lm.Unlock()
+	if d <= 0 {
+		delete(lm.delays, addr)
+		return
+	}
+	lm.delays[addr] = d
+}
+
+// SimulateAuthentication makes the new connections carry the public key of
+// the certificate of the host dialing them, as set by SetCertificate. Like
+// for a TLS connection, the Router accepting the connection then rejects it
+// if the public key of the ServerIdentity sent by the peer is different.
+func (lm *LocalManager) SimulateAuthentication(enable bool) {
+	lm.Lock()
+	defer lm.Unlock()
+	lm.authenticate = enable
+}
+
+// SetCertificate sets the public key that the connections dialed from addr
+// prove to the other side if SimulateAuthentication is enabled. The local
+// routers set the key of their ServerIdentity.
+func (lm *LocalManager) SetCertificate(addr Address, pub kyber.Point) {
+	lm.Lock()
+	defer lm.Unlock()
+	lm.certificates[addr] = pub
+}
+
+// delay returns the delay set for addr.
+func (lm *LocalManager) delay(addr Address) time.Duration {
+	lm.Lock()
+	defer lm.Unlock()
+	return lm.delays[addr]
+}
+
 // connect checks if the remote address is listening. Then it creates
 // the two connections, and launches the listening function in a go routine.
 // It returns the outgoing connection, or nil followed by an error, if any.
@@ -128,6 +178,10 @@ func (lm *LocalManager) connect(local, remote Address, s Suite) (*LocalConn, err
 
 	outgoing := newLocalConn(lm, outEndpoint, incEndpoint, s)
 	incoming := newLocalConn(lm, incEndpoint, outEndpoint, s)
+	if lm.authenticate {
+		incoming.authenticated = true
+		incoming.peerPublic = lm.certificates[local]
+	}
 
 	// map the endpoint to the connection
 	lm.conns[outEndpoint] = outgoing
@@ -219,6 +273,11 @@ type LocalConn struct {
 
 	// the suite used to unmarshal
 	suite Suite
+
+	// if authenticated is true, peerPublic is the public key proven by the
+	// remote host, like the certificate of a TLS connection
+	authenticated bool
+	peerPublic    kyber.Point
 }
 
 // newLocalConn initializes the fields of a LocalConn but doesn't
@@ -256,16 +315,27 @@ func NewLocalConnWithManager(lm *LocalManager, local, remote Address, s Suite) (
 }
 
 func (lc *LocalConn) start(wg *sync.WaitGroup) {
+	stop := func() {
+		// to signal that the conn is closed
+		close(lc.outgoingQueue)
+		close(lc.incomingQueue)
+		lc.closeConfirm <- true
+		wg.Done()
+	}
 	for {
 		select {
 		case buff := <-lc.incomingQueue:
+			if d := lc.manager.delay(lc.local.addr); d > 0 {
+				select {
+				case <-time.After(d):
+				case <-lc.closeCh:
+					stop()
+					return
+				}
+			}
 			lc.outgoingQueue <- buff
 		case <-lc.closeCh:
-			// to signal that the conn is closed
-			close(lc.outgoingQueue)
-			close(lc.incomingQueue)
-			lc.closeConfirm <- true
-			wg.Done()
+			stop()
 			return
 		}
 	}
@@ -2,9 +2,14 @@ package network
 
 import (
 	"crypto/tls"
+	"os"
 	"strings"
 	"sync"
+	"time"
 
+	"github.com/BurntSushi/toml"
+	"go.dedis.ch/kyber/v3"
+	"go.dedis.ch/kyber/v3/util/encoding"
 	"go.dedis.ch/onet/v3/log"
 	"golang.org/x/xerrors"
 )
@@ -34,10 +39,18 @@ type Router struct {
 	// can be opened at the same time on both endpoints, there can be more
 	// than one connection per ServerIdentityID.
 	connections map[ServerIdentityID][]Conn
+	// identities keeps the ServerIdentity of every peer in connections.
+	identities map[ServerIdentityID]*ServerIdentity
+	// activity keeps when every connection in connections has last been
+	// used, and if it is being closed for being idle.
+	activity map[Conn]*connActivity
 	sync.Mutex
 
 	// boolean flag indicating that the router is already clos{ing,ed}.
 	isClosed bool
+	// closed when Drain is called, after which no new connection is made
+	draining     chan struct{}
+	drainingOnce sync.Once
 
 	// wg waits for all handleConn routines to be done.
 	wg sync.WaitGroup
@@ -53,18 +66,62 @@ type Router struct {
 	// If paused is not nil, then handleConn will stop processing. When unpaused
 	// it will break the connection. This is for testing node failure cases.
 	paused chan bool
+	// Like paused, but only for the connections of some peers.
+	pausedPeers map[ServerIdentityID]chan bool
+	// If processing is not nil, it bounds the number of messages dispatched
+	// at the same time over all connections.
+	processing chan bool
 	// This field should only be set during testing. It disables an important
 	// log message meant to discourage TCP connections.
 	UnauthOk bool
 	// Quiets the startup of the server if set to true.
 	Quiet bool
+	// HandshakeTimeout is the maximum time an incoming connection has to
+	// send its ServerIdentity before it is closed. Zero means no timeout
+	// besides the one of the connection itself.
+	HandshakeTimeout time.Duration
+	// ConnIdleTimeout is how long a connection can stay without receiving
+	// or sending messages before it is closed. It is dialed again the next
+	// time a message is sent to the peer. Zero keeps the connections open.
+	// The error handlers are called for the connections closed this way.
+	// It must be set before the first connection.
+	ConnIdleTimeout time.Duration
+	// CoalesceSends avoids sending a message to a peer if an identical one
+	// is still waiting for the connection, which happens when the same
+	// message is flooded from many places. It only applies to the TCP and
+	// TLS connections.
+	CoalesceSends bool
+	// MaxConnections is the maximum number of connections the router keeps
+	// open at the same time. Incoming connections above this limit are
+	// closed. Zero means no limit.
+	MaxConnections int
+	// evicting is true once the routine closing idle connections is started
+	evicting bool
+
+	// If not nil, gives the address to dial for a peer instead of its own.
+	addressRewriter    func(*ServerIdentity) Address
+	addressRewriterMut sync.Mutex
+
+	// If not nil, called on every new connection once the identity of the
+	// peer is known, and closing the connection if it returns an error.
+	connectHook    func(*ServerIdentity, Conn) error
+	connectHookMut sync.Mutex
 
 	// Set of valid peers, used to filter allowed in/out connections.
 	// It is organized as a data structure allowing for subsets of peers to
 	// evolve indipendently, each subset being identified by a PeerSetID.
 	validPeers validPeers
+
+	// suite of the host, used to read the public keys of the peers files
+	suite Suite
+	// closed when the router is stopped, to end the peers files watchers
+	stopped chan struct{}
 }
 
+// errTooManyConnections is returned when an incoming connection would exceed
+// Router.MaxConnections.
+var errTooManyConnections = xerrors.New("too many connections")
+
 // PeerSetID is the identifier for a subset of valid peers.
 // This should typically be linked in a unique way to a service, e.g.
 // hash(serviceID | skipChainID) for ByzCoin
@@ -124,8 +181,25 @@ func (vp *validPeers) get(peerSetID PeerSetID) []ServerIdentityID {
 	return peerList
 }
 
+// Returns the identifiers of all the sets of valid peers.
+func (vp *validPeers) ids() []PeerSetID {
+	vp.lock.Lock()
+	defer vp.lock.Unlock()
+
+	var ids []PeerSetID
+	for id := range vp.peers {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
 // Checks whether the given peer is valid (among all the subsets).
 func (vp *validPeers) isValid(peer *ServerIdentity) bool {
+	return vp.isValidID(peer.ID)
+}
+
+// Checks whether the peer with the given ID is valid (among all the subsets).
+func (vp *validPeers) isValidID(id ServerIdentityID) bool {
 	vp.lock.Lock()
 	defer vp.lock.Unlock()
 
@@ -136,7 +210,7 @@ func (vp *validPeers) isValid(peer *ServerIdentity) bool {
 
 	// Search whether the given peer is valid in any of the peer subsets
 	for _, peers := range vp.peers {
-		_, ok := peers[peer.ID]
+		_, ok := peers[id]
 		if ok {
 			return true
 		}
@@ -150,6 +224,152 @@ func (r *Router) SetValidPeers(peerSetID PeerSetID, peers []*ServerIdentity) {
 	r.validPeers.set(peerSetID, peers)
 }
 
+// UpdateValidPeers sets the set of valid peers for a given PeerSetID like
+// SetValidPeers, and closes the connections to the peers removed from the set
+// that are not valid in any other set. The connections to the peers still
+// valid are kept.
+func (r *Router) UpdateValidPeers(peerSetID PeerSetID, peers []*ServerIdentity) {
+	old := r.validPeers.get(peerSetID)
+	r.validPeers.set(peerSetID, peers)
+
+	removed := make(map[ServerIdentityID]bool)
+	if old == nil {
+		// all peers were valid until now
+		r.Lock()
+		for id := range r.connections {
+			removed[id] = true
+		}
+		r.Unlock()
+	}
+	for _, id := range old {
+		removed[id] = true
+	}
+	for _, peer := range peers {
+		delete(removed, peer.ID)
+	}
+
+	var invalid []Conn
+	r.Lock()
+	for id := range removed {
+		if !r.validPeers.isValidID(id) {
+			invalid = append(invalid, r.connections[id]...)
+		}
+	}
+	r.Unlock()
+	for _, c := range invalid {
+		log.Lvl3(r.address, "closing connection to invalid peer", c.Remote())
+		if err := c.Close(); err != nil {
+			log.Lvl5(err)
+		}
+	}
+}
+
+// peersFile is the content of a file given to LoadValidPeersFromFile. It is
+// the same as the toml of a roster.
+type peersFile struct {
+	List []*ServerIdentityToml
+}
+
+// LoadValidPeersFromFile reads the roster in the toml file at path and sets
+// its members as the valid peers for the given PeerSetID. The current valid
+// peers are kept if the file can't be read.
+func (r *Router) LoadValidPeersFromFile(peerSetID PeerSetID, path string) error {
+	if r.suite == nil {
+		return xerrors.New("the router has no suite to read the public keys")
+	}
+	var pf peersFile
+	if _, err := toml.DecodeFile(path, &pf); err != nil {
+		return xerrors.Errorf("toml decoding: %v", err)
+	}
+	peers := make([]*ServerIdentity, len(pf.List))
+	for i, sit := range pf.List {
+		pub, err := encoding.ReadHexPoint(r.suite, strings.NewReader(sit.Public))
+		if err != nil {
+			return xerrors.Errorf("reading public key of %s: %v", sit.Address, err)
+		}
+		peers[i] = NewServerIdentity(pub, sit.Address)
+	}
+	r.SetValidPeers(peerSetID, peers)
+	return nil
+}
+
+// WatchValidPeersFile loads the valid peers from the file like
+// LoadValidPeersFromFile does, then checks every interval if the file has
+// been modified and loads it again if so. Errors while reloading are logged
+// and the current valid peers are kept. The watch ends when the router is
+// stopped. The interval must be positive.
+func (r *Router) WatchValidPeersFile(peerSetID PeerSetID, path string, interval time.Duration) error {
+	if interval <= 0 {
+		return xerrors.Errorf("invalid interval %v: must be positive", interval)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return xerrors.Errorf("peers file: %v", err)
+	}
+	if err := r.LoadValidPeersFromFile(peerSetID, path); err != nil {
+		return xerrors.Errorf("loading peers: %v", err)
+	}
+
+	go func() {
+		modTime := fi.ModTime()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-r.stopped:
+				return
+			case <-ticker.C:
+			}
+
+			fi, err := os.Stat(path)
+			if err != nil {
+				log.Warnf("couldn't check peers file %s: %v", path, err)
+				continue
+			}
+			if fi.ModTime().Equal(modTime) {
+				continue
+			}
+			modTime = fi.ModTime()
+			if err := r.LoadValidPeersFromFile(peerSetID, path); err != nil {
+				log.Warnf("couldn't reload peers file %s: %v", path, err)
+			}
+		}
+	}()
+	return nil
+}
+
+// SetAddressRewriter sets a function returning the address to dial when
+// connecting to a peer. This lets deployments behind a NAT map the internal
+// addresses of the ServerIdentities to reachable ones. The identity of the
+// peer is not changed. A nil function dials the address of the peer again.
+func (r *Router) SetAddressRewriter(f func(*ServerIdentity) Address) {
+	r.addressRewriterMut.Lock()
+	defer r.addressRewriterMut.Unlock()
+	r.addressRewriter = f
+}
+
+// SetConnectHook sets a function called on every new connection, incoming
+// or outgoing, right after the ServerIdentities are exchanged and before
+// any message is dispatched. It can use the connection for an application
+// level handshake, like a version negotiation. If it returns an error, the
+// connection is closed. A nil function removes the hook.
+func (r *Router) SetConnectHook(f func(si *ServerIdentity, c Conn) error) {
+	r.connectHookMut.Lock()
+	defer r.connectHookMut.Unlock()
+	r.connectHook = f
+}
+
+// runConnectHook calls the connect hook, if any.
+func (r *Router) runConnectHook(si *ServerIdentity, c Conn) error {
+	r.connectHookMut.Lock()
+	hook := r.connectHook
+	r.connectHookMut.Unlock()
+	if hook == nil {
+		return nil
+	}
+	return hook(si, c)
+}
+
 // GetValidPeers returns the set of valid peers for a given PeerSetID
 // The return value is `nil` in case the set of valid peers has not yet been
 // initialized, meaning that all peers are valid.
@@ -157,26 +377,62 @@ func (r *Router) GetValidPeers(peerSetID PeerSetID) []ServerIdentityID {
 	return r.validPeers.get(peerSetID)
 }
 
+// ValidPeerSets returns the identifiers of the sets of valid peers that have
+// been set.
+func (r *Router) ValidPeerSets() []PeerSetID {
+	return r.validPeers.ids()
+}
+
 // isPeerValid checks whether the provided ServerIdentity is among the valid
 // peers for this router.
 func (r *Router) isPeerValid(peer *ServerIdentity) bool {
 	return r.validPeers.isValid(peer)
 }
 
+// connActivity is the activity of a connection, used to close the idle ones.
+type connActivity struct {
+	last time.Time
+	idle bool
+}
+
 // NewRouter returns a new Router attached to a ServerIdentity and the host we want to
 // use.
 func NewRouter(own *ServerIdentity, h Host) *Router {
 	r := &Router{
 		ServerIdentity:          own,
 		connections:             make(map[ServerIdentityID][]Conn),
+		identities:              make(map[ServerIdentityID]*ServerIdentity),
+		activity:                make(map[Conn]*connActivity),
 		host:                    h,
 		Dispatcher:              NewBlockingDispatcher(),
 		connectionErrorHandlers: make([]func(*ServerIdentity), 0),
+		stopped:                 make(chan struct{}),
+		draining:                make(chan struct{}),
 	}
 	r.address = h.Address()
+	switch h := h.(type) {
+	case *TCPHost:
+		r.suite = h.suite
+	case *LocalHost:
+		r.suite = h.suite
+	}
 	return r
 }
 
+// SetMaxConcurrentProcessing limits how many incoming messages are dispatched
+// at the same time, over all connections. The connections waiting for a slot
+// stop reading new messages until they get one. A value of 0 or less removes
+// the limit.
+func (r *Router) SetMaxConcurrentProcessing(max int) {
+	r.Lock()
+	defer r.Unlock()
+	if max <= 0 {
+		r.processing = nil
+		return
+	}
+	r.processing = make(chan bool, max)
+}
+
 // Pause casues the router to stop after reading the next incoming message. It
 // sleeps until it is woken up by Unpause. For testing use only.
 func (r *Router) Pause() {
@@ -198,6 +454,32 @@ func (r *Router) Unpause() {
 	r.Unlock()
 }
 
+// PausePeer is like Pause, but only stops the connections with the given
+// peer, so that a partition of the network can be simulated. The other
+// connections keep working. For testing use only.
+func (r *Router) PausePeer(id ServerIdentityID) {
+	r.Lock()
+	if r.pausedPeers == nil {
+		r.pausedPeers = make(map[ServerIdentityID]chan bool)
+	}
+	if _, ok := r.pausedPeers[id]; !ok {
+		r.pausedPeers[id] = make(chan bool)
+	}
+	r.Unlock()
+}
+
+// ResumePeer reverses a previous call to PausePeer. The paused connections
+// with this peer are closed and new ones are processed normally. For testing
+// use only.
+func (r *Router) ResumePeer(id ServerIdentityID) {
+	r.Lock()
+	if paused, ok := r.pausedPeers[id]; ok {
+		close(paused)
+		delete(r.pausedPeers, id)
+	}
+	r.Unlock()
+}
+
 // Start the listening routine of the underlying Host. This is a
 // blocking call until r.Stop() is called.
 func (r *Router) Start() {
@@ -215,7 +497,7 @@ func (r *Router) Start() {
 				log.Errorf("receiving server identity from %#v failed: %+v",
 					c.Remote().NetworkAddress(), err)
 			}
-			if err := c.Close(); err != nil {
+			if err := c.Close(); err != nil && !xerrors.Is(err, ErrClosed) {
 				log.Error("Couldn't close secure connection:",
 					err)
 			}
@@ -232,7 +514,24 @@ func (r *Router) Start() {
 			return
 		}
 
-		if err := r.registerConnection(dst, c); err != nil {
+		if err := r.runConnectHook(dst, c); err != nil {
+			log.Errorf("rejecting incoming connection from %v: %v",
+				dst.Address, err)
+			if err := c.Close(); err != nil {
+				log.Warnf("closing connection: %v", err)
+			}
+			return
+		}
+
+		if err := r.registerConnection(dst, c, true); err != nil {
+			if xerrors.Is(err, errTooManyConnections) {
+				log.Warnf("%v rejects incoming connection from %v: %v",
+					r.address, c.Remote(), err)
+				if err := c.Close(); err != nil {
+					log.Warnf("closing connection: %v", err)
+				}
+				return
+			}
 			log.Lvl3(r.address, "does not accept incoming connection from", c.Remote(), "because it's closed")
 			return
 		}
@@ -254,10 +553,20 @@ func (r *Router) Start() {
 // Router.
 func (r *Router) Stop() error {
 	var err error
-	err = r.host.Stop()
+	// Drain already stopped the host.
+	if !r.isDraining() {
+		err = r.host.Stop()
+	}
 	r.Unpause()
 	r.Lock()
+	for id, paused := range r.pausedPeers {
+		close(paused)
+		delete(r.pausedPeers, id)
+	}
 	// set the isClosed to true
+	if !r.isClosed {
+		close(r.stopped)
+	}
 	r.isClosed = true
 
 	// then close all connections
@@ -279,11 +588,64 @@ func (r *Router) Stop() error {
 	return nil
 }
 
+// Drain stops the router gracefully: it stops accepting new connections and
+// waits up to timeout for the peers to close the existing ones, after having
+// sent their last messages, before stopping the router like Stop. While
+// draining, messages are still received and sent through the open
+// connections, but no new connection is made and the idle ones are not
+// closed.
+func (r *Router) Drain(timeout time.Duration) error {
+	if r.Closed() || r.isDraining() {
+		return xerrors.Errorf("draining: %w", ErrClosed)
+	}
+	var err error
+	r.drainingOnce.Do(func() {
+		r.Lock()
+		close(r.draining)
+		r.Unlock()
+		err = r.host.Stop()
+	})
+	if err != nil {
+		log.Error("stopping the host:", err)
+	}
+
+	// The connections cannot be added anymore, so the wait group is only
+	// decreasing.
+	done := make(chan struct{})
+	go func() {
+		r.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		log.Lvl2(r.address, "closing the connections still open after draining")
+	}
+	return r.Stop()
+}
+
+// isDraining returns true once Drain has been called.
+func (r *Router) isDraining() bool {
+	select {
+	case <-r.draining:
+		return true
+	default:
+		return false
+	}
+}
+
 // Send sends to an ServerIdentity without wrapping the msg into a
 // ProtocolMsg. It can take more than one message at once to be sure that all
 // the messages are sent through the same connection and thus are correctly
 // ordered.
 func (r *Router) Send(e *ServerIdentity, msgs ...Message) (uint64, error) {
+	return r.SendWithPriority(e, PriorityNormal, msgs...)
+}
+
+// SendWithPriority is like Send, but the messages jump ahead of the messages
+// of lower priority waiting for the same connection. It has no effect on
+// connections not implementing a SendWithPriority method.
+func (r *Router) SendWithPriority(e *ServerIdentity, p Priority, msgs ...Message) (uint64, error) {
 	for _, msg := range msgs {
 		if msg == nil {
 			return 0, xerrors.New("cannot send nil-packets")
@@ -334,31 +696,64 @@ func (r *Router) Send(e *ServerIdentity, msgs ...Message) (uint64, error) {
 
 	for _, msg := range msgs {
 		log.Lvlf4("%s sends a msg to %s", r.address, e)
-		sentLen, err := c.Send(msg)
+		sentLen, err := sendWithPriority(c, msg, p, r.CoalesceSends)
 		totSentLen += sentLen
 		if err != nil {
 			log.Lvl2(r.address, "Couldn't send to", e, ":", err, "trying again")
-			c, sentLen, err := r.connect(e)
+			c, sentLen, err = r.connect(e)
 			totSentLen += sentLen
 			if err != nil {
 				return totSentLen, xerrors.Errorf("connecting: %v", err)
 			}
-			sentLen, err = c.Send(msg)
+			sentLen, err = sendWithPriority(c, msg, p, r.CoalesceSends)
 			totSentLen += sentLen
 			if err != nil {
 				return totSentLen, xerrors.Errorf("connecting: %v", err)
 			}
 		}
+		r.touch(c)
 	}
 	log.Lvl5("Message sent")
 	return totSentLen, nil
 }
 
+// sendWithPriority uses the SendWithPriority method of the connection if it
+// has one, else Send. If coalesce is true, it uses SendCoalesced instead when
+// the connection has it.
+func sendWithPriority(c Conn, msg Message, p Priority, coalesce bool) (uint64, error) {
+	if cc, ok := c.(interface {
+		SendCoalesced(Message, Priority) (uint64, error)
+	}); ok && coalesce {
+		return cc.SendCoalesced(msg, p)
+	}
+	if pc, ok := c.(interface {
+		SendWithPriority(Message, Priority) (uint64, error)
+	}); ok {
+		return pc.SendWithPriority(msg, p)
+	}
+	return c.Send(msg)
+}
+
 // connect starts a new connection and launches the listener for incoming
 // messages.
 func (r *Router) connect(si *ServerIdentity) (Conn, uint64, error) {
+	if r.isDraining() {
+		return nil, 0, xerrors.Errorf("draining: %w", ErrClosed)
+	}
 	log.Lvl3(r.address, "Connecting to", si.Address)
-	c, err := r.host.Connect(si)
+	dialSI := si
+	r.addressRewriterMut.Lock()
+	rewrite := r.addressRewriter
+	r.addressRewriterMut.Unlock()
+	if rewrite != nil {
+		if addr := rewrite(si); addr != si.Address {
+			log.Lvl3(r.address, "Dialing", addr, "for", si.Address)
+			copySI := *si
+			copySI.Address = addr
+			dialSI = &copySI
+		}
+	}
+	c, err := r.host.Connect(dialSI)
 	if err != nil {
 		log.Lvl3("Could not connect to", si.Address, err)
 		return nil, 0, xerrors.Errorf("connecting: %v", err)
@@ -369,7 +764,14 @@ func (r *Router) connect(si *ServerIdentity) (Conn, uint64, error) {
 		return nil, sentLen, xerrors.Errorf("sending: %v", err)
 	}
 
-	if err = r.registerConnection(si, c); err != nil {
+	if err = r.runConnectHook(si, c); err != nil {
+		if errClose := c.Close(); errClose != nil {
+			log.Warnf("closing connection: %v", errClose)
+		}
+		return nil, sentLen, xerrors.Errorf("connect hook: %v", err)
+	}
+
+	if err = r.registerConnection(si, c, false); err != nil {
 		return nil, sentLen, xerrors.Errorf("register connection: %v", err)
 	}
 
@@ -400,6 +802,10 @@ func (r *Router) removeConnection(si *ServerIdentity, c Conn) {
 	arr[toDelete] = arr[len(arr)-1]
 	arr[len(arr)-1] = nil
 	r.connections[si.GetID()] = arr[:len(arr)-1]
+	delete(r.activity, c)
+	if len(arr) == 1 {
+		delete(r.identities, si.GetID())
+	}
 }
 
 // triggerConnectionErrorHandlers trigger all registered connectionsErrorHandlers
@@ -434,6 +840,8 @@ func (r *Router) handleConn(remote *ServerIdentity, c Conn) {
 		// pausing, or else Unpause would deadlock.
 		r.Lock()
 		paused := r.paused
+		peerPaused := r.pausedPeers[remote.ID]
+		processing := r.processing
 		r.Unlock()
 		if paused != nil {
 			<-paused
@@ -442,12 +850,21 @@ func (r *Router) handleConn(remote *ServerIdentity, c Conn) {
 			r.Unlock()
 			return
 		}
+		if peerPaused != nil {
+			<-peerPaused
+			return
+		}
 
 		if r.Closed() {
 			return
 		}
 
 		if err != nil {
+			if r.isIdle(c) {
+				log.Lvlf4("%s drops %s connection: idle", r.ServerIdentity.Address, remote.Address)
+				r.triggerConnectionErrorHandlers(remote)
+				return
+			}
 			if xerrors.Is(err, ErrTimeout) {
 				log.Lvlf5("%s drops %s connection: timeout", r.ServerIdentity.Address, remote.Address)
 				r.triggerConnectionErrorHandlers(remote)
@@ -472,13 +889,20 @@ func (r *Router) handleConn(remote *ServerIdentity, c Conn) {
 		}
 
 		packet.ServerIdentity = remote
+		r.touch(c)
 
 		// Update the message counter with the new message about to be processed.
 		r.msgTraffic.updateRx(1)
 
+		if processing != nil {
+			processing <- true
+		}
 		if err := r.Dispatch(packet); err != nil {
 			log.Lvl3("Error dispatching:", err)
 		}
+		if processing != nil {
+			<-processing
+		}
 
 	}
 }
@@ -497,27 +921,120 @@ func (r *Router) connection(sid ServerIdentityID) Conn {
 
 // registerConnection registers a ServerIdentity for a new connection, mapped with the
 // real physical address of the connection and the connection itself.
-// It uses the networkLock mutex.
-func (r *Router) registerConnection(remote *ServerIdentity, c Conn) error {
+// It uses the networkLock mutex. Incoming connections are refused once
+// MaxConnections is reached.
+func (r *Router) registerConnection(remote *ServerIdentity, c Conn, incoming bool) error {
 	log.Lvl4(r.address, "Registers", remote.Address)
 	r.Lock()
 	defer r.Unlock()
-	if r.isClosed {
+	if r.isClosed || r.isDraining() {
 		return xerrors.Errorf("closing: %w", ErrClosed)
 	}
+	if incoming && r.MaxConnections > 0 {
+		count := 0
+		for _, arr := range r.connections {
+			count += len(arr)
+		}
+		if count >= r.MaxConnections {
+			return xerrors.Errorf("%d open connections: %w", count,
+				errTooManyConnections)
+		}
+	}
 	_, okc := r.connections[remote.GetID()]
 	if okc {
 		log.Lvl5("Connection already registered. " +
 			"Appending new connection to same identity.")
 	}
 	r.connections[remote.GetID()] = append(r.connections[remote.GetID()], c)
+	if r.identities == nil {
+		r.identities = make(map[ServerIdentityID]*ServerIdentity)
+	}
+	r.identities[remote.GetID()] = remote
+	r.activity[c] = &connActivity{last: time.Now()}
+	if r.ConnIdleTimeout > 0 && !r.evicting {
+		r.evicting = true
+		r.wg.Add(1)
+		go r.closeIdleConns(r.ConnIdleTimeout)
+	}
 	return nil
 }
 
+// touch records that the connection has just been used.
+func (r *Router) touch(c Conn) {
+	r.Lock()
+	defer r.Unlock()
+	if a, ok := r.activity[c]; ok {
+		a.last = time.Now()
+	}
+}
+
+// isIdle returns true if the connection has been closed for being idle.
+func (r *Router) isIdle(c Conn) bool {
+	r.Lock()
+	defer r.Unlock()
+	a, ok := r.activity[c]
+	return ok && a.idle
+}
+
+// minIdleCheck is the shortest interval between two checks of the idle
+// connections, whatever the ConnIdleTimeout.
+const minIdleCheck = time.Millisecond
+
+// closeIdleConns regularly closes the connections that have not been used
+// for the timeout, until the router is stopped or drained.
+func (r *Router) closeIdleConns(timeout time.Duration) {
+	defer r.wg.Done()
+	interval := timeout / 4
+	if interval < minIdleCheck {
+		interval = minIdleCheck
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.stopped:
+			return
+		case <-r.draining:
+			return
+		case <-ticker.C:
+		}
+
+		var idle []Conn
+		r.Lock()
+		for c, a := range r.activity {
+			if !a.idle && time.Since(a.last) >= timeout {
+				a.idle = true
+				idle = append(idle, c)
+			}
+		}
+		r.Unlock()
+		for _, c := range idle {
+			log.Lvl3(r.address, "closing idle connection to", c.Remote())
+			if err := c.Close(); err != nil {
+				log.Lvl5(err)
+			}
+		}
+	}
+}
+
+// ConnectedPeers returns the ServerIdentities of all the peers this router
+// currently has at least one connection with.
+func (r *Router) ConnectedPeers() []*ServerIdentity {
+	r.Lock()
+	defer r.Unlock()
+	var peers []*ServerIdentity
+	for id, arr := range r.connections {
+		if len(arr) > 0 && r.identities[id] != nil {
+			peers = append(peers, r.identities[id])
+		}
+	}
+	return peers
+}
+
 func (r *Router) launchHandleRoutine(dst *ServerIdentity, c Conn) error {
 	r.Lock()
 	defer r.Unlock()
-	if r.isClosed {
+	if r.isClosed || r.isDraining() {
 		return xerrors.Errorf("closing: %w", ErrClosed)
 	}
 	r.wg.Add(1)
@@ -584,8 +1101,21 @@ func (r *Router) Listening() bool {
 // wait for the server identities of the remote party. It returns
 // the ServerIdentity of the remote party and register the connection.
 func (r *Router) receiveServerIdentity(c Conn) (*ServerIdentity, error) {
+	// A peer that never sends its identity must not hold the connection
+	// forever, so it is closed once the handshake timeout expires.
+	var deadline *time.Timer
+	if r.HandshakeTimeout > 0 {
+		deadline = time.AfterFunc(r.HandshakeTimeout, func() {
+			c.Close()
+		})
+	}
+
 	// Receive the other ServerIdentity
 	nm, err := c.Receive()
+	if deadline != nil && !deadline.Stop() {
+		return nil, xerrors.Errorf("no ServerIdentity received after %v: %w",
+			r.HandshakeTimeout, ErrTimeout)
+	}
 	if err != nil {
 		return nil, xerrors.Errorf("Error while receiving ServerIdentity during negotiation %s", err)
 	}
@@ -599,32 +1129,55 @@ func (r *Router) receiveServerIdentity(c Conn) (*ServerIdentity, error) {
 
 	// See if we have a cryptographically proven pubkey for this peer. If so,
 	// check it against dst.Public.
-	if tcpConn, ok := c.(*TCPConn); ok {
-		if tlsConn, ok := tcpConn.conn.(*tls.Conn); ok {
-			cs := tlsConn.ConnectionState()
-			if len(cs.PeerCertificates) == 0 {
-				return nil, xerrors.New("TLS connection with no peer certs?")
-			}
-			pub, err := pubFromCN(tcpConn.suite, cs.PeerCertificates[0].Subject.CommonName)
-			if err != nil {
-				return nil, xerrors.Errorf("decoding key: %v", err)
-			}
-
-			if !pub.Equal(dst.Public) {
-				return nil, xerrors.New("mismatch between certificate CommonName and ServerIdentity.Public")
-			}
-			log.Lvl4(r.address, "Public key from CommonName and ServerIdentity match:", pub)
-		} else {
-			// We get here for TCPConn && !tls.Conn. Make them wish they were using TLS...
-			if !r.UnauthOk {
-				log.Warn("Public key", dst.Public, "from ServerIdentity not authenticated.")
-			}
+	pub, proven, err := provenPublic(c)
+	if err != nil {
+		return nil, err
+	}
+	if proven {
+		if !pub.Equal(dst.Public) {
+			return nil, xerrors.New("mismatch between certificate CommonName and ServerIdentity.Public")
 		}
+		log.Lvl4(r.address, "Public key from CommonName and ServerIdentity match:", pub)
+	} else if _, ok := c.(*TCPConn); ok && !r.UnauthOk {
+		// We get here for TCPConn && !tls.Conn. Make them wish they were using TLS...
+		log.Warn("Public key", dst.Public, "from ServerIdentity not authenticated.")
 	}
 	log.Lvlf3("%s: Identity received si=%v from %s", r.address, dst.Public, dst.Address)
 	return dst, nil
 }
 
+// provenPublic returns the public key proven by the peer of the connection
+// with its certificate, and false if the connection is not authenticated.
+// Local connections carry a simulated certificate if their LocalManager
+// simulates authentication.
+func provenPublic(c Conn) (kyber.Point, bool, error) {
+	switch conn := c.(type) {
+	case *TCPConn:
+		tlsConn, ok := conn.conn.(*tls.Conn)
+		if !ok {
+			return nil, false, nil
+		}
+		cs := tlsConn.ConnectionState()
+		if len(cs.PeerCertificates) == 0 {
+			return nil, false, xerrors.New("TLS connection with no peer certs?")
+		}
+		pub, err := pubFromCN(conn.suite, cs.PeerCertificates[0].Subject.CommonName)
+		if err != nil {
+			return nil, false, xerrors.Errorf("decoding key: %v", err)
+		}
+		return pub, true, nil
+	case *LocalConn:
+		if !conn.authenticated {
+			return nil, false, nil
+		}
+		if conn.peerPublic == nil {
+			return nil, false, xerrors.New("simulated TLS connection with no peer certs")
+		}
+		return conn.peerPublic, true, nil
+	}
+	return nil, false, nil
+}
+
 // AddErrorHandler adds a network error handler function for this router. The functions will be called
 // on network error (e.g. Timeout, Connection Closed, or EOF) with the identity of the faulty
 // remote host as 1st parameter.
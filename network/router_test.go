@@ -1,10 +1,14 @@
 package network
 
 import (
+	"io/ioutil"
+	"net"
+	"os"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/BurntSushi/toml"
 	"github.com/stretchr/testify/require"
 	"go.dedis.ch/onet/v3/log"
 	"golang.org/x/xerrors"
@@ -600,6 +604,200 @@ func TestRouterRxTx(t *testing.T) {
 	defer router1.Stop()
 }
 
+func TestRouterConnectedPeers(t *testing.T) {
+	routers := make([]*Router, 3)
+	for i := range routers {
+		var err error
+		routers[i], err = NewTestRouterTCP(0)
+		require.NoError(t, err)
+		go routers[i].Start()
+		defer routers[i].Stop()
+	}
+	require.Empty(t, routers[0].ConnectedPeers())
+
+	for _, r := range routers[1:] {
+		_, err := routers[0].Send(r.ServerIdentity, routers[0].ServerIdentity)
+		require.NoError(t, err)
+	}
+	peers := routers[0].ConnectedPeers()
+	require.Equal(t, 2, len(peers))
+	for _, r := range routers[1:] {
+		found := false
+		for _, p := range peers {
+			if p.Equal(r.ServerIdentity) {
+				found = true
+			}
+		}
+		require.True(t, found)
+	}
+
+	// The incoming side also knows the peer.
+	waitTimeout(time.Second, 10, func() bool {
+		return len(routers[1].ConnectedPeers()) == 1
+	})
+	require.True(t, routers[1].ConnectedPeers()[0].Equal(routers[0].ServerIdentity))
+
+	routers[1].Stop()
+	waitTimeout(time.Second, 10, func() bool {
+		return len(routers[0].ConnectedPeers()) == 1
+	})
+	require.True(t, routers[0].ConnectedPeers()[0].Equal(routers[2].ServerIdentity))
+}
+
+func TestRouterAddressRewriter(t *testing.T) {
+	routers := make([]*Router, 2)
+	for i := range routers {
+		var err error
+		routers[i], err = NewTestRouterTCP(0)
+		require.NoError(t, err)
+		go routers[i].Start()
+		defer routers[i].Stop()
+	}
+
+	// The address in the identity of the peer is not reachable.
+	internal := *routers[1].ServerIdentity
+	internal.Address = NewTCPAddress("10.255.255.1:2000")
+	external := routers[1].ServerIdentity.Address
+	var rewritten []Address
+	routers[0].SetAddressRewriter(func(si *ServerIdentity) Address {
+		rewritten = append(rewritten, si.Address)
+		if si.Address == internal.Address {
+			return external
+		}
+		return si.Address
+	})
+
+	_, err := routers[0].Send(&internal, routers[0].ServerIdentity)
+	require.NoError(t, err)
+	require.Equal(t, []Address{internal.Address}, rewritten)
+	peers := routers[0].ConnectedPeers()
+	require.Equal(t, 1, len(peers))
+	require.Equal(t, internal.Address, peers[0].Address)
+
+	waitTimeout(time.Second, 10, func() bool {
+		return len(routers[1].ConnectedPeers()) == 1
+	})
+	require.True(t, routers[1].ConnectedPeers()[0].Equal(routers[0].ServerIdentity))
+}
+
+func TestRouterConnectHook(t *testing.T) {
+	log.OutputToBuf()
+	defer log.OutputToOs()
+
+	// The second router advertises a version that the others reject.
+	versions := []int64{2, 1, 2}
+	routers := make([]*Router, len(versions))
+	for i := range routers {
+		var err error
+		routers[i], err = NewTestRouterTCP(0)
+		require.NoError(t, err)
+		version := versions[i]
+		routers[i].SetConnectHook(func(si *ServerIdentity, c Conn) error {
+			if _, err := c.Send(&SimpleMessage{I: version}); err != nil {
+				return err
+			}
+			env, err := c.Receive()
+			if err != nil {
+				return err
+			}
+			peer, ok := env.Msg.(*SimpleMessage)
+			if !ok || peer.I < 2 {
+				return xerrors.New("peer version is too old")
+			}
+			return nil
+		})
+		go routers[i].Start()
+		defer routers[i].Stop()
+	}
+
+	_, err := routers[0].Send(routers[1].ServerIdentity, &SimpleMessage{I: 3})
+	require.Error(t, err)
+	_, err = routers[0].Send(routers[2].ServerIdentity, &SimpleMessage{I: 3})
+	require.NoError(t, err)
+
+	// The old peer accepts the version of the first router, which closes
+	// the connection on its side, so the message might or might not be sent.
+	routers[1].Send(routers[0].ServerIdentity, &SimpleMessage{I: 3})
+	waitTimeout(time.Second, 10, func() bool {
+		return len(routers[1].ConnectedPeers()) == 0
+	})
+	peers := routers[0].ConnectedPeers()
+	require.Equal(t, 1, len(peers))
+	require.True(t, peers[0].Equal(routers[2].ServerIdentity))
+}
+
+func TestRouterDrain(t *testing.T) {
+	routers := make([]*Router, 3)
+	for i := range routers {
+		var err error
+		routers[i], err = NewTestRouterTCP(0)
+		require.NoError(t, err)
+		go routers[i].Start()
+		defer routers[i].Stop()
+	}
+	proc := &simpleMessageProc{t, make(chan SimpleMessage, 10)}
+	routers[0].RegisterProcessor(proc, SimpleMessageType)
+	routers[1].RegisterProcessor(proc, SimpleMessageType)
+
+	_, err := routers[1].Send(routers[0].ServerIdentity, &SimpleMessage{I: 1})
+	require.NoError(t, err)
+	require.Equal(t, int64(1), (<-proc.relay).I)
+
+	drained := make(chan error)
+	start := time.Now()
+	go func() {
+		drained <- routers[0].Drain(5 * time.Second)
+	}()
+	waitTimeout(time.Second, 10, func() bool {
+		return routers[0].isDraining()
+	})
+	require.Error(t, routers[0].Drain(time.Second))
+
+	// The open connection still works in both directions, but no new
+	// connection is made.
+	_, err = routers[1].Send(routers[0].ServerIdentity, &SimpleMessage{I: 2})
+	require.NoError(t, err)
+	require.Equal(t, int64(2), (<-proc.relay).I)
+	_, err = routers[0].Send(routers[1].ServerIdentity, &SimpleMessage{I: 3})
+	require.NoError(t, err)
+	require.Equal(t, int64(3), (<-proc.relay).I)
+	_, err = routers[0].Send(routers[2].ServerIdentity, &SimpleMessage{I: 4})
+	require.Error(t, err)
+	_, err = routers[2].Send(routers[0].ServerIdentity, &SimpleMessage{I: 5})
+	require.Error(t, err)
+
+	// The drain ends as soon as the peer closes the connection.
+	require.NoError(t, routers[1].Stop())
+	require.NoError(t, <-drained)
+	require.True(t, time.Since(start) < 5*time.Second)
+	require.True(t, routers[0].Closed())
+}
+
+func TestRouterDrainTimeout(t *testing.T) {
+	routers := make([]*Router, 2)
+	for i := range routers {
+		var err error
+		routers[i], err = NewTestRouterTCP(0)
+		require.NoError(t, err)
+		go routers[i].Start()
+		defer routers[i].Stop()
+	}
+	_, err := routers[1].Send(routers[0].ServerIdentity, &SimpleMessage{I: 1})
+	require.NoError(t, err)
+	waitTimeout(time.Second, 10, func() bool {
+		return len(routers[0].ConnectedPeers()) == 1
+	})
+
+	// The peer keeps its connection open, so it is closed after the timeout.
+	start := time.Now()
+	require.NoError(t, routers[0].Drain(200*time.Millisecond))
+	require.True(t, time.Since(start) >= 200*time.Millisecond)
+	require.True(t, routers[0].Closed())
+	waitTimeout(time.Second, 10, func() bool {
+		return len(routers[1].ConnectedPeers()) == 0
+	})
+}
+
 func waitTimeout(timeout time.Duration, repeat int,
 	f func() bool) {
 	success := make(chan bool)
@@ -653,6 +851,87 @@ func (c *testConn) Type() ConnType {
 
 // This test insures that an unknown error cannot end up as an infinite loop
 // when handling a connection
+func TestRouterHandshakeTimeout(t *testing.T) {
+	r, err := NewTestRouterTCP(0)
+	require.NoError(t, err)
+	r.HandshakeTimeout = 200 * time.Millisecond
+	go r.Start()
+	defer r.Stop()
+
+	log.OutputToBuf()
+	defer log.OutputToOs()
+
+	// A raw connection that never sends its identity.
+	c, err := net.Dial("tcp", r.ServerIdentity.Address.NetworkAddress())
+	require.NoError(t, err)
+	defer c.Close()
+
+	start := time.Now()
+	require.NoError(t, c.SetReadDeadline(start.Add(5*time.Second)))
+	_, err = c.Read(make([]byte, 1))
+	require.Error(t, err)
+	netErr, ok := err.(net.Error)
+	require.False(t, ok && netErr.Timeout(), "connection was not closed by the router")
+	require.True(t, time.Since(start) >= r.HandshakeTimeout)
+}
+
+func TestRouterMaxConcurrentProcessing(t *testing.T) {
+	r, err := NewTestRouterLocal(2600)
+	require.NoError(t, err)
+	r.SetMaxConcurrentProcessing(2)
+	go r.Start()
+	defer r.Stop()
+
+	var mut sync.Mutex
+	var running, maxRunning, received int
+	r.RegisterProcessorFunc(SimpleMessageType, func(*Envelope) error {
+		mut.Lock()
+		running++
+		received++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		mut.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		mut.Lock()
+		running--
+		mut.Unlock()
+		return nil
+	})
+
+	nbrPeers := 10
+	var wg sync.WaitGroup
+	for i := 0; i < nbrPeers; i++ {
+		peer, err := NewTestRouterLocal(2601 + i)
+		require.NoError(t, err)
+		go peer.Start()
+		defer peer.Stop()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 3; j++ {
+				_, err := peer.Send(r.ServerIdentity, &SimpleMessage{int64(j)})
+				require.NoError(t, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	for i := 0; i < 100; i++ {
+		mut.Lock()
+		done := received == nbrPeers*3
+		mut.Unlock()
+		if done {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	mut.Lock()
+	defer mut.Unlock()
+	require.Equal(t, nbrPeers*3, received)
+	require.Equal(t, 2, maxRunning)
+}
+
 func TestRouterHandleUnknownError(t *testing.T) {
 	router, err := NewTestRouterTCP(0)
 	require.NoError(t, err)
@@ -661,3 +940,249 @@ func TestRouterHandleUnknownError(t *testing.T) {
 	// The test will leak 1 goroutine if the connection is not dropped
 	go router.handleConn(router.ServerIdentity, &testConn{})
 }
+
+func TestRouterLoadValidPeersFromFile(t *testing.T) {
+	routers := make([]*Router, 3)
+	for i := range routers {
+		var err error
+		routers[i], err = NewTestRouterTCP(0)
+		require.NoError(t, err)
+		defer routers[i].Stop()
+	}
+
+	f, err := ioutil.TempFile("", "peers.toml")
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	defer os.Remove(f.Name())
+	writePeers := func(peers ...*ServerIdentity) {
+		var pf peersFile
+		for _, si := range peers {
+			pf.List = append(pf.List, si.Toml(tSuite))
+		}
+		f, err := os.Create(f.Name())
+		require.NoError(t, err)
+		require.NoError(t, toml.NewEncoder(f).Encode(pf))
+		require.NoError(t, f.Close())
+	}
+
+	psID := NewPeerSetID([]byte("peers"))
+	writePeers(routers[0].ServerIdentity, routers[1].ServerIdentity)
+	require.NoError(t, routers[0].LoadValidPeersFromFile(psID, f.Name()))
+	require.Equal(t, 2, len(routers[0].GetValidPeers(psID)))
+	require.True(t, routers[0].isPeerValid(routers[1].ServerIdentity))
+	require.False(t, routers[0].isPeerValid(routers[2].ServerIdentity))
+
+	require.Error(t, routers[0].LoadValidPeersFromFile(psID, f.Name()+".missing"))
+	require.True(t, routers[0].isPeerValid(routers[1].ServerIdentity))
+
+	require.Error(t, routers[0].WatchValidPeersFile(psID, f.Name(), 0))
+
+	// The watcher reloads the file once it is modified.
+	require.NoError(t, routers[0].WatchValidPeersFile(psID, f.Name(), 10*time.Millisecond))
+	writePeers(routers[0].ServerIdentity, routers[2].ServerIdentity)
+	later := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(f.Name(), later, later))
+	waitTimeout(time.Second, 10, func() bool {
+		return routers[0].isPeerValid(routers[2].ServerIdentity)
+	})
+	require.False(t, routers[0].isPeerValid(routers[1].ServerIdentity))
+}
+
+func TestRouterConnIdleTimeout(t *testing.T) {
+	routers := make([]*Router, 3)
+	for i := range routers {
+		var err error
+		routers[i], err = NewTestRouterTCP(0)
+		require.NoError(t, err)
+		go routers[i].Start()
+		defer routers[i].Stop()
+	}
+	r := routers[0]
+	r.ConnIdleTimeout = 200 * time.Millisecond
+	idle, active := routers[1].ServerIdentity, routers[2].ServerIdentity
+	dropped := make(chan *ServerIdentity, 1)
+	r.AddErrorHandler(func(si *ServerIdentity) {
+		select {
+		case dropped <- si:
+		default:
+		}
+	})
+
+	_, err := r.Send(idle, r.ServerIdentity)
+	require.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		_, err = r.Send(active, r.ServerIdentity)
+		require.NoError(t, err)
+		time.Sleep(50 * time.Millisecond)
+	}
+	peers := r.ConnectedPeers()
+	require.Equal(t, 1, len(peers))
+	require.True(t, peers[0].Equal(active))
+	require.True(t, (<-dropped).Equal(idle))
+
+	// The idle peer is dialed again when needed.
+	_, err = r.Send(idle, r.ServerIdentity)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(r.ConnectedPeers()))
+}
+
+// A timeout too short to be divided in checks doesn't panic.
+func TestRouterConnIdleTimeout_tiny(t *testing.T) {
+	routers := make([]*Router, 2)
+	for i := range routers {
+		var err error
+		routers[i], err = NewTestRouterTCP(0)
+		require.NoError(t, err)
+		go routers[i].Start()
+		defer routers[i].Stop()
+	}
+	r := routers[0]
+	r.ConnIdleTimeout = time.Nanosecond
+	dropped := make(chan *ServerIdentity, 1)
+	r.AddErrorHandler(func(si *ServerIdentity) {
+		select {
+		case dropped <- si:
+		default:
+		}
+	})
+
+	_, err := r.Send(routers[1].ServerIdentity, r.ServerIdentity)
+	require.NoError(t, err)
+	select {
+	case si := <-dropped:
+		require.True(t, si.Equal(routers[1].ServerIdentity))
+	case <-time.After(time.Second):
+		require.Fail(t, "idle connection not closed")
+	}
+}
+
+func TestRouterUpdateValidPeers(t *testing.T) {
+	routers := make([]*Router, 3)
+	for i := range routers {
+		var err error
+		routers[i], err = NewTestRouterTCP(0)
+		require.NoError(t, err)
+		go routers[i].Start()
+		defer routers[i].Stop()
+	}
+	r := routers[0]
+	for _, other := range routers[1:] {
+		_, err := r.Send(other.ServerIdentity, r.ServerIdentity)
+		require.NoError(t, err)
+	}
+	require.Equal(t, 2, len(r.ConnectedPeers()))
+
+	// Only the connection to the removed peer is closed.
+	psID := NewPeerSetID([]byte("peers"))
+	r.UpdateValidPeers(psID, []*ServerIdentity{r.ServerIdentity, routers[2].ServerIdentity})
+	waitTimeout(time.Second, 10, func() bool {
+		return len(r.ConnectedPeers()) == 1
+	})
+	require.True(t, r.ConnectedPeers()[0].Equal(routers[2].ServerIdentity))
+
+	// A peer still valid in another set keeps its connection.
+	r.SetValidPeers(NewPeerSetID([]byte("other")), []*ServerIdentity{routers[2].ServerIdentity})
+	r.UpdateValidPeers(psID, []*ServerIdentity{r.ServerIdentity})
+	time.Sleep(100 * time.Millisecond)
+	require.Equal(t, 1, len(r.ConnectedPeers()))
+}
+
+func TestRouterMaxConnections(t *testing.T) {
+	routers := make([]*Router, 4)
+	for i := range routers {
+		var err error
+		routers[i], err = NewTestRouterTCP(0)
+		require.NoError(t, err)
+		if i == 0 {
+			routers[i].MaxConnections = 2
+		}
+		go routers[i].Start()
+		defer routers[i].Stop()
+	}
+	proc := &simpleMessageProc{t, make(chan SimpleMessage, 10)}
+	routers[0].RegisterProcessor(proc, SimpleMessageType)
+
+	for i := 1; i <= 2; i++ {
+		_, err := routers[i].Send(routers[0].ServerIdentity, &SimpleMessage{I: int64(i)})
+		require.NoError(t, err)
+		require.Equal(t, int64(i), (<-proc.relay).I)
+	}
+	waitTimeout(time.Second, 10, func() bool {
+		return len(routers[0].ConnectedPeers()) == 2
+	})
+
+	// The third connection is closed by routers[0] without being handled.
+	routers[3].Send(routers[0].ServerIdentity, &SimpleMessage{I: 3})
+	waitTimeout(time.Second, 10, func() bool {
+		return len(routers[3].ConnectedPeers()) == 0
+	})
+	select {
+	case msg := <-proc.relay:
+		t.Fatalf("unexpected message %d", msg.I)
+	case <-time.After(100 * time.Millisecond):
+	}
+	require.Equal(t, 2, len(routers[0].ConnectedPeers()))
+}
+
+func TestRouterCoalesceSends(t *testing.T) {
+	routers := make([]*Router, 2)
+	for i := range routers {
+		var err error
+		routers[i], err = NewTestRouterTCP(0)
+		require.NoError(t, err)
+		go routers[i].Start()
+		defer routers[i].Stop()
+	}
+	r, dst := routers[0], routers[1].ServerIdentity
+	r.CoalesceSends = true
+	proc := &simpleMessageProc{t, make(chan SimpleMessage, 10)}
+	routers[1].RegisterProcessor(proc, SimpleMessageType)
+
+	_, err := r.Send(dst, &SimpleMessage{I: 1})
+	require.NoError(t, err)
+	require.Equal(t, int64(1), (<-proc.relay).I)
+
+	// Simulate a congested connection while queuing the same message three
+	// times, then another one.
+	c := r.connection(dst.GetID()).(*TCPConn)
+	c.sendQueue.acquire(PriorityNormal)
+	sent := make(chan uint64, 4)
+	send := func(i int64) {
+		n, err := r.Send(dst, &SimpleMessage{I: i})
+		require.NoError(t, err)
+		sent <- n
+	}
+	for i := 0; i < 3; i++ {
+		go send(2)
+	}
+	waitTimeout(time.Second, 10, func() bool {
+		c.pendingMut.Lock()
+		defer c.pendingMut.Unlock()
+		for _, ps := range c.pending {
+			return ps.waiters == 2
+		}
+		return false
+	})
+	go send(3)
+	waitTimeout(time.Second, 10, func() bool {
+		c.sendQueue.Lock()
+		defer c.sendQueue.Unlock()
+		return len(c.sendQueue.waiting[PriorityNormal]) == 2
+	})
+	c.sendQueue.release()
+
+	require.Equal(t, int64(2), (<-proc.relay).I)
+	require.Equal(t, int64(3), (<-proc.relay).I)
+	empty := 0
+	for i := 0; i < 4; i++ {
+		if <-sent == 0 {
+			empty++
+		}
+	}
+	require.Equal(t, 2, empty)
+	select {
+	case msg := <-proc.relay:
+		t.Fatalf("unexpected message %d", msg.I)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -87,6 +87,10 @@ type ServerIdentity struct {
 	// The URL where the WebSocket interface can be found. (If not set, then default is http, on port+1.)
 	// optional
 	URL string `protobuf:"opt"`
+	// Labels of the server, like its region or version, used for service
+	// discovery. They are not part of the ID of the server or of a roster.
+	// optional
+	Metadata map[string]string `protobuf:"opt"`
 }
 
 // ServerIdentityID uniquely identifies an ServerIdentity struct
@@ -160,8 +164,9 @@ var ServerIdentityType = RegisterMessage(ServerIdentity{})
 
 // ServerIdentityToml is the struct that can be marshalled into a toml file
 type ServerIdentityToml struct {
-	Public  string
-	Address Address
+	Public   string
+	Address  Address
+	Metadata map[string]string `toml:",omitempty"`
 }
 
 // NewServerIdentity creates a new ServerIdentity based on a public key and with a slice
@@ -264,8 +269,9 @@ func (si *ServerIdentity) Toml(suite Suite) *ServerIdentityToml {
 		log.Error("Error while writing public key:", err)
 	}
 	return &ServerIdentityToml{
-		Address: si.Address,
-		Public:  buf.String(),
+		Address:  si.Address,
+		Public:   buf.String(),
+		Metadata: si.Metadata,
 	}
 }
 
@@ -276,8 +282,9 @@ func (si *ServerIdentityToml) ServerIdentity(suite Suite) *ServerIdentity {
 		log.Error("Error while reading public key:", err)
 	}
 	return &ServerIdentity{
-		Public:  pub,
-		Address: si.Address,
+		Public:   pub,
+		Address:  si.Address,
+		Metadata: si.Metadata,
 	}
 }
 
@@ -2,11 +2,13 @@ package network
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"encoding/binary"
 	"io"
 	"net"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"go.dedis.ch/onet/v3/log"
@@ -31,6 +33,32 @@ var timeoutLock = sync.RWMutex{}
 // packets, increase this value.
 var MaxPacketSize = Size(10 * 1024 * 1024)
 
+// StreamThreshold is the size of the encoded message from which Send writes
+// the type and the message to the connection one after the other, as
+// MarshalTo does, instead of copying them to a single buffer first. Smaller
+// messages are sent in a single write.
+var StreamThreshold = 64 * 1024
+
+// FragmentSize, if > 0, is the size from which the encoded messages are cut
+// in fragments of this size. Every fragment waits for the connection like a
+// message of its own, so that other messages, of the same or of another
+// protocol, can be sent between the fragments of a big message instead of
+// waiting for it to be sent completely. The order of the messages sent one
+// after the other by the same sender is kept. Fragments are always
+// understood by the receiving side, but must only be sent once all nodes
+// know about them, so this is disabled by default.
+var FragmentSize = 0
+
+// fragment holds a part of an encoded message. The fragments of one message
+// share the same stream, unique for the connection.
+type fragment struct {
+	Stream uint64
+	Last   bool
+	Data   []byte
+}
+
+var fragmentType = RegisterMessage(&fragment{})
+
 // NewTCPAddress returns a new Address that has type PlainTCP with the given
 // address addr.
 func NewTCPAddress(addr string) Address {
@@ -77,8 +105,18 @@ type TCPConn struct {
 	closedMut sync.Mutex
 	// So we only handle one receiving packet at a time
 	receiveMutex sync.Mutex
-	// So we only handle one sending packet at a time
-	sendMutex sync.Mutex
+	// So we only handle one sending packet at a time, the most urgent first
+	sendQueue sendQueue
+	// the messages of SendCoalesced waiting for the connection, indexed by
+	// the hash of their encoding
+	pending    map[[sha256.Size]byte]*pendingSend
+	pendingMut sync.Mutex
+	// the last stream used for the fragments of a message
+	lastStream uint32
+	// the fragments of the messages not received completely yet, only
+	// used by Receive
+	fragments     map[uint64][]byte
+	fragmentsSize int
 
 	counterSafe
 
@@ -115,12 +153,28 @@ func NewTCPConn(addr Address, suite Suite) (conn *TCPConn, err error) {
 // It returns the Envelope containing the message,
 // or EmptyEnvelope and an error if something wrong happened.
 func (c *TCPConn) Receive() (env *Envelope, e error) {
-	buff, err := c.receiveRaw()
-	if err != nil {
-		return nil, xerrors.Errorf("receiving: %w", err)
+	var buff []byte
+	var id MessageTypeID
+	var body Message
+	var err error
+	for {
+		buff, err = c.receiveRaw()
+		if err != nil {
+			return nil, xerrors.Errorf("receiving: %w", err)
+		}
+		id, body, err = Unmarshal(buff, c.suite)
+		if err != nil || !id.Equal(fragmentType) {
+			break
+		}
+		buff, err = c.addFragment(body.(*fragment))
+		if err != nil {
+			return nil, xerrors.Errorf("receiving fragment: %v", err)
+		}
+		if buff != nil {
+			id, body, err = Unmarshal(buff, c.suite)
+			break
+		}
 	}
-
-	id, body, err := Unmarshal(buff, c.suite)
 	return &Envelope{
 		MsgType: id,
 		Msg:     body,
@@ -128,6 +182,27 @@ func (c *TCPConn) Receive() (env *Envelope, e error) {
 	}, err
 }
 
+// addFragment stores the fragment and returns the whole encoded message if
+// it was the last one of its stream, or nil.
+func (c *TCPConn) addFragment(f *fragment) ([]byte, error) {
+	if c.fragments == nil {
+		c.fragments = make(map[uint64][]byte)
+	}
+	c.fragmentsSize += len(f.Data)
+	if c.fragmentsSize > int(MaxPacketSize) {
+		return nil, xerrors.Errorf("%v sends too big fragmented packets: %v>%v",
+			c.conn.RemoteAddr(), c.fragmentsSize, MaxPacketSize)
+	}
+	buf := append(c.fragments[f.Stream], f.Data...)
+	if !f.Last {
+		c.fragments[f.Stream] = buf
+		return nil, nil
+	}
+	delete(c.fragments, f.Stream)
+	c.fragmentsSize -= len(buf)
+	return buf, nil
+}
+
 func (c *TCPConn) receiveRaw() ([]byte, error) {
 	if c.receiveRawTest != nil {
 		return c.receiveRawTest()
@@ -188,52 +263,243 @@ func (c *TCPConn) receiveRawProd() ([]byte, error) {
 // and sends it using send().
 // It returns the number of bytes sent and an error if anything was wrong.
 func (c *TCPConn) Send(msg Message) (uint64, error) {
-	c.sendMutex.Lock()
-	defer c.sendMutex.Unlock()
+	return c.SendWithPriority(msg, PriorityNormal)
+}
 
-	b, err := Marshal(msg)
+// SendWithPriority is like Send, but if other messages are waiting for the
+// connection to be free, the message is sent before those of lower priority.
+// Messages of the same priority are sent in order.
+func (c *TCPConn) SendWithPriority(msg Message, p Priority) (uint64, error) {
+	msgType, buf, err := encodeMessage(msg)
 	if err != nil {
 		return 0, xerrors.Errorf("Error marshaling  message: %s", err.Error())
 	}
-	len, err := c.sendRaw(b)
+	return c.sendEncoded(msgType, buf, p, nil)
+}
+
+// pendingSend is a message of SendCoalesced waiting for the connection.
+// The identical messages sent meanwhile wait for it to be done instead of
+// being sent again.
+type pendingSend struct {
+	done chan struct{}
+	err  error
+	// number of identical messages waiting for this one
+	waiters int
+}
+
+// SendCoalesced is like SendWithPriority, but if an identical message is
+// still waiting for the connection to be free, the message is not sent a
+// second time. The call then waits for the pending message to be sent and
+// returns its error, with no byte sent. Distinct messages keep their order.
+func (c *TCPConn) SendCoalesced(msg Message, p Priority) (uint64, error) {
+	msgType, buf, err := encodeMessage(msg)
+	if err != nil {
+		return 0, xerrors.Errorf("Error marshaling  message: %s", err.Error())
+	}
+	key := sha256.Sum256(append(msgType[:], buf...))
+
+	c.pendingMut.Lock()
+	if ps, ok := c.pending[key]; ok {
+		ps.waiters++
+		c.pendingMut.Unlock()
+		<-ps.done
+		return 0, ps.err
+	}
+	if c.pending == nil {
+		c.pending = make(map[[sha256.Size]byte]*pendingSend)
+	}
+	ps := &pendingSend{done: make(chan struct{})}
+	c.pending[key] = ps
+	c.pendingMut.Unlock()
+
+	// Once the message starts to be sent, an identical one must be sent
+	// again.
+	n, err := c.sendEncoded(msgType, buf, p, func() {
+		c.pendingMut.Lock()
+		delete(c.pending, key)
+		c.pendingMut.Unlock()
+	})
+	ps.err = err
+	close(ps.done)
+	return n, err
+}
+
+// sendEncoded sends the encoded message when the connection is free for a
+// sender of priority p. If not nil, started is called once the connection
+// is acquired, before sending.
+func (c *TCPConn) sendEncoded(msgType MessageTypeID, buf []byte, p Priority,
+	started func()) (uint64, error) {
+	if FragmentSize > 0 && len(msgType)+len(buf) > FragmentSize {
+		return c.sendFragments(append(msgType[:], buf...), p, started)
+	}
+
+	c.sendQueue.acquire(p)
+	defer c.sendQueue.release()
+	if started != nil {
+		started()
+	}
+	len, err := c.sendMessage(msgType, buf)
 	if err != nil {
 		return len, xerrors.Errorf("sending: %w", err)
 	}
 	return len, nil
 }
 
+// sendMessage sends the type and the encoded message in a single packet.
+// From StreamThreshold on, they are written to the connection by
+// writeMessage, like MarshalTo does, instead of being copied to a single
+// buffer first.
+func (c *TCPConn) sendMessage(msgType MessageTypeID, buf []byte) (uint64, error) {
+	if len(buf) < StreamThreshold {
+		return c.sendRaw(append(msgType[:], buf...))
+	}
+	return c.sendPacket(Size(len(msgType)+len(buf)), func(w io.Writer) error {
+		return writeMessage(w, msgType, buf)
+	})
+}
+
+// sendFragments sends the encoded message in fragments of FragmentSize. The
+// connection is released after every fragment, so that other senders can use
+// it.
+func (c *TCPConn) sendFragments(buf []byte, p Priority, started func()) (uint64, error) {
+	stream := uint64(atomic.AddUint32(&c.lastStream, 1))
+	var sentLen uint64
+	for len(buf) > 0 {
+		f := &fragment{Stream: stream, Data: buf}
+		if len(buf) > FragmentSize {
+			f.Data = buf[:FragmentSize]
+		}
+		buf = buf[len(f.Data):]
+		f.Last = len(buf) == 0
+		msgType, fBuf, err := encodeMessage(f)
+		if err != nil {
+			return sentLen, xerrors.Errorf("encoding fragment: %v", err)
+		}
+		c.sendQueue.acquire(p)
+		if started != nil {
+			started()
+			started = nil
+		}
+		n, err := c.sendMessage(msgType, fBuf)
+		c.sendQueue.release()
+		sentLen += n
+		if err != nil {
+			return sentLen, xerrors.Errorf("sending: %w", err)
+		}
+	}
+	return sentLen, nil
+}
+
+// Priority orders the messages waiting to be sent on a connection.
+type Priority int
+
+const (
+	// PriorityLow is for bulk transfers that can wait.
+	PriorityLow Priority = iota
+	// PriorityNormal is used by Send.
+	PriorityNormal
+	// PriorityHigh is for urgent control messages.
+	PriorityHigh
+	nbrPriorities
+)
+
+// sendQueue lets one sender at a time use the connection. When it is busy,
+// the waiting senders get it by priority, then in the order they arrived.
+// The zero value is an idle queue.
+type sendQueue struct {
+	sync.Mutex
+	busy    bool
+	waiting [nbrPriorities][]chan bool
+}
+
+// acquire blocks until the connection is free for a sender of priority p.
+func (q *sendQueue) acquire(p Priority) {
+	if p < PriorityLow {
+		p = PriorityLow
+	} else if p >= nbrPriorities {
+		p = nbrPriorities - 1
+	}
+	q.Lock()
+	if !q.busy {
+		q.busy = true
+		q.Unlock()
+		return
+	}
+	ready := make(chan bool)
+	q.waiting[p] = append(q.waiting[p], ready)
+	q.Unlock()
+	<-ready
+}
+
+// release hands the connection to the next waiting sender, if any.
+func (q *sendQueue) release() {
+	q.Lock()
+	defer q.Unlock()
+	for p := nbrPriorities - 1; p >= PriorityLow; p-- {
+		if len(q.waiting[p]) > 0 {
+			ready := q.waiting[p][0]
+			q.waiting[p] = q.waiting[p][1:]
+			close(ready)
+			return
+		}
+	}
+	q.busy = false
+}
+
 // sendRaw writes the number of bytes of the message to the network then the
-// whole message b in slices of size maxChunkSize.
-// In case of an error it aborts.
+// message. In case of an error it aborts.
 func (c *TCPConn) sendRaw(b []byte) (uint64, error) {
+	return c.sendPacket(Size(len(b)), func(w io.Writer) error {
+		_, err := w.Write(b)
+		return err
+	})
+}
+
+// sendPacket writes the size of the packet to the network, then lets write
+// send its content through the connection. In case of an error it aborts.
+func (c *TCPConn) sendPacket(packetSize Size, write func(io.Writer) error) (uint64, error) {
 	timeoutLock.RLock()
 	c.conn.SetWriteDeadline(time.Now().Add(timeout))
 	timeoutLock.RUnlock()
 
 	// First write the size
-	packetSize := Size(len(b))
 	if err := binary.Write(c.conn, globalOrder, packetSize); err != nil {
 		return 0, xerrors.Errorf("buffer write: %v", err)
 	}
 	// Then send everything through the connection
-	// Send chunk by chunk
 	log.Lvl5("Sending from", c.conn.LocalAddr(), "to", c.conn.RemoteAddr())
-	var sent Size
-	for sent < packetSize {
-		n, err := c.conn.Write(b[sent:])
-		if err != nil {
-			sentLen := 4 + uint64(sent)
-			c.updateTx(sentLen)
-			return sentLen, xerrors.Errorf("sending: %w", handleError(err))
-		}
-		sent += Size(n)
-	}
+	w := &connWriter{conn: c.conn}
+	err := write(w)
 	// update stats on the connection. Plus 4 for the uint32 for the frame size.
-	sentLen := 4 + uint64(sent)
+	sentLen := 4 + w.sent
 	c.updateTx(sentLen)
+	if err != nil {
+		return sentLen, xerrors.Errorf("sending: %w", err)
+	}
 	return sentLen, nil
 }
 
+// connWriter writes to a connection and counts the bytes sent.
+type connWriter struct {
+	conn net.Conn
+	sent uint64
+}
+
+// Write implements io.Writer. It keeps writing until all of b is sent or an
+// error occurs.
+func (w *connWriter) Write(b []byte) (int, error) {
+	var written int
+	for written < len(b) {
+		n, err := w.conn.Write(b[written:])
+		written += n
+		w.sent += uint64(n)
+		if err != nil {
+			return written, handleError(err)
+		}
+	}
+	return written, nil
+}
+
 // Remote returns the name of the peer at the end point of
 // the connection.
 func (c *TCPConn) Remote() Address {
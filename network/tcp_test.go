@@ -2,6 +2,7 @@ package network
 
 import (
 	"bytes"
+	"crypto/rand"
 	"encoding/binary"
 	"fmt"
 	"net"
@@ -123,6 +124,82 @@ func TestTCPsendRaw(t *testing.T) {
 	}
 }
 
+func TestTCPConnSendStream(t *testing.T) {
+	local, remote := net.Pipe()
+	sender := &TCPConn{conn: local}
+	receiver := &TCPConn{conn: remote}
+	defer sender.Close()
+	defer receiver.Close()
+
+	for _, size := range []int{StreamThreshold / 2, 2 * StreamThreshold} {
+		msg := &BigMsg{Array: make([]byte, size)}
+		rand.Read(msg.Array)
+		buf, err := Marshal(msg)
+		require.NoError(t, err)
+
+		sent := make(chan uint64, 1)
+		go func() {
+			n, err := sender.Send(msg)
+			require.NoError(t, err)
+			sent <- n
+		}()
+		env, err := receiver.Receive()
+		require.NoError(t, err)
+		require.Equal(t, msg.Array, env.Msg.(*BigMsg).Array)
+		require.Equal(t, uint64(4+len(buf)), <-sent)
+	}
+
+	// A big message to a closed connection fails.
+	require.NoError(t, receiver.Close())
+	_, err := sender.Send(&BigMsg{Array: make([]byte, 2*StreamThreshold)})
+	require.Error(t, err)
+}
+
+func TestTCPConnSendFragments(t *testing.T) {
+	defer func(size int) { FragmentSize = size }(FragmentSize)
+	FragmentSize = 1024
+
+	local, remote := net.Pipe()
+	sender := &TCPConn{conn: local}
+	receiver := &TCPConn{conn: remote}
+	defer sender.Close()
+	defer receiver.Close()
+
+	// The bulk message blocks the connection until the receiver reads it.
+	bulk := &BigMsg{Array: make([]byte, 64*1024)}
+	rand.Read(bulk.Array)
+	sent := make(chan error, 2)
+	go func() {
+		_, err := sender.Send(bulk)
+		sent <- err
+	}()
+	waitTimeout(time.Second, 100, func() bool {
+		sender.sendQueue.Lock()
+		defer sender.sendQueue.Unlock()
+		return sender.sendQueue.busy
+	})
+	go func() {
+		_, err := sender.Send(&SimpleMessage{I: 42})
+		sent <- err
+	}()
+	waitTimeout(time.Second, 100, func() bool {
+		sender.sendQueue.Lock()
+		defer sender.sendQueue.Unlock()
+		return len(sender.sendQueue.waiting[PriorityNormal]) == 1
+	})
+
+	// The small message is sent between the fragments of the bulk message.
+	env, err := receiver.Receive()
+	require.NoError(t, err)
+	require.Equal(t, int64(42), env.Msg.(*SimpleMessage).I)
+	env, err = receiver.Receive()
+	require.NoError(t, err)
+	require.Equal(t, bulk.Array, env.Msg.(*BigMsg).Array)
+	require.NoError(t, <-sent)
+	require.NoError(t, <-sent)
+	require.Empty(t, receiver.fragments)
+}
+
 // Test the receiving part of a message for tcp connections if the response is
 // buffered correctly.
 func TestTCPConnReceiveRaw(t *testing.T) {
@@ -264,6 +341,61 @@ func TestTCPConn(t *testing.T) {
 	<-done
 }
 
+func TestTCPConn_SendWithPriority(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	received := make(chan *Envelope, 3)
+	go func() {
+		conn, err := ln.Accept()
+		require.NoError(t, err)
+		rc := &TCPConn{conn: conn, suite: tSuite}
+		defer rc.Close()
+		for i := 0; i < 3; i++ {
+			env, err := rc.Receive()
+			require.NoError(t, err)
+			received <- env
+		}
+	}()
+
+	c, err := NewTCPConn(NewTCPAddress(ln.Addr().String()), tSuite)
+	require.NoError(t, err)
+	defer c.Close()
+
+	waiting := func(p Priority, n int) {
+		for i := 0; i < 100; i++ {
+			c.sendQueue.Lock()
+			l := len(c.sendQueue.waiting[p])
+			c.sendQueue.Unlock()
+			if l == n {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatal("message didn't get queued")
+	}
+
+	// Simulate a congested connection, then queue the bulk message before
+	// the urgent ones.
+	c.sendQueue.acquire(PriorityNormal)
+	go c.SendWithPriority(&basicMessage{Value: 1}, PriorityLow)
+	waiting(PriorityLow, 1)
+	go c.SendWithPriority(&basicMessage{Value: 2}, PriorityHigh)
+	waiting(PriorityHigh, 1)
+	go c.SendWithPriority(&basicMessage{Value: 3}, PriorityHigh)
+	waiting(PriorityHigh, 2)
+	c.sendQueue.release()
+
+	for _, v := range []int{2, 3, 1} {
+		select {
+		case env := <-received:
+			require.Equal(t, v, env.Msg.(*basicMessage).Value)
+		case <-time.After(5 * time.Second):
+			t.Fatal("didn't receive the message")
+		}
+	}
+}
+
 func TestTCPConnTimeout(t *testing.T) {
 	var timeoutForTest = 100 * time.Millisecond
 
@@ -1,11 +1,14 @@
 package onet
 
 import (
+	"crypto/sha256"
+	"encoding/binary"
 	"fmt"
 	"sync"
 	"time"
 
 	"github.com/google/uuid"
+	"go.dedis.ch/kyber/v3/sign/schnorr"
 	"go.dedis.ch/onet/v3/log"
 	"go.dedis.ch/onet/v3/network"
 	"golang.org/x/xerrors"
@@ -15,6 +18,18 @@ import (
 // asking for resources for this range of time (i.e. tree)
 const globalProtocolTimeout = 10 * time.Minute
 
+const (
+	// defaultTreeRequestInterval is the time to wait for an answer before
+	// asking again for an unknown tree. It doubles after each request.
+	defaultTreeRequestInterval = 5 * time.Second
+	// defaultTreeRequestRetries is how many times an unknown tree is asked
+	// again before dropping the messages waiting for it.
+	defaultTreeRequestRetries = 3
+	// maxTreeResponses is how many trees are sent at the same time to the
+	// nodes asking for them. Further requests wait for their turn.
+	maxTreeResponses = 8
+)
+
 // Overlay keeps all trees and entity-lists for a given Server. It creates
 // Nodes and ProtocolInstances upon request and dispatches the messages.
 type Overlay struct {
@@ -47,19 +62,67 @@ type Overlay struct {
 	protoIO *messageProxyStore
 
 	pendingConfigs    map[TokenID]*GenericConfig
+	pendingDeadlines  map[TokenID]time.Time
 	pendingConfigsMut sync.Mutex
+
+	// dispatchPool, if not nil, is used by new TreeNodeInstances instead of
+	// having one go-routine each. All pools ever created are kept in
+	// dispatchPools so they can be stopped on Close.
+	dispatchPool    *dispatchPool
+	dispatchPools   []*dispatchPool
+	dispatchPoolMut sync.Mutex
+
+	// treeRequests holds the timers to ask again for the trees that have been
+	// requested but not received yet.
+	treeRequests        map[TreeID]*time.Timer
+	treeRequestInterval time.Duration
+	treeRequestRetries  int
+	treeRequestsClosed  bool
+	treeRequestsMut     sync.Mutex
+	// number of trees requested to and received from other nodes
+	treeRequestsSent   safeAdder
+	treeResponsesRecvd safeAdder
+	// treeResponses bounds the number of trees being sent at the same time
+	treeResponses chan bool
+	// received trees deeper than this are rejected, if > 0
+	maxTreeDepth    int
+	maxTreeDepthMut sync.Mutex
+	// received trees are checked with Tree.Validate if true
+	validateTrees    bool
+	validateTreesMut sync.Mutex
+
+	// callbacks of the services for the roster changes
+	rosterChangeCbs []func(old, new *Roster)
+	// epoch of the last change accepted for a roster
+	rosterChangeEpochs map[RosterID]uint64
+	rosterChangeMut    sync.Mutex
+
+	// bytes of the messages waiting to be aggregated in all instances, by
+	// message type, and the maximum for each type if > 0
+	aggregatedBytes   map[network.MessageTypeID]uint64
+	aggregationBudget uint64
+	aggregationMut    sync.Mutex
+	// number of messages dropped because of the aggregation budget
+	aggregationDrops safeAdder
 }
 
 // NewOverlay creates a new overlay-structure
 func NewOverlay(c *Server) *Overlay {
 	o := &Overlay{
-		server:             c,
-		treeStorage:        newTreeStorage(globalProtocolTimeout),
-		instances:          make(map[TokenID]*TreeNodeInstance),
-		instancesInfo:      make(map[TokenID]bool),
-		protocolInstances:  make(map[TokenID]ProtocolInstance),
-		pendingTreeMarshal: make(map[RosterID][]*TreeMarshal),
-		pendingConfigs:     make(map[TokenID]*GenericConfig),
+		server:              c,
+		treeStorage:         newTreeStorage(globalProtocolTimeout),
+		instances:           make(map[TokenID]*TreeNodeInstance),
+		instancesInfo:       make(map[TokenID]bool),
+		protocolInstances:   make(map[TokenID]ProtocolInstance),
+		pendingTreeMarshal:  make(map[RosterID][]*TreeMarshal),
+		pendingConfigs:      make(map[TokenID]*GenericConfig),
+		pendingDeadlines:    make(map[TokenID]time.Time),
+		treeRequests:        make(map[TreeID]*time.Timer),
+		treeRequestInterval: defaultTreeRequestInterval,
+		treeRequestRetries:  defaultTreeRequestRetries,
+		treeResponses:       make(chan bool, maxTreeResponses),
+		aggregatedBytes:     make(map[network.MessageTypeID]uint64),
+		rosterChangeEpochs:  make(map[RosterID]uint64),
 	}
 	o.protoIO = newMessageProxyStore(c.suite, c, o)
 	// messages going to protocol instances
@@ -70,7 +133,9 @@ func NewOverlay(c *Server) *Overlay {
 		RequestRosterMsgID,
 		SendRosterMsgID,
 		SendTreeMsgID,
-		ConfigMsgID) // fetch config information
+		ConfigMsgID,       // fetch config information
+		DeadlineMsgID,     // fetch the deadline of a protocol instance
+		RosterChangeMsgID) // notify the services of a new roster
 	return o
 }
 
@@ -82,6 +147,14 @@ func (o *Overlay) Process(env *network.Envelope) {
 		o.handleConfigMessage(env)
 		return
 	}
+	if env.MsgType.Equal(DeadlineMsgID) {
+		o.handleDeadlineMessage(env)
+		return
+	}
+	if env.MsgType.Equal(RosterChangeMsgID) {
+		o.handleRosterChange(env)
+		return
+	}
 
 	// get messageProxy or default one
 	io := o.protoIO.getByPacketType(env.MsgType)
@@ -111,6 +184,9 @@ func (o *Overlay) Process(env *network.Envelope) {
 			MsgType:        typ,
 			Size:           env.Size,
 		}
+		if pm, ok := env.Msg.(*ProtocolMsg); ok {
+			protoMsg.MsgSlice = pm.MsgSlice
+		}
 		err = o.TransmitMsg(protoMsg, io)
 		if err != nil {
 			log.Errorf("Msg %s from %s produced error: %+v", protoMsg.MsgType,
@@ -171,7 +247,10 @@ func (o *Overlay) TransmitMsg(onetMsg *ProtocolMsg, io MessageProxy) error {
 			config = onetMsg.Config
 		}
 
+		tni.configMut.Lock()
 		tni.config = config
+		tni.deadline = o.getDeadline(onetMsg.To.ID())
+		tni.configMut.Unlock()
 
 		// request the PI from the Service and binds the two
 		pi, err = o.server.serviceManager.newProtocol(tni, config)
@@ -209,6 +288,9 @@ func (o *Overlay) TransmitMsg(onetMsg *ProtocolMsg, io MessageProxy) error {
 			return xerrors.New("Error Binding TreeNodeInstance and ProtocolInstance:" +
 				err.Error())
 		}
+		tni.configMut.Lock()
+		tni.armDeadline()
+		tni.configMut.Unlock()
 		log.Lvl4(o.server.Address(), "Overlay created new ProtocolInstace msg => ",
 			fmt.Sprintf("%+v", onetMsg.To))
 	}
@@ -279,9 +361,9 @@ func (o *Overlay) checkPendingTreeMarshal(el *Roster) {
 		return
 	}
 	for _, tm := range sl {
-		tree, err := tm.MakeTree(el)
+		tree, err := o.makeTree(tm, el)
 		if err != nil {
-			log.Error("Tree from Roster failed")
+			log.Error("Tree from Roster failed:", err)
 			continue
 		}
 		// add the tree into our "database"
@@ -307,10 +389,14 @@ func (o *Overlay) savePendingMsg(onetMsg *ProtocolMsg, io MessageProxy) {
 func (o *Overlay) requestTree(si *network.ServerIdentity, onetMsg *ProtocolMsg, io MessageProxy) error {
 	o.savePendingMsg(onetMsg, io)
 
+	req := &RequestTree{TreeID: onetMsg.To.TreeID, Version: 1}
+	if o.knownRoster(onetMsg.To.RosterID) != nil {
+		// no need to get the roster again
+		req.RosterID = onetMsg.To.RosterID
+	}
+
 	// try to prepare the message before locking the storage
-	msg, err := io.Wrap(nil, &OverlayMsg{
-		RequestTree: &RequestTree{TreeID: onetMsg.To.TreeID, Version: 1},
-	})
+	msg, err := io.Wrap(nil, &OverlayMsg{RequestTree: req})
 	if err != nil {
 		return xerrors.Errorf("wrapping message: %v", err)
 	}
@@ -329,13 +415,207 @@ func (o *Overlay) requestTree(si *network.ServerIdentity, onetMsg *ProtocolMsg,
 		o.treeStorage.Unregister(onetMsg.To.TreeID)
 		return xerrors.Errorf("sending tree request: %v", err)
 	}
+	o.treeRequestsSent.add(1)
 
+	o.scheduleTreeRequest(si, onetMsg.To.TreeID, onetMsg.To.RosterID, io, 1)
 	return nil
 }
 
+// SetTreeRequestRetry sets how the overlay asks again for a tree it requested
+// but didn't receive. The first new request is sent after interval, and the
+// interval doubles for every further request. If the tree is still unknown
+// after retries new requests, the messages waiting for this tree are dropped.
+// An interval of 0 or less disables the new requests, so the messages wait
+// for the tree forever.
+func (o *Overlay) SetTreeRequestRetry(interval time.Duration, retries int) {
+	o.treeRequestsMut.Lock()
+	defer o.treeRequestsMut.Unlock()
+	o.treeRequestInterval = interval
+	o.treeRequestRetries = retries
+}
+
+// SetMaxTreeDepth makes the overlay reject the trees it receives from other
+// nodes if their depth is above max, as a maliciously deep tree uses a lot of
+// stack to be built and to send messages along its branches. A value of 0,
+// the default, accepts all trees.
+func (o *Overlay) SetMaxTreeDepth(max int) {
+	o.maxTreeDepthMut.Lock()
+	defer o.maxTreeDepthMut.Unlock()
+	o.maxTreeDepth = max
+}
+
+func (o *Overlay) getMaxTreeDepth() int {
+	o.maxTreeDepthMut.Lock()
+	defer o.maxTreeDepthMut.Unlock()
+	return o.maxTreeDepth
+}
+
+// SetValidateTrees makes the overlay check the trees it receives from other
+// nodes with Tree.Validate, and reject the invalid ones. The trees are not
+// checked by default.
+func (o *Overlay) SetValidateTrees(validate bool) {
+	o.validateTreesMut.Lock()
+	defer o.validateTreesMut.Unlock()
+	o.validateTrees = validate
+}
+
+// makeTree creates the tree of tm with ro, and validates it if
+// SetValidateTrees is enabled.
+func (o *Overlay) makeTree(tm *TreeMarshal, ro *Roster) (*Tree, error) {
+	tree, err := tm.MakeTree(ro)
+	if err != nil {
+		return nil, xerrors.Errorf("making tree: %v", err)
+	}
+	o.validateTreesMut.Lock()
+	validate := o.validateTrees
+	o.validateTreesMut.Unlock()
+	if validate {
+		if err := tree.Validate(); err != nil {
+			return nil, xerrors.Errorf("invalid tree: %v", err)
+		}
+	}
+	return tree, nil
+}
+
+// SetAggregationBudget limits how many bytes of messages of a same type wait
+// to be aggregated, summed over all the protocol instances of this overlay.
+// While the budget of a type is used, the messages of this type from the
+// children are dropped, except the ones completing an aggregation. A budget
+// of 0, the default, doesn't limit the messages.
+func (o *Overlay) SetAggregationBudget(bytes uint64) {
+	o.aggregationMut.Lock()
+	defer o.aggregationMut.Unlock()
+	o.aggregationBudget = bytes
+}
+
+// AggregatedBytes returns how many bytes of messages of type mt are waiting
+// to be aggregated in the protocol instances.
+func (o *Overlay) AggregatedBytes(mt network.MessageTypeID) uint64 {
+	o.aggregationMut.Lock()
+	defer o.aggregationMut.Unlock()
+	return o.aggregatedBytes[mt]
+}
+
+// AggregationDrops returns how many messages have been dropped because the
+// aggregation budget of their type was used.
+func (o *Overlay) AggregationDrops() uint64 {
+	return o.aggregationDrops.get()
+}
+
+// reserveAggregation accounts for size bytes of type mt waiting to be
+// aggregated. It returns false, and counts a drop, if it doesn't fit in the
+// budget.
+func (o *Overlay) reserveAggregation(mt network.MessageTypeID, size uint64) bool {
+	o.aggregationMut.Lock()
+	defer o.aggregationMut.Unlock()
+	if o.aggregationBudget > 0 && o.aggregatedBytes[mt]+size > o.aggregationBudget {
+		o.aggregationDrops.add(1)
+		return false
+	}
+	o.aggregatedBytes[mt] += size
+	return true
+}
+
+// releaseAggregation is called when size bytes of type mt don't wait to be
+// aggregated anymore.
+func (o *Overlay) releaseAggregation(mt network.MessageTypeID, size uint64) {
+	o.aggregationMut.Lock()
+	defer o.aggregationMut.Unlock()
+	if size >= o.aggregatedBytes[mt] {
+		delete(o.aggregatedBytes, mt)
+		return
+	}
+	o.aggregatedBytes[mt] -= size
+}
+
+// scheduleTreeRequest plans to ask si again for the tree if it is still
+// unknown after the interval corresponding to the attempt.
+func (o *Overlay) scheduleTreeRequest(si *network.ServerIdentity, id TreeID, rid RosterID, io MessageProxy, attempt int) {
+	o.treeRequestsMut.Lock()
+	defer o.treeRequestsMut.Unlock()
+	if o.treeRequestsClosed || o.treeRequestInterval <= 0 {
+		return
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(o.treeRequestInterval<<uint(attempt-1), func() {
+		o.retryTreeRequest(&timer, si, id, rid, io, attempt)
+	})
+	o.treeRequests[id] = timer
+}
+
+// retryTreeRequest asks again for the tree, or drops the pending messages of
+// this tree if there were too many attempts. Like requestTree, it only asks
+// for the roster rid if it is not known.
+func (o *Overlay) retryTreeRequest(timer **time.Timer, si *network.ServerIdentity, id TreeID, rid RosterID, io MessageProxy, attempt int) {
+	o.treeRequestsMut.Lock()
+	// timer is only read with the lock, as it is set after the creation
+	if o.treeRequestsClosed || o.treeRequests[id] != *timer {
+		// the tree arrived in the meantime
+		o.treeRequestsMut.Unlock()
+		return
+	}
+	delete(o.treeRequests, id)
+	retries := o.treeRequestRetries
+	o.treeRequestsMut.Unlock()
+
+	if o.treeStorage.Get(id) != nil {
+		return
+	}
+
+	if attempt > retries {
+		log.Warnf("%s: didn't get tree %x from %s after %d requests, "+
+			"dropping its pending messages", o.server.ServerIdentity, id[:],
+			si, attempt)
+		o.dropPendingMsgs(id)
+		o.treeStorage.Unregister(id)
+		return
+	}
+
+	log.Lvlf2("%s: requesting tree %x again from %s", o.server.ServerIdentity,
+		id[:], si)
+	req := &RequestTree{TreeID: id, Version: 1}
+	if o.knownRoster(rid) != nil {
+		req.RosterID = rid
+	}
+	msg, err := io.Wrap(nil, &OverlayMsg{RequestTree: req})
+	if err == nil {
+		_, err = o.server.Send(si, msg)
+	}
+	if err != nil {
+		log.Error("couldn't request tree again:", err)
+	} else {
+		o.treeRequestsSent.add(1)
+	}
+	o.scheduleTreeRequest(si, id, rid, io, attempt+1)
+}
+
+// stopTreeRequest cancels the next request for the tree, if any.
+func (o *Overlay) stopTreeRequest(id TreeID) {
+	o.treeRequestsMut.Lock()
+	defer o.treeRequestsMut.Unlock()
+	if timer := o.treeRequests[id]; timer != nil {
+		timer.Stop()
+		delete(o.treeRequests, id)
+	}
+}
+
+// dropPendingMsgs removes all the pending messages waiting for the tree.
+func (o *Overlay) dropPendingMsgs(id TreeID) {
+	o.pendingMsgLock.Lock()
+	defer o.pendingMsgLock.Unlock()
+	var remaining []pendingMsg
+	for _, msg := range o.pendingMsg {
+		if !id.Equal(msg.To.TreeID) {
+			remaining = append(remaining, msg)
+		}
+	}
+	o.pendingMsg = remaining
+}
+
 // RegisterTree takes a tree and puts it in the map
 func (o *Overlay) RegisterTree(t *Tree) {
 	o.treeStorage.Set(t)
+	o.stopTreeRequest(t.ID)
 
 	o.checkPendingMessages(t)
 }
@@ -379,6 +659,17 @@ func (o *Overlay) Tx() uint64 {
 	return o.server.Tx()
 }
 
+// TreeRequests returns how many times this overlay asked another node for a
+// tree it didn't know.
+func (o *Overlay) TreeRequests() uint64 {
+	return o.treeRequestsSent.get()
+}
+
+// TreeResponses returns how many of the requested trees have been received.
+func (o *Overlay) TreeResponses() uint64 {
+	return o.treeResponsesRecvd.get()
+}
+
 // Send the tree or do nothing when it is not known
 func (o *Overlay) handleRequestTree(si *network.ServerIdentity, req *RequestTree, io MessageProxy) {
 	tree := o.treeStorage.Get(req.TreeID)
@@ -388,7 +679,16 @@ func (o *Overlay) handleRequestTree(si *network.ServerIdentity, req *RequestTree
 		return
 	}
 
-	treeM := tree.MakeTreeMarshal()
+	// All the children of a node ask for the tree at the same time when
+	// they get their first message, so the marshaled tree is shared and
+	// only some of them are served at once.
+	o.treeResponses <- true
+	defer func() { <-o.treeResponses }()
+	treeM := o.treeStorage.getMarshal(req.TreeID)
+	if treeM == nil {
+		log.Error("couldn't find the tree")
+		return
+	}
 
 	if req.Version == 0 {
 		log.Warnf("[DEPRECATION] got an old version of the RequestTree from %s", si)
@@ -396,12 +696,16 @@ func (o *Overlay) handleRequestTree(si *network.ServerIdentity, req *RequestTree
 		return
 	}
 
-	msg, err := io.Wrap(nil, &OverlayMsg{
-		ResponseTree: &ResponseTree{
-			TreeMarshal: treeM,
-			Roster:      tree.Roster,
-		},
-	})
+	rt := &ResponseTree{
+		TreeMarshal: treeM,
+		Roster:      tree.Roster,
+		View:        tree.View,
+	}
+	if !req.RosterID.IsNil() && req.RosterID.Equal(tree.Roster.ID) {
+		rt.Roster = nil
+	}
+
+	msg, err := io.Wrap(nil, &OverlayMsg{ResponseTree: rt})
 
 	if err != nil {
 		log.Error("couldn't wrap ResponseTree:", err)
@@ -476,7 +780,12 @@ func (o *Overlay) handleSendTree(si *network.ServerIdentity, rt *ResponseTree, i
 		return
 	}
 
-	if rt.Roster == nil {
+	ro := rt.Roster
+	if ro == nil {
+		// the roster has been left out because we announced we know it
+		ro = o.knownRoster(rt.TreeMarshal.RosterID)
+	}
+	if ro == nil {
 		log.Error("received an empty roster")
 		return
 	}
@@ -488,15 +797,50 @@ func (o *Overlay) handleSendTree(si *network.ServerIdentity, rt *ResponseTree, i
 		return
 	}
 
-	tree, err := rt.TreeMarshal.MakeTree(rt.Roster)
+	// The depth is checked before building the tree, which is recursive.
+	if max := o.getMaxTreeDepth(); max > 0 {
+		if depth := rt.TreeMarshal.Depth(); depth > max {
+			log.Errorf("ignoring tree of depth %d above %d", depth, max)
+			return
+		}
+	}
+
+	tree, err := o.makeTree(rt.TreeMarshal, ro)
 	if err != nil {
 		log.Error("Couldn't create tree:", err)
 		return
 	}
+	if rt.View != nil {
+		if err := tree.SetView(rt.View); err != nil {
+			log.Error("Couldn't set view of tree:", err)
+			return
+		}
+	}
 	log.Lvl4("Received new tree")
+	o.treeResponsesRecvd.add(1)
 	o.RegisterTree(tree)
 }
 
+// knownRoster returns the roster with the given ID if it is used by one of the
+// stored trees or one of the instances, or nil.
+func (o *Overlay) knownRoster(id RosterID) *Roster {
+	if id.IsNil() {
+		return nil
+	}
+	if ro := o.treeStorage.GetRoster(id); ro != nil {
+		return ro
+	}
+
+	o.instancesLock.Lock()
+	defer o.instancesLock.Unlock()
+	for _, inst := range o.instances {
+		if inst.Roster().ID.Equal(id) {
+			return inst.Roster()
+		}
+	}
+	return nil
+}
+
 // Deprecated: roster is not sent anymore, only the tree
 func (o *Overlay) handleRequestRoster(si *network.ServerIdentity, req *RequestRoster, io MessageProxy) {
 	ro := o.treeStorage.GetRoster(req.RosterID)
@@ -545,6 +889,187 @@ func (o *Overlay) handleConfigMessage(env *network.Envelope) {
 	o.pendingConfigs[config.Dest] = &config.Config
 }
 
+// handleDeadlineMessage stores the deadline of a protocol instance, to be
+// given to the instance once its first message arrives.
+func (o *Overlay) handleDeadlineMessage(env *network.Envelope) {
+	dl, ok := env.Msg.(*DeadlineMsg)
+	if !ok {
+		log.Error(o.server.Address(), "Wrong deadline type, most likely invalid packet got through.")
+		return
+	}
+
+	o.pendingConfigsMut.Lock()
+	defer o.pendingConfigsMut.Unlock()
+	o.pendingDeadlines[dl.Dest] = time.Unix(0, dl.Deadline)
+}
+
+// onRosterChange registers a callback for the roster changes.
+func (o *Overlay) onRosterChange(fn func(old, new *Roster)) {
+	o.rosterChangeMut.Lock()
+	defer o.rosterChangeMut.Unlock()
+	o.rosterChangeCbs = append(o.rosterChangeCbs, fn)
+}
+
+// notifyRosterChange calls the callbacks registered with onRosterChange.
+func (o *Overlay) notifyRosterChange(old, new *Roster) {
+	o.rosterChangeMut.Lock()
+	cbs := append([]func(old, new *Roster){}, o.rosterChangeCbs...)
+	o.rosterChangeMut.Unlock()
+	for _, cb := range cbs {
+		cb(old, new)
+	}
+}
+
+// acceptRosterEpoch records epoch as the last change of the roster, unless a
+// change with the same or a higher epoch has already been accepted.
+func (o *Overlay) acceptRosterEpoch(id RosterID, epoch uint64) bool {
+	o.rosterChangeMut.Lock()
+	defer o.rosterChangeMut.Unlock()
+	if epoch <= o.rosterChangeEpochs[id] {
+		return false
+	}
+	o.rosterChangeEpochs[id] = epoch
+	return true
+}
+
+// rosterChangeHash returns the hash signed by the leader of old to replace it
+// with new at the given epoch.
+func rosterChangeHash(old, new *Roster, epoch uint64) ([]byte, error) {
+	h := sha256.New()
+	if err := binary.Write(h, binary.BigEndian, epoch); err != nil {
+		return nil, xerrors.Errorf("hashing epoch: %v", err)
+	}
+	for _, ro := range []*Roster{old, new} {
+		id, err := ro.GetIDWithMetadata()
+		if err != nil {
+			return nil, xerrors.Errorf("roster id: %v", err)
+		}
+		h.Write(ro.ID[:])
+		h.Write(id[:])
+		for _, si := range ro.List {
+			h.Write([]byte(si.Address))
+			h.Write([]byte(si.URL))
+		}
+	}
+	return h.Sum(nil), nil
+}
+
+// rosterIDMatches returns true if the ID of ro is the one computed from its
+// list.
+func rosterIDMatches(ro *Roster) bool {
+	for _, si := range ro.List {
+		if si == nil || si.Public == nil {
+			return false
+		}
+		for _, srvid := range si.ServiceIdentities {
+			if srvid.Public == nil {
+				return false
+			}
+		}
+	}
+	id, err := ro.GetID()
+	return err == nil && id.Equal(ro.ID)
+}
+
+// changeRoster signs the change from old to new, sends it to all members of
+// both rosters and calls the local callbacks. This node must be the leader of
+// old.
+func (o *Overlay) changeRoster(old, new *Roster) error {
+	if old == nil || new == nil || len(old.List) == 0 || len(new.List) == 0 {
+		return xerrors.New("empty roster")
+	}
+	us := o.server.ServerIdentity
+	if !old.List[0].ID.Equal(us.ID) {
+		return xerrors.New("only the leader of the old roster can change it")
+	}
+	// The time orders the changes even if the leader restarts.
+	epoch := uint64(time.Now().UnixNano())
+	if !o.acceptRosterEpoch(old.ID, epoch) {
+		return xerrors.New("a more recent change of the roster exists")
+	}
+	hash, err := rosterChangeHash(old, new, epoch)
+	if err != nil {
+		return xerrors.Errorf("hashing: %v", err)
+	}
+	sig, err := schnorr.Sign(o.server.suite, o.server.private, hash)
+	if err != nil {
+		return xerrors.Errorf("signing: %v", err)
+	}
+	msg := &RosterChange{Old: old, New: new, Epoch: epoch, Signature: sig}
+
+	var errs []string
+	sent := make(map[network.ServerIdentityID]bool)
+	for _, si := range append(append([]*network.ServerIdentity{}, old.List...), new.List...) {
+		if si.ID.Equal(us.ID) || sent[si.ID] {
+			continue
+		}
+		sent[si.ID] = true
+		if _, err := o.server.Send(si, msg); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", si.Address, err))
+		}
+	}
+	o.notifyRosterChange(old, new)
+	if len(errs) > 0 {
+		return xerrors.Errorf("couldn't notify all nodes: %v", errs)
+	}
+	return nil
+}
+
+// handleRosterChange calls the callbacks for a roster change sent and signed
+// by the leader of the old roster, and including this node. If this node
+// knows the old roster, the known one is given to the callbacks instead of
+// the one of the message. Else, e.g. for a node only in the new roster, the
+// old roster of the message is used if its ID matches its list, so that it
+// can't pass for another roster.
+func (o *Overlay) handleRosterChange(env *network.Envelope) {
+	rc, ok := env.Msg.(*RosterChange)
+	if !ok || rc.Old == nil || rc.New == nil {
+		log.Error(o.server.Address(), "Wrong roster change from", env.ServerIdentity)
+		return
+	}
+	old := o.knownRoster(rc.Old.ID)
+	if old == nil {
+		if !rosterIDMatches(rc.Old) {
+			log.Error(o.server.Address(), "Change of a roster with a wrong ID from", env.ServerIdentity)
+			return
+		}
+		old = rc.Old
+	}
+	if len(old.List) == 0 {
+		log.Error(o.server.Address(), "Change of an empty roster from", env.ServerIdentity)
+		return
+	}
+	leader := old.List[0]
+	if env.ServerIdentity == nil || !env.ServerIdentity.ID.Equal(leader.ID) ||
+		!env.ServerIdentity.Public.Equal(leader.Public) {
+		log.Error(o.server.Address(), "Roster change not sent by the leader from", env.ServerIdentity)
+		return
+	}
+	us := o.server.ServerIdentity.ID
+	if i, _ := old.Search(us); i < 0 {
+		if i, _ := rc.New.Search(us); i < 0 {
+			log.Error(o.server.Address(), "Roster change not including us from", env.ServerIdentity)
+			return
+		}
+	}
+	hash, err := rosterChangeHash(old, rc.New, rc.Epoch)
+	if err != nil {
+		log.Error(o.server.Address(), "Couldn't hash roster change:", err)
+		return
+	}
+	err = schnorr.Verify(o.server.suite, leader.Public, hash, rc.Signature)
+	if err != nil {
+		log.Error(o.server.Address(), "Roster change not signed by the leader from",
+			env.ServerIdentity, ":", err)
+		return
+	}
+	if !o.acceptRosterEpoch(old.ID, rc.Epoch) {
+		log.Error(o.server.Address(), "Outdated roster change from", env.ServerIdentity)
+		return
+	}
+	o.notifyRosterChange(old, rc.New)
+}
+
 // getConfig returns the generic config corresponding to this node if present,
 // and removes it from the list of pending configs.
 func (o *Overlay) getConfig(id TokenID) *GenericConfig {
@@ -555,6 +1080,16 @@ func (o *Overlay) getConfig(id TokenID) *GenericConfig {
 	return c
 }
 
+// getDeadline returns the deadline of this node if one was received, or the
+// zero time. Like getConfig, it deletes the deadline.
+func (o *Overlay) getDeadline(id TokenID) time.Time {
+	o.pendingConfigsMut.Lock()
+	defer o.pendingConfigsMut.Unlock()
+	d := o.pendingDeadlines[id]
+	delete(o.pendingDeadlines, id)
+	return d
+}
+
 // SendToTreeNode sends a message to a treeNode
 // from is the sender token
 // to is the treenode of the destination
@@ -564,12 +1099,23 @@ func (o *Overlay) getConfig(id TokenID) *GenericConfig {
 // in the `NewProtocol` method if a Service has created the protocol and set the
 // config with `SetConfig`. It can be nil.
 func (o *Overlay) SendToTreeNode(from *Token, to *TreeNode, msg network.Message, io MessageProxy, c *GenericConfig) (uint64, error) {
+	return o.sendToTreeNodeAt(from, to, to.ServerIdentity, msg, io, c, time.Time{})
+}
+
+// sendToTreeNodeAt sends the message for the given TreeNode to the server si,
+// which is either the ServerIdentity of the node or its ViewIdentity. The
+// deadline, if not zero, is sent beforehand like the config.
+func (o *Overlay) sendToTreeNodeAt(from *Token, to *TreeNode, si *network.ServerIdentity,
+	msg network.Message, io MessageProxy, c *GenericConfig, deadline time.Time) (uint64, error) {
 	tokenTo := from.ChangeTreeNodeID(to.ID)
 
-	// first send the config if present
-	var confMsg *ConfigMsg
+	// first send the config and the deadline if present
+	var msgs []network.Message
 	if c != nil {
-		confMsg = &ConfigMsg{*c, tokenTo.ID()}
+		msgs = append(msgs, &ConfigMsg{*c, tokenTo.ID()})
+	}
+	if !deadline.IsZero() {
+		msgs = append(msgs, &DeadlineMsg{deadline.UnixNano(), tokenTo.ID()})
 	}
 	// then send the message
 	var final interface{}
@@ -587,12 +1133,7 @@ func (o *Overlay) SendToTreeNode(from *Token, to *TreeNode, msg network.Message,
 		return 0, xerrors.Errorf("wrapping message: %v", err)
 	}
 
-	var sentLen uint64
-	if confMsg != nil {
-		sentLen, err = o.server.Send(to.ServerIdentity, confMsg, final)
-	} else {
-		sentLen, err = o.server.Send(to.ServerIdentity, final)
-	}
+	sentLen, err := o.server.Send(si, append(msgs, final)...)
 	if err != nil {
 		err = xerrors.Errorf("sending: %v", err)
 	}
@@ -607,6 +1148,14 @@ func (o *Overlay) nodeDone(tok *Token) {
 	o.instancesLock.Unlock()
 }
 
+// IsInstanceDone returns true if the protocol instance with the given token
+// has finished on this node. Messages sent to a finished instance are dropped.
+func (o *Overlay) IsInstanceDone(tok TokenID) bool {
+	o.instancesLock.Lock()
+	defer o.instancesLock.Unlock()
+	return o.instancesInfo[tok]
+}
+
 // nodeDelete needs to be separated from nodeDone, as it is also called from
 // Close, but due to locking-issues here we don't lock.
 func (o *Overlay) nodeDelete(token *Token) {
@@ -662,6 +1211,48 @@ func (o *Overlay) Close() {
 
 	// force cleaning routines to shutdown
 	o.treeStorage.Close()
+
+	o.treeRequestsMut.Lock()
+	o.treeRequestsClosed = true
+	for id, timer := range o.treeRequests {
+		timer.Stop()
+		delete(o.treeRequests, id)
+	}
+	o.treeRequestsMut.Unlock()
+
+	o.dispatchPoolMut.Lock()
+	for _, p := range o.dispatchPools {
+		p.stop()
+	}
+	o.dispatchPool = nil
+	o.dispatchPools = nil
+	o.dispatchPoolMut.Unlock()
+}
+
+// SetDispatchPool makes the TreeNodeInstances created from now on share a
+// pool of size go-routines to dispatch their messages, instead of each
+// of them running its own go-routine. Messages of a given instance are still
+// dispatched one at a time and in the order they arrived. A size of 0 or less
+// goes back to one go-routine per instance.
+//
+// As a worker is busy while a handler runs, protocols using the pool should
+// not block in their handlers, e.g. by waiting on other messages of the same
+// protocol or on full channels.
+func (o *Overlay) SetDispatchPool(size int) {
+	o.dispatchPoolMut.Lock()
+	defer o.dispatchPoolMut.Unlock()
+	if size <= 0 {
+		o.dispatchPool = nil
+		return
+	}
+	o.dispatchPool = newDispatchPool(size)
+	o.dispatchPools = append(o.dispatchPools, o.dispatchPool)
+}
+
+func (o *Overlay) getDispatchPool() *dispatchPool {
+	o.dispatchPoolMut.Lock()
+	defer o.dispatchPoolMut.Unlock()
+	return o.dispatchPool
 }
 
 // CreateProtocol creates a ProtocolInstance, registers it to the Overlay.
@@ -669,10 +1260,46 @@ func (o *Overlay) Close() {
 // so the protocol will be picked up by the correct service and handled by its
 // NewProtocol method. If the sid is NilServiceID, then the protocol is handled by onet alone.
 func (o *Overlay) CreateProtocol(name string, t *Tree, sid ServiceID) (ProtocolInstance, error) {
+	return o.createProtocol(name, t, rootToken(name, t, sid, RoundID(uuid.Must(uuid.NewRandom()))))
+}
+
+// CreateProtocolWithRound does the same as CreateProtocol but uses the given
+// RoundID instead of a random one. Nodes deriving the same RoundID, e.g. from
+// a block hash, get the same token for the same tree and protocol. It returns
+// an error if an instance with this token already exists.
+func (o *Overlay) CreateProtocolWithRound(name string, t *Tree, sid ServiceID, rid RoundID) (ProtocolInstance, error) {
+	return o.createProtocol(name, t, rootToken(name, t, sid, rid))
+}
+
+// rootToken returns the token of the root of t for the protocol name in the
+// round rid.
+func rootToken(name string, t *Tree, sid ServiceID, rid RoundID) *Token {
+	return &Token{
+		TreeNodeID: t.Root.ID,
+		TreeID:     t.ID,
+		RosterID:   t.Roster.ID,
+		ProtoID:    ProtocolNameToID(name),
+		ServiceID:  sid,
+		RoundID:    rid,
+	}
+}
+
+// createProtocol creates the ProtocolInstance of the root of t for tok,
+// registers it and starts its Dispatch. It returns an error if an instance
+// with this token already exists.
+func (o *Overlay) createProtocol(name string, t *Tree, tok *Token) (ProtocolInstance, error) {
 	io := o.protoIO.getByName(name)
-	tni := o.NewTreeNodeInstanceFromService(t, t.Root, ProtocolNameToID(name), sid, io)
-	pi, err := o.server.protocolInstantiate(tni.token.ProtoID, tni)
+	tni, err := o.addTreeNodeInstance(t.Root, tok, io)
+	if err != nil {
+		return nil, xerrors.Errorf("an instance of %s already exists for round %v",
+			name, tok.RoundID)
+	}
+	o.RegisterTree(t)
+	pi, err := o.server.protocolInstantiate(tok.ProtoID, tni)
 	if err != nil {
+		o.instancesLock.Lock()
+		o.nodeDelete(tok)
+		o.instancesLock.Unlock()
 		return nil, xerrors.Errorf("instantiating protocol: %v", err)
 	}
 	if err = o.RegisterProtocolInstance(pi); err != nil {
@@ -689,10 +1316,10 @@ func (o *Overlay) CreateProtocol(name string, t *Tree, sid ServiceID) (ProtocolI
 		err := pi.Dispatch()
 		if err != nil {
 			log.Errorf("%s.Dispatch() created in service %s returned error %s",
-				name, ServiceFactory.Name(sid), err)
+				name, ServiceFactory.Name(tok.ServiceID), err)
 		}
 	}()
-	return pi, err
+	return pi, nil
 }
 
 // StartProtocol will create and start a ProtocolInstance.
@@ -724,6 +1351,30 @@ func (o *Overlay) NewTreeNodeInstanceFromProtoName(t *Tree, name string) *TreeNo
 	return o.NewTreeNodeInstanceFromProtocol(t, t.Root, ProtocolNameToID(name), io)
 }
 
+// StartProtocolSync creates a ProtocolInstance and calls its Start method
+// before returning, so that an error from Start is returned to the caller.
+// It is only meant for protocols whose Start doesn't block, as the caller
+// waits for it. If Start fails, the instance is done and nil is returned.
+func (o *Overlay) StartProtocolSync(name string, t *Tree, sid ServiceID) (_ ProtocolInstance, err error) {
+	pi, err := o.CreateProtocol(name, t, sid)
+	if err != nil {
+		return nil, xerrors.Errorf("creating protocol: %v", err)
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			err = xerrors.Errorf("panic in %s.Start(): %v", name, r)
+		}
+		if err != nil {
+			o.nodeDone(pi.Token())
+		}
+	}()
+
+	if err := pi.Start(); err != nil {
+		return nil, xerrors.Errorf("starting %s: %v", name, err)
+	}
+	return pi, nil
+}
+
 // NewTreeNodeInstanceFromProtocol takes a tree and a treenode (normally the
 // root) and and protocolID and returns a fresh TreeNodeInstance.
 func (o *Overlay) NewTreeNodeInstanceFromProtocol(t *Tree, tn *TreeNode, protoID ProtocolID, io MessageProxy) *TreeNodeInstance {
@@ -771,6 +1422,20 @@ func (o *Overlay) newTreeNodeInstanceFromToken(tn *TreeNode, tok *Token, io Mess
 	return tni
 }
 
+// addTreeNodeInstance does the same as newTreeNodeInstanceFromToken, unless
+// an instance with this token already exists, in which case it returns an
+// error. The check and the insertion are done under the same lock.
+func (o *Overlay) addTreeNodeInstance(tn *TreeNode, tok *Token, io MessageProxy) (*TreeNodeInstance, error) {
+	o.instancesLock.Lock()
+	defer o.instancesLock.Unlock()
+	if _, exists := o.instances[tok.ID()]; exists {
+		return nil, xerrors.New("instance already exists")
+	}
+	tni := newTreeNodeInstance(o, tok, tn, io)
+	o.instances[tok.ID()] = tni
+	return tni, nil
+}
+
 // ErrWrongTreeNodeInstance is returned when you already binded a TNI with a PI.
 var ErrWrongTreeNodeInstance = xerrors.New("This TreeNodeInstance doesn't exist")
 
@@ -806,6 +1471,63 @@ func (o *Overlay) RegisterMessageProxy(m MessageProxy) {
 	o.protoIO.RegisterMessageProxy(m)
 }
 
+// dispatchPool is a fixed set of go-routines that dispatch the messages of
+// the TreeNodeInstances submitted to it. An instance is only present once in
+// the queue, which keeps its messages in order.
+type dispatchPool struct {
+	queue   []*TreeNodeInstance
+	stopped bool
+	cond    *sync.Cond
+	sync.Mutex
+}
+
+func newDispatchPool(size int) *dispatchPool {
+	p := &dispatchPool{}
+	p.cond = sync.NewCond(&p.Mutex)
+	for i := 0; i < size; i++ {
+		go p.worker()
+	}
+	return p
+}
+
+// submit adds the instance to the queue of instances having messages to
+// dispatch. It never blocks.
+func (p *dispatchPool) submit(n *TreeNodeInstance) {
+	p.Lock()
+	defer p.Unlock()
+	if p.stopped {
+		return
+	}
+	p.queue = append(p.queue, n)
+	p.cond.Signal()
+}
+
+func (p *dispatchPool) worker() {
+	for {
+		p.Lock()
+		for len(p.queue) == 0 && !p.stopped {
+			p.cond.Wait()
+		}
+		if p.stopped {
+			p.Unlock()
+			return
+		}
+		n := p.queue[0]
+		p.queue = p.queue[1:]
+		p.Unlock()
+
+		n.dispatchFromPool()
+	}
+}
+
+func (p *dispatchPool) stop() {
+	p.Lock()
+	p.stopped = true
+	p.queue = nil
+	p.cond.Broadcast()
+	p.Unlock()
+}
+
 // pendingMsg is used to store messages destined for ProtocolInstances but when
 // the tree designated is not known to the Overlay. When the tree is sent to the
 // overlay, then the pendingMsg that are relying on this tree will get
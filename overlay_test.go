@@ -3,6 +3,8 @@ package onet
 import (
 	"errors"
 	"net/http"
+	"runtime"
+	"sync"
 	"testing"
 	"time"
 
@@ -95,6 +97,53 @@ func TestOverlayDispatchFailure(t *testing.T) {
 	pi.(*ProtocolOverlay).Done()
 }
 
+func TestOverlayCreateProtocolWithRound(t *testing.T) {
+	GlobalProtocolRegister("ProtocolOverlay", func(n *TreeNodeInstance) (ProtocolInstance, error) {
+		return &ProtocolOverlay{TreeNodeInstance: n}, nil
+	})
+	local := NewLocalTest(tSuite)
+	defer local.CloseAll()
+	servers, _, tree := local.GenTree(2, true)
+
+	rid := RoundID(uuid.NewSHA1(uuid.NameSpaceURL, []byte("block hash")))
+	p1, err := servers[0].overlay.CreateProtocolWithRound("ProtocolOverlay", tree, NilServiceID, rid)
+	require.NoError(t, err)
+	defer p1.(*ProtocolOverlay).Done()
+	p2, err := servers[1].overlay.CreateProtocolWithRound("ProtocolOverlay", tree, NilServiceID, rid)
+	require.NoError(t, err)
+	defer p2.(*ProtocolOverlay).Done()
+	require.Equal(t, rid, p1.Token().RoundID)
+	require.Equal(t, p1.Token().ID(), p2.Token().ID())
+
+	// the same round can't be created twice on a node
+	_, err = servers[0].overlay.CreateProtocolWithRound("ProtocolOverlay", tree, NilServiceID, rid)
+	require.Error(t, err)
+
+	// without a given round, the tokens differ
+	p3, err := servers[0].overlay.CreateProtocol("ProtocolOverlay", tree, NilServiceID)
+	require.NoError(t, err)
+	defer p3.(*ProtocolOverlay).Done()
+	require.NotEqual(t, p1.Token().ID(), p3.Token().ID())
+
+	// only one of concurrent creations of the same round succeeds
+	rid = RoundID(uuid.NewSHA1(uuid.NameSpaceURL, []byte("next block hash")))
+	created := make(chan ProtocolInstance, 10)
+	var wg sync.WaitGroup
+	for i := 0; i < cap(created); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			pi, err := servers[0].overlay.CreateProtocolWithRound("ProtocolOverlay", tree, NilServiceID, rid)
+			if err == nil {
+				created <- pi
+			}
+		}()
+	}
+	wg.Wait()
+	require.Equal(t, 1, len(created))
+	(<-created).(*ProtocolOverlay).Done()
+}
+
 func TestOverlayDone(t *testing.T) {
 	log.OutputToBuf()
 	defer log.OutputToOs()
@@ -173,6 +222,123 @@ func (po *protocolCatastrophic) Dispatch() error {
 
 // TestOverlayCatastrophicFailure checks if a panic during a protocol could
 // cause the server to crash
+func TestOverlay_IsInstanceDone(t *testing.T) {
+	GlobalProtocolRegister("ProtocolOverlay", func(n *TreeNodeInstance) (ProtocolInstance, error) {
+		return &ProtocolOverlay{TreeNodeInstance: n}, nil
+	})
+	local := NewLocalTest(tSuite)
+	defer local.CloseAll()
+	servers, _, tree := local.GenTree(1, true)
+	p, err := servers[0].CreateProtocol("ProtocolOverlay", tree)
+	require.NoError(t, err)
+	po := p.(*ProtocolOverlay)
+	tok := po.Token().ID()
+
+	require.False(t, servers[0].overlay.IsInstanceDone(tok))
+	require.False(t, po.IsDone())
+	po.Release()
+	require.True(t, servers[0].overlay.IsInstanceDone(tok))
+	require.True(t, po.IsDone())
+}
+
+type protocolStartErr struct {
+	*TreeNodeInstance
+}
+
+func (p *protocolStartErr) Start() error {
+	return errors.New("start failed")
+}
+
+func TestOverlay_StartProtocolSync(t *testing.T) {
+	GlobalProtocolRegister("ProtocolStartErr", func(n *TreeNodeInstance) (ProtocolInstance, error) {
+		return &protocolStartErr{TreeNodeInstance: n}, nil
+	})
+	GlobalProtocolRegister("ProtocolOverlay", func(n *TreeNodeInstance) (ProtocolInstance, error) {
+		return &ProtocolOverlay{TreeNodeInstance: n}, nil
+	})
+	local := NewLocalTest(tSuite)
+	defer local.CloseAll()
+	servers, _, tree := local.GenTree(1, true)
+	o := servers[0].overlay
+
+	pi, err := o.StartProtocolSync("ProtocolStartErr", tree, ServiceID{})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "start failed")
+	require.Nil(t, pi)
+	o.instancesLock.Lock()
+	require.Equal(t, 0, len(o.instances))
+	o.instancesLock.Unlock()
+
+	pi, err = o.StartProtocolSync("ProtocolOverlay", tree, ServiceID{})
+	require.NoError(t, err)
+	pi.(*ProtocolOverlay).Release()
+}
+
+// protocolDeadline sends a message from the root to its children, which
+// never finish.
+type protocolDeadline struct {
+	*TreeNodeInstance
+	received chan bool
+	shutdown chan bool
+}
+
+func (p *protocolDeadline) Start() error {
+	return p.SendToChildren(&SimpleMessage{1})
+}
+
+func (p *protocolDeadline) handle(MsgSimpleMessage) error {
+	p.received <- true
+	return nil
+}
+
+func (p *protocolDeadline) Shutdown() error {
+	p.shutdown <- true
+	return nil
+}
+
+func TestOverlay_Deadline(t *testing.T) {
+	received := make(chan bool, 1)
+	shutdown := make(chan bool, 2)
+	GlobalProtocolRegister("ProtocolDeadline", func(n *TreeNodeInstance) (ProtocolInstance, error) {
+		p := &protocolDeadline{TreeNodeInstance: n, received: received,
+			shutdown: shutdown}
+		return p, p.RegisterHandler(p.handle)
+	})
+	local := NewLocalTest(tSuite)
+	defer local.CloseAll()
+	servers, _, tree := local.GenTree(2, true)
+
+	pi, err := servers[0].overlay.CreateProtocol("ProtocolDeadline", tree, ServiceID{})
+	require.NoError(t, err)
+	root := pi.(*protocolDeadline)
+	deadline := time.Now().Add(500 * time.Millisecond)
+	require.NoError(t, root.SetDeadline(deadline))
+	require.Error(t, root.SetDeadline(deadline))
+	require.NoError(t, root.Start())
+	<-received
+
+	child := root.Token().ChangeTreeNodeID(tree.Root.Children[0].ID).ID()
+	require.False(t, servers[1].overlay.IsInstanceDone(child))
+	servers[1].overlay.instancesLock.Lock()
+	tni := servers[1].overlay.instances[child]
+	servers[1].overlay.instancesLock.Unlock()
+	d, ok := tni.Deadline()
+	require.True(t, ok)
+	require.Equal(t, deadline.UnixNano(), d.UnixNano())
+
+	// Both the root and the child are stopped after the deadline.
+	for i := 0; i < 2; i++ {
+		select {
+		case <-shutdown:
+		case <-time.After(5 * time.Second):
+			t.Fatal("instance not stopped after the deadline")
+		}
+	}
+	require.False(t, time.Now().Before(deadline))
+	require.True(t, servers[0].overlay.IsInstanceDone(root.Token().ID()))
+	require.True(t, servers[1].overlay.IsInstanceDone(child))
+}
+
 func TestOverlayCatastrophicFailure(t *testing.T) {
 	log.OutputToBuf()
 	defer log.OutputToOs()
@@ -350,6 +516,86 @@ func TestOverlayTreePropagation(t *testing.T) {
 	}
 }
 
+// Tests that the roster is left out of the response when the requester
+// already knows it, and that the tree is still rebuilt.
+func TestOverlayTreePropagation_knownRoster(t *testing.T) {
+	local := NewLocalTest(tSuite)
+	hosts, ro, tree := local.GenTree(3, false)
+	defer local.CloseAll()
+	h1 := hosts[0]
+	h2 := hosts[1]
+
+	// h1 knows the roster through another tree
+	other := ro.GenerateNaryTree(1)
+	require.NotEqual(t, tree.ID, other.ID)
+	h1.AddTree(other)
+	require.Equal(t, ro, h1.overlay.knownRoster(ro.ID))
+	h1.Overlay().treeStorage.Register(tree.ID)
+	h2.AddTree(tree)
+
+	proc := newOverlayProc()
+	h1.RegisterProcessor(proc, ResponseTreeMsgID)
+
+	_, err := h1.Send(h2.ServerIdentity, &RequestTree{TreeID: tree.ID, Version: 1, RosterID: ro.ID})
+	require.NoError(t, err)
+	rt := <-proc.responseTree
+	require.Nil(t, rt.Roster)
+
+	h1.overlay.Process(&network.Envelope{
+		ServerIdentity: h2.ServerIdentity,
+		Msg:            rt,
+		MsgType:        ResponseTreeMsgID,
+	})
+	tree2, ok := h1.GetTree(tree.ID)
+	require.True(t, ok)
+	require.True(t, tree.Equal(tree2))
+
+	// an unknown roster ID still gets the roster
+	_, err = h1.Send(h2.ServerIdentity, &RequestTree{TreeID: tree.ID, Version: 1, RosterID: RosterID(uuid.Must(uuid.NewRandom()))})
+	require.NoError(t, err)
+	rt = <-proc.responseTree
+	require.NotNil(t, rt.Roster)
+	require.True(t, rt.Roster.ID.Equal(ro.ID))
+}
+
+func TestOverlayTreePropagation_wide(t *testing.T) {
+	local := NewLocalTest(tSuite)
+	defer local.CloseAll()
+
+	servers := local.GenServers(20)
+	tree := local.GenRosterFromHost(servers...).GenerateStar()
+	root := servers[0]
+	root.AddTree(tree)
+
+	// All the children ask for the tree at the same time.
+	procs := make([]*overlayProc, len(servers))
+	var wg sync.WaitGroup
+	for i, s := range servers[1:] {
+		procs[i] = newOverlayProc()
+		s.RegisterProcessor(procs[i], ResponseTreeMsgID)
+		wg.Add(1)
+		go func(s *Server) {
+			defer wg.Done()
+			_, err := s.Send(root.ServerIdentity, &RequestTree{TreeID: tree.ID, Version: 1})
+			require.NoError(t, err)
+		}(s)
+	}
+	wg.Wait()
+	for _, proc := range procs[:len(servers)-1] {
+		select {
+		case rt := <-proc.responseTree:
+			require.True(t, rt.TreeMarshal.TreeID.Equal(tree.ID))
+		case <-time.After(5 * time.Second):
+			t.Fatal("didn't get the tree")
+		}
+	}
+
+	// The tree has been marshaled only once.
+	root.overlay.treeStorage.Lock()
+	require.Equal(t, 1, root.overlay.treeStorage.marshalsBuilt)
+	root.overlay.treeStorage.Unlock()
+}
+
 // Tests if a tree can be requested even after a failure
 func TestOverlayTreeFailure(t *testing.T) {
 	local := NewLocalTest(tSuite)
@@ -466,6 +712,161 @@ func TestOverlayHandlersBadParameters(t *testing.T) {
 	h.overlay.handleSendRoster(h.ServerIdentity, &Roster{})
 }
 
+func TestOverlay_MaxTreeDepth(t *testing.T) {
+	local := NewLocalTest(tSuite)
+	hosts, ro, _ := local.GenTree(5, false)
+	defer local.CloseAll()
+	h := hosts[0]
+
+	// A line of 5 nodes has a depth of 4.
+	tree := ro.GenerateNaryTree(1)
+	tm := tree.MakeTreeMarshal()
+	require.Equal(t, 4, tm.Depth())
+	binary := ro.GenerateBinaryTree()
+	require.Equal(t, binary.Depth(), binary.MakeTreeMarshal().Depth())
+
+	h.overlay.SetMaxTreeDepth(3)
+	h.overlay.treeStorage.Register(tree.ID)
+	h.overlay.handleSendTree(h.ServerIdentity, &ResponseTree{TreeMarshal: tm, Roster: ro}, nil)
+	require.Nil(t, h.overlay.treeStorage.Get(tree.ID))
+
+	h.overlay.SetMaxTreeDepth(4)
+	h.overlay.handleSendTree(h.ServerIdentity, &ResponseTree{TreeMarshal: tm, Roster: ro}, nil)
+	require.NotNil(t, h.overlay.treeStorage.Get(tree.ID))
+}
+
+func TestOverlay_SetValidateTrees(t *testing.T) {
+	local := NewLocalTest(tSuite)
+	hosts, ro, _ := local.GenTree(5, false)
+	defer local.CloseAll()
+	h := hosts[0]
+
+	// invalidTree returns the marshaled tree of an n-ary tree with
+	// duplicate TreeNodeIDs.
+	invalidTree := func(n int) (*Tree, *TreeMarshal) {
+		tree := ro.GenerateNaryTree(n)
+		tree.Root.Children[1].ID = tree.Root.Children[0].ID
+		return tree, tree.MakeTreeMarshal()
+	}
+
+	h.overlay.SetValidateTrees(true)
+	tree, tm := invalidTree(2)
+	h.overlay.treeStorage.Register(tree.ID)
+	h.overlay.handleSendTree(h.ServerIdentity, &ResponseTree{TreeMarshal: tm, Roster: ro}, nil)
+	require.Nil(t, h.overlay.treeStorage.Get(tree.ID))
+
+	// The trees waiting for their roster are validated too.
+	pending, pendingTm := invalidTree(3)
+	h.overlay.addPendingTreeMarshal(pendingTm)
+	h.overlay.checkPendingTreeMarshal(ro)
+	require.Nil(t, h.overlay.treeStorage.Get(pending.ID))
+
+	h.overlay.SetValidateTrees(false)
+	h.overlay.handleSendTree(h.ServerIdentity, &ResponseTree{TreeMarshal: tm, Roster: ro}, nil)
+	require.NotNil(t, h.overlay.treeStorage.Get(tree.ID))
+}
+
+// Tests that the messages of an instance using the dispatch pool are
+// delivered in order, and that protocols run correctly through the pool.
+func TestOverlay_SetDispatchPool(t *testing.T) {
+	local := NewLocalTest(tSuite)
+	defer local.CloseAll()
+
+	hosts, _, tree := local.GenTree(1, true)
+	hosts[0].overlay.SetDispatchPool(2)
+	tni, err := local.NewTreeNodeInstance(tree.Root, spawnName)
+	require.NoError(t, err)
+	require.NotNil(t, tni.pool)
+
+	const nbr = 100
+	var mut sync.Mutex
+	var received []int64
+	done := make(chan bool)
+	err = tni.RegisterHandler(func(m spawnMsg) error {
+		mut.Lock()
+		defer mut.Unlock()
+		received = append(received, m.M.I)
+		if len(received) == nbr {
+			close(done)
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	for i := 0; i < nbr; i++ {
+		tni.ProcessProtocolMsg(&ProtocolMsg{
+			MsgType: network.RegisterMessage(&spawn{}),
+			From:    &Token{TreeNodeID: tni.treeNode.ID},
+			Msg:     &spawn{I: int64(i)},
+		})
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("didn't get all messages in time")
+	}
+	for i, r := range received {
+		require.Equal(t, int64(i), r)
+	}
+
+	servers, _, tree := local.GenTree(5, true)
+	for _, s := range servers {
+		s.overlay.SetDispatchPool(1)
+	}
+	pi, err := local.StartProtocol(pingPongProtoName, tree)
+	require.NoError(t, err)
+	select {
+	case <-pi.(*pingPongProto).done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("protocol didn't finish in time")
+	}
+}
+
+func benchmarkDispatchPool(b *testing.B, poolSize int) {
+	local := NewLocalTest(tSuite)
+	defer local.CloseAll()
+	hosts, _, tree := local.GenTree(1, true)
+	hosts[0].overlay.SetDispatchPool(poolSize)
+
+	const nbrInstances = 1000
+	for i := 0; i < b.N; i++ {
+		before := runtime.NumGoroutine()
+		var wg sync.WaitGroup
+		wg.Add(nbrInstances)
+		tnis := make([]*TreeNodeInstance, nbrInstances)
+		for j := range tnis {
+			tok := &Token{TreeID: tree.ID, TreeNodeID: tree.Root.ID}
+			tni := newTreeNodeInstance(hosts[0].overlay, tok, tree.Root, nil)
+			require.NoError(b, tni.RegisterHandler(func(m spawnMsg) error {
+				wg.Done()
+				return nil
+			}))
+			tnis[j] = tni
+		}
+		b.ReportMetric(float64(runtime.NumGoroutine()-before), "goroutines")
+		for _, tni := range tnis {
+			tni.ProcessProtocolMsg(&ProtocolMsg{
+				MsgType: network.RegisterMessage(&spawn{}),
+				From:    &Token{TreeNodeID: tni.treeNode.ID},
+				Msg:     &spawn{},
+			})
+		}
+		wg.Wait()
+		for _, tni := range tnis {
+			// There is no protocol instance bound, so the error is expected.
+			tni.closeDispatch()
+		}
+	}
+}
+
+func BenchmarkDispatchGoroutines(b *testing.B) {
+	benchmarkDispatchPool(b, 0)
+}
+
+func BenchmarkDispatchPool(b *testing.B) {
+	benchmarkDispatchPool(b, 16)
+}
+
 func TestTokenId(t *testing.T) {
 	t1 := &Token{
 		RosterID: RosterID(uuid.Must(uuid.NewUUID())),
@@ -543,3 +944,67 @@ func TestOverlay_ConfigInMessage(t *testing.T) {
 	err = h.overlay.TransmitMsg(env.(*ProtocolMsg), io)
 	require.NoError(t, err)
 }
+
+// Tests that an unknown tree is requested again when the first request is
+// lost.
+func TestOverlay_TreeRequestRetry(t *testing.T) {
+	local := NewLocalTest(tSuite)
+	defer local.CloseAll()
+
+	servers, _, tree := local.GenTree(2, true)
+	servers[1].overlay.SetTreeRequestRetry(100*time.Millisecond, 3)
+	// servers[1] knows the roster from another tree, so the requests don't
+	// ask for it.
+	servers[1].overlay.RegisterTree(tree.Roster.GenerateNaryTreeWithRoot(1, servers[1].ServerIdentity))
+
+	var mut sync.Mutex
+	requests := 0
+	var rosterIDs []RosterID
+	servers[0].RegisterProcessorFunc(RequestTreeMsgID, func(env *network.Envelope) error {
+		mut.Lock()
+		requests++
+		drop := requests == 1
+		rosterIDs = append(rosterIDs, env.Msg.(*RequestTree).RosterID)
+		mut.Unlock()
+		if !drop {
+			servers[0].overlay.Process(env)
+		}
+		return nil
+	})
+
+	pi, err := local.StartProtocol(pingPongProtoName, tree)
+	require.NoError(t, err)
+	select {
+	case <-pi.(*pingPongProto).done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("protocol didn't finish in time")
+	}
+	mut.Lock()
+	require.Equal(t, 2, requests)
+	require.Equal(t, []RosterID{tree.Roster.ID, tree.Roster.ID}, rosterIDs)
+	mut.Unlock()
+}
+
+// Tests that the tree requests of a node not knowing the tree are counted.
+func TestOverlay_TreeRequests(t *testing.T) {
+	local := NewLocalTest(tSuite)
+	defer local.CloseAll()
+
+	servers, _, tree := local.GenTree(2, true)
+	require.Equal(t, uint64(0), servers[1].overlay.TreeRequests())
+
+	pi, err := local.StartProtocol(pingPongProtoName, tree)
+	require.NoError(t, err)
+	select {
+	case <-pi.(*pingPongProto).done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("protocol didn't finish in time")
+	}
+
+	require.Equal(t, uint64(1), servers[1].overlay.TreeRequests())
+	require.Equal(t, uint64(1), servers[1].overlay.TreeResponses())
+	require.Equal(t, uint64(0), servers[0].overlay.TreeRequests())
+	st := servers[1].GetStatus()
+	require.Equal(t, "1", st.Field["TreeRequests"])
+	require.Equal(t, "1", st.Field["TreeResponses"])
+}
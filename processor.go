@@ -12,10 +12,11 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"go.dedis.ch/onet/v3/log"
 	"go.dedis.ch/onet/v3/network"
-	"go.dedis.ch/protobuf"
 	"golang.org/x/xerrors"
 )
 
@@ -24,22 +25,166 @@ import (
 // a pointer. It will process client requests that have been registered
 // with RegisterMessage.
 type ServiceProcessor struct {
-	handlers map[string]serviceHandler
+	handlers    map[string]serviceHandler
+	handlersMut sync.RWMutex
+	fallback    func(path string, buf []byte) ([]byte, error)
+	// whether the calls of the handlers are recorded in their stats
+	statsEnabled bool
+	// how the streaming handlers deal with slow clients, by path, and the
+	// streams closed because of it
+	streamPolicies map[string]streamPolicy
+	streamErrs     map[chan []byte]error
+	streamMut      sync.Mutex
 	*Context
 }
 
+// StreamPolicy tells what a streaming handler does when the client reads the
+// replies slower than the service produces them, and the high-water mark of
+// waiting replies is reached. See SetStreamPolicy.
+type StreamPolicy int
+
+const (
+	// StreamBlock waits for the client to read a reply before taking the
+	// next one from the service, which then blocks on its channel. It is the
+	// default: no reply is lost, but a slow client slows down the service.
+	StreamBlock StreamPolicy = iota
+	// StreamDropOldest drops the oldest waiting reply to make room for the
+	// new one. The service never waits, but the client misses replies
+	// without being told, except for the gaps in sequenced streams.
+	StreamDropOldest
+	// StreamErrorAndClose closes the stream with StreamOverflowCloseCode. The
+	// service never waits and the client learns that it fell behind, but it
+	// has to open the stream again, or resume it if the handler allows it.
+	StreamErrorAndClose
+)
+
+// DefaultStreamHighWater is the number of replies of a streaming handler
+// that can wait for the client if SetStreamPolicy didn't set another one.
+const DefaultStreamHighWater = 100
+
+// StreamOverflowCloseCode is the websocket close code of the streams closed
+// because of StreamErrorAndClose.
+const StreamOverflowCloseCode = 4002
+
+// ErrStreamOverflow is the reason of the streams closed because of
+// StreamErrorAndClose.
+var ErrStreamOverflow = xerrors.New("client fell behind the stream")
+
+type streamPolicy struct {
+	highWater int
+	policy    StreamPolicy
+}
+
+// push sends buf to out according to the policy. It returns false if the
+// stream has to be closed.
+func (sp streamPolicy) push(out chan []byte, buf []byte) bool {
+	switch sp.policy {
+	case StreamDropOldest:
+		for {
+			select {
+			case out <- buf:
+				return true
+			default:
+			}
+			select {
+			case <-out:
+				log.Lvl3("dropping the oldest reply of a slow stream")
+			default:
+			}
+		}
+	case StreamErrorAndClose:
+		select {
+		case out <- buf:
+			return true
+		default:
+			return false
+		}
+	default:
+		out <- buf
+		return true
+	}
+}
+
 // serviceHandler stores the handler and the message-type.
 type serviceHandler struct {
 	handler   interface{}
 	msgType   reflect.Type
 	streaming bool
+	stats     *handlerCounters
+	// whether the replies of a streaming handler are prefixed by their type
+	typed bool
+}
+
+// HandlerStatBounds are the upper bounds of the buckets of the latency
+// histogram of HandlerStat. The last bucket of the histogram counts the
+// calls taking longer than the last bound.
+var HandlerStatBounds = [...]time.Duration{time.Millisecond,
+	10 * time.Millisecond, 100 * time.Millisecond, time.Second,
+	10 * time.Second}
+
+// HandlerStat holds the statistics of the calls to a handler, as returned by
+// ServiceProcessor.HandlerStats.
+type HandlerStat struct {
+	Calls  uint64
+	Errors uint64
+	// Total is the cumulative duration of the calls, and Max the longest one
+	Total time.Duration
+	Max   time.Duration
+	// Histogram counts the calls in the buckets of HandlerStatBounds
+	Histogram [len(HandlerStatBounds) + 1]uint64
+}
+
+// handlerCounters are updated atomically by the concurrent calls to a
+// handler.
+type handlerCounters struct {
+	calls     uint64
+	errors    uint64
+	total     uint64
+	max       uint64
+	histogram [len(HandlerStatBounds) + 1]uint64
+}
+
+// record adds a call of the given duration to the counters.
+func (hc *handlerCounters) record(d time.Duration, err error) {
+	atomic.AddUint64(&hc.calls, 1)
+	if err != nil {
+		atomic.AddUint64(&hc.errors, 1)
+	}
+	atomic.AddUint64(&hc.total, uint64(d))
+	for {
+		max := atomic.LoadUint64(&hc.max)
+		if uint64(d) <= max || atomic.CompareAndSwapUint64(&hc.max, max, uint64(d)) {
+			break
+		}
+	}
+	i := 0
+	for i < len(HandlerStatBounds) && d > HandlerStatBounds[i] {
+		i++
+	}
+	atomic.AddUint64(&hc.histogram[i], 1)
+}
+
+// stat returns a snapshot of the counters.
+func (hc *handlerCounters) stat() HandlerStat {
+	hs := HandlerStat{
+		Calls:  atomic.LoadUint64(&hc.calls),
+		Errors: atomic.LoadUint64(&hc.errors),
+		Total:  time.Duration(atomic.LoadUint64(&hc.total)),
+		Max:    time.Duration(atomic.LoadUint64(&hc.max)),
+	}
+	for i := range hc.histogram {
+		hs.Histogram[i] = atomic.LoadUint64(&hc.histogram[i])
+	}
+	return hs
 }
 
 // NewServiceProcessor initializes your ServiceProcessor.
 func NewServiceProcessor(c *Context) *ServiceProcessor {
 	return &ServiceProcessor{
-		handlers: make(map[string]serviceHandler),
-		Context:  c,
+		handlers:       make(map[string]serviceHandler),
+		streamPolicies: make(map[string]streamPolicy),
+		streamErrs:     make(map[chan []byte]error),
+		Context:        c,
 	}
 }
 
@@ -65,7 +210,9 @@ func (p *ServiceProcessor) RegisterHandler(f interface{}) error {
 	if err != nil {
 		return xerrors.Errorf("creating handler: %v", err)
 	}
+	p.handlersMut.Lock()
 	p.handlers[pm] = sh
+	p.handlersMut.Unlock()
 
 	return nil
 }
@@ -84,6 +231,10 @@ func (p *ServiceProcessor) RegisterHandler(f interface{}) error {
 //    the handler must stop sending messages and close retChan.
 //  * err is an error, it can be nil, or any type that implements error.
 //
+// If msg implements ResumableRequest, the stream can be resumed by the client
+// after its connection broke. To send replies of different types, use
+// RegisterTypedStreamingHandler.
+//
 // struct_name is stripped of its package-name, so a structure like
 // network.Body will be converted to Body.
 func (p *ServiceProcessor) RegisterStreamingHandler(f interface{}) error {
@@ -126,11 +277,168 @@ func (p *ServiceProcessor) RegisterStreamingHandler(f interface{}) error {
 	cr := ft.In(0)
 	log.Lvl4("Registering streaming handler", cr.String())
 	pm := strings.Split(cr.Elem().String(), ".")[1]
-	p.handlers[pm] = serviceHandler{f, cr.Elem(), true}
+	p.handlersMut.Lock()
+	p.handlers[pm] = serviceHandler{handler: f, msgType: cr.Elem(),
+		streaming: true, stats: &handlerCounters{}}
+	p.handlersMut.Unlock()
 
 	return nil
 }
 
+// RegisterTypedStreamingHandler does the same as RegisterStreamingHandler,
+// but every reply is prefixed by its message type, as with network.Marshal.
+// So the handler can send messages of different types over a channel of
+// network.Message, and the client decodes each one as its actual type by
+// reading it into a *network.Message with StreamingConn.ReadMessage. The
+// messages must be registered with network.RegisterMessage, and are always
+// encoded with protobuf.
+func (p *ServiceProcessor) RegisterTypedStreamingHandler(f interface{}) error {
+	if err := p.RegisterStreamingHandler(f); err != nil {
+		return err
+	}
+	pm := strings.Split(reflect.TypeOf(f).In(0).Elem().String(), ".")[1]
+	p.handlersMut.Lock()
+	defer p.handlersMut.Unlock()
+	mh := p.handlers[pm]
+	mh.typed = true
+	p.handlers[pm] = mh
+	return nil
+}
+
+// UnregisterHandler removes the handler registered for the given path with
+// RegisterHandler or RegisterStreamingHandler. The following requests to this
+// path fail, or go to the fallback handler if there is one. Handlers
+// registered with RegisterRESTHandler cannot be removed, as the routes of the
+// http multiplexer are fixed.
+func (p *ServiceProcessor) UnregisterHandler(path string) error {
+	p.handlersMut.Lock()
+	defer p.handlersMut.Unlock()
+	if _, ok := p.handlers[path]; !ok {
+		return xerrors.New("no handler registered for " + path)
+	}
+	delete(p.handlers, path)
+	return nil
+}
+
+// RequirePaths returns an error listing the paths that have no handler
+// registered with RegisterHandler or RegisterStreamingHandler. It is meant to
+// be called at the end of the constructor of a service, so that a missing
+// handler is detected at startup instead of at the first request.
+func (p *ServiceProcessor) RequirePaths(paths ...string) error {
+	p.handlersMut.RLock()
+	defer p.handlersMut.RUnlock()
+	var missing []string
+	for _, path := range paths {
+		if _, ok := p.handlers[path]; !ok {
+			missing = append(missing, path)
+		}
+	}
+	if len(missing) > 0 {
+		return xerrors.Errorf("no handler registered for: %s",
+			strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// SetStreamPolicy sets how many replies of the streaming handler of path
+// wait for a slow client, and what happens once highWater replies are
+// waiting. A highWater of 0 or less uses DefaultStreamHighWater. It only
+// applies to the streams opened afterwards.
+func (p *ServiceProcessor) SetStreamPolicy(path string, highWater int, policy StreamPolicy) error {
+	mh, ok := p.getHandler(path)
+	if !ok || !mh.streaming {
+		return xerrors.New("no streaming handler registered for " + path)
+	}
+	if highWater <= 0 {
+		highWater = DefaultStreamHighWater
+	}
+	p.streamMut.Lock()
+	defer p.streamMut.Unlock()
+	p.streamPolicies[path] = streamPolicy{highWater, policy}
+	return nil
+}
+
+// StreamError returns why the stream with the outgoing channel out, as
+// returned by ProcessClientStreamRequest, has been closed, or nil if the
+// service finished it. It must be called once the channel is closed.
+func (p *ServiceProcessor) StreamError(out chan []byte) error {
+	p.streamMut.Lock()
+	defer p.streamMut.Unlock()
+	err := p.streamErrs[out]
+	delete(p.streamErrs, out)
+	return err
+}
+
+func (p *ServiceProcessor) getStreamPolicy(path string) streamPolicy {
+	p.streamMut.Lock()
+	defer p.streamMut.Unlock()
+	sp, ok := p.streamPolicies[path]
+	if !ok {
+		return streamPolicy{DefaultStreamHighWater, StreamBlock}
+	}
+	return sp
+}
+
+// getHandler returns the handler registered for the path.
+func (p *ServiceProcessor) getHandler(path string) (serviceHandler, bool) {
+	p.handlersMut.RLock()
+	defer p.handlersMut.RUnlock()
+	mh, ok := p.handlers[path]
+	return mh, ok
+}
+
+// EnableHandlerStats starts or stops recording the number of calls, errors
+// and the latency of the handlers registered with RegisterHandler and
+// RegisterStreamingHandler, which are returned by HandlerStats. For streaming
+// handlers, the latency is the one of the call to the handler for each
+// message of the client. The recording only uses atomic counters, so it can
+// be left on in production.
+func (p *ServiceProcessor) EnableHandlerStats(enable bool) {
+	p.handlersMut.Lock()
+	defer p.handlersMut.Unlock()
+	p.statsEnabled = enable
+}
+
+// HandlerStats returns the statistics of the handlers, indexed by their
+// path. The statistics are kept while the recording is stopped.
+func (p *ServiceProcessor) HandlerStats() map[string]HandlerStat {
+	p.handlersMut.RLock()
+	defer p.handlersMut.RUnlock()
+	stats := make(map[string]HandlerStat)
+	for path, mh := range p.handlers {
+		stats[path] = mh.stats.stat()
+	}
+	return stats
+}
+
+// recordCall adds the call to the stats of the handler, if enabled.
+func (p *ServiceProcessor) recordCall(mh serviceHandler, start time.Time, err error) {
+	p.handlersMut.RLock()
+	enabled := p.statsEnabled
+	p.handlersMut.RUnlock()
+	if enabled {
+		mh.stats.record(time.Since(start), err)
+	}
+}
+
+// RegisterFallbackHandler stores a handler that is called for the client
+// requests whose path doesn't match any registered handler, which allows for
+// dynamic routing. The handler gets the path and the raw message, and returns
+// the raw reply that is sent back to the client. Requests going to the
+// fallback handler are never streaming.
+func (p *ServiceProcessor) RegisterFallbackHandler(f func(path string, buf []byte) ([]byte, error)) {
+	p.handlersMut.Lock()
+	defer p.handlersMut.Unlock()
+	p.fallback = f
+}
+
+// getFallback returns the handler stored with RegisterFallbackHandler, or nil.
+func (p *ServiceProcessor) getFallback() func(path string, buf []byte) ([]byte, error) {
+	p.handlersMut.RLock()
+	defer p.handlersMut.RUnlock()
+	return p.fallback
+}
+
 // getRouter returns the gorilla mutiplexing router. If we need to support
 // arbitrary registration of REST API, we could make this method public.
 func (p *ServiceProcessor) getRouter() *http.ServeMux {
@@ -344,7 +652,8 @@ func createServiceHandler(f interface{}) (string, serviceHandler, error) {
 	log.Lvl4("Registering handler", cr.String())
 	pm := strings.Split(cr.Elem().String(), ".")[1]
 
-	return pm, serviceHandler{f, cr.Elem(), false}, nil
+	return pm, serviceHandler{handler: f, msgType: cr.Elem(),
+		stats: &handlerCounters{}}, nil
 }
 
 func handlerInputCheck(f interface{}) error {
@@ -399,6 +708,24 @@ func (p *ServiceProcessor) NewProtocol(tn *TreeNodeInstance, conf *GenericConfig
 	return nil, nil
 }
 
+// handlerProvider is implemented by the services embedding a
+// ServiceProcessor, so that their handlers can be called directly.
+type handlerProvider interface {
+	getHandler(path string) (serviceHandler, bool)
+}
+
+// ResumableRequest is implemented by the requests of streaming handlers that
+// can resume a stream. The replies of a stream are numbered from 1, and when
+// a client resumes a stream, ResumeFrom is called on the request with the
+// number of the last reply the client got, before the handler is called. The
+// handler must then only send the replies following that one, in the same
+// order as for the original stream.
+type ResumableRequest interface {
+	ResumeFrom(seq uint64)
+}
+
+var resumableRequestType = reflect.TypeOf((*ResumableRequest)(nil)).Elem()
+
 // StreamingTunnel is used as a tunnel between service processor and its
 // caller, usually the websocket read-loop. When the tunnel is returned to the
 // websocket loop, it should read from the out channel and forward the content
@@ -453,10 +780,34 @@ func callInterfaceFunc(handler, input interface{}, streaming bool) (intf interfa
 // it is done.
 func (p *ServiceProcessor) ProcessClientStreamRequest(req *http.Request, path string,
 	clientInputs chan []byte) (chan []byte, error) {
+	return p.processStream(req, path, 0, false, clientInputs)
+}
+
+// ProcessClientStreamRequestFrom does the same as ProcessClientStreamRequest
+// but resumes the stream after the reply with sequence number seq. If seq is
+// not 0, the request of the handler must implement ResumableRequest. Every
+// reply is prefixed by its sequence number, as in the frames of
+// SequencedStreamSubprotocol. The replies are numbered before the
+// StreamPolicy drops any of them, so the client sees the gaps and the
+// numbers match the ones of the handler when resuming.
+func (p *ServiceProcessor) ProcessClientStreamRequestFrom(req *http.Request, path string,
+	seq uint64, clientInputs chan []byte) (chan []byte, error) {
+	return p.processStream(req, path, seq, true, clientInputs)
+}
 
-	outChan := make(chan []byte, 100)
+// processStream starts the stream of the handler of path, resuming it after
+// the reply seq, and numbering the replies if numbered is true.
+func (p *ServiceProcessor) processStream(req *http.Request, path string,
+	seq uint64, numbered bool, clientInputs chan []byte) (chan []byte, error) {
+
+	policy := p.getStreamPolicy(path)
+	// number of the last reply, the lock also keeps the replies in the
+	// order of their numbers
+	lastSeq := seq
+	var lastSeqMut sync.Mutex
+	outChan := make(chan []byte, policy.highWater)
 	var closeOutOnce sync.Once
-	mh, ok := p.handlers[path]
+	mh, ok := p.getHandler(path)
 
 	if !ok {
 		err := xerrors.New("the requested message hasn't been " +
@@ -464,6 +815,13 @@ func (p *ServiceProcessor) ProcessClientStreamRequest(req *http.Request, path st
 		log.Error(err)
 		return nil, err
 	}
+	if seq > 0 && !reflect.PtrTo(mh.msgType).Implements(resumableRequestType) {
+		return nil, xerrors.Errorf("streams of %s can't be resumed", path)
+	}
+	codec, err := requestCodec(req)
+	if err != nil {
+		return nil, err
+	}
 
 	// This goroutine listens on any new messages from the client and executes
 	// the request. Executing the request should fill the service's channel, as
@@ -476,15 +834,22 @@ func (p *ServiceProcessor) ProcessClientStreamRequest(req *http.Request, path st
 			// create a new instance of a handler
 			msg := reflect.New(mh.msgType).Interface()
 
-			err := protobuf.DecodeWithConstructors(buf, msg,
+			err := codec.Unmarshal(buf, msg,
 				network.DefaultConstructors(p.Context.server.Suite()))
 			if err != nil {
 				log.Error(xerrors.Errorf("failed to decode message: %v", err))
 				close(outChan)
 				return
 			}
+			// Only the request starting the stream resumes it.
+			if seq > 0 {
+				msg.(ResumableRequest).ResumeFrom(seq)
+				seq = 0
+			}
 
+			start := time.Now()
 			reply, stopServiceChan, err := callInterfaceFunc(mh.handler, msg, mh.streaming)
+			p.recordCall(mh, start, err)
 			if err != nil {
 				log.Error(err)
 
@@ -537,12 +902,32 @@ func (p *ServiceProcessor) ProcessClientStreamRequest(req *http.Request, path st
 					}
 					if chosen == 0 {
 						// Send information down to the client.
-						buf, err := protobuf.Encode(v.Interface())
+						var buf []byte
+						var err error
+						if mh.typed {
+							buf, err = network.Marshal(v.Interface())
+						} else {
+							buf, err = codec.Marshal(v.Interface())
+						}
 						if err != nil {
 							log.Error(err)
 							return
 						}
-						outChan <- buf
+						lastSeqMut.Lock()
+						if numbered {
+							lastSeq++
+							buf = append(encodeSeq(lastSeq), buf...)
+						}
+						pushed := policy.push(outChan, buf)
+						lastSeqMut.Unlock()
+						if !pushed {
+							log.Warnf("closing stream of %s as the client "+
+								"fell behind", path)
+							p.streamMut.Lock()
+							p.streamErrs[outChan] = ErrStreamOverflow
+							p.streamMut.Unlock()
+							return
+						}
 					} else {
 						panic("no such channel index")
 					}
@@ -562,8 +947,11 @@ func (p *ServiceProcessor) ProcessClientStreamRequest(req *http.Request, path st
 // IsStreaming tell if the service registered at the given path is a streaming
 // service or not. Return an error if the service is not registered.
 func (p *ServiceProcessor) IsStreaming(path string) (bool, error) {
-	mh, ok := p.handlers[path]
+	mh, ok := p.getHandler(path)
 	if !ok {
+		if p.getFallback() != nil {
+			return false, nil
+		}
 		err := xerrors.New("The requested message hasn't been registered: " + path)
 		log.Error(err)
 		return false, err
@@ -574,34 +962,53 @@ func (p *ServiceProcessor) IsStreaming(path string) (bool, error) {
 // ProcessClientRequest implements the Service interface, see the interface
 // documentation.
 func (p *ServiceProcessor) ProcessClientRequest(req *http.Request, path string, buf []byte) ([]byte, *StreamingTunnel, error) {
-	mh, ok := p.handlers[path]
+	mh, ok := p.getHandler(path)
+	fallback := p.getFallback()
+	if !ok && fallback != nil {
+		reply, err := fallback(path, buf)
+		if err != nil {
+			return nil, nil, xerrors.Errorf("fallback handler: %v", err)
+		}
+		return reply, nil, nil
+	}
 
 	if mh.streaming {
 		return nil, nil, xerrors.Errorf("using a streaming request with " +
 			"ProcessClientRequest: Please use instead ProcessClientStreamRequest")
 	}
 
-	reply, _, err := func() (interface{}, chan bool, error) {
-		if !ok {
-			err := xerrors.New("The requested message hasn't been registered: " + path)
-			log.Error(err)
-			return nil, nil, err
-		}
+	if !ok {
+		err := xerrors.New("The requested message hasn't been registered: " + path)
+		log.Error(err)
+		return nil, nil, err
+	}
+
+	codec, err := requestCodec(req)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	start := time.Now()
+	reply, err := func() ([]byte, error) {
 		msg := reflect.New(mh.msgType).Interface()
-		if err := protobuf.DecodeWithConstructors(buf, msg,
+		if err := codec.Unmarshal(buf, msg,
 			network.DefaultConstructors(p.Context.server.Suite())); err != nil {
-			return nil, nil, xerrors.Errorf("decoding: %v", err)
+			return nil, xerrors.Errorf("decoding: %v", err)
+		}
+		reply, _, err := callInterfaceFunc(mh.handler, msg, mh.streaming)
+		if err != nil {
+			return nil, err
 		}
-		return callInterfaceFunc(mh.handler, msg, mh.streaming)
+		buf, err := codec.Marshal(reply)
+		if err != nil {
+			log.Error(err)
+			return nil, xerrors.Errorf("encoding: %v", err)
+		}
+		return buf, nil
 	}()
+	p.recordCall(mh, start, err)
 	if err != nil {
 		return nil, nil, err
 	}
-
-	buf, err = protobuf.Encode(reply)
-	if err != nil {
-		log.Error(err)
-		return nil, nil, xerrors.Errorf("encoding: %v", err)
-	}
-	return buf, nil, nil
+	return reply, nil, nil
 }
@@ -12,6 +12,7 @@ import (
 	"strconv"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 	"go.dedis.ch/kyber/v3"
@@ -159,6 +160,89 @@ func TestServiceProcessor_ProcessClientRequest(t *testing.T) {
 	require.NotEqual(t, "", log.GetStdErr())
 }
 
+func TestServiceProcessor_UnregisterHandler(t *testing.T) {
+	h1 := NewLocalServer(tSuite, 2000)
+	defer h1.Close()
+	p := NewServiceProcessor(&Context{server: h1})
+	require.NoError(t, p.RegisterHandlers(procMsg, procMsg2))
+
+	buf, err := protobuf.Encode(&testMsg{11})
+	require.NoError(t, err)
+	_, _, err = p.ProcessClientRequest(nil, "testMsg", buf)
+	require.NoError(t, err)
+
+	require.NoError(t, p.UnregisterHandler("testMsg"))
+	require.Error(t, p.UnregisterHandler("testMsg"))
+
+	log.OutputToBuf()
+	_, _, err = p.ProcessClientRequest(nil, "testMsg", buf)
+	log.OutputToOs()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "hasn't been registered")
+
+	// The other handler is still there.
+	buf, err = protobuf.Encode(&testMsg2{11})
+	require.NoError(t, err)
+	_, _, err = p.ProcessClientRequest(nil, "testMsg2", buf)
+	require.NoError(t, err)
+}
+
+func TestServiceProcessor_RequirePaths(t *testing.T) {
+	h1 := NewLocalServer(tSuite, 2000)
+	defer h1.Close()
+	p := NewServiceProcessor(&Context{server: h1})
+	require.NoError(t, p.RegisterHandlers(procMsg, procMsg2))
+
+	require.NoError(t, p.RequirePaths())
+	require.NoError(t, p.RequirePaths("testMsg", "testMsg2"))
+	err := p.RequirePaths("testMsg", "testMsg3", "testMsg4")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "testMsg3, testMsg4")
+}
+
+func TestServiceProcessor_HandlerStats(t *testing.T) {
+	h1 := NewLocalServer(tSuite, 2000)
+	defer h1.Close()
+	p := NewServiceProcessor(&Context{server: h1})
+	require.NoError(t, p.RegisterHandlers(procMsg, procMsg2))
+
+	send := func(i int64) {
+		buf, err := protobuf.Encode(&testMsg{i})
+		require.NoError(t, err)
+		p.ProcessClientRequest(nil, "testMsg", buf)
+	}
+
+	// Nothing is recorded by default.
+	send(11)
+	require.Equal(t, HandlerStat{}, p.HandlerStats()["testMsg"])
+
+	p.EnableHandlerStats(true)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			send(11)
+		}()
+	}
+	wg.Wait()
+	send(42)
+
+	stats := p.HandlerStats()
+	require.Equal(t, 2, len(stats))
+	require.Equal(t, HandlerStat{}, stats["testMsg2"])
+	st := stats["testMsg"]
+	require.Equal(t, uint64(11), st.Calls)
+	require.Equal(t, uint64(1), st.Errors)
+	require.True(t, st.Max > 0)
+	require.True(t, st.Total >= st.Max)
+	var inHistogram uint64
+	for _, n := range st.Histogram {
+		inHistogram += n
+	}
+	require.Equal(t, st.Calls, inHistogram)
+}
+
 func TestServiceProcessor_ProcessClientRequest_Streaming_Simple(t *testing.T) {
 	h1 := NewLocalServer(tSuite, 2000)
 	defer h1.Close()
@@ -201,6 +285,70 @@ func TestServiceProcessor_ProcessClientRequest_Streaming_Simple(t *testing.T) {
 	close(inputChan)
 }
 
+func TestServiceProcessor_SetStreamPolicy(t *testing.T) {
+	h1 := NewLocalServer(tSuite, 2000)
+	defer h1.Close()
+
+	p := NewServiceProcessor(&Context{server: h1})
+	// The handler sends m.I messages, as fast as they are taken, and closes
+	// the channel unless it is stopped before.
+	h := func(m *testMsg) (chan network.Message, chan bool, error) {
+		outChan := make(chan network.Message)
+		closeChan := make(chan bool)
+		go func() {
+			defer close(outChan)
+			for i := 0; i < int(m.I); i++ {
+				select {
+				case outChan <- &testMsg{int64(i)}:
+				case <-closeChan:
+					return
+				}
+			}
+		}()
+		return outChan, closeChan, nil
+	}
+	require.NoError(t, p.RegisterStreamingHandler(h))
+	require.NoError(t, p.RegisterHandler(procMsg2))
+	require.Error(t, p.SetStreamPolicy("testMsg2", 2, StreamDropOldest))
+	require.Error(t, p.SetStreamPolicy("unknown", 2, StreamDropOldest))
+
+	buf, err := protobuf.Encode(&testMsg{10})
+	require.NoError(t, err)
+	// stream starts a stream and reads the replies once the client had
+	// time to fall behind.
+	stream := func() (chan []byte, []int64) {
+		inputChan := make(chan []byte, 1)
+		inputChan <- buf
+		outChan, err := p.ProcessClientStreamRequest(nil, "testMsg", inputChan)
+		require.NoError(t, err)
+		time.Sleep(100 * time.Millisecond)
+		var got []int64
+		for buf := range outChan {
+			val := &testMsg{}
+			require.NoError(t, protobuf.Decode(buf, val))
+			got = append(got, val.I)
+		}
+		close(inputChan)
+		return outChan, got
+	}
+
+	require.NoError(t, p.SetStreamPolicy("testMsg", 2, StreamBlock))
+	outChan, got := stream()
+	require.Equal(t, []int64{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}, got)
+	require.NoError(t, p.StreamError(outChan))
+
+	require.NoError(t, p.SetStreamPolicy("testMsg", 2, StreamDropOldest))
+	outChan, got = stream()
+	require.Equal(t, []int64{8, 9}, got)
+	require.NoError(t, p.StreamError(outChan))
+
+	require.NoError(t, p.SetStreamPolicy("testMsg", 2, StreamErrorAndClose))
+	outChan, got = stream()
+	require.Equal(t, []int64{0, 1}, got)
+	require.True(t, xerrors.Is(p.StreamError(outChan), ErrStreamOverflow))
+	require.NoError(t, p.StreamError(outChan))
+}
+
 func TestServiceProcessor_ProcessClientRequest_Streaming_Multiple(t *testing.T) {
 	h1 := NewLocalServer(tSuite, 2000)
 
@@ -370,6 +518,39 @@ func TestProcessor_ProcessClientRequest(t *testing.T) {
 	}
 }
 
+func TestProcessor_FallbackHandler(t *testing.T) {
+	serName := "fallbackService"
+	_, err := RegisterNewService(serName, func(c *Context) (Service, error) {
+		ts := &testService{ServiceProcessor: NewServiceProcessor(c)}
+		if err := ts.RegisterHandler(ts.ProcessMsg); err != nil {
+			return nil, err
+		}
+		ts.RegisterFallbackHandler(func(path string, buf []byte) ([]byte, error) {
+			if path != "dynamic" {
+				return nil, xerrors.New("unknown path " + path)
+			}
+			return append([]byte(path+":"), buf...), nil
+		})
+		return ts, nil
+	})
+	require.NoError(t, err)
+	defer UnregisterService(serName)
+
+	local := NewTCPTest(tSuite)
+	h := local.GenServers(1)[0]
+	defer local.CloseAll()
+	client := local.NewClient(serName)
+
+	// Registered handlers still take precedence.
+	msg := &testMsg{}
+	require.NoError(t, client.SendProtobuf(h.ServerIdentity, &testMsg{12}, msg))
+	require.Equal(t, int64(12), msg.I)
+
+	reply, err := client.Send(h.ServerIdentity, "dynamic", []byte("hello"))
+	require.NoError(t, err)
+	require.Equal(t, "dynamic:hello", string(reply))
+}
+
 // Test that the panic will be recovered and announced without crashing the server.
 func TestProcessor_PanicClientRequest(t *testing.T) {
 	local := NewTCPTest(tSuite)
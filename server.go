@@ -1,7 +1,10 @@
 package onet
 
 import (
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"net/http"
 	"os"
 	"runtime"
 	"sort"
@@ -76,6 +79,11 @@ func newServer(s network.Suite, dbPath string, r *network.Router, pkey kyber.Sca
 	}
 	c.overlay = NewOverlay(c)
 	c.WebSocket = NewWebSocket(r.ServerIdentity)
+	c.WebSocket.knownRoster = c.overlay.knownRoster
+	c.WebSocket.mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		w.Write([]byte(c.PrometheusMetrics()))
+	})
 	c.serviceManager = newServiceManager(c, c.overlay, dbPath, delDb)
 	c.statusReporterStruct.RegisterStatusReporter("Generic", c)
 	return c
@@ -127,6 +135,8 @@ func (c *Server) GetStatus() *Status {
 		"ConnType":    string(c.ServerIdentity.Address.ConnType()),
 		"GoRoutines":  fmt.Sprintf("%v", runtime.NumGoroutine()),
 	}}
+	st.Field["TreeRequests"] = strconv.FormatUint(c.overlay.TreeRequests(), 10)
+	st.Field["TreeResponses"] = strconv.FormatUint(c.overlay.TreeResponses(), 10)
 
 	goverOnce.Do(func() {
 		v, err := version.ReadExe(os.Args[0])
@@ -169,6 +179,112 @@ func (c *Server) Close() error {
 	return err
 }
 
+// PrometheusMetrics returns the counters of the server in the Prometheus text
+// exposition format. They are also served on the /metrics endpoint of the
+// websocket.
+func (c *Server) PrometheusMetrics() string {
+	var b strings.Builder
+	metric := func(name, typ, help string, value interface{}) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n%s %v\n",
+			name, help, name, typ, name, value)
+	}
+
+	c.overlay.instancesLock.Lock()
+	instances := len(c.overlay.instances)
+	c.overlay.instancesLock.Unlock()
+	uptime := 0.0
+	if !c.started.IsZero() {
+		uptime = time.Since(c.started).Seconds()
+	}
+
+	metric("onet_tx_bytes_total", "counter", "Bytes sent to other nodes.", c.Router.Tx())
+	metric("onet_rx_bytes_total", "counter", "Bytes received from other nodes.", c.Router.Rx())
+	metric("onet_tx_messages_total", "counter", "Messages sent to other nodes.", c.Router.MsgTx())
+	metric("onet_rx_messages_total", "counter", "Messages received from other nodes.", c.Router.MsgRx())
+	metric("onet_connected_peers", "gauge", "Nodes with an open connection.", len(c.Router.ConnectedPeers()))
+	metric("onet_protocol_instances", "gauge", "Running protocol instances.", instances)
+	metric("onet_tree_requests_total", "counter", "Unknown trees requested to other nodes.", c.overlay.TreeRequests())
+	metric("onet_tree_responses_total", "counter", "Requested trees received from other nodes.", c.overlay.TreeResponses())
+	metric("onet_goroutines", "gauge", "Number of go-routines.", runtime.NumGoroutine())
+	metric("onet_uptime_seconds", "gauge", "Time since the server started.", uptime)
+	return b.String()
+}
+
+// DumpConfig returns a snapshot of the configuration of the server, to
+// compare the nodes when debugging: its identity, suites, services,
+// protocols and sets of valid peers. It doesn't contain any private key.
+func (c *Server) DumpConfig() map[string]interface{} {
+	si := c.ServerIdentity
+	services := c.serviceManager.availableServices()
+	sort.Strings(services)
+
+	c.protocols.Lock()
+	var protocols []string
+	for name := range c.protocols.instantiators {
+		protocols = append(protocols, name)
+	}
+	c.protocols.Unlock()
+	sort.Strings(protocols)
+
+	serviceSuites := make(map[string]string)
+	for _, srvid := range si.ServiceIdentities {
+		serviceSuites[srvid.Name] = srvid.Suite
+	}
+
+	validPeers := make(map[string][]string)
+	for _, id := range c.Router.ValidPeerSets() {
+		var peers []string
+		for _, peer := range c.Router.GetValidPeers(id) {
+			peers = append(peers, peer.String())
+		}
+		sort.Strings(peers)
+		validPeers[hex.EncodeToString(id[:])] = peers
+	}
+
+	return map[string]interface{}{
+		"address":        si.Address.String(),
+		"url":            si.URL,
+		"description":    si.Description,
+		"id":             si.GetID().String(),
+		"public":         si.Public.String(),
+		"metadata":       si.Metadata,
+		"suite":          c.suite.String(),
+		"service_suites": serviceSuites,
+		"services":       services,
+		"protocols":      protocols,
+		"valid_peers":    validPeers,
+	}
+}
+
+// DumpConfigJSON returns the configuration of DumpConfig encoded in JSON.
+func (c *Server) DumpConfigJSON() ([]byte, error) {
+	buf, err := json.MarshalIndent(c.DumpConfig(), "", "  ")
+	if err != nil {
+		return nil, xerrors.Errorf("encoding config: %v", err)
+	}
+	return buf, nil
+}
+
+// SetRateLimit limits the requests that a client, identified by its IP
+// address, sends to the service through the websocket: it can send burst
+// requests at once, and then rate requests per second. Every request of a
+// batch counts, so a batch bigger than burst is always refused. The
+// connection of a client above the limit is closed with RateLimitCloseCode,
+// without processing the request. A rate of 0 or less removes the limit, which is
+// the default.
+func (c *Server) SetRateLimit(service string, rate float64, burst int) {
+	c.WebSocket.setRateLimit(service, rate, burst)
+}
+
+// SetServiceWorkers makes the services use at most workers go routines at the
+// same time to process the messages of the other servers. The messages
+// arriving while all of them are busy are queued. A value of 0 or less
+// removes the limit. The default is taken from the ONET_SERVICE_WORKERS
+// environment variable, and is no limit if it is not set.
+func (c *Server) SetServiceWorkers(workers int) {
+	c.serviceManager.setWorkers(workers)
+}
+
 // Address returns the address used by the Router.
 func (c *Server) Address() network.Address {
 	return c.ServerIdentity.Address
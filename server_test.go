@@ -1,6 +1,9 @@
 package onet
 
 import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
 	"testing"
 	"time"
 
@@ -27,6 +30,30 @@ func TestServer_ProtocolRegisterName(t *testing.T) {
 	require.NotNil(t, err)
 }
 
+func TestServer_DumpConfig(t *testing.T) {
+	c := NewLocalServer(tSuite, 0)
+	defer c.Close()
+	_, err := c.ProtocolRegister("ServerProtocol", NewServerProtocol)
+	require.NoError(t, err)
+	c.SetValidPeers(network.NewPeerSetID([]byte{1}),
+		[]*network.ServerIdentity{c.ServerIdentity})
+
+	cfg := c.DumpConfig()
+	require.Equal(t, c.ServerIdentity.Address.String(), cfg["address"])
+	require.Contains(t, cfg["services"], testServiceName)
+	require.Contains(t, cfg["protocols"], "ServerProtocol")
+	require.Equal(t, tSuite.String(), cfg["suite"])
+
+	buf, err := c.DumpConfigJSON()
+	require.NoError(t, err)
+	var decoded map[string]interface{}
+	require.NoError(t, json.Unmarshal(buf, &decoded))
+	require.Equal(t, cfg["address"], decoded["address"])
+	peers := decoded["valid_peers"].(map[string]interface{})
+	require.Equal(t, 1, len(peers))
+	require.NotContains(t, string(buf), c.private.String())
+}
+
 func TestServer_GetService(t *testing.T) {
 	c := NewLocalServer(tSuite, 0)
 	defer c.Close()
@@ -119,3 +146,33 @@ func NewServerProtocol2(n *TreeNodeInstance) (ProtocolInstance, error) {
 func (cp *ServerProtocol) Start() error {
 	return nil
 }
+
+func TestServer_PrometheusMetrics(t *testing.T) {
+	local := NewTCPTest(tSuite)
+	defer local.CloseAll()
+
+	servers, _, tree := local.GenTree(2, true)
+	pi, err := local.StartProtocol(pingPongProtoName, tree)
+	require.NoError(t, err)
+	select {
+	case <-pi.(*pingPongProto).done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("protocol didn't finish in time")
+	}
+
+	hp, err := getWSHostPort(servers[1].ServerIdentity, false)
+	require.NoError(t, err)
+	resp, err := http.Get("http://" + hp + "/metrics")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	metrics := string(body)
+	require.Contains(t, metrics, "# TYPE onet_tree_requests_total counter\n")
+	require.Contains(t, metrics, "\nonet_tree_requests_total 1\n")
+	require.Contains(t, metrics, "\nonet_tree_responses_total 1\n")
+	require.Contains(t, metrics, "\nonet_connected_peers 1\n")
+	require.Regexp(t, "\nonet_rx_bytes_total [1-9][0-9]*\n", metrics)
+}
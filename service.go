@@ -7,6 +7,7 @@ import (
 	"os"
 	"path"
 	"strconv"
+	"strings"
 	"sync"
 
 	"github.com/google/uuid"
@@ -14,6 +15,7 @@ import (
 	"go.dedis.ch/kyber/v3/util/key"
 	"go.dedis.ch/onet/v3/log"
 	"go.dedis.ch/onet/v3/network"
+	"go.dedis.ch/protobuf"
 	bbolt "go.etcd.io/bbolt"
 	"golang.org/x/xerrors"
 )
@@ -70,6 +72,24 @@ type BidirectionalStreamer interface {
 	IsStreaming(path string) (bool, error)
 }
 
+// ResumableStreamer is implemented by the services able to resume a stream
+// after the connection of the client broke. ProcessClientStreamRequestFrom
+// does the same as ProcessClientStreamRequest, but the service only sends the
+// replies following the one with sequence number seq, each one prefixed by
+// its sequence number as a big-endian uint64. It is used for all the streams
+// of SequencedStreamSubprotocol, with a seq of 0 for a new stream.
+type ResumableStreamer interface {
+	ProcessClientStreamRequestFrom(req *http.Request, path string, seq uint64, clientInputs chan []byte) (chan []byte, error)
+}
+
+// StreamErrorReporter is implemented by the streaming services that can
+// close a stream on their own, like the ServiceProcessor with
+// StreamErrorAndClose. StreamError returns why the stream with the outgoing
+// channel out has been closed, so that the client is told.
+type StreamErrorReporter interface {
+	StreamError(out chan []byte) error
+}
+
 // NewServiceFunc is the type of a function that is used to instantiate a given Service
 // A service is initialized with a Server (to send messages to someone).
 type NewServiceFunc func(c *Context) (Service, error)
@@ -101,6 +121,29 @@ type GenericConfig struct {
 	Data []byte
 }
 
+// NewGenericConfig returns a GenericConfig holding the protobuf-encoding of v,
+// so that a typed config can be passed with SetConfig.
+func NewGenericConfig(v interface{}) (*GenericConfig, error) {
+	buf, err := protobuf.Encode(v)
+	if err != nil {
+		return nil, xerrors.Errorf("encoding: %v", err)
+	}
+	return &GenericConfig{Data: buf}, nil
+}
+
+// Decode protobuf-decodes the data of the config into v, which must be a
+// pointer to the same type as the one given to NewGenericConfig.
+func (g *GenericConfig) Decode(v interface{}) error {
+	if g == nil {
+		return xerrors.New("no config given")
+	}
+	err := protobuf.Decode(g.Data, v)
+	if err != nil {
+		return xerrors.Errorf("decoding: %v", err)
+	}
+	return nil
+}
+
 // A serviceFactory is used to register a NewServiceFunc
 type serviceFactory struct {
 	constructors []serviceEntry
@@ -314,8 +357,23 @@ type serviceManager struct {
 	dbPath string
 	// should the db be deleted on close?
 	delDb bool
+	// the databases opened with Context.GetServiceDB, by file name
+	serviceDBs    map[string]*bbolt.DB
+	serviceDBsMut sync.Mutex
 	// the dispatcher can take registration of Processors
-	network.Dispatcher
+	dispatcher    network.Dispatcher
+	dispatcherMut sync.Mutex
+}
+
+// serviceWorkers returns the default number of go routines the services can
+// use at the same time to process messages, as set in ONET_SERVICE_WORKERS.
+// It returns 0 if there is no limit.
+func serviceWorkers() int {
+	workers, err := strconv.Atoi(os.Getenv("ONET_SERVICE_WORKERS"))
+	if err != nil {
+		return 0
+	}
+	return workers
 }
 
 // newServiceManager will create a serviceStore out of all the registered Service
@@ -326,8 +384,9 @@ func newServiceManager(srv *Server, o *Overlay, dbPath string, delDb bool) *serv
 		server:     srv,
 		dbPath:     dbPath,
 		delDb:      delDb,
-		Dispatcher: network.NewRoutineDispatcher(),
+		dispatcher: network.NewRoutineDispatcher(),
 	}
+	s.setWorkers(serviceWorkers())
 
 	s.updateDbFileName()
 
@@ -386,6 +445,37 @@ func (s *serviceManager) dbFileName() string {
 	return path.Join(s.dbPath, fmt.Sprintf("%x.db", h.Sum(nil)))
 }
 
+// serviceDBFileName returns the file of the database name of the service.
+func (s *serviceManager) serviceDBFileName(service, name string) string {
+	return fmt.Sprintf("%s_%s_%s.db", strings.TrimSuffix(s.dbFileName(), ".db"),
+		service, name)
+}
+
+// serviceDB returns the database name of the service, opening it if needed.
+func (s *serviceManager) serviceDB(service, name string) (*bbolt.DB, error) {
+	for _, n := range []string{service, name} {
+		if n == "" || strings.ContainsAny(n, `/\`) {
+			return nil, xerrors.Errorf("invalid database name: %q", n)
+		}
+	}
+	fileName := s.serviceDBFileName(service, name)
+
+	s.serviceDBsMut.Lock()
+	defer s.serviceDBsMut.Unlock()
+	if db, ok := s.serviceDBs[fileName]; ok {
+		return db, nil
+	}
+	db, err := openDb(fileName)
+	if err != nil {
+		return nil, xerrors.Errorf("opening service db: %v", err)
+	}
+	if s.serviceDBs == nil {
+		s.serviceDBs = make(map[string]*bbolt.DB)
+	}
+	s.serviceDBs[fileName] = db
+	return db, nil
+}
+
 // updateDbFileName checks if the old database file name exists, if it does, it
 // will rename it to the new file name.
 func (s *serviceManager) updateDbFileName() {
@@ -402,12 +492,57 @@ func (s *serviceManager) updateDbFileName() {
 // messages to the right Service.
 func (s *serviceManager) Process(env *network.Envelope) {
 	// will launch a go routine for that message
-	s.Dispatch(env)
+	s.getDispatcher().Dispatch(env)
+}
+
+// setWorkers makes the services use at most workers go routines at the same
+// time to process messages, or removes the limit if workers is 0 or less.
+// The processors already registered are kept.
+func (s *serviceManager) setWorkers(workers int) {
+	s.dispatcherMut.Lock()
+	defer s.dispatcherMut.Unlock()
+	var procs *network.BlockingDispatcher
+	switch d := s.dispatcher.(type) {
+	case *network.RoutineDispatcher:
+		procs = d.BlockingDispatcher
+	case *network.BoundedRoutineDispatcher:
+		procs = d.BlockingDispatcher
+	}
+	if workers > 0 {
+		d := network.NewBoundedRoutineDispatcher(workers)
+		d.BlockingDispatcher = procs
+		s.dispatcher = d
+	} else {
+		d := network.NewRoutineDispatcher()
+		d.BlockingDispatcher = procs
+		s.dispatcher = d
+	}
+}
+
+// getDispatcher returns the dispatcher of the messages for the services.
+func (s *serviceManager) getDispatcher() network.Dispatcher {
+	s.dispatcherMut.Lock()
+	defer s.dispatcherMut.Unlock()
+	return s.dispatcher
 }
 
 // closeDatabase closes the database.
 // It also removes the database file if the path is not default (i.e. testing config)
 func (s *serviceManager) closeDatabase() error {
+	s.serviceDBsMut.Lock()
+	for fileName, db := range s.serviceDBs {
+		if err := db.Close(); err != nil {
+			log.Error("Close service database failed with: " + err.Error())
+		}
+		if s.delDb {
+			if err := os.Remove(fileName); err != nil {
+				log.Error("Removing service database failed with: " + err.Error())
+			}
+		}
+	}
+	s.serviceDBs = nil
+	s.serviceDBsMut.Unlock()
+
 	if s.db != nil {
 		err := s.db.Close()
 		if err != nil {
@@ -464,14 +599,14 @@ func (s *serviceManager) registerProcessor(p network.Processor, msgType network.
 	// delegate message to host so the host will pass the message to ourself
 	s.server.RegisterProcessor(s, msgType)
 	// handle the message ourselves (will be launched in a go routine)
-	s.Dispatcher.RegisterProcessor(p, msgType)
+	s.getDispatcher().RegisterProcessor(p, msgType)
 }
 
 func (s *serviceManager) registerProcessorFunc(msgType network.MessageTypeID, fn func(*network.Envelope) error) {
 	// delegate message to host so the host will pass the message to ourself
 	s.server.RegisterProcessor(s, msgType)
 	// handle the message ourselves (will be launched in a go routine)
-	s.Dispatcher.RegisterProcessorFunc(msgType, fn)
+	s.getDispatcher().RegisterProcessorFunc(msgType, fn)
 
 }
 
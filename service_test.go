@@ -368,6 +368,27 @@ func TestServiceMessages(t *testing.T) {
 	require.True(t, <-ism.GotResponse, "Didn't get response")
 }
 
+// TestServer_SetServiceWorkers makes sure the services still get their
+// messages after the dispatcher changed.
+func TestServer_SetServiceWorkers(t *testing.T) {
+	local := NewLocalTest(tSuite)
+	defer local.CloseAll()
+	servers, _, _ := local.GenTree(2, true)
+	ism := servers[0].serviceManager.service(ismServiceName).(*ServiceMessages)
+
+	servers[0].SetServiceWorkers(2)
+	require.IsType(t, &network.BoundedRoutineDispatcher{},
+		servers[0].serviceManager.getDispatcher())
+	ism.SendRaw(servers[0].ServerIdentity, &SimpleResponse{})
+	require.True(t, <-ism.GotResponse, "Didn't get response")
+
+	servers[0].SetServiceWorkers(0)
+	require.IsType(t, &network.RoutineDispatcher{},
+		servers[0].serviceManager.getDispatcher())
+	ism.SendRaw(servers[0].ServerIdentity, &SimpleResponse{})
+	require.True(t, <-ism.GotResponse, "Didn't get response")
+}
+
 func TestServiceProtocolInstantiation(t *testing.T) {
 	local := NewLocalTest(tSuite)
 	defer local.CloseAll()
@@ -389,6 +410,37 @@ func TestServiceProtocolInstantiation(t *testing.T) {
 	waitOrFatal(link, t)
 }
 
+func TestServiceTypedGenericConfig(t *testing.T) {
+	local := NewLocalTest(tSuite)
+	defer local.CloseAll()
+	servers, _, tree := local.GenTree(2, true)
+
+	ds1 := servers[0].serviceManager.service(dummyService2Name).(*dummyService2)
+	ds2 := servers[1].serviceManager.service(dummyService2Name).(*dummyService2)
+	ds2.typedConfigs = make(chan *typedConfig, 1)
+
+	tni := ds1.NewTreeNodeInstance(tree, tree.Root, dummyService2Name)
+	pi, err := newDummyProtocol2(tni)
+	require.NoError(t, err)
+	require.NoError(t, ds1.RegisterProtocolInstance(pi))
+
+	conf, err := NewGenericConfig(&typedConfig{Name: "typed", Value: 42})
+	require.NoError(t, err)
+	require.NoError(t, tni.SetConfig(conf))
+	require.NoError(t, pi.Start())
+
+	select {
+	case tc := <-ds2.typedConfigs:
+		require.Equal(t, "typed", tc.Name)
+		require.Equal(t, int64(42), tc.Value)
+	case <-time.After(time.Second):
+		t.Fatal("didn't get the config in time")
+	}
+
+	var nilConf *GenericConfig
+	require.Error(t, nilConf.Decode(&typedConfig{}))
+}
+
 func TestServiceGenericConfig(t *testing.T) {
 	local := NewLocalTest(tSuite)
 	defer local.CloseAll()
@@ -740,6 +792,13 @@ func newServiceMessages(c *Context) (Service, error) {
 type dummyService2 struct {
 	*Context
 	link chan bool
+	// if set, the config is decoded as a typedConfig and sent here
+	typedConfigs chan *typedConfig
+}
+
+type typedConfig struct {
+	Name  string
+	Value int64
 }
 
 func newDummyService2(c *Context) (Service, error) {
@@ -753,7 +812,15 @@ func (ds *dummyService2) ProcessClientRequest(req *http.Request, path string, bu
 var serviceConfig = []byte{0x01, 0x02, 0x03, 0x04}
 
 func (ds *dummyService2) NewProtocol(tn *TreeNodeInstance, conf *GenericConfig) (ProtocolInstance, error) {
-	ds.link <- conf != nil && bytes.Equal(conf.Data, serviceConfig)
+	if ds.typedConfigs != nil {
+		tc := &typedConfig{}
+		if err := conf.Decode(tc); err != nil {
+			return nil, xerrors.Errorf("decoding config: %v", err)
+		}
+		ds.typedConfigs <- tc
+	} else {
+		ds.link <- conf != nil && bytes.Equal(conf.Data, serviceConfig)
+	}
 	pi, err := newDummyProtocol2(tn)
 	if err != nil {
 		return nil, xerrors.Errorf("couldn't create dummyProtocol2: %+v", err)
@@ -7,7 +7,10 @@ import (
 	"encoding/binary"
 	"encoding/hex"
 	"fmt"
+	"math/big"
 	"math/rand"
+	"net/url"
+	"sort"
 
 	"github.com/google/uuid"
 	"go.dedis.ch/kyber/v3"
@@ -40,6 +43,10 @@ type Tree struct {
 	ID     TreeID
 	Roster *Roster
 	Root   *TreeNode
+	// View is an optional second roster of the same size as Roster, used by
+	// reconfiguration protocols to address the nodes in another committee.
+	// The node at RosterIndex i is View.List[i] in that view.
+	View *Roster
 }
 
 // TreeID uniquely identifies a Tree struct in the onet framework.
@@ -114,6 +121,59 @@ func NewTreeFromMarshal(s network.Suite, buf []byte, el *Roster) (*Tree, error)
 	return t, nil
 }
 
+// Validate checks the structure of the tree: the children point back to
+// their parent, the TreeNodeIDs are unique, and the ServerIdentity of every
+// node is in the Roster at its RosterIndex. The error names the first node
+// found wrong.
+func (t *Tree) Validate() error {
+	if t.Root == nil {
+		return xerrors.New("tree has no root")
+	}
+	if t.Roster == nil {
+		return xerrors.New("tree has no roster")
+	}
+	if t.Root.Parent != nil {
+		return xerrors.Errorf("root %s has a parent", t.Root.ID)
+	}
+	seen := make(map[TreeNodeID]bool)
+	var check func(tn *TreeNode) error
+	check = func(tn *TreeNode) error {
+		if seen[tn.ID] {
+			return xerrors.Errorf("node %s appears twice", tn.ID)
+		}
+		seen[tn.ID] = true
+		if tn.ServerIdentity == nil {
+			return xerrors.Errorf("node %s has no ServerIdentity", tn.ID)
+		}
+		if tn.RosterIndex < 0 || tn.RosterIndex >= len(t.Roster.List) {
+			return xerrors.Errorf("node %s (%s) has RosterIndex %d out of the roster",
+				tn.ID, tn.ServerIdentity.Address, tn.RosterIndex)
+		}
+		if !t.Roster.List[tn.RosterIndex].ID.Equal(tn.ServerIdentity.ID) {
+			if i, _ := t.Roster.Search(tn.ServerIdentity.ID); i < 0 {
+				return xerrors.Errorf("node %s (%s) is not in the roster",
+					tn.ID, tn.ServerIdentity.Address)
+			}
+			return xerrors.Errorf("node %s (%s) has wrong RosterIndex %d",
+				tn.ID, tn.ServerIdentity.Address, tn.RosterIndex)
+		}
+		for _, c := range tn.Children {
+			if c == nil {
+				return xerrors.Errorf("node %s has a nil child", tn.ID)
+			}
+			if c.Parent != tn {
+				return xerrors.Errorf("node %s doesn't point back to its parent %s",
+					c.ID, tn.ID)
+			}
+			if err := check(c); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return check(t.Root)
+}
+
 // MakeTreeMarshal creates a replacement-tree that is safe to send: no
 // parent (creates loops), only sends ids (not send the roster again)
 func (t *Tree) MakeTreeMarshal() *TreeMarshal {
@@ -140,8 +200,9 @@ func (t *Tree) Marshal() ([]byte, error) {
 }
 
 type tbmStruct struct {
-	T  []byte
-	Ro *Roster
+	T    []byte
+	Ro   *Roster
+	View *Roster
 }
 
 // BinaryMarshaler does the same as Marshal
@@ -151,8 +212,9 @@ func (t *Tree) BinaryMarshaler() ([]byte, error) {
 		return nil, xerrors.Errorf("marshaling: %v", err)
 	}
 	tbm := &tbmStruct{
-		T:  bt,
-		Ro: t.Roster,
+		T:    bt,
+		Ro:   t.Roster,
+		View: t.View,
 	}
 	b, err := network.Marshal(tbm)
 	if err != nil {
@@ -172,9 +234,33 @@ func (t *Tree) BinaryUnmarshaler(s network.Suite, b []byte) error {
 	if err != nil {
 		return xerrors.Errorf("making tree marshal: %v", err)
 	}
+	if tbm.View != nil {
+		if err := tree.SetView(tbm.View); err != nil {
+			return xerrors.Errorf("setting view: %v", err)
+		}
+	}
 	t.Roster = tbm.Ro
 	t.ID = tree.ID
 	t.Root = tree.Root
+	t.View = tree.View
+	return nil
+}
+
+// SetView attaches a secondary roster to the tree, so that every node can
+// also be addressed by its ServerIdentity in that view. The view must have
+// the same size as the roster of the tree.
+func (t *Tree) SetView(view *Roster) error {
+	if view == nil {
+		return xerrors.New("nil view")
+	}
+	if len(view.List) != len(t.Roster.List) {
+		return xerrors.Errorf("view has %d nodes instead of %d",
+			len(view.List), len(t.Roster.List))
+	}
+	t.View = view
+	for _, tn := range t.List() {
+		tn.ViewIdentity = view.List[tn.RosterIndex]
+	}
 	return nil
 }
 
@@ -208,6 +294,24 @@ func (t *Tree) Dump() string {
 	return ret
 }
 
+// DumpDot returns the tree in the DOT format of Graphviz, with an edge from
+// every parent to its children. The nodes are labelled with the address,
+// the index in the roster and the TreeNodeID, so that a server present more
+// than once in the tree can be told apart.
+func (t *Tree) DumpDot() string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "digraph \"%s\" {\n", t.ID)
+	t.Root.Visit(0, func(d int, tn *TreeNode) {
+		fmt.Fprintf(&buf, "\t\"%s\" [label=\"%s\\n#%d\\n%s\"];\n", tn.ID,
+			tn.ServerIdentity.Address, tn.RosterIndex, tn.ID.String()[:8])
+		if tn.Parent != nil {
+			fmt.Fprintf(&buf, "\t\"%s\" -> \"%s\";\n", tn.Parent.ID, tn.ID)
+		}
+	})
+	buf.WriteString("}\n")
+	return buf.String()
+}
+
 // Search searches the Tree for the given TreeNodeID and returns the corresponding TreeNode
 func (t *Tree) Search(tn TreeNodeID) (ret *TreeNode) {
 	found := func(d int, tns *TreeNode) {
@@ -219,6 +323,24 @@ func (t *Tree) Search(tn TreeNodeID) (ret *TreeNode) {
 	return ret
 }
 
+// Contains returns true if the ServerIdentity with the given ID is used by at
+// least one TreeNode of the Tree.
+func (t *Tree) Contains(id network.ServerIdentityID) bool {
+	return len(t.NodesFor(id)) > 0
+}
+
+// NodesFor returns all TreeNodes using the ServerIdentity with the given ID,
+// as a same host can be at more than one position in the Tree.
+func (t *Tree) NodesFor(id network.ServerIdentityID) (ret []*TreeNode) {
+	add := func(d int, tns *TreeNode) {
+		if tns.ServerIdentity.ID.Equal(id) {
+			ret = append(ret, tns)
+		}
+	}
+	t.Root.Visit(0, add)
+	return ret
+}
+
 // List returns a list of TreeNodes generated by DFS-iterating the Tree
 func (t *Tree) List() (ret []*TreeNode) {
 	ret = make([]*TreeNode, 0)
@@ -229,6 +351,91 @@ func (t *Tree) List() (ret []*TreeNode) {
 	return ret
 }
 
+// Leaves returns the nodes without children in the same order as List. The
+// root is not a leaf, so a tree with only a root returns an empty slice.
+func (t *Tree) Leaves() []*TreeNode {
+	ret := make([]*TreeNode, 0)
+	t.Root.Visit(0, func(d int, tn *TreeNode) {
+		if d > 0 && tn.IsLeaf() {
+			ret = append(ret, tn)
+		}
+	})
+	return ret
+}
+
+// PathToRoot returns the nodes from the node with the given ID up to the
+// root, both included.
+func (t *Tree) PathToRoot(id TreeNodeID) ([]*TreeNode, error) {
+	tn := t.Search(id)
+	if tn == nil {
+		return nil, xerrors.Errorf("node %s not found in the tree", id)
+	}
+	var path []*TreeNode
+	for n := tn; n != nil; n = n.Parent {
+		path = append(path, n)
+	}
+	return path, nil
+}
+
+// CommonAncestor returns the deepest node having both nodes in its subtree,
+// which is one of them if it is an ancestor of the other.
+func (t *Tree) CommonAncestor(a, b TreeNodeID) (*TreeNode, error) {
+	pathA, pathB, err := t.pathsToRoot(a, b)
+	if err != nil {
+		return nil, err
+	}
+	i, _ := commonAncestor(pathA, pathB)
+	return pathA[i], nil
+}
+
+// Path returns the nodes to go through from one node to another along the
+// edges of the tree, up to their common ancestor and down again, both ends
+// included. If from and to are the same node, the path only holds this node.
+func (t *Tree) Path(from, to TreeNodeID) ([]*TreeNode, error) {
+	pathFrom, pathTo, err := t.pathsToRoot(from, to)
+	if err != nil {
+		return nil, err
+	}
+	i, j := commonAncestor(pathFrom, pathTo)
+	path := append([]*TreeNode{}, pathFrom[:i+1]...)
+	for j--; j >= 0; j-- {
+		path = append(path, pathTo[j])
+	}
+	return path, nil
+}
+
+// pathsToRoot returns the paths to the root of both nodes.
+func (t *Tree) pathsToRoot(a, b TreeNodeID) ([]*TreeNode, []*TreeNode, error) {
+	pathA, err := t.PathToRoot(a)
+	if err != nil {
+		return nil, nil, xerrors.Errorf("path of a: %v", err)
+	}
+	pathB, err := t.PathToRoot(b)
+	if err != nil {
+		return nil, nil, xerrors.Errorf("path of b: %v", err)
+	}
+	return pathA, pathB, nil
+}
+
+// commonAncestor returns the indexes of the common ancestor in two paths to
+// the root of the same tree, which both end with the root.
+func commonAncestor(pathA, pathB []*TreeNode) (int, int) {
+	i, j := len(pathA)-1, len(pathB)-1
+	for i > 0 && j > 0 && pathA[i-1].ID.Equal(pathB[j-1].ID) {
+		i--
+		j--
+	}
+	return i, j
+}
+
+// Iterate calls fn on the nodes of the tree in the same order as List, without
+// building the list. It stops as soon as fn returns false.
+func (t *Tree) Iterate(fn func(*TreeNode) bool) {
+	if t.Root != nil {
+		t.Root.iterate(fn)
+	}
+}
+
 // IsBinary returns true if every node has two or no children
 func (t *Tree) IsBinary(root *TreeNode) bool {
 	return t.IsNary(root, 2)
@@ -258,6 +465,18 @@ func (t *Tree) Size() int {
 	return size
 }
 
+// Depth returns the number of levels below the root, so a tree with only
+// a root has a depth of 0.
+func (t *Tree) Depth() int {
+	depth := 0
+	t.Root.Visit(0, func(d int, tn *TreeNode) {
+		if d > depth {
+			depth = d
+		}
+	})
+	return depth
+}
+
 // UsesList returns true if all ServerIdentities of the list are used at least once
 // in the tree
 func (t *Tree) UsesList() bool {
@@ -340,6 +559,21 @@ func TreeMarshalCopyTree(tr *TreeNode) *TreeMarshal {
 	return tm
 }
 
+// Depth returns the depth of the tree described by tm, as Tree.Depth would
+// return it, without recursion.
+func (tm *TreeMarshal) Depth() int {
+	// The top-node and the root are not counted.
+	depth := -2
+	for level := []*TreeMarshal{tm}; len(level) > 0; depth++ {
+		var next []*TreeMarshal
+		for _, n := range level {
+			next = append(next, n.Children...)
+		}
+		level = next
+	}
+	return depth
+}
+
 // MakeTree creates a tree given an Roster
 func (tm TreeMarshal) MakeTree(ro *Roster) (*Tree, error) {
 	if !ro.ID.Equal(tm.RosterID) {
@@ -478,6 +712,59 @@ func (ro *Roster) GetID() (RosterID, error) {
 	return RosterID(uuid.NewSHA1(uuid.NameSpaceURL, []byte(hex.EncodeToString(h.Sum(nil))))), nil
 }
 
+// GetIDWithMetadata returns an ID of the roster that also covers the metadata
+// of its ServerIdentities, so that two rosters with the same keys but
+// different labels get different IDs. It is not used for the ID field of the
+// roster, which only depends on the keys as returned by GetID.
+func (ro *Roster) GetIDWithMetadata() (RosterID, error) {
+	id, err := ro.GetID()
+	if err != nil {
+		return RosterID{}, xerrors.Errorf("getting id: %v", err)
+	}
+
+	h := sha256.New()
+	h.Write(id[:])
+	for _, si := range ro.List {
+		keys := make([]string, 0, len(si.Metadata))
+		for k := range si.Metadata {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		binary.Write(h, binary.LittleEndian, uint64(len(keys)))
+		for _, k := range keys {
+			for _, s := range []string{k, si.Metadata[k]} {
+				binary.Write(h, binary.LittleEndian, uint64(len(s)))
+				h.Write([]byte(s))
+			}
+		}
+	}
+
+	return RosterID(uuid.NewSHA1(uuid.NameSpaceURL, []byte(hex.EncodeToString(h.Sum(nil))))), nil
+}
+
+// MarshalCompact returns the ID of the roster only, for peers that already
+// share the roster. Use UnmarshalCompactRoster to get the roster back.
+func (ro *Roster) MarshalCompact() []byte {
+	return append([]byte{}, ro.ID[:]...)
+}
+
+// UnmarshalCompactRoster returns the roster of known whose ID is in b, as
+// created by Roster.MarshalCompact. It returns an error if b is not a valid
+// ID or if the roster is not known.
+func UnmarshalCompactRoster(b []byte, known map[RosterID]*Roster) (*Roster, error) {
+	var id RosterID
+	if len(b) != len(id) {
+		return nil, xerrors.Errorf("wrong length for a roster ID: %d", len(b))
+	}
+	copy(id[:], b)
+	ro, ok := known[id]
+	if !ok || ro == nil {
+		return nil, xerrors.Errorf("unknown roster %s", id)
+	}
+	return ro, nil
+}
+
 // Search searches the Roster for the given ServerIdentityID and returns the
 // corresponding ServerIdentity.
 func (ro *Roster) Search(eID network.ServerIdentityID) (int, *network.ServerIdentity) {
@@ -522,12 +809,27 @@ func (ro *Roster) ServicePublics(name string) []kyber.Point {
 
 // ServiceAggregate returns the sum of all public keys of a given service. This
 // is often used as the aggregate public key.
-// If one or more of the service public keys are not present, it will return an error.
+// If one or more of the service public keys are not present, or if they are
+// not all of the same suite and cannot be added, it will return an error.
 func (ro Roster) ServiceAggregate(name string) (kyber.Point, error) {
+	if len(ro.List) == 0 {
+		return nil, xerrors.New("empty roster")
+	}
+	suite := ""
 	for _, si := range ro.List {
 		if !si.HasServicePublic(name) {
 			return nil, xerrors.New("not all nodes have this service keypair")
 		}
+		for _, srvid := range si.ServiceIdentities {
+			if srvid.Name != name {
+				continue
+			}
+			if suite != "" && srvid.Suite != suite {
+				return nil, xerrors.Errorf("cannot aggregate keys of suites %s and %s",
+					suite, srvid.Suite)
+			}
+			suite = srvid.Suite
+		}
 	}
 	aggregate := ro.List[0].ServicePublic(name).Clone().Null()
 	for _, p := range ro.ServicePublics(name) {
@@ -536,6 +838,33 @@ func (ro Roster) ServiceAggregate(name string) (kyber.Point, error) {
 	return aggregate, nil
 }
 
+// ValidateAddresses checks that the address of every ServerIdentity of the
+// roster is well formed, and that the URL, if present, is a valid http(s) URL.
+// It returns one error per invalid entry, or nil if all entries are valid.
+// No connection is made to the servers.
+func (ro *Roster) ValidateAddresses() []error {
+	var errs []error
+	for i, si := range ro.List {
+		if !si.Address.Valid() {
+			errs = append(errs, xerrors.Errorf("entry %d: invalid address %q",
+				i, si.Address))
+		}
+		if si.URL == "" {
+			continue
+		}
+		u, err := url.Parse(si.URL)
+		if err != nil {
+			errs = append(errs, xerrors.Errorf("entry %d: invalid URL: %v", i, err))
+			continue
+		}
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, xerrors.Errorf("entry %d: invalid URL %q: "+
+				"need an http or https scheme and a host", i, si.URL))
+		}
+	}
+	return errs
+}
+
 // GenerateBigNaryTree creates a tree where each node has N children.
 // It will make a tree with exactly 'nodes' elements, regardless of the
 // size of the Roster. If 'nodes' is bigger than the number of elements
@@ -546,9 +875,13 @@ func (ro Roster) ServiceAggregate(name string) (kyber.Point, error) {
 // However, for some configurations it is impossible to use all ServerIdentities from
 // the Roster and still avoid having a parent and a child from the same
 // host. In this case use-all has preference over not-the-same-host.
+//
+// An empty Roster or nodes < 1 returns `nil`, and nodes == 1 returns a tree
+// with only the root. If more than one node is requested, N must be at least
+// 1, else `nil` is returned.
 func (ro *Roster) GenerateBigNaryTree(N, nodes int) *Tree {
-	if len(ro.List) == 0 {
-		panic("empty roster")
+	if len(ro.List) == 0 || nodes < 1 || (N < 1 && nodes > 1) {
+		return nil
 	}
 
 	// list of which hosts are already used
@@ -636,7 +969,14 @@ func (ro *Roster) NewRosterWithRoot(root *network.ServerIdentity) *Roster {
 // If you need the root node to be at the first position of the roster, then
 // you need to create a new roster using roster.NewRosterWithRoot. Else this method
 // does not change the underlying roster or create a new one.
+//
+// An empty roster returns `nil` and a roster with one element returns a tree
+// with only the root. For bigger rosters N must be at least 1, else `nil` is
+// returned.
 func (ro *Roster) GenerateNaryTreeWithRoot(N int, root *network.ServerIdentity) *Tree {
+	if len(ro.List) == 0 || (N < 1 && len(ro.List) > 1) {
+		return nil
+	}
 	// Fetch the root node, set to the first element of the roster if
 	// root == nil.
 	rootIndex := 0
@@ -673,7 +1013,8 @@ func (ro *Roster) GenerateNaryTreeWithRoot(N int, root *network.ServerIdentity)
 }
 
 // GenerateNaryTree creates a tree where each node has N children.
-// The first element of the Roster will be the root element.
+// The first element of the Roster will be the root element. The edge cases
+// are the same as for GenerateNaryTreeWithRoot.
 func (ro *Roster) GenerateNaryTree(N int) *Tree {
 	return ro.GenerateNaryTreeWithRoot(N, nil)
 }
@@ -684,9 +1025,50 @@ func (ro *Roster) GenerateBinaryTree() *Tree {
 	return ro.GenerateNaryTree(2)
 }
 
+// OptimalBranching returns the smallest branching factor so that an n-ary
+// tree with the given number of nodes has a depth of at most maxDepth. It
+// returns 0 if no such tree exists, i.e. if maxDepth < 1 and nodes > 1.
+func OptimalBranching(nodes, maxDepth int) int {
+	if nodes <= 1 {
+		return 1
+	}
+	if maxDepth < 1 {
+		return 0
+	}
+	for bf := 1; ; bf++ {
+		// Count the nodes fitting in maxDepth levels below the root,
+		// stopping as soon as there is enough room.
+		total, level := 1, 1
+		for d := 0; d < maxDepth && total < nodes; d++ {
+			level *= bf
+			total += level
+		}
+		if total >= nodes {
+			return bf
+		}
+	}
+}
+
+// GenerateTreeWithDepth creates an n-ary tree out of the Roster with the
+// smallest branching factor keeping its depth at most maxDepth. The first
+// element of the Roster will be the root element. If no such tree exists,
+// `nil` will be returned.
+func (ro *Roster) GenerateTreeWithDepth(maxDepth int) *Tree {
+	bf := OptimalBranching(len(ro.List), maxDepth)
+	if bf == 0 {
+		return nil
+	}
+	return ro.GenerateNaryTree(bf)
+}
+
 // GenerateStar creates a star topology with the first element
 // of Roster as root, and all other elements as children of the root.
+// An empty Roster returns `nil`, and a Roster with one element returns a
+// tree with only the root.
 func (ro *Roster) GenerateStar() *Tree {
+	if len(ro.List) == 1 {
+		return ro.GenerateNaryTree(1)
+	}
 	return ro.GenerateNaryTree(len(ro.List) - 1)
 }
 
@@ -698,16 +1080,59 @@ func (ro *Roster) RandomServerIdentity() *network.ServerIdentity {
 	return ro.List[rand.Int()%len(ro.List)]
 }
 
+// WeightedRandom returns an element of the Roster chosen with a probability
+// proportional to its weight, using a cryptographically secure source. It
+// returns nil if there isn't one weight per element, if a weight is negative
+// or if all weights are 0.
+func (ro *Roster) WeightedRandom(weights []int) *network.ServerIdentity {
+	if len(ro.List) == 0 || len(weights) != len(ro.List) {
+		return nil
+	}
+	total := big.NewInt(0)
+	for _, w := range weights {
+		if w < 0 {
+			return nil
+		}
+		total.Add(total, big.NewInt(int64(w)))
+	}
+	if total.Sign() == 0 {
+		return nil
+	}
+	r, err := cryptorand.Int(cryptorand.Reader, total)
+	if err != nil {
+		panic("WeightedRandom cannot get random: " + err.Error())
+	}
+	for i, w := range weights {
+		r.Sub(r, big.NewInt(int64(w)))
+		if r.Sign() < 0 {
+			return ro.List[i]
+		}
+	}
+	return nil
+}
+
 // RandomSubset returns a new Roster which starts with root and is
 // followed by a random subset of n elements of ro, not including root.
 func (ro *Roster) RandomSubset(root *network.ServerIdentity, n int) *Roster {
+	return ro.permutedSubset(root, n, securePermute(len(ro.List)))
+}
+
+// SeededSubset is like RandomSubset, but the subset is derived from the seed,
+// so that all nodes using the same seed on the same roster get the same
+// subset. It must not be used where the subset has to be unpredictable.
+func (ro *Roster) SeededSubset(root *network.ServerIdentity, n int, seed []byte) *Roster {
+	return ro.permutedSubset(root, n, seededPermute(len(ro.List), seed))
+}
+
+// permutedSubset returns a new Roster which starts with root and is followed
+// by the first n elements of ro in the order of perm, not including root.
+func (ro *Roster) permutedSubset(root *network.ServerIdentity, n int, perm []int) *Roster {
 	if n > len(ro.List) {
 		n = len(ro.List)
 	}
 	out := make([]*network.ServerIdentity, 1, n+1)
 	out[0] = root
 
-	perm := securePermute(len(ro.List))
 	for _, p := range perm {
 		if !ro.List[p].ID.Equal(root.ID) {
 			out = append(out, ro.List[p])
@@ -742,6 +1167,14 @@ func securePermute(n int) []int {
 	return r.Perm(n)
 }
 
+// seededPermute is like rand.Perm, with the source seeded by the hash of
+// seed.
+func seededPermute(n int, seed []byte) []int {
+	h := sha256.Sum256(seed)
+	src := rand.NewSource(int64(binary.LittleEndian.Uint64(h[:8])))
+	return rand.New(src).Perm(n)
+}
+
 // IsRotation returns true if the target is a rotated (the same roster but with
 // shifted server identities) version of the receiver.
 func (ro Roster) IsRotation(target *Roster) bool {
@@ -828,6 +1261,48 @@ func (ro *Roster) Concat(sis ...*network.ServerIdentity) *Roster {
 	return NewRoster(tmpRoster.List)
 }
 
+// Remove makes a new roster using an existing one without the given
+// server identities, while preserving the order of the remaining ones.
+// Identities that are not in the roster are ignored. It returns nil if
+// no server identity is left.
+func (ro *Roster) Remove(sis ...*network.ServerIdentity) *Roster {
+	list := make([]*network.ServerIdentity, 0, len(ro.List))
+	for _, si := range ro.List {
+		removed := false
+		for _, rm := range sis {
+			if si.ID.Equal(rm.ID) {
+				removed = true
+				break
+			}
+		}
+		if !removed {
+			list = append(list, si)
+		}
+	}
+
+	return NewRoster(list)
+}
+
+// Intersect makes a new roster with the server identities of ro that are
+// also in other, in the order of ro. It returns nil if there is none.
+func (ro *Roster) Intersect(other *Roster) *Roster {
+	if other == nil {
+		return nil
+	}
+	inOther := make(map[network.ServerIdentityID]bool, len(other.List))
+	for _, si := range other.List {
+		inOther[si.ID] = true
+	}
+	var list []*network.ServerIdentity
+	for _, si := range ro.List {
+		if inOther[si.ID] {
+			list = append(list, si)
+		}
+	}
+
+	return NewRoster(list)
+}
+
 // addNary is a recursive function to create the binary tree.
 func (ro *Roster) addNary(parent *TreeNode, N, start, end int) *TreeNode {
 	if !(start <= end && end < len(ro.List)) {
@@ -863,6 +1338,9 @@ type TreeNode struct {
 	// Aggregate public key for *this* subtree,i.e. this node's public key + the
 	// aggregate of all its children's aggregate public key
 	PublicAggregateSubTree kyber.Point
+	// ViewIdentity is the ServerIdentity of this node in the view of the
+	// tree, if any. It is set by Tree.SetView.
+	ViewIdentity *network.ServerIdentity
 }
 
 // TreeNodeID identifies a given TreeNode struct in the onet framework.
@@ -927,6 +1405,16 @@ func (t *TreeNode) IsRoot() bool {
 	return t.Parent == nil
 }
 
+// Depth returns the distance to the root, following the parents, so the root
+// has a depth of 0.
+func (t *TreeNode) Depth() int {
+	depth := 0
+	for n := t.Parent; n != nil; n = n.Parent {
+		depth++
+	}
+	return depth
+}
+
 // IsInTree - verifies if the TreeNode is in the given Tree
 func (t *TreeNode) IsInTree(tree *Tree) bool {
 	root := *t
@@ -975,6 +1463,20 @@ func (t *TreeNode) Visit(firstDepth int, fn func(depth int, n *TreeNode)) {
 	}
 }
 
+// iterate calls fn on t and its subtree in depth-first order. It returns false
+// if fn did so.
+func (t *TreeNode) iterate(fn func(*TreeNode) bool) bool {
+	if !fn(t) {
+		return false
+	}
+	for _, c := range t.Children {
+		if !c.iterate(fn) {
+			return false
+		}
+	}
+	return true
+}
+
 // SubtreeCount returns how many children are attached to that
 // TreeNode.
 func (t *TreeNode) SubtreeCount() int {
@@ -1,6 +1,7 @@
 package onet
 
 import (
+	"fmt"
 	"io/ioutil"
 	"math/rand"
 	"os"
@@ -18,6 +19,28 @@ import (
 
 var prefix = "127.0.0.1:"
 
+func TestRoster_SeededSubset(t *testing.T) {
+	names := genLocalhostPeerNames(20, 0)
+	ro := genRoster(tSuite, names)
+	root := ro.List[3]
+
+	r := ro.SeededSubset(root, 5, []byte("block 1"))
+	require.Equal(t, 6, len(r.List))
+	require.Equal(t, root, r.List[0])
+	require.NotContains(t, r.List[1:], root)
+	for _, x := range r.List {
+		require.Contains(t, ro.List, x)
+	}
+
+	// Another node with the same roster and seed gets the same subset.
+	ro2 := NewRoster(append([]*network.ServerIdentity{}, ro.List...))
+	r2 := ro2.SeededSubset(root, 5, []byte("block 1"))
+	require.True(t, r.ID.Equal(r2.ID))
+
+	r3 := ro.SeededSubset(root, 5, []byte("block 2"))
+	require.False(t, r.ID.Equal(r3.ID))
+}
+
 func TestSubset(t *testing.T) {
 	// subset of 10 from roster of 1: degenerate case
 	names := genLocalhostPeerNames(1, 0)
@@ -140,6 +163,42 @@ func TestInitPeerListFromConfigFile(t *testing.T) {
 	}
 }
 
+func TestRoster_Metadata(t *testing.T) {
+	ro := genRoster(tSuite, genLocalhostPeerNames(2, 2000))
+	id, err := ro.GetID()
+	require.NoError(t, err)
+	idMeta, err := ro.GetIDWithMetadata()
+	require.NoError(t, err)
+
+	ro.List[0].Metadata = map[string]string{"region": "eu", "version": "3"}
+	ro.List[1].Metadata = map[string]string{"capacity": "10"}
+
+	tmpDir, err := ioutil.TempDir("", "tree_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	WriteTomlConfig(ro.Toml(tSuite), "identities.toml", tmpDir)
+	var decoded RosterToml
+	require.NoError(t, ReadTomlConfig(&decoded, "identities.toml", tmpDir))
+	ro2 := decoded.Roster(tSuite)
+	for i := range ro.List {
+		require.Equal(t, ro.List[i].Metadata, ro2.List[i].Metadata)
+	}
+
+	// The metadata also survives the network encoding.
+	buf, err := network.Marshal(ro)
+	require.NoError(t, err)
+	_, msg, err := network.Unmarshal(buf, tSuite)
+	require.NoError(t, err)
+	require.Equal(t, ro.List[0].Metadata, msg.(*Roster).List[0].Metadata)
+
+	id2, err := ro.GetID()
+	require.NoError(t, err)
+	require.Equal(t, id, id2)
+	idMeta2, err := ro.GetIDWithMetadata()
+	require.NoError(t, err)
+	require.NotEqual(t, idMeta, idMeta2)
+}
+
 // Test initialisation of new random tree from a peer-list
 
 // Test initialisation of new graph from config-file using a peer-list
@@ -200,6 +259,51 @@ func TestUnMarshalTree(t *testing.T) {
 	}
 }
 
+func TestTree_Validate(t *testing.T) {
+	names := genLocalhostPeerNames(7, 2000)
+	ro := genRoster(tSuite, names)
+	other := genRoster(tSuite, genLocalhostPeerNames(1, 3000))
+	check := func(msg string, corrupt func(tree *Tree)) {
+		tree := ro.GenerateBinaryTree()
+		require.NoError(t, tree.Validate())
+		corrupt(tree)
+		err := tree.Validate()
+		require.Error(t, err)
+		require.Contains(t, err.Error(), msg)
+	}
+
+	check("doesn't point back", func(tree *Tree) {
+		tree.Root.Children[0].Children[1].Parent = tree.Root
+	})
+	check("doesn't point back", func(tree *Tree) {
+		tree.Root.Children[0].Children[1].Parent = nil
+		tree.Root.Children[0].Children[1].ServerIdentity = nil
+	})
+	check("has no ServerIdentity", func(tree *Tree) {
+		tree.Root.Children[0].Children[1].ServerIdentity = nil
+	})
+	check("appears twice", func(tree *Tree) {
+		tree.Root.Children[1].Children[0].ID = tree.Root.Children[0].ID
+	})
+	check("wrong RosterIndex", func(tree *Tree) {
+		tree.Root.Children[1].RosterIndex = 0
+	})
+	check("not in the roster", func(tree *Tree) {
+		tree.Root.Children[1].ServerIdentity = other.List[0]
+	})
+
+	// The duplicate IDs go through marshaling.
+	tree := ro.GenerateBinaryTree()
+	tree.Root.Children[1].ID = tree.Root.Children[0].ID
+	buf, err := tree.Marshal()
+	require.NoError(t, err)
+	tree, err = NewTreeFromMarshal(tSuite, buf, ro)
+	require.NoError(t, err)
+	err = tree.Validate()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), tree.Root.Children[0].ID.String())
+}
+
 func TestGetNode(t *testing.T) {
 	tree, _ := genLocalTree(10, 2000)
 	for _, tn := range tree.List() {
@@ -312,6 +416,85 @@ func TestBigNaryTree(t *testing.T) {
 	}
 }
 
+func TestTree_NodesFor(t *testing.T) {
+	names := genLocalDiffPeerNames(3, 2000)
+	peerList := genRoster(tSuite, names)
+	// 4 nodes on 3 hosts, so one host is used twice.
+	tree := peerList.GenerateBigNaryTree(3, 4)
+
+	counts := make(map[network.ServerIdentityID]int)
+	for _, tn := range tree.List() {
+		counts[tn.ServerIdentity.ID]++
+	}
+	reused := 0
+	for _, si := range peerList.List {
+		require.True(t, tree.Contains(si.ID))
+		nodes := tree.NodesFor(si.ID)
+		require.Equal(t, counts[si.ID], len(nodes))
+		for _, tn := range nodes {
+			require.True(t, tn.ServerIdentity.Equal(si))
+		}
+		if len(nodes) == 2 {
+			reused++
+			require.False(t, nodes[0] == nodes[1])
+		}
+	}
+	require.Equal(t, 1, reused)
+
+	other := network.NewServerIdentity(tSuite.Point().Pick(tSuite.RandomStream()),
+		network.NewLocalAddress("127.0.0.1:3000"))
+	require.False(t, tree.Contains(other.ID))
+	require.Empty(t, tree.NodesFor(other.ID))
+}
+
+func TestTree_Iterate(t *testing.T) {
+	names := genLocalDiffPeerNames(10, 2000)
+	peerList := genRoster(tSuite, names)
+	tree := peerList.GenerateNaryTree(3)
+	list := tree.List()
+
+	var visited []*TreeNode
+	tree.Iterate(func(tn *TreeNode) bool {
+		visited = append(visited, tn)
+		return true
+	})
+	require.Equal(t, list, visited)
+
+	// Stop after the fifth node.
+	visited = nil
+	tree.Iterate(func(tn *TreeNode) bool {
+		visited = append(visited, tn)
+		return len(visited) < 5
+	})
+	require.Equal(t, list[:5], visited)
+}
+
+func TestTree_LeavesDepth(t *testing.T) {
+	names := genLocalDiffPeerNames(10, 2000)
+	peerList := genRoster(tSuite, names)
+	tree := peerList.GenerateNaryTree(3)
+
+	leaves := tree.Leaves()
+	require.Equal(t, 7, len(leaves))
+	var want []*TreeNode
+	for _, tn := range tree.List() {
+		if tn.IsLeaf() {
+			want = append(want, tn)
+		}
+	}
+	require.Equal(t, want, leaves)
+
+	tree.Root.Visit(0, func(d int, tn *TreeNode) {
+		require.Equal(t, d, tn.Depth())
+	})
+	require.Equal(t, tree.Depth(), leaves[0].Depth())
+
+	single := genRoster(tSuite, names[:1]).GenerateNaryTree(3)
+	require.NotNil(t, single.Leaves())
+	require.Empty(t, single.Leaves())
+	require.Equal(t, 0, single.Root.Depth())
+}
+
 func TestTreeIsColored(t *testing.T) {
 	names := genLocalPeerName(2, 2)
 	peerList := genRoster(tSuite, names)
@@ -400,6 +583,38 @@ func TestTreeComputeSubtreeAggregate(t *testing.T) {
 
 }
 
+func TestTree_Path(t *testing.T) {
+	names := genLocalDiffPeerNames(7, 2000)
+	tree := genRoster(tSuite, names).GenerateBinaryTree()
+	root := tree.Root
+	left, right := root.Children[0], root.Children[1]
+	a, b := left.Children[1], right.Children[0]
+
+	path, err := tree.Path(a.ID, b.ID)
+	require.NoError(t, err)
+	require.Equal(t, []*TreeNode{a, left, root, right, b}, path)
+
+	lca, err := tree.CommonAncestor(a.ID, left.Children[0].ID)
+	require.NoError(t, err)
+	require.Equal(t, left, lca)
+	path, err = tree.Path(a.ID, left.Children[0].ID)
+	require.NoError(t, err)
+	require.Equal(t, []*TreeNode{a, left, left.Children[0]}, path)
+
+	path, err = tree.Path(root.ID, b.ID)
+	require.NoError(t, err)
+	require.Equal(t, []*TreeNode{root, right, b}, path)
+
+	path, err = tree.Path(a.ID, a.ID)
+	require.NoError(t, err)
+	require.Equal(t, []*TreeNode{a}, path)
+
+	_, err = tree.Path(a.ID, TreeNodeID{})
+	require.Error(t, err)
+	_, err = tree.Path(TreeNodeID{}, a.ID)
+	require.Error(t, err)
+}
+
 func TestTree_BinaryMarshaler(t *testing.T) {
 	tree, _ := genLocalTree(5, 2000)
 	b, err := tree.BinaryMarshaler()
@@ -416,6 +631,56 @@ func TestTree_BinaryMarshaler(t *testing.T) {
 	log.Lvl1(tree2.Dump())
 }
 
+func TestTree_SetView(t *testing.T) {
+	tree, _ := genLocalTree(5, 2000)
+	_, view := genLocalTree(5, 3000)
+	other, _ := genLocalTree(4, 4000)
+
+	require.Error(t, tree.SetView(nil))
+	require.Error(t, tree.SetView(other.Roster))
+	require.NoError(t, tree.SetView(view))
+	for _, tn := range tree.List() {
+		require.True(t, view.List[tn.RosterIndex].Equal(tn.ViewIdentity))
+	}
+
+	b, err := tree.BinaryMarshaler()
+	require.NoError(t, err)
+	tree2 := &Tree{}
+	require.NoError(t, tree2.BinaryUnmarshaler(tSuite, b))
+	require.True(t, tree.Equal(tree2))
+	require.True(t, tree2.View.ID.Equal(view.ID))
+	require.True(t, tree.Root.ViewIdentity.Equal(tree2.Root.ViewIdentity))
+}
+
+func TestOptimalBranching(t *testing.T) {
+	require.Equal(t, 1, OptimalBranching(1, 0))
+	require.Equal(t, 0, OptimalBranching(2, 0))
+	require.Equal(t, 1, OptimalBranching(5, 4))
+	require.Equal(t, 4, OptimalBranching(5, 1))
+	require.Equal(t, 2, OptimalBranching(7, 2))
+	require.Equal(t, 3, OptimalBranching(8, 2))
+	require.Equal(t, 10, OptimalBranching(1000, 3))
+
+	for _, c := range []struct{ nodes, maxDepth int }{
+		{1, 0}, {2, 1}, {5, 1}, {7, 2}, {8, 2}, {20, 2}, {20, 3}, {100, 3}, {100, 10},
+	} {
+		_, ro := genLocalTree(c.nodes, 2000)
+		tree := ro.GenerateTreeWithDepth(c.maxDepth)
+		require.NotNil(t, tree)
+		require.Equal(t, c.nodes, tree.Size())
+		require.True(t, tree.Depth() <= c.maxDepth,
+			"%d nodes: depth %d > %d", c.nodes, tree.Depth(), c.maxDepth)
+		bf := OptimalBranching(c.nodes, c.maxDepth)
+		if bf > 1 {
+			smaller := ro.GenerateNaryTree(bf - 1)
+			require.True(t, smaller.Depth() > c.maxDepth)
+		}
+	}
+
+	_, ro := genLocalTree(3, 2000)
+	require.Nil(t, ro.GenerateTreeWithDepth(0))
+}
+
 func TestTreeNode_SubtreeCount(t *testing.T) {
 	tree, _ := genLocalTree(15, 2000)
 	if tree.Root.SubtreeCount() != 14 {
@@ -555,6 +820,37 @@ func TestRoster_GenerateNaryTreeWithRoot(t *testing.T) {
 	}
 }
 
+func TestRoster_GenerateEdgeCases(t *testing.T) {
+	empty := &Roster{}
+	require.Nil(t, empty.GenerateNaryTree(2))
+	require.Nil(t, empty.GenerateBinaryTree())
+	require.Nil(t, empty.GenerateStar())
+	require.Nil(t, empty.GenerateBigNaryTree(2, 3))
+
+	single := genRoster(tSuite, genLocalhostPeerNames(1, 2000))
+	trees := []*Tree{
+		single.GenerateNaryTree(2),
+		single.GenerateNaryTree(0),
+		single.GenerateBinaryTree(),
+		single.GenerateStar(),
+		single.GenerateBigNaryTree(2, 1),
+		single.GenerateBigNaryTree(0, 1),
+	}
+	for _, tree := range trees {
+		require.NotNil(t, tree)
+		require.Equal(t, 1, tree.Size())
+		require.True(t, tree.Root.ServerIdentity.Equal(single.List[0]))
+		require.Empty(t, tree.Root.Children)
+	}
+	require.Nil(t, single.GenerateBigNaryTree(2, 0))
+
+	// Several nodes need a branching factor of at least one.
+	roster := genRoster(tSuite, genLocalhostPeerNames(3, 2000))
+	require.Nil(t, roster.GenerateNaryTree(0))
+	require.Nil(t, roster.GenerateBigNaryTree(0, 3))
+	require.Equal(t, 3, roster.GenerateStar().Size())
+}
+
 func TestRoster_Publics(t *testing.T) {
 	_, roster := genLocalTree(5, 2000)
 	agg := roster.Publics()
@@ -629,6 +925,60 @@ func TestRoster_Concat(t *testing.T) {
 	require.Equal(t, len(r1.List), len(r.List))
 }
 
+func TestTree_DumpDot(t *testing.T) {
+	tree, _ := genLocalTree(3, 2000)
+	dot := tree.DumpDot()
+	require.True(t, strings.HasPrefix(dot, "digraph \""+tree.ID.String()+"\" {\n"))
+	require.True(t, strings.HasSuffix(dot, "}\n"))
+	for _, tn := range tree.List() {
+		require.Contains(t, dot, fmt.Sprintf("\t\"%s\" [label=\"%s\\n#%d\\n",
+			tn.ID, tn.ServerIdentity.Address, tn.RosterIndex))
+		if tn.Parent != nil {
+			require.Contains(t, dot, fmt.Sprintf("\t\"%s\" -> \"%s\";\n",
+				tn.Parent.ID, tn.ID))
+		}
+	}
+	require.Equal(t, len(tree.List())*2+1, strings.Count(dot, "\n"))
+}
+
+func TestRoster_Remove(t *testing.T) {
+	_, roster := genLocalTree(5, 2000)
+	id := roster.ID
+
+	r := roster.Remove(roster.List[0], roster.List[3])
+	require.Equal(t, 3, len(r.List))
+	require.Equal(t, []*network.ServerIdentity{roster.List[1], roster.List[2], roster.List[4]}, r.List)
+	require.Equal(t, 5, len(roster.List))
+	require.True(t, id.Equal(roster.ID))
+
+	// Removing unknown identities doesn't change anything.
+	_, other := genLocalTree(1, 2100)
+	r = roster.Remove(other.List[0])
+	require.Equal(t, roster.List, r.List)
+	r = roster.Remove()
+	require.Equal(t, roster.List, r.List)
+
+	require.Nil(t, roster.Remove(roster.List...))
+}
+
+func TestRoster_Intersect(t *testing.T) {
+	_, roster := genLocalTree(6, 2000)
+	r1 := NewRoster([]*network.ServerIdentity{roster.List[4], roster.List[0],
+		roster.List[2], roster.List[1]})
+	r2 := NewRoster([]*network.ServerIdentity{roster.List[1], roster.List[5],
+		roster.List[2], roster.List[4]})
+
+	r := r1.Intersect(r2)
+	require.Equal(t, []*network.ServerIdentity{roster.List[4], roster.List[2],
+		roster.List[1]}, r.List)
+	r = r2.Intersect(r1)
+	require.Equal(t, []*network.ServerIdentity{roster.List[1], roster.List[2],
+		roster.List[4]}, r.List)
+
+	require.Nil(t, NewRoster(roster.List[:3]).Intersect(NewRoster(roster.List[3:])))
+	require.Nil(t, r1.Intersect(nil))
+}
+
 func TestTreeNode_AggregatePublic(t *testing.T) {
 	tree, el := genLocalTree(7, 2000)
 	agg := el.Aggregate
@@ -656,6 +1006,81 @@ func TestRoster_ServiceAggregate(t *testing.T) {
 	require.Error(t, err)
 	_, err = ro.ServiceAggregate("ServiceTest")
 	require.NoError(t, err)
+
+	_, err = Roster{}.ServiceAggregate("ServiceTest")
+	require.Error(t, err)
+
+	bn := suites.MustFind("bn256.adapter")
+	sum := bn.Point().Null()
+	for _, si := range ro.List {
+		si.ServiceIdentities[0] = genServiceIdentity("ServiceTest", bn)
+		sum.Add(sum, si.ServiceIdentities[0].Public)
+	}
+	agg, err := ro.ServiceAggregate("ServiceTest")
+	require.NoError(t, err)
+	require.True(t, agg.Equal(sum))
+
+	// Keys of different suites can't be added together.
+	ro.List[1].ServiceIdentities[0] = genServiceIdentity("ServiceTest", tSuite)
+	_, err = ro.ServiceAggregate("ServiceTest")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "cannot aggregate")
+}
+
+func TestRoster_ValidateAddresses(t *testing.T) {
+	names := genLocalhostPeerNames(4, 2000)
+	ro := genRoster(tSuite, names)
+	require.Nil(t, ro.ValidateAddresses())
+
+	ro.List[1].Address = network.Address("tls://127.0.0.1")
+	ro.List[2].URL = "https://example.com:7771"
+	ro.List[3].URL = "example.com:7771"
+	errs := ro.ValidateAddresses()
+	require.Equal(t, 2, len(errs))
+	require.Contains(t, errs[0].Error(), "entry 1: invalid address")
+	require.Contains(t, errs[1].Error(), "entry 3: invalid URL")
+}
+
+func TestRoster_MarshalCompact(t *testing.T) {
+	ro1 := genRoster(tSuite, genLocalhostPeerNames(4, 2000))
+	ro2 := genRoster(tSuite, genLocalhostPeerNames(3, 2000))
+	known := map[RosterID]*Roster{ro1.ID: ro1, ro2.ID: ro2}
+
+	buf := ro1.MarshalCompact()
+	require.Equal(t, 16, len(buf))
+	ro, err := UnmarshalCompactRoster(buf, known)
+	require.NoError(t, err)
+	require.Equal(t, ro1, ro)
+
+	ro, err = UnmarshalCompactRoster(ro2.MarshalCompact(), known)
+	require.NoError(t, err)
+	require.Equal(t, ro2, ro)
+
+	delete(known, ro1.ID)
+	_, err = UnmarshalCompactRoster(buf, known)
+	require.Error(t, err)
+	_, err = UnmarshalCompactRoster(buf[1:], known)
+	require.Error(t, err)
+}
+
+func TestRoster_WeightedRandom(t *testing.T) {
+	ro := genRoster(tSuite, genLocalhostPeerNames(4, 2000))
+	require.Nil(t, ro.WeightedRandom([]int{1, 2, 3}))
+	require.Nil(t, ro.WeightedRandom([]int{1, 2, -3, 4}))
+	require.Nil(t, ro.WeightedRandom([]int{0, 0, 0, 0}))
+	require.Equal(t, ro.List[2], ro.WeightedRandom([]int{0, 0, 5, 0}))
+
+	weights := []int{1, 2, 0, 5}
+	const draws = 8000
+	counts := make(map[network.ServerIdentityID]int)
+	for i := 0; i < draws; i++ {
+		counts[ro.WeightedRandom(weights).ID]++
+	}
+	for i, si := range ro.List {
+		expected := float64(draws*weights[i]) / 8
+		require.InDelta(t, expected, float64(counts[si.ID]), draws*0.03,
+			"frequency of entry %d", i)
+	}
 }
 
 // BenchmarkTreeMarshal will be the benchmark for the conversion between TreeMarshall and Tree
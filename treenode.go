@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"reflect"
 	"sync"
+	"time"
 
 	"go.dedis.ch/kyber/v3"
 	"go.dedis.ch/onet/v3/log"
@@ -33,9 +34,24 @@ type TreeNodeInstance struct {
 	instance ProtocolInstance
 	// aggregate messages in order to dispatch them at once in the protocol
 	// instance
-	msgQueue map[network.MessageTypeID][]*ProtocolMsg
+	msgQueue    map[network.MessageTypeID][]*ProtocolMsg
+	msgQueueMut sync.Mutex
+	// maximum time to wait for all children before dispatching a partial
+	// aggregate, and the corresponding running timers
+	aggregateTimeouts map[network.MessageTypeID]time.Duration
+	aggregateTimers   map[network.MessageTypeID]*time.Timer
+	// if > 0, maximum number of messages waiting to be aggregated
+	maxAggregation int
 	// done callback
 	onDoneCallback func() bool
+	// if not nil, checks the messages before they are dispatched
+	msgVerifier    func(*network.ServerIdentity, network.MessageTypeID, []byte) error
+	msgVerifierMut sync.Mutex
+	// ring buffer of the last messages received, if enabled
+	msgLog     []MsgRecord
+	msgLogSize int
+	msgLogNext int
+	msgLogMut  sync.Mutex
 	// queue holding msgs
 	msgDispatchQueue []*ProtocolMsg
 	// locking for msgqueue
@@ -44,6 +60,15 @@ type TreeNodeInstance struct {
 	msgDispatchQueueWait chan bool
 	// whether this node is closing
 	closing bool
+	// pool dispatching the messages, if nil the node has its own go-routine
+	pool *dispatchPool
+	// whether the node is currently in the queue of the pool
+	poolScheduled bool
+	// message-types that have to be dispatched before the key message-type,
+	// and the message-types dispatched so far. Protected by
+	// msgDispatchQueueMutex.
+	orderBefore map[network.MessageTypeID][]network.MessageTypeID
+	orderSeen   map[network.MessageTypeID]bool
 
 	protoIO MessageProxy
 
@@ -52,6 +77,13 @@ type TreeNodeInstance struct {
 	config    *GenericConfig
 	sentTo    map[TreeNodeID]bool
 	configMut sync.Mutex
+	// the time by which the node must be done, and the timer stopping it
+	// once it is passed, protected by configMut
+	deadline      time.Time
+	deadlineTimer *time.Timer
+	// if > 0, maximum number of messages sent at the same time by the
+	// parallel sending methods
+	maxParallelSends int
 
 	// used for the CounterIO interface
 	tx safeAdder
@@ -97,13 +129,22 @@ func newTreeNodeInstance(o *Overlay, tok *Token, tn *TreeNode, io MessageProxy)
 		handlers:             make(map[network.MessageTypeID]interface{}),
 		messageTypeFlags:     make(map[network.MessageTypeID]uint32),
 		msgQueue:             make(map[network.MessageTypeID][]*ProtocolMsg),
+		aggregateTimeouts:    make(map[network.MessageTypeID]time.Duration),
+		aggregateTimers:      make(map[network.MessageTypeID]*time.Timer),
+		orderBefore:          make(map[network.MessageTypeID][]network.MessageTypeID),
+		orderSeen:            make(map[network.MessageTypeID]bool),
 		treeNode:             tn,
 		msgDispatchQueue:     make([]*ProtocolMsg, 0, 1),
 		msgDispatchQueueWait: make(chan bool, 1),
 		protoIO:              io,
 		sentTo:               make(map[TreeNodeID]bool),
 	}
-	go n.dispatchMsgReader()
+	if o != nil {
+		n.pool = o.getDispatchPool()
+	}
+	if n.pool == nil {
+		go n.dispatchMsgReader()
+	}
 	return n
 }
 
@@ -159,15 +200,79 @@ func (n *TreeNodeInstance) SendTo(to *TreeNode, msg interface{}) error {
 	}
 	n.msgDispatchQueueMutex.Unlock()
 	var c *GenericConfig
-	// only sends the config once
+	var deadline time.Time
+	// only sends the config and the deadline once
 	n.configMut.Lock()
 	if !n.sentTo[to.ID] {
 		c = n.config
+		deadline = n.deadline
 		n.sentTo[to.ID] = true
 	}
 	n.configMut.Unlock()
 
-	sentLen, err := n.overlay.SendToTreeNode(n.token, to, msg, n.protoIO, c)
+	sentLen, err := n.overlay.sendToTreeNodeAt(n.token, to, to.ServerIdentity,
+		msg, n.protoIO, c, deadline)
+	n.tx.add(sentLen)
+	if err != nil {
+		if c != nil || !deadline.IsZero() {
+			// the config has to be sent with the next message
+			n.configMut.Lock()
+			n.sentTo[to.ID] = false
+			n.configMut.Unlock()
+		}
+		return xerrors.Errorf("sending: %v", err)
+	}
+	return nil
+}
+
+// SendToWithRetry does the same as SendTo, but tries again up to retries
+// times if sending fails, waiting backoff before the first new try and
+// doubling the wait for every further one. The router connects again to the
+// node for every try.
+func (n *TreeNodeInstance) SendToWithRetry(to *TreeNode, msg interface{}, retries int, backoff time.Duration) error {
+	err := n.SendTo(to, msg)
+	for attempt := 0; err != nil && attempt < retries; attempt++ {
+		n.msgDispatchQueueMutex.Lock()
+		closing := n.closing
+		n.msgDispatchQueueMutex.Unlock()
+		if closing {
+			return xerrors.Errorf("sending: %v", err)
+		}
+		log.Lvlf2("%s: couldn't send to %s, trying again in %v: %v",
+			n.ServerIdentity(), to.ServerIdentity, backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+		err = n.SendTo(to, msg)
+	}
+	if err != nil {
+		return xerrors.Errorf("sending after %d retries: %v", retries, err)
+	}
+	return nil
+}
+
+// SendToView sends to a given node using its ServerIdentity in the view of
+// the tree, as set by Tree.SetView. The config, if any, is always sent along
+// because the server in the view might not have received it yet.
+func (n *TreeNodeInstance) SendToView(to *TreeNode, msg interface{}) error {
+	if to == nil {
+		return xerrors.New("Sent to a nil TreeNode")
+	}
+	if to.ViewIdentity == nil {
+		return xerrors.New("TreeNode has no identity in a view")
+	}
+	n.msgDispatchQueueMutex.Lock()
+	if n.closing {
+		n.msgDispatchQueueMutex.Unlock()
+		return xerrors.New("is closing")
+	}
+	n.msgDispatchQueueMutex.Unlock()
+	n.configMut.Lock()
+	c := n.config
+	deadline := n.deadline
+	n.configMut.Unlock()
+
+	sentLen, err := n.overlay.sendToTreeNodeAt(n.token, to, to.ViewIdentity,
+		msg, n.protoIO, c, deadline)
 	n.tx.add(sentLen)
 	if err != nil {
 		return xerrors.Errorf("sending: %v", err)
@@ -260,6 +365,212 @@ func (n *TreeNodeInstance) RegisterChannelLength(c interface{}, length int) erro
 	return nil
 }
 
+// RegisterChannelTimeout is a compatibility-method for
+// RegisterChannelWithTimeout with the default channel length.
+func (n *TreeNodeInstance) RegisterChannelTimeout(c interface{}, timeout time.Duration) error {
+	err := n.RegisterChannelWithTimeout(c, DefaultChannelLength, timeout)
+	if err != nil {
+		return xerrors.Errorf("registering channel timeout: %v", err)
+	}
+	return nil
+}
+
+// RegisterChannelWithTimeout registers a channel of slices like
+// RegisterChannelLength, but doesn't wait forever for the messages of all
+// children: if some of them are still missing timeout after the first message
+// of a round arrived, the messages received so far are sent to the channel.
+// As the slices can't carry a flag, use IsPartialAggregate and
+// MissingChildren to know whether a slice misses some children.
+func (n *TreeNodeInstance) RegisterChannelWithTimeout(c interface{}, length int, timeout time.Duration) error {
+	cr := reflect.TypeOf(c)
+	if cr.Kind() == reflect.Ptr {
+		cr = cr.Elem()
+	}
+	if cr.Kind() != reflect.Chan || cr.Elem().Kind() != reflect.Slice {
+		return xerrors.New("Input is not channel of slices")
+	}
+	if err := n.RegisterChannelLength(c, length); err != nil {
+		return xerrors.Errorf("registering channel: %v", err)
+	}
+	typ := network.RegisterMessage(reflect.New(cr.Elem().Elem().Field(1).Type).Interface())
+	n.aggregateTimeouts[typ] = timeout
+	return nil
+}
+
+// SetMaxAggregation limits how many messages of the children are kept while
+// waiting for the others. Once max messages of a type are waiting, they are
+// dispatched right away as a partial aggregate, and a warning is logged. A
+// max of 0 or less removes the limit.
+func (n *TreeNodeInstance) SetMaxAggregation(max int) {
+	n.msgQueueMut.Lock()
+	defer n.msgQueueMut.Unlock()
+	n.maxAggregation = max
+}
+
+// RequireBefore makes sure that no message of type b is dispatched before a
+// message of type a has been dispatched. Messages of type b arriving first
+// are held in the dispatch queue, while the other messages are dispatched
+// as usual.
+func (n *TreeNodeInstance) RequireBefore(a, b network.MessageTypeID) {
+	n.msgDispatchQueueMutex.Lock()
+	defer n.msgDispatchQueueMutex.Unlock()
+	n.orderBefore[b] = append(n.orderBefore[b], a)
+	// held messages might already be in the queue
+	if len(n.msgDispatchQueue) > 0 {
+		n.notifyDispatch()
+	}
+}
+
+// SetMessageVerifier sets a function called on every message before it is
+// given to a channel or a handler, with the sender, the type and the
+// marshalled message. The messages for which it returns an error are dropped.
+// A nil verifier accepts all the messages.
+func (n *TreeNodeInstance) SetMessageVerifier(verifier func(from *network.ServerIdentity, mt network.MessageTypeID, raw []byte) error) {
+	n.msgVerifierMut.Lock()
+	defer n.msgVerifierMut.Unlock()
+	n.msgVerifier = verifier
+}
+
+// verifyMsg runs the message verifier, if any, on the message.
+func (n *TreeNodeInstance) verifyMsg(onetMsg *ProtocolMsg) error {
+	n.msgVerifierMut.Lock()
+	verifier := n.msgVerifier
+	n.msgVerifierMut.Unlock()
+	if verifier == nil {
+		return nil
+	}
+
+	raw := onetMsg.MsgSlice
+	if raw == nil {
+		var err error
+		raw, err = network.Marshal(onetMsg.Msg)
+		if err != nil {
+			return xerrors.Errorf("marshaling: %v", err)
+		}
+	}
+	return verifier(onetMsg.ServerIdentity, onetMsg.MsgType, raw)
+}
+
+// MsgRecord describes a message received by a TreeNodeInstance, as kept by
+// EnableMessageLog.
+type MsgRecord struct {
+	Type network.MessageTypeID
+	From *network.ServerIdentity
+	Size network.Size
+	Time time.Time
+}
+
+// EnableMessageLog keeps a record of the last k messages received by the node,
+// to be returned by MessageLog. This helps to find out why a protocol is
+// stuck. Messages are recorded before being verified or aggregated. A k <= 0
+// disables the log, which is the default.
+func (n *TreeNodeInstance) EnableMessageLog(k int) {
+	n.msgLogMut.Lock()
+	defer n.msgLogMut.Unlock()
+	n.msgLog = nil
+	n.msgLogNext = 0
+	n.msgLogSize = k
+	if k > 0 {
+		n.msgLog = make([]MsgRecord, 0, k)
+	}
+}
+
+// MessageLog returns the messages recorded since EnableMessageLog, oldest
+// first.
+func (n *TreeNodeInstance) MessageLog() []MsgRecord {
+	n.msgLogMut.Lock()
+	defer n.msgLogMut.Unlock()
+	ret := make([]MsgRecord, 0, len(n.msgLog))
+	ret = append(ret, n.msgLog[n.msgLogNext:]...)
+	return append(ret, n.msgLog[:n.msgLogNext]...)
+}
+
+// logMsg adds the message to the message log, if it is enabled.
+func (n *TreeNodeInstance) logMsg(onetMsg *ProtocolMsg) {
+	n.msgLogMut.Lock()
+	defer n.msgLogMut.Unlock()
+	if n.msgLogSize <= 0 {
+		return
+	}
+	rec := MsgRecord{
+		Type: onetMsg.MsgType,
+		From: onetMsg.ServerIdentity,
+		Size: onetMsg.Size,
+		Time: time.Now(),
+	}
+	if len(n.msgLog) < n.msgLogSize {
+		n.msgLog = append(n.msgLog, rec)
+		return
+	}
+	n.msgLog[n.msgLogNext] = rec
+	n.msgLogNext = (n.msgLogNext + 1) % n.msgLogSize
+}
+
+// IsPartialAggregate returns true if msgs, a slice received from a channel
+// registered with RegisterChannelWithTimeout, holds fewer messages than this
+// node has children.
+func (n *TreeNodeInstance) IsPartialAggregate(msgs interface{}) bool {
+	return n.MissingChildren(msgs) > 0
+}
+
+// MissingChildren returns how many children didn't send their message in
+// msgs, a slice received from a channel registered with
+// RegisterChannelWithTimeout. It returns 0 if msgs is not a slice.
+func (n *TreeNodeInstance) MissingChildren(msgs interface{}) int {
+	v := reflect.ValueOf(msgs)
+	if v.Kind() != reflect.Slice {
+		return 0
+	}
+	return len(n.Children()) - v.Len()
+}
+
+// AutoRegisterChannels registers all the channels of a protocol, which must be
+// a pointer to a struct embedding *TreeNodeInstance. Every exported field that
+// is a channel of structs, or of slices of structs, whose first element is a
+// *TreeNode and second element a message, is registered with RegisterChannel.
+// Nil channels are created with the default length. Other fields are ignored.
+func AutoRegisterChannels(pi ProtocolInstance) error {
+	v := reflect.ValueOf(pi)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		return xerrors.New("protocol is not a pointer to a struct")
+	}
+	v = v.Elem()
+	// The field of the embedded instance hides its TreeNodeInstance method.
+	tniField := v.FieldByName("TreeNodeInstance")
+	if !tniField.IsValid() || tniField.Type() != reflect.TypeOf(&TreeNodeInstance{}) {
+		return xerrors.New("protocol doesn't embed *TreeNodeInstance")
+	}
+	n, ok := tniField.Interface().(*TreeNodeInstance)
+	if !ok || n == nil {
+		return xerrors.New("protocol has a nil TreeNodeInstance")
+	}
+
+	treeNodeType := reflect.TypeOf(&TreeNode{})
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Field(i)
+		if !f.CanSet() || f.Kind() != reflect.Chan {
+			continue
+		}
+		el := f.Type().Elem()
+		if el.Kind() == reflect.Slice {
+			el = el.Elem()
+		}
+		if el.Kind() != reflect.Struct || el.NumField() != 2 ||
+			el.Field(0).Type != treeNodeType {
+			continue
+		}
+		c := f.Addr().Interface()
+		if !f.IsNil() {
+			c = f.Interface()
+		}
+		if err := n.RegisterChannel(c); err != nil {
+			return xerrors.Errorf("registering channel %s: %v",
+				v.Type().Field(i).Name, err)
+		}
+	}
+	return nil
+}
+
 // RegisterChannels registers a list of given channels by calling RegisterChannel above
 func (n *TreeNodeInstance) RegisterChannels(channels ...interface{}) error {
 	for _, ch := range channels {
@@ -292,17 +603,63 @@ func (n *TreeNodeInstance) RegisterChannelsLength(length int, channels ...interf
 //     - aggregation or not of messages: if you give a channel of slices, the
 //       messages will be aggregated, otherwise they will come one by one
 func (n *TreeNodeInstance) RegisterHandler(c interface{}) error {
+	ci, flags, err := checkHandler(c)
+	if err != nil {
+		return err
+	}
+	// Automatic registration of the message to the network library.
+	ptr := reflect.New(ci.Field(1).Type)
+	typ := network.RegisterMessage(ptr.Interface())
+	n.handlers[typ] = c
+	n.messageTypeFlags[typ] = flags
+	log.Lvl3("Registered handler", typ, "with flags", flags)
+	return nil
+}
+
+// RegisterHandlerForTypes registers one handler for all the message-types of
+// msgs, which are pointers to the messages. The second element of the
+// structure taken by the handler must be an interface, like interface{},
+// every message can be assigned to. The handler receives the messages
+// the same way as with RegisterHandler, and can use a type switch on the
+// second element to know which message it got.
+func (n *TreeNodeInstance) RegisterHandlerForTypes(c interface{}, msgs ...interface{}) error {
+	ci, flags, err := checkHandler(c)
+	if err != nil {
+		return err
+	}
+	field := ci.Field(1).Type
+	if field.Kind() != reflect.Interface {
+		return xerrors.New("Input-handler doesn't have an interface as message")
+	}
+	for _, msg := range msgs {
+		mt := reflect.TypeOf(msg)
+		if mt.Kind() != reflect.Ptr || !mt.Elem().AssignableTo(field) {
+			return xerrors.Errorf("message %T can't be given to the handler", msg)
+		}
+	}
+	for _, msg := range msgs {
+		typ := network.RegisterMessage(msg)
+		n.handlers[typ] = c
+		n.messageTypeFlags[typ] = flags
+		log.Lvl3("Registered handler", typ, "with flags", flags)
+	}
+	return nil
+}
+
+// checkHandler verifies that c is a message-handler and returns the structure
+// it takes as argument, and the flags of its messages.
+func checkHandler(c interface{}) (reflect.Type, uint32, error) {
 	flags := uint32(0)
 	cr := reflect.TypeOf(c)
 	// Check we have the correct channel-type
 	if cr.Kind() != reflect.Func {
-		return xerrors.New("Input is not function")
+		return nil, 0, xerrors.New("Input is not function")
 	}
 	if cr.NumOut() != 1 {
-		return xerrors.New("Need exactly one return argument of type error")
+		return nil, 0, xerrors.New("Need exactly one return argument of type error")
 	}
 	if cr.Out(0) != reflect.TypeOf((*error)(nil)).Elem() {
-		return xerrors.New("return-type of message-handler needs to be error")
+		return nil, 0, xerrors.New("return-type of message-handler needs to be error")
 	}
 	ci := cr.In(0)
 	if ci.Kind() == reflect.Slice {
@@ -310,21 +667,15 @@ func (n *TreeNodeInstance) RegisterHandler(c interface{}) error {
 		ci = ci.Elem()
 	}
 	if ci.Kind() != reflect.Struct {
-		return xerrors.New("Input is not a structure")
+		return nil, 0, xerrors.New("Input is not a structure")
 	}
 	if ci.NumField() != 2 {
-		return xerrors.New("Input is not a structure with 2 elements")
+		return nil, 0, xerrors.New("Input is not a structure with 2 elements")
 	}
 	if ci.Field(0).Type != reflect.TypeOf(&TreeNode{}) {
-		return xerrors.New("Input-handler doesn't have TreeNode as element")
+		return nil, 0, xerrors.New("Input-handler doesn't have TreeNode as element")
 	}
-	// Automatic registration of the message to the network library.
-	ptr := reflect.New(ci.Field(1).Type)
-	typ := network.RegisterMessage(ptr.Interface())
-	n.handlers[typ] = c
-	n.messageTypeFlags[typ] = flags
-	log.Lvl3("Registered handler", typ, "with flags", flags)
-	return nil
+	return ci, flags, nil
 }
 
 // RegisterHandlers registers a list of given handlers by calling RegisterHandler above
@@ -368,6 +719,20 @@ func (n *TreeNodeInstance) closeDispatch() error {
 	close(n.msgDispatchQueueWait)
 	n.msgDispatchQueueMutex.Unlock()
 	log.Lvl3("Closed node", n.Info())
+	n.msgQueueMut.Lock()
+	for mt := range n.msgQueue {
+		n.clearAggregate(mt)
+	}
+	for mt, timer := range n.aggregateTimers {
+		timer.Stop()
+		delete(n.aggregateTimers, mt)
+	}
+	n.msgQueueMut.Unlock()
+	n.configMut.Lock()
+	if n.deadlineTimer != nil {
+		n.deadlineTimer.Stop()
+	}
+	n.configMut.Unlock()
 	pni := n.ProtocolInstance()
 	if pni == nil {
 		return xerrors.New("Can't shutdown empty ProtocolInstance")
@@ -435,7 +800,8 @@ func (n *TreeNodeInstance) createValueAndVerify(t reflect.Type, msg *ProtocolMsg
 		// Check whether the sender treenode actually is the same as the node who sent it.
 		// We can trust msg.ServerIdentity, because it is written in Router.handleConn and
 		// is not writable by the sending node.
-		if msg.ServerIdentity != nil && tn != nil && !tn.ServerIdentity.Equal(msg.ServerIdentity) {
+		if msg.ServerIdentity != nil && tn != nil && !tn.ServerIdentity.Equal(msg.ServerIdentity) &&
+			(tn.ViewIdentity == nil || !tn.ViewIdentity.Equal(msg.ServerIdentity)) {
 			return m, xerrors.Errorf("ServerIdentity in the tree node referenced by the message (%v) does not match the ServerIdentity of the message originator (%v)",
 				tn.ServerIdentity, msg.ServerIdentity)
 		}
@@ -510,6 +876,13 @@ func (n *TreeNodeInstance) ProcessProtocolMsg(msg *ProtocolMsg) {
 }
 
 func (n *TreeNodeInstance) notifyDispatch() {
+	if n.pool != nil {
+		if !n.poolScheduled {
+			n.poolScheduled = true
+			n.pool.submit(n)
+		}
+		return
+	}
 	select {
 	case n.msgDispatchQueueWait <- true:
 		return
@@ -530,11 +903,9 @@ func (n *TreeNodeInstance) dispatchMsgReader() {
 			n.msgDispatchQueueMutex.Unlock()
 			return
 		}
-		if len(n.msgDispatchQueue) > 0 {
+		if msg := n.popDispatchMsg(); msg != nil {
 			log.Lvl4(n.Info(), "Read message and dispatching it",
 				len(n.msgDispatchQueue))
-			msg := n.msgDispatchQueue[0]
-			n.msgDispatchQueue = n.msgDispatchQueue[1:]
 			n.msgDispatchQueueMutex.Unlock()
 			err := n.dispatchMsgToProtocol(msg)
 			if err != nil {
@@ -552,11 +923,86 @@ func (n *TreeNodeInstance) dispatchMsgReader() {
 	}
 }
 
+// dispatchFromPool is called by a worker of the dispatch pool. It dispatches
+// one message and submits the node again if more messages are waiting, so that
+// busy instances don't starve the others.
+func (n *TreeNodeInstance) dispatchFromPool() {
+	n.msgDispatchQueueMutex.Lock()
+	var msg *ProtocolMsg
+	if !n.closing {
+		msg = n.popDispatchMsg()
+	}
+	if msg == nil {
+		n.poolScheduled = false
+		n.msgDispatchQueueMutex.Unlock()
+		return
+	}
+	n.msgDispatchQueueMutex.Unlock()
+
+	log.TraceID(n.token.RoundID[:])
+	err := n.dispatchMsgToProtocol(msg)
+	if err != nil {
+		log.Errorf("%s: error while dispatching message %s: %s",
+			n.Name(), reflect.TypeOf(msg.Msg), err)
+	}
+
+	n.msgDispatchQueueMutex.Lock()
+	if !n.closing && n.nextDispatchMsg() >= 0 {
+		n.pool.submit(n)
+	} else {
+		n.poolScheduled = false
+	}
+	n.msgDispatchQueueMutex.Unlock()
+}
+
+// nextDispatchMsg returns the index of the first message in the dispatch queue
+// that is not held back by RequireBefore, or -1 if there is none.
+// msgDispatchQueueMutex must be held by the caller.
+func (n *TreeNodeInstance) nextDispatchMsg() int {
+	for i, msg := range n.msgDispatchQueue {
+		held := false
+		for _, a := range n.orderBefore[msg.MsgType] {
+			if !n.orderSeen[a] {
+				held = true
+				break
+			}
+		}
+		if !held {
+			return i
+		}
+	}
+	return -1
+}
+
+// popDispatchMsg removes the next message to be dispatched from the queue and
+// returns it, or nil if there is none. msgDispatchQueueMutex must be held by
+// the caller.
+func (n *TreeNodeInstance) popDispatchMsg() *ProtocolMsg {
+	i := n.nextDispatchMsg()
+	if i < 0 {
+		return nil
+	}
+	msg := n.msgDispatchQueue[i]
+	if i == 0 {
+		n.msgDispatchQueue = n.msgDispatchQueue[1:]
+	} else {
+		n.msgDispatchQueue = append(n.msgDispatchQueue[:i], n.msgDispatchQueue[i+1:]...)
+	}
+	n.orderSeen[msg.MsgType] = true
+	return msg
+}
+
 // dispatchMsgToProtocol will dispatch this onet.Data to the right instance
 func (n *TreeNodeInstance) dispatchMsgToProtocol(onetMsg *ProtocolMsg) error {
 	log.Lvl3("Dispatching", onetMsg.MsgType)
 
 	n.rx.add(uint64(onetMsg.Size))
+	n.logMsg(onetMsg)
+
+	if err := n.verifyMsg(onetMsg); err != nil {
+		return xerrors.Errorf("dropping message from %v: %v",
+			onetMsg.ServerIdentity, err)
+	}
 
 	// if message comes from parent, dispatch directly
 	// if messages come from children we must aggregate them
@@ -610,26 +1056,105 @@ func (n *TreeNodeInstance) aggregate(onetMsg *ProtocolMsg) (network.MessageTypeI
 	if fromParent || !n.hasFlag(mt, AggregateMessages) {
 		return mt, []*ProtocolMsg{onetMsg}, true
 	}
-	// store the msg according to its type
-	if _, ok := n.msgQueue[mt]; !ok {
-		n.msgQueue[mt] = make([]*ProtocolMsg, 0)
-	}
-	msgs := append(n.msgQueue[mt], onetMsg)
-	n.msgQueue[mt] = msgs
-	log.Lvl4(n.ServerIdentity().Address, "received", len(msgs), "of", len(n.Children()), "messages")
+	n.msgQueueMut.Lock()
+	defer n.msgQueueMut.Unlock()
+	queued := n.msgQueue[mt]
+	log.Lvl4(n.ServerIdentity().Address, "received", len(queued)+1, "of", len(n.Children()), "messages")
 
 	// do we have everything yet or no
 	// get the node this host is in this tree
 	// OK we have all the children messages
-	if len(msgs) == len(n.Children()) {
+	if len(queued)+1 == len(n.Children()) {
 		// erase
-		delete(n.msgQueue, mt)
+		n.clearAggregate(mt)
+		return mt, append(queued, onetMsg), true
+	}
+
+	// store the msg according to its type, if the budget of the overlay
+	// allows it
+	if !n.overlay.reserveAggregation(mt, uint64(onetMsg.Size)) {
+		log.Warnf("%s: dropping message from %v as the aggregation budget "+
+			"is used", n.Name(), onetMsg.ServerIdentity)
+		return mt, nil, false
+	}
+	msgs := append(queued, onetMsg)
+	n.msgQueue[mt] = msgs
+	if n.maxAggregation > 0 && len(msgs) >= n.maxAggregation {
+		log.Warnf("%s: dispatching %d of %d messages as the maximum "+
+			"aggregation is reached", n.Name(), len(msgs), len(n.Children()))
+		n.clearAggregate(mt)
 		return mt, msgs, true
 	}
+	if timeout := n.aggregateTimeouts[mt]; timeout > 0 && len(msgs) == 1 {
+		var timer *time.Timer
+		timer = time.AfterFunc(timeout, func() {
+			n.dispatchPartialAggregate(mt, &timer)
+		})
+		n.aggregateTimers[mt] = timer
+	}
 	// no we still have to wait!
 	return mt, nil, false
 }
 
+// ChildrenResponded returns how many messages of the given type have been
+// received from the children and are waiting to be aggregated, and the total
+// number of children. It is only meaningful for message-types registered with
+// the AggregateMessages flag, and lets protocols implement their own logic
+// on partial aggregation.
+func (n *TreeNodeInstance) ChildrenResponded(mt network.MessageTypeID) (got, total int) {
+	n.msgQueueMut.Lock()
+	defer n.msgQueueMut.Unlock()
+	return len(n.msgQueue[mt]), len(n.Children())
+}
+
+// clearAggregate removes the waiting messages of the type and stops its
+// timer. msgQueueMut must be held by the caller.
+func (n *TreeNodeInstance) clearAggregate(mt network.MessageTypeID) {
+	n.overlay.releaseAggregation(mt, queuedSize(n.msgQueue[mt]))
+	delete(n.msgQueue, mt)
+	if timer := n.aggregateTimers[mt]; timer != nil {
+		timer.Stop()
+		delete(n.aggregateTimers, mt)
+	}
+}
+
+// queuedSize returns the number of bytes of the messages.
+func queuedSize(msgs []*ProtocolMsg) (size uint64) {
+	for _, msg := range msgs {
+		size += uint64(msg.Size)
+	}
+	return
+}
+
+// dispatchPartialAggregate sends the messages received so far to the channel
+// of the message-type, if the timer is still the one of the current round.
+func (n *TreeNodeInstance) dispatchPartialAggregate(mt network.MessageTypeID, timer **time.Timer) {
+	n.msgQueueMut.Lock()
+	// timer is only read with the lock, as it is set after the creation
+	if n.aggregateTimers[mt] != *timer {
+		n.msgQueueMut.Unlock()
+		return
+	}
+	delete(n.aggregateTimers, mt)
+	msgs := n.msgQueue[mt]
+	n.overlay.releaseAggregation(mt, queuedSize(msgs))
+	delete(n.msgQueue, mt)
+	n.msgQueueMut.Unlock()
+
+	n.msgDispatchQueueMutex.Lock()
+	closing := n.closing
+	n.msgDispatchQueueMutex.Unlock()
+	if closing || len(msgs) == 0 {
+		return
+	}
+	log.Lvlf2("%s: dispatching %d of %d messages after timeout", n.Name(),
+		len(msgs), len(n.Children()))
+	if err := n.dispatchChannel(msgs); err != nil {
+		log.Errorf("%s: error while dispatching partial aggregate: %v",
+			n.Name(), err)
+	}
+}
+
 // startProtocol calls the Start() on the underlying protocol which in turn will
 // initiate the first message to its children
 func (n *TreeNodeInstance) startProtocol() error {
@@ -653,6 +1178,11 @@ func (n *TreeNodeInstance) Done() {
 	n.overlay.nodeDone(n.token)
 }
 
+// IsDone returns true once Done has deleted the resources of this node.
+func (n *TreeNodeInstance) IsDone() bool {
+	return n.overlay.IsInstanceDone(n.token.ID())
+}
+
 // OnDoneCallback should be called if we want to control the Done() of the node.
 // It is used by protocols that uses others protocols inside and that want to
 // control when the final Done() should be called.
@@ -774,6 +1304,26 @@ func (n *TreeNodeInstance) Broadcast(msg interface{}) []error {
 	return errs
 }
 
+// BroadcastInParallel does the same as Broadcast, but sends the message to
+// all the nodes at the same time. Use SetMaxParallelSends to limit the number
+// of connections opened at once on very large trees.
+func (n *TreeNodeInstance) BroadcastInParallel(msg interface{}) []error {
+	var nodes []*TreeNode
+	for _, node := range n.List() {
+		if !node.Equal(n.TreeNode()) {
+			nodes = append(nodes, node)
+		}
+	}
+	return n.sendInParallel(nodes, msg)
+}
+
+// SetMaxParallelSends limits how many messages are sent at the same time by
+// BroadcastInParallel and SendToChildrenInParallel. A max of 0 or less
+// removes the limit, which is the default. It must be called before sending.
+func (n *TreeNodeInstance) SetMaxParallelSends(max int) {
+	n.maxParallelSends = max
+}
+
 // Multicast ... XXX: should probably have a parallel more robust version like "SendToChildrenInParallel"
 func (n *TreeNodeInstance) Multicast(msg interface{}, nodes ...*TreeNode) []error {
 	var errs []error
@@ -825,13 +1375,25 @@ func (n *TreeNodeInstance) SendToChildrenInParallel(msg interface{}) []error {
 	if n.IsLeaf() {
 		return nil
 	}
-	children := n.Children()
+	return n.sendInParallel(n.Children(), msg)
+}
+
+// sendInParallel sends msg to all the nodes, each one in its own go-routine,
+// and collects the errors.
+func (n *TreeNodeInstance) sendInParallel(nodes []*TreeNode, msg interface{}) []error {
 	var errs []error
 	eMut := sync.Mutex{}
 	wg := sync.WaitGroup{}
-	for _, node := range children {
+	var slots chan bool
+	if n.maxParallelSends > 0 {
+		slots = make(chan bool, n.maxParallelSends)
+	}
+	for _, node := range nodes {
 		name := node.Name()
 		wg.Add(1)
+		if slots != nil {
+			slots <- true
+		}
 		go func(n2 *TreeNode) {
 			log.TraceID(n.token.RoundID[:])
 			if err := n.SendTo(n2, msg); err != nil {
@@ -839,6 +1401,9 @@ func (n *TreeNodeInstance) SendToChildrenInParallel(msg interface{}) []error {
 				errs = append(errs, xerrors.Errorf("%s: %v", name, err))
 				eMut.Unlock()
 			}
+			if slots != nil {
+				<-slots
+			}
 			wg.Done()
 		}(node)
 	}
@@ -887,6 +1452,43 @@ func (n *TreeNodeInstance) SetConfig(c *GenericConfig) error {
 	return nil
 }
 
+// SetDeadline sets the time by which the protocol run must be done. Like the
+// config, the deadline is passed down in the first message to the other
+// nodes, and this instance and the ones created on the other nodes are
+// stopped once it is passed.
+func (n *TreeNodeInstance) SetDeadline(deadline time.Time) error {
+	n.configMut.Lock()
+	defer n.configMut.Unlock()
+	if !n.deadline.IsZero() {
+		return xerrors.New("Can't set deadline twice")
+	}
+	n.deadline = deadline
+	n.armDeadline()
+	return nil
+}
+
+// Deadline returns the time by which this instance must be done, as given
+// to SetDeadline on the root, and false if there is none.
+func (n *TreeNodeInstance) Deadline() (time.Time, bool) {
+	n.configMut.Lock()
+	defer n.configMut.Unlock()
+	return n.deadline, !n.deadline.IsZero()
+}
+
+// armDeadline starts the timer stopping the node once its deadline is
+// passed, if there is one. configMut must be held.
+func (n *TreeNodeInstance) armDeadline() {
+	if n.deadline.IsZero() || n.deadlineTimer != nil {
+		return
+	}
+	d := time.Until(n.deadline)
+	n.deadlineTimer = time.AfterFunc(d, func() {
+		log.Lvlf2("%s: deadline of %s passed, stopping it", n.Info(),
+			n.ProtocolName())
+		n.overlay.nodeDone(n.token)
+	})
+}
+
 // Rx implements the CounterIO interface
 func (n *TreeNodeInstance) Rx() uint64 {
 	return n.rx.get()
@@ -1,6 +1,7 @@
 package onet
 
 import (
+	"errors"
 	"sync"
 	"testing"
 	"time"
@@ -14,6 +15,8 @@ import (
 func init() {
 	GlobalProtocolRegister(spawnName, newSpawnProto)
 	GlobalProtocolRegister(pingPongProtoName, newPingPongProto)
+	GlobalProtocolRegister(viewProtoName, newViewProto)
+	GlobalProtocolRegister(broadcastProtoName, newBroadcastProto)
 }
 
 func TestTreeNodeInstance_KeyPairs(t *testing.T) {
@@ -173,6 +176,560 @@ func TestTreeNodeInstance_RegisterChannel(t *testing.T) {
 	log.ErrFatal(ri.dispatchChannel(msg))
 }
 
+func TestTreeNodeInstance_ChildrenResponded(t *testing.T) {
+	local := NewLocalTest(tSuite)
+	defer local.CloseAll()
+
+	_, _, tree := local.GenBigTree(4, 4, 3, true)
+	ri, err := local.NewTreeNodeInstance(tree.Root, spawnName)
+	require.NoError(t, err)
+	require.Equal(t, 3, len(ri.Children()))
+
+	var c chan []spawnMsg
+	require.NoError(t, ri.RegisterChannel(&c))
+
+	mt := network.RegisterMessage(&spawn{})
+	got, total := ri.ChildrenResponded(mt)
+	require.Equal(t, 0, got)
+	require.Equal(t, 3, total)
+
+	for _, child := range ri.Children()[:2] {
+		_, msgs, ok := ri.aggregate(&ProtocolMsg{
+			MsgType: mt,
+			From:    &Token{TreeNodeID: child.ID},
+			Msg:     &spawn{},
+		})
+		require.False(t, ok)
+		require.Nil(t, msgs)
+	}
+	got, total = ri.ChildrenResponded(mt)
+	require.Equal(t, 2, got)
+	require.Equal(t, 3, total)
+}
+
+func TestTreeNodeInstance_RegisterChannelTimeout(t *testing.T) {
+	local := NewLocalTest(tSuite)
+	defer local.CloseAll()
+
+	_, _, tree := local.GenBigTree(4, 4, 3, true)
+	ri, err := local.NewTreeNodeInstance(tree.Root, spawnName)
+	require.NoError(t, err)
+
+	var single chan spawnMsg
+	require.Error(t, ri.RegisterChannelTimeout(&single, time.Second))
+
+	var c chan []spawnMsg
+	require.NoError(t, ri.RegisterChannelWithTimeout(&c, 2, 100*time.Millisecond))
+	require.Equal(t, 2, cap(c))
+
+	// The last child never sends its message.
+	mt := network.RegisterMessage(&spawn{})
+	for i, child := range ri.Children()[:2] {
+		ri.ProcessProtocolMsg(&ProtocolMsg{
+			MsgType: mt,
+			From:    &Token{TreeNodeID: child.ID},
+			Msg:     &spawn{I: int64(i)},
+		})
+	}
+	select {
+	case msgs := <-c:
+		require.Equal(t, 2, len(msgs))
+		require.True(t, ri.IsPartialAggregate(msgs))
+		require.Equal(t, 1, ri.MissingChildren(msgs))
+	case <-time.After(5 * time.Second):
+		t.Fatal("didn't get the partial aggregate")
+	}
+	got, _ := ri.ChildrenResponded(mt)
+	require.Equal(t, 0, got)
+
+	// A complete round is not partial.
+	for i, child := range ri.Children() {
+		ri.ProcessProtocolMsg(&ProtocolMsg{
+			MsgType: mt,
+			From:    &Token{TreeNodeID: child.ID},
+			Msg:     &spawn{I: int64(i)},
+		})
+	}
+	select {
+	case msgs := <-c:
+		require.Equal(t, 3, len(msgs))
+		require.False(t, ri.IsPartialAggregate(msgs))
+		require.Equal(t, 0, ri.MissingChildren(msgs))
+	case <-time.After(5 * time.Second):
+		t.Fatal("didn't get the aggregate")
+	}
+	require.Equal(t, 0, ri.MissingChildren(nil))
+	require.Equal(t, 0, ri.MissingChildren(spawnMsg{}))
+}
+
+func TestTreeNodeInstance_SetMaxAggregation(t *testing.T) {
+	local := NewLocalTest(tSuite)
+	defer local.CloseAll()
+
+	_, _, tree := local.GenBigTree(6, 6, 5, true)
+	ri, err := local.NewTreeNodeInstance(tree.Root, spawnName)
+	require.NoError(t, err)
+	require.Equal(t, 5, len(ri.Children()))
+	ri.SetMaxAggregation(2)
+
+	var c chan []spawnMsg
+	require.NoError(t, ri.RegisterChannel(&c))
+
+	mt := network.RegisterMessage(&spawn{})
+	log.OutputToBuf()
+	defer log.OutputToOs()
+	for i, child := range ri.Children() {
+		_, msgs, ok := ri.aggregate(&ProtocolMsg{
+			MsgType: mt,
+			From:    &Token{TreeNodeID: child.ID},
+			Msg:     &spawn{I: int64(i)},
+		})
+		got, _ := ri.ChildrenResponded(mt)
+		require.True(t, got < 2)
+		if i%2 == 0 {
+			require.False(t, ok)
+			continue
+		}
+		require.True(t, ok)
+		require.Equal(t, 2, len(msgs))
+	}
+	got, _ := ri.ChildrenResponded(mt)
+	require.Equal(t, 1, got)
+	require.Contains(t, log.GetStdOut()+log.GetStdErr(), "maximum aggregation")
+}
+
+func TestOverlay_SetAggregationBudget(t *testing.T) {
+	local := NewLocalTest(tSuite)
+	defer local.CloseAll()
+
+	_, _, tree := local.GenBigTree(4, 4, 3, true)
+	o := local.Overlays[tree.Root.ServerIdentity.ID]
+	o.SetAggregationBudget(100)
+	mt := network.RegisterMessage(&spawn{})
+
+	log.OutputToBuf()
+	defer log.OutputToOs()
+	// Every instance gets the messages of two of its three children.
+	var instances []*TreeNodeInstance
+	for i := 0; i < 10; i++ {
+		ri, err := local.NewTreeNodeInstance(tree.Root, spawnName)
+		require.NoError(t, err)
+		var c chan []spawnMsg
+		require.NoError(t, ri.RegisterChannel(&c))
+		instances = append(instances, ri)
+
+		for _, child := range ri.Children()[:2] {
+			ri.aggregate(&ProtocolMsg{
+				MsgType: mt,
+				From:    &Token{TreeNodeID: child.ID},
+				Msg:     &spawn{},
+				Size:    30,
+			})
+			require.True(t, o.AggregatedBytes(mt) <= 100)
+		}
+	}
+	require.Equal(t, uint64(90), o.AggregatedBytes(mt))
+	require.Equal(t, uint64(17), o.AggregationDrops())
+	require.Contains(t, log.GetStdOut()+log.GetStdErr(), "aggregation budget")
+
+	// The message completing an aggregation is never dropped.
+	ri := instances[0]
+	_, msgs, ok := ri.aggregate(&ProtocolMsg{
+		MsgType: mt,
+		From:    &Token{TreeNodeID: ri.Children()[2].ID},
+		Msg:     &spawn{},
+		Size:    30,
+	})
+	require.True(t, ok)
+	require.Equal(t, 3, len(msgs))
+	require.Equal(t, uint64(30), o.AggregatedBytes(mt))
+
+	// Closing an instance releases its waiting messages, even if it has no
+	// protocol to shut down.
+	require.Error(t, instances[1].closeDispatch())
+	require.Equal(t, uint64(0), o.AggregatedBytes(mt))
+}
+
+type autoChannelsProto struct {
+	*TreeNodeInstance
+	SpawnChan    chan spawnMsg
+	PingPongChan chan []struct {
+		*TreeNode
+		PingPongMsg
+	}
+	Done chan bool
+}
+
+func (p *autoChannelsProto) Start() error {
+	return nil
+}
+
+func TestAutoRegisterChannels(t *testing.T) {
+	local := NewLocalTest(tSuite)
+	defer local.CloseAll()
+
+	_, _, tree := local.GenTree(3, true)
+	ri, err := local.NewTreeNodeInstance(tree.Root, spawnName)
+	require.NoError(t, err)
+
+	require.Error(t, AutoRegisterChannels(&autoChannelsProto{}))
+
+	p := &autoChannelsProto{TreeNodeInstance: ri}
+	require.NoError(t, AutoRegisterChannels(p))
+	require.NotNil(t, p.SpawnChan)
+	require.NotNil(t, p.PingPongChan)
+	require.Nil(t, p.Done)
+
+	spawnType := network.RegisterMessage(&spawn{})
+	pingPongType := network.RegisterMessage(&PingPongMsg{})
+	require.Equal(t, 2, len(ri.channels))
+	require.NotNil(t, ri.channels[spawnType])
+	require.False(t, ri.hasFlag(spawnType, AggregateMessages))
+	require.NotNil(t, ri.channels[pingPongType])
+	require.True(t, ri.hasFlag(pingPongType, AggregateMessages))
+
+	ri.ProcessProtocolMsg(&ProtocolMsg{
+		MsgType: spawnType,
+		From:    &Token{TreeNodeID: ri.treeNode.ID},
+		Msg:     &spawn{I: 3},
+	})
+	select {
+	case msg := <-p.SpawnChan:
+		require.Equal(t, int64(3), msg.M.I)
+	case <-time.After(5 * time.Second):
+		t.Fatal("didn't get the message")
+	}
+}
+
+func TestTreeNodeInstance_SetMessageVerifier(t *testing.T) {
+	local := NewLocalTest(tSuite)
+	defer local.CloseAll()
+
+	servers, _, tree := local.GenTree(3, true)
+	ri, err := local.NewTreeNodeInstance(tree.Root, spawnName)
+	require.NoError(t, err)
+	c := make(chan spawnMsg, 2)
+	require.NoError(t, ri.RegisterChannel(c))
+	spawnType := network.MessageType(&spawn{})
+
+	rejected := servers[1].ServerIdentity
+	ri.SetMessageVerifier(func(from *network.ServerIdentity, mt network.MessageTypeID, raw []byte) error {
+		require.True(t, mt.Equal(spawnType))
+		require.NotEmpty(t, raw)
+		if from.Equal(rejected) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	})
+
+	for i, child := range tree.Root.Children {
+		ri.ProcessProtocolMsg(&ProtocolMsg{
+			MsgType:        spawnType,
+			From:           &Token{TreeNodeID: child.ID},
+			ServerIdentity: servers[i+1].ServerIdentity,
+			Msg:            &spawn{I: int64(i + 1)},
+		})
+	}
+	select {
+	case msg := <-c:
+		require.Equal(t, int64(2), msg.M.I)
+	case <-time.After(5 * time.Second):
+		t.Fatal("didn't get the message")
+	}
+	select {
+	case msg := <-c:
+		t.Fatal("got a message that should have been dropped:", msg.M.I)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestTreeNodeInstance_MessageLog(t *testing.T) {
+	local := NewLocalTest(tSuite)
+	defer local.CloseAll()
+
+	servers, _, tree := local.GenTree(2, true)
+	ri, err := local.NewTreeNodeInstance(tree.Root, spawnName)
+	require.NoError(t, err)
+	cSpawn := make(chan spawnMsg, 4)
+	require.NoError(t, ri.RegisterChannel(cSpawn))
+	cView := make(chan struct {
+		*TreeNode
+		ViewMsg
+	}, 4)
+	require.NoError(t, ri.RegisterChannel(cView))
+	spawnType := network.MessageType(&spawn{})
+	viewType := network.MessageType(&ViewMsg{})
+
+	require.Empty(t, ri.MessageLog())
+	ri.EnableMessageLog(3)
+	msgs := []network.Message{&spawn{I: 1}, &ViewMsg{}, &spawn{I: 2}, &ViewMsg{}}
+	for _, msg := range msgs {
+		ri.ProcessProtocolMsg(&ProtocolMsg{
+			MsgType:        network.MessageType(msg),
+			From:           &Token{TreeNodeID: tree.Root.Children[0].ID},
+			ServerIdentity: servers[1].ServerIdentity,
+			Msg:            msg,
+			Size:           10,
+		})
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-cSpawn:
+		case <-time.After(5 * time.Second):
+			t.Fatal("didn't get the spawn message")
+		}
+		select {
+		case <-cView:
+		case <-time.After(5 * time.Second):
+			t.Fatal("didn't get the view message")
+		}
+	}
+
+	log := ri.MessageLog()
+	require.Equal(t, 3, len(log))
+	for i, mt := range []network.MessageTypeID{viewType, spawnType, viewType} {
+		require.True(t, log[i].Type.Equal(mt))
+		require.True(t, log[i].From.Equal(servers[1].ServerIdentity))
+		require.Equal(t, network.Size(10), log[i].Size)
+	}
+	require.False(t, log[2].Time.Before(log[0].Time))
+
+	ri.EnableMessageLog(0)
+	require.Empty(t, ri.MessageLog())
+}
+
+func TestTreeNodeInstance_RequireBefore(t *testing.T) {
+	local := NewLocalTest(tSuite)
+	defer local.CloseAll()
+
+	servers, _, tree := local.GenTree(2, true)
+	ri, err := local.NewTreeNodeInstance(tree.Root, spawnName)
+	require.NoError(t, err)
+	order := make(chan string, 2)
+	require.NoError(t, ri.RegisterHandler(func(msg spawnMsg) error {
+		order <- "spawn"
+		return nil
+	}))
+	require.NoError(t, ri.RegisterHandler(func(msg struct {
+		*TreeNode
+		ViewMsg
+	}) error {
+		order <- "view"
+		return nil
+	}))
+	ri.RequireBefore(network.MessageType(&spawn{}), network.MessageType(&ViewMsg{}))
+
+	for _, msg := range []network.Message{&ViewMsg{}, &spawn{I: 1}} {
+		ri.ProcessProtocolMsg(&ProtocolMsg{
+			MsgType:        network.MessageType(msg),
+			From:           &Token{TreeNodeID: tree.Root.Children[0].ID},
+			ServerIdentity: servers[1].ServerIdentity,
+			Msg:            msg,
+		})
+	}
+	for _, exp := range []string{"spawn", "view"} {
+		select {
+		case got := <-order:
+			require.Equal(t, exp, got)
+		case <-time.After(5 * time.Second):
+			t.Fatal("didn't get the", exp, "message")
+		}
+	}
+}
+
+func TestTreeNodeInstance_BroadcastInParallel(t *testing.T) {
+	local := NewLocalTest(tSuite)
+	defer local.CloseAll()
+
+	servers, _, tree := local.GenTree(6, true)
+	pi, err := local.CreateProtocol(broadcastProtoName, tree)
+	require.NoError(t, err)
+	bp := pi.(*broadcastProto)
+	bp.SetMaxParallelSends(2)
+	require.NoError(t, bp.Start())
+	require.Empty(t, bp.errs)
+	require.NotZero(t, bp.Tx())
+
+	got := make(map[network.ServerIdentityID]bool)
+	for range servers[1:] {
+		select {
+		case si := <-broadcastCh:
+			got[si.ID] = true
+		case <-time.After(5 * time.Second):
+			t.Fatal("didn't get all the messages")
+		}
+	}
+	for _, s := range servers[1:] {
+		require.True(t, got[s.ServerIdentity.ID])
+	}
+}
+
+func TestTreeNodeInstance_RegisterHandlerForTypes(t *testing.T) {
+	local := NewLocalTest(tSuite)
+	defer local.CloseAll()
+
+	servers, _, tree := local.GenTree(2, true)
+	ri, err := local.NewTreeNodeInstance(tree.Root, spawnName)
+	require.NoError(t, err)
+
+	require.Error(t, ri.RegisterHandlerForTypes(func(msg spawnMsg) error {
+		return nil
+	}, &spawn{}))
+	require.Error(t, ri.RegisterHandlerForTypes(func(msg struct {
+		*TreeNode
+		Msg error
+	}) error {
+		return nil
+	}, &spawn{}))
+
+	got := make(chan interface{}, 2)
+	require.NoError(t, ri.RegisterHandlerForTypes(func(msg struct {
+		*TreeNode
+		Msg interface{}
+	}) error {
+		require.NotNil(t, msg.TreeNode)
+		got <- msg.Msg
+		return nil
+	}, &spawn{}, &ViewMsg{}))
+
+	for _, msg := range []network.Message{&spawn{I: 3}, &ViewMsg{}} {
+		ri.ProcessProtocolMsg(&ProtocolMsg{
+			MsgType:        network.MessageType(msg),
+			From:           &Token{TreeNodeID: tree.Root.Children[0].ID},
+			ServerIdentity: servers[1].ServerIdentity,
+			Msg:            msg,
+		})
+	}
+	for _, exp := range []interface{}{spawn{I: 3}, ViewMsg{}} {
+		select {
+		case msg := <-got:
+			require.Equal(t, exp, msg)
+		case <-time.After(5 * time.Second):
+			t.Fatal("didn't get the message")
+		}
+	}
+}
+
+func TestTreeNodeInstance_SendToWithRetry(t *testing.T) {
+	local := NewLocalTest(tSuite)
+	defer local.CloseAll()
+
+	servers, _, tree := local.GenTree(2, true)
+	child := tree.Root.Children[0]
+	// The first connection goes to a server which is down.
+	var dials int
+	servers[0].SetAddressRewriter(func(si *network.ServerIdentity) network.Address {
+		dials++
+		if dials == 1 {
+			return network.NewLocalAddress("127.0.0.1:1")
+		}
+		return si.Address
+	})
+
+	pi, err := local.CreateProtocol(viewProtoName, tree)
+	require.NoError(t, err)
+	vp := pi.(*viewProto)
+	defer vp.Done()
+	require.Error(t, vp.SendToWithRetry(child, &ViewMsg{}, 0, 0))
+
+	dials = 0
+	require.NoError(t, vp.SendToWithRetry(child, &ViewMsg{}, 2, 10*time.Millisecond))
+	require.Equal(t, 2, dials)
+	select {
+	case si := <-viewCh:
+		require.True(t, si.Equal(servers[1].ServerIdentity))
+	case <-time.After(5 * time.Second):
+		t.Fatal("didn't get the message")
+	}
+}
+
+func TestTreeNodeInstance_PausedPeer(t *testing.T) {
+	local := NewLocalTest(tSuite)
+	defer local.CloseAll()
+
+	servers, _, tree := local.GenTree(3, true)
+	var ok, cut *TreeNode
+	for _, c := range tree.Root.Children {
+		if c.ServerIdentity.Equal(servers[2].ServerIdentity) {
+			cut = c
+		} else {
+			ok = c
+		}
+	}
+	require.NotNil(t, ok)
+	require.NotNil(t, cut)
+
+	pi, err := local.CreateProtocol(viewProtoName, tree)
+	require.NoError(t, err)
+	vp := pi.(*viewProto)
+	defer vp.Done()
+
+	// Only the edge between the root and the cut node is down.
+	servers[2].PausePeer(servers[0].ServerIdentity.ID)
+	require.NoError(t, vp.SendTo(cut, &ViewMsg{}))
+	require.NoError(t, vp.SendTo(ok, &ViewMsg{}))
+	select {
+	case si := <-viewCh:
+		require.True(t, si.Equal(ok.ServerIdentity))
+	case <-time.After(5 * time.Second):
+		t.Fatal("didn't get the message over the working edge")
+	}
+	select {
+	case <-viewCh:
+		t.Fatal("got a message over the paused edge")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	// Resuming drops the paused connection, the next message goes through
+	// a new one.
+	servers[2].ResumePeer(servers[0].ServerIdentity.ID)
+	connected := func() bool {
+		for _, si := range servers[2].ConnectedPeers() {
+			if si.Equal(servers[0].ServerIdentity) {
+				return true
+			}
+		}
+		return false
+	}
+	for connected() {
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.NoError(t, vp.SendTo(cut, &ViewMsg{}))
+	select {
+	case si := <-viewCh:
+		require.True(t, si.Equal(cut.ServerIdentity))
+	case <-time.After(5 * time.Second):
+		t.Fatal("didn't get the message after resuming")
+	}
+}
+
+func TestTreeNodeInstance_SendToView(t *testing.T) {
+	local := NewLocalTest(tSuite)
+	defer local.CloseAll()
+
+	servers := local.GenServers(4)
+	old := local.GenRosterFromHost(servers[0], servers[1])
+	view := local.GenRosterFromHost(servers[2], servers[3])
+	tree := old.GenerateStar()
+	require.NoError(t, tree.SetView(view))
+	servers[0].overlay.RegisterTree(tree)
+
+	pi, err := local.CreateProtocol(viewProtoName, tree)
+	require.NoError(t, err)
+	noView := *tree.Root
+	noView.ViewIdentity = nil
+	require.Error(t, pi.(*viewProto).SendToView(&noView, &ViewMsg{}))
+	require.NoError(t, pi.Start())
+
+	select {
+	case si := <-viewCh:
+		// The child received the message at its address in the view.
+		require.True(t, si.Equal(servers[3].ServerIdentity))
+	case <-time.After(5 * time.Second):
+		t.Fatal("didn't get the message in the view")
+	}
+}
+
 // spawnCh is used to dispatch information from a spawnProto to the test
 var spawnCh = make(chan bool)
 
@@ -275,3 +832,72 @@ func (cp *pingPongProto) Start() error {
 
 	return nil
 }
+
+// Simple protocol sending to the children in the view of the tree
+const viewProtoName = "ViewProtoTest"
+
+// viewCh gets the identity of the server on which the message arrived
+var viewCh = make(chan *network.ServerIdentity, 1)
+
+type ViewMsg struct{}
+
+type viewProto struct {
+	*TreeNodeInstance
+}
+
+func newViewProto(tn *TreeNodeInstance) (ProtocolInstance, error) {
+	vp := &viewProto{TreeNodeInstance: tn}
+	err := vp.RegisterHandler(vp.handleView)
+	return vp, err
+}
+
+func (vp *viewProto) Start() error {
+	defer vp.Done()
+	for _, c := range vp.Children() {
+		if err := vp.SendToView(c, &ViewMsg{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (vp *viewProto) handleView(msg struct {
+	*TreeNode
+	ViewMsg
+}) error {
+	defer vp.Done()
+	viewCh <- vp.Host().ServerIdentity
+	return nil
+}
+
+// Simple protocol broadcasting a message to all the nodes in parallel
+const broadcastProtoName = "BroadcastProtoTest"
+
+// broadcastCh gets the identity of the servers receiving the message
+var broadcastCh = make(chan *network.ServerIdentity, 10)
+
+type broadcastProto struct {
+	*TreeNodeInstance
+	errs []error
+}
+
+func newBroadcastProto(tn *TreeNodeInstance) (ProtocolInstance, error) {
+	bp := &broadcastProto{TreeNodeInstance: tn}
+	err := bp.RegisterHandler(bp.handleBroadcast)
+	return bp, err
+}
+
+func (bp *broadcastProto) Start() error {
+	defer bp.Done()
+	bp.errs = bp.BroadcastInParallel(&ViewMsg{})
+	return nil
+}
+
+func (bp *broadcastProto) handleBroadcast(msg struct {
+	*TreeNode
+	ViewMsg
+}) error {
+	defer bp.Done()
+	broadcastCh <- bp.Host().ServerIdentity
+	return nil
+}
@@ -12,6 +12,11 @@ type treeStorage struct {
 	trees         map[TreeID]*Tree
 	cancellations map[TreeID]chan struct{}
 	closed        bool
+	// marshals keeps the marshaled trees sent to the nodes asking for them,
+	// so that a tree is only marshaled once even if many nodes ask for it.
+	marshals map[TreeID]*TreeMarshal
+	// marshalsBuilt counts how many trees have been marshaled
+	marshalsBuilt int
 }
 
 func newTreeStorage(t time.Duration) *treeStorage {
@@ -20,6 +25,7 @@ func newTreeStorage(t time.Duration) *treeStorage {
 		trees:         make(map[TreeID]*Tree),
 		cancellations: make(map[TreeID]chan struct{}),
 		closed:        false,
+		marshals:      make(map[TreeID]*TreeMarshal),
 	}
 }
 
@@ -78,6 +84,26 @@ func (ts *treeStorage) Set(tree *Tree) {
 	ts.cancelDeletion(tree.ID)
 
 	ts.trees[tree.ID] = tree
+	delete(ts.marshals, tree.ID)
+}
+
+// getMarshal returns the marshaled tree, which is only created the first time
+// it is asked for. It returns nil if the tree is not known.
+func (ts *treeStorage) getMarshal(id TreeID) *TreeMarshal {
+	ts.Lock()
+	defer ts.Unlock()
+
+	if tm, ok := ts.marshals[id]; ok {
+		return tm
+	}
+	tree := ts.trees[id]
+	if tree == nil {
+		return nil
+	}
+	tm := tree.MakeTreeMarshal()
+	ts.marshals[id] = tm
+	ts.marshalsBuilt++
+	return tm
 }
 
 // Remove starts a timeout to remove the tree from the storage
@@ -112,6 +138,7 @@ func (ts *treeStorage) Remove(id TreeID) {
 			ts.Lock()
 			delete(ts.trees, id)
 			delete(ts.cancellations, id)
+			delete(ts.marshals, id)
 			ts.Unlock()
 		case <-c:
 			timer.Stop()
@@ -126,7 +153,8 @@ func (ts *treeStorage) GetRoster(id RosterID) *Roster {
 	defer ts.Unlock()
 
 	for _, tree := range ts.trees {
-		if tree.Roster.ID.Equal(id) {
+		// requested trees are registered without being known yet
+		if tree != nil && tree.Roster.ID.Equal(id) {
 			return tree.Roster
 		}
 	}
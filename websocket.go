@@ -2,9 +2,12 @@ package onet
 
 import (
 	"context"
+	"crypto/subtle"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/binary"
 	"fmt"
+	"net"
 	"net/http"
 	"strings"
 	"sync"
@@ -13,11 +16,33 @@ import (
 	"github.com/gorilla/websocket"
 	"go.dedis.ch/onet/v3/log"
 	"go.dedis.ch/onet/v3/network"
+	"go.dedis.ch/protobuf"
 	"golang.org/x/xerrors"
 )
 
 const certificateReloaderLeeway = 1 * time.Hour
 
+// BatchSubprotocol is the websocket subprotocol a client negotiates to send
+// batched requests: every frame then holds several requests for the same
+// path, each one prefixed by its length as a big-endian uint32. The reply
+// frame holds the replies in the same format and order, each one starting
+// with batchReplyOK followed by the reply, or batchReplyError followed by the
+// error message.
+const BatchSubprotocol = "onet-batch"
+
+const (
+	batchReplyOK byte = iota
+	batchReplyError
+)
+
+// SequencedStreamSubprotocol is the websocket subprotocol a client negotiates
+// to get numbered streaming replies, so that it can resume a stream after the
+// connection broke. The first frame of the stream starts with the sequence
+// number of the last reply the client got, or 0 for a new stream, and every
+// reply frame starts with its own sequence number. Sequence numbers are
+// big-endian uint64 and the first reply of a new stream has number 1.
+const SequencedStreamSubprotocol = "onet-seq"
+
 // CertificateReloader takes care of reloading a TLS certificate when
 // requested.
 type CertificateReloader struct {
@@ -102,14 +127,124 @@ type WebSocket struct {
 	startstop chan bool
 	started   bool
 	TLSConfig *tls.Config // can only be modified before Start is called
+	// requests taking longer than this are logged, if > 0
+	slowHandlerThreshold time.Duration
+	// whether clients can ask for compressed messages
+	compression bool
+	// open streaming connections, to be notified when shutting down
+	streams    map[*websocket.Conn]bool
+	streamsMut sync.Mutex
+	// returns the roster with the given ID if the server knows it
+	knownRoster func(RosterID) *Roster
+	// token needed to stream the log lines, disabled if empty
+	logStreamToken string
+	// TLS options overriding the ones of TLSConfig, if set
+	tlsMinVersion   uint16
+	tlsCipherSuites []uint16
+	// rate limiters of the requests of the clients, by service
+	rateLimiters map[string]*rateLimiter
 	sync.Mutex
 }
 
+// RateLimitCloseCode is the websocket close code sent to a client whose
+// requests exceed the rate limit of the service, see Server.SetRateLimit.
+const RateLimitCloseCode = 4290
+
+// maxRateLimitClients is the number of clients above which a rate limiter
+// forgets the clients that used none of their burst.
+const maxRateLimitClients = 10000
+
+// rateLimiter is a token bucket for every client IP: a client can send burst
+// requests at once, and then rate requests per second.
+type rateLimiter struct {
+	rate    float64
+	burst   float64
+	buckets map[string]*tokenBucket
+	sync.Mutex
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// allow takes n tokens from the bucket of the client, if there are enough
+// left, one for every request.
+func (rl *rateLimiter) allow(client string, n int, now time.Time) bool {
+	rl.Lock()
+	defer rl.Unlock()
+	b, ok := rl.buckets[client]
+	if !ok {
+		if len(rl.buckets) >= maxRateLimitClients {
+			rl.forgetIdle(now)
+		}
+		b = &tokenBucket{tokens: rl.burst, last: now}
+		rl.buckets[client] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * rl.rate
+	if b.tokens > rl.burst {
+		b.tokens = rl.burst
+	}
+	b.last = now
+	if b.tokens < float64(n) {
+		return false
+	}
+	b.tokens -= float64(n)
+	return true
+}
+
+// forgetIdle removes the buckets that are full again. The lock must be held
+// by the caller.
+func (rl *rateLimiter) forgetIdle(now time.Time) {
+	for client, b := range rl.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*rl.rate >= rl.burst {
+			delete(rl.buckets, client)
+		}
+	}
+}
+
+// verifyRosterPath is the path of the VerifyRoster request, answered for
+// every service. The dot keeps it apart from the paths of the services.
+const verifyRosterPath = "onet.VerifyRoster"
+
+// logStreamPath is the path of the LogStream request, answered for every
+// service once enabled with SetLogStream.
+const logStreamPath = "onet.LogStream"
+
+// DefaultTLSMinVersion is the minimum TLS version accepted by the websocket,
+// unless set in TLSConfig or with SetTLSOptions.
+const DefaultTLSMinVersion = tls.VersionTLS12
+
+// DefaultTLSCipherSuites are the cipher suites accepted by the websocket for
+// TLS 1.2, unless set in TLSConfig or with SetTLSOptions. They all have
+// forward secrecy and authenticated encryption. The cipher suites of TLS 1.3
+// cannot be configured.
+var DefaultTLSCipherSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+}
+
 // NewWebSocket opens a webservice-listener at the given si.URL.
 func NewWebSocket(si *network.ServerIdentity) *WebSocket {
 	w := &WebSocket{
 		services:  make(map[string]Service),
 		startstop: make(chan bool),
+		streams:   make(map[*websocket.Conn]bool),
 	}
 	webHost, err := getWSHostPort(si, true)
 	log.ErrFatal(err)
@@ -171,7 +306,7 @@ func (w *WebSocket) Listening() bool {
 func (w *WebSocket) start() {
 	w.Lock()
 	w.started = true
-	w.server.TLSConfig = w.TLSConfig
+	w.server.TLSConfig = w.tlsConfig()
 	log.Lvl2("Starting to listen on", w.server.Addr)
 	started := make(chan bool)
 	go func() {
@@ -188,6 +323,107 @@ func (w *WebSocket) start() {
 	w.startstop <- true
 }
 
+// SetTLSOptions sets the minimum TLS version and the TLS 1.2 cipher suites
+// accepted by the websocket, e.g. tls.VersionTLS13 to comply with a policy.
+// A version of 0 or nil cipher suites keep the ones of TLSConfig, or
+// DefaultTLSMinVersion and DefaultTLSCipherSuites if TLSConfig doesn't set
+// them. Like TLSConfig, it must be called before the server is started.
+func (w *WebSocket) SetTLSOptions(minVersion uint16, cipherSuites []uint16) {
+	w.Lock()
+	defer w.Unlock()
+	w.tlsMinVersion = minVersion
+	w.tlsCipherSuites = cipherSuites
+}
+
+// tlsConfig returns a copy of TLSConfig with the options of SetTLSOptions,
+// or nil if there is no TLSConfig. It must be called with the lock held.
+func (w *WebSocket) tlsConfig() *tls.Config {
+	if w.TLSConfig == nil {
+		return nil
+	}
+	cfg := w.TLSConfig.Clone()
+	if w.tlsMinVersion != 0 {
+		cfg.MinVersion = w.tlsMinVersion
+	} else if cfg.MinVersion == 0 {
+		cfg.MinVersion = DefaultTLSMinVersion
+	}
+	if w.tlsCipherSuites != nil {
+		cfg.CipherSuites = w.tlsCipherSuites
+	} else if cfg.CipherSuites == nil {
+		cfg.CipherSuites = DefaultTLSCipherSuites
+	}
+	return cfg
+}
+
+// SetSlowHandlerThreshold makes the websocket log a warning with the service,
+// the path and the duration of every client request whose processing takes
+// longer than d. The request is not aborted. A value of 0 disables the
+// warnings.
+func (w *WebSocket) SetSlowHandlerThreshold(d time.Duration) {
+	w.Lock()
+	defer w.Unlock()
+	w.slowHandlerThreshold = d
+}
+
+// SetCompression lets the clients asking for it, like the Client with
+// EnableCompression, use the permessage-deflate extension to compress the
+// messages. The other clients are not affected. It is disabled by default,
+// as some clients, like the mobile app on iOS, don't support it well.
+func (w *WebSocket) SetCompression(enable bool) {
+	w.Lock()
+	defer w.Unlock()
+	w.compression = enable
+}
+
+func (w *WebSocket) getCompression() bool {
+	w.Lock()
+	defer w.Unlock()
+	return w.compression
+}
+
+// SetLogStream lets the clients knowing the token stream the log lines of
+// the server, e.g. with Client.StreamLogs, for live debugging. The lines of
+// the levels up to the one asked by the client are sent, capped at the
+// debug-level of the server: a client can't get more details than the server
+// logs itself. The lines are dropped if the client is too slow to read them.
+// An empty token disables it, which is the default.
+func (w *WebSocket) SetLogStream(token string) {
+	w.Lock()
+	defer w.Unlock()
+	w.logStreamToken = token
+}
+
+func (w *WebSocket) getLogStreamToken() string {
+	w.Lock()
+	defer w.Unlock()
+	return w.logStreamToken
+}
+
+func (w *WebSocket) setRateLimit(service string, rate float64, burst int) {
+	w.Lock()
+	defer w.Unlock()
+	if rate <= 0 {
+		delete(w.rateLimiters, service)
+		return
+	}
+	if w.rateLimiters == nil {
+		w.rateLimiters = make(map[string]*rateLimiter)
+	}
+	w.rateLimiters[service] = newRateLimiter(rate, burst)
+}
+
+func (w *WebSocket) getRateLimiter(service string) *rateLimiter {
+	w.Lock()
+	defer w.Unlock()
+	return w.rateLimiters[service]
+}
+
+func (w *WebSocket) getSlowHandlerThreshold() time.Duration {
+	w.Lock()
+	defer w.Unlock()
+	return w.slowHandlerThreshold
+}
+
 // registerService stores a service to the given path. All requests to that
 // path and it's sub-endpoints will be forwarded to ProcessClientRequest.
 func (w *WebSocket) registerService(service string, s Service) error {
@@ -199,6 +435,7 @@ func (w *WebSocket) registerService(service string, s Service) error {
 	h := &wsHandler{
 		service:     s,
 		serviceName: service,
+		webSocket:   w,
 	}
 	w.mux.Handle(fmt.Sprintf("/%s/", service), h)
 	return nil
@@ -213,6 +450,16 @@ func (w *WebSocket) stop() {
 	}
 	log.Lvl3("Stopping", w.server.Addr)
 
+	// The streaming connections are hijacked, so they are not closed by
+	// Shutdown. Tell the clients it's a planned shutdown and not a crash.
+	w.streamsMut.Lock()
+	for ws := range w.streams {
+		ws.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down"),
+			time.Now().Add(time.Millisecond*500))
+	}
+	w.streamsMut.Unlock()
+
 	d := time.Now().Add(100 * time.Millisecond)
 	ctx, cancel := context.WithDeadline(context.Background(), d)
 	w.server.Shutdown(ctx)
@@ -222,10 +469,124 @@ func (w *WebSocket) stop() {
 	w.started = false
 }
 
+// verifyRoster answers a VerifyRoster request.
+func (w *WebSocket) verifyRoster(buf []byte) ([]byte, error) {
+	req := &VerifyRoster{}
+	if err := protobuf.Decode(buf, req); err != nil {
+		return nil, xerrors.Errorf("decoding: %v", err)
+	}
+	reply := &VerifyRosterReply{}
+	if w.knownRoster != nil {
+		if ro := w.knownRoster(req.RosterID); ro != nil {
+			reply.Known = true
+			id, err := ro.GetID()
+			if err != nil {
+				return nil, xerrors.Errorf("roster id: %v", err)
+			}
+			reply.Matching = id.Equal(req.ListID)
+		}
+	}
+	buf, err := protobuf.Encode(reply)
+	if err != nil {
+		return nil, xerrors.Errorf("encoding: %v", err)
+	}
+	return buf, nil
+}
+
+// streamLogs answers a LogStream request by registering a logger sending the
+// lines to the returned channel, until the inputs are closed.
+func (w *WebSocket) streamLogs(buf []byte, inputs chan []byte) (chan []byte, error) {
+	req := &LogStream{}
+	if err := protobuf.Decode(buf, req); err != nil {
+		return nil, xerrors.Errorf("decoding: %v", err)
+	}
+	token := w.getLogStreamToken()
+	if token == "" {
+		return nil, xerrors.New("log streaming is disabled")
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(req.Token)) != 1 {
+		return nil, xerrors.New("wrong log streaming token")
+	}
+
+	tap := &logTap{
+		info:  &log.LoggerInfo{DebugLvl: req.Level},
+		lines: make(chan []byte, 100),
+	}
+	key := log.RegisterLogger(tap)
+	go func() {
+		// The inputs are closed when the client goes away.
+		for range inputs {
+		}
+		log.UnregisterLogger(key)
+	}()
+	return tap.lines, nil
+}
+
+// logTap is a logger sending the encoded lines to a streaming client.
+type logTap struct {
+	info  *log.LoggerInfo
+	lines chan []byte
+}
+
+// Log is called with the lock of the log package held, so it must neither
+// block nor log.
+func (lt *logTap) Log(level int, msg string) {
+	buf, err := protobuf.Encode(&LogStreamReply{Level: level, Msg: msg})
+	if err != nil {
+		return
+	}
+	select {
+	case lt.lines <- buf:
+	default:
+	}
+}
+
+func (lt *logTap) Close() {}
+
+// LimitedToStd implements log.StdLimited, so a client never gets more than
+// the server logs.
+func (lt *logTap) LimitedToStd() bool {
+	return true
+}
+
+func (lt *logTap) GetLoggerInfo() *log.LoggerInfo {
+	return lt.info
+}
+
+// addStream registers a streaming connection to be closed on shutdown.
+func (w *WebSocket) addStream(ws *websocket.Conn) {
+	w.streamsMut.Lock()
+	defer w.streamsMut.Unlock()
+	w.streams[ws] = true
+}
+
+// removeStream removes a connection added with addStream.
+func (w *WebSocket) removeStream(ws *websocket.Conn) {
+	w.streamsMut.Lock()
+	defer w.streamsMut.Unlock()
+	delete(w.streams, ws)
+}
+
+// ClientCertCN returns the common name of the client certificate of a request
+// to a websocket requiring them, as set up by the app with
+// WebSocketTLSRequireClientCert. Services can use it in their
+// ProcessClientRequest to authorize the client. Only the certificates
+// verified against the client CAs are taken into account.
+func ClientCertCN(req *http.Request) (string, error) {
+	if req == nil || req.TLS == nil {
+		return "", xerrors.New("not a TLS connection")
+	}
+	if len(req.TLS.VerifiedChains) == 0 || len(req.TLS.VerifiedChains[0]) == 0 {
+		return "", xerrors.New("no verified client certificate")
+	}
+	return req.TLS.VerifiedChains[0][0].Subject.CommonName, nil
+}
+
 // Pass the request to the websocket.
 type wsHandler struct {
 	serviceName string
 	service     Service
+	webSocket   *WebSocket
 }
 
 // Wrapper-function so that http.Requests get 'upgraded' to websockets
@@ -240,14 +601,16 @@ func (t wsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}()
 
 	u := websocket.Upgrader{
-		// The mobile app on iOS doesn't support compression well...
-		EnableCompression: false,
+		// The mobile app on iOS doesn't support compression well, so it
+		// has to be enabled with SetCompression.
+		EnableCompression: t.webSocket.getCompression(),
 		// As the website will not be served from ourselves, we
 		// need to accept _all_ origins. Cross-site scripting is
 		// required.
 		CheckOrigin: func(*http.Request) bool {
 			return true
 		},
+		Subprotocols: []string{BatchSubprotocol, SequencedStreamSubprotocol},
 	}
 	ws, err := u.Upgrade(w, r, http.Header{})
 	if err != nil {
@@ -255,6 +618,8 @@ func (t wsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	defer ws.Close()
+	batch := ws.Subprotocol() == BatchSubprotocol
+	sequenced := ws.Subprotocol() == SequencedStreamSubprotocol
 
 	// Loop for each message
 outerReadLoop:
@@ -267,15 +632,37 @@ outerReadLoop:
 		rx += len(buf)
 		n++
 
+		if rl := t.webSocket.getRateLimiter(t.serviceName); rl != nil {
+			client, _, serr := net.SplitHostPort(r.RemoteAddr)
+			if serr != nil {
+				client = r.RemoteAddr
+			}
+			// Every request of a batch counts, the frame being refused
+			// if the bucket doesn't have enough tokens for all of them.
+			requests := 1
+			if batch {
+				if reqs, err := decodeBatch(buf); err == nil && len(reqs) > 1 {
+					requests = len(reqs)
+				}
+			}
+			if !rl.allow(client, requests, time.Now()) {
+				log.Warnf("too many requests from %s to %s", client, t.serviceName)
+				ws.WriteControl(websocket.CloseMessage,
+					websocket.FormatCloseMessage(RateLimitCloseCode, "too many requests"),
+					time.Now().Add(time.Millisecond*500))
+				return
+			}
+		}
+
 		s := t.service
 		var reply []byte
 		var outChan chan []byte
 		path := strings.TrimPrefix(r.URL.Path, "/"+t.serviceName+"/")
 		log.Lvlf2("ws request from %s: %s/%s", r.RemoteAddr, t.serviceName, path)
 
-		isStreaming := false
+		isStreaming := path == logStreamPath
 		bidirectionalStreamer, ok := s.(BidirectionalStreamer)
-		if ok {
+		if ok && path != verifyRosterPath && !isStreaming {
 			isStreaming, err = bidirectionalStreamer.IsStreaming(path)
 			if err != nil {
 				log.Errorf("failed to check if it is a streaming "+
@@ -284,8 +671,35 @@ outerReadLoop:
 			}
 		}
 
+		if batch {
+			if isStreaming {
+				err = xerrors.New("streaming requests can't be batched")
+			} else {
+				reply, err = t.processBatch(r, path, buf)
+			}
+			if err != nil {
+				log.Errorf("Got an error while executing batch %s/%s: %+v",
+					t.serviceName, path, err)
+				continue
+			}
+		}
+
+		if sequenced && !isStreaming {
+			log.Errorf("only streaming requests can be sequenced: %s/%s",
+				t.serviceName, path)
+			continue
+		}
+
 		if !isStreaming {
-			reply, _, err = s.ProcessClientRequest(r, path, buf)
+			if !batch {
+				start := time.Now()
+				if path == verifyRosterPath {
+					reply, err = t.webSocket.verifyRoster(buf)
+				} else {
+					reply, _, err = s.ProcessClientRequest(r, path, buf)
+				}
+				t.checkSlowHandler(path, time.Since(start))
+			}
 			if err != nil {
 				log.Errorf("Got an error while executing %s/%s: %+v",
 					t.serviceName, path, err)
@@ -310,16 +724,44 @@ outerReadLoop:
 			continue
 		}
 
+		var seq uint64
+		if sequenced {
+			if len(buf) < 8 {
+				log.Errorf("missing sequence number in streaming request %s/%s",
+					t.serviceName, path)
+				continue
+			}
+			seq = binary.BigEndian.Uint64(buf)
+			buf = buf[8:]
+		}
+
 		clientInputs := make(chan []byte, 10)
 		clientInputs <- buf
-		outChan, err = bidirectionalStreamer.ProcessClientStreamRequest(r,
-			path, clientInputs)
+		// whether the replies are already numbered by the service
+		numbered := false
+		resumableStreamer, resumable := s.(ResumableStreamer)
+		if path == logStreamPath {
+			outChan, err = t.webSocket.streamLogs(buf, clientInputs)
+		} else if sequenced && resumable {
+			outChan, err = resumableStreamer.ProcessClientStreamRequestFrom(r,
+				path, seq, clientInputs)
+			numbered = true
+		} else if seq > 0 {
+			log.Errorf("service %s can't resume streams", t.serviceName)
+			continue
+		} else {
+			outChan, err = bidirectionalStreamer.ProcessClientStreamRequest(r,
+				path, clientInputs)
+		}
 		if err != nil {
 			log.Errorf("got an error while processing streaming "+
 				"request %s/%s: %+v", t.serviceName, path, err)
 			continue
 		}
 
+		t.webSocket.addStream(ws)
+		defer t.webSocket.removeStream(ws)
+
 		closing := make(chan bool)
 		go func() {
 			for {
@@ -343,12 +785,25 @@ outerReadLoop:
 				break outerReadLoop
 			case reply, ok := <-outChan:
 				if !ok {
-					ws.WriteControl(websocket.CloseMessage,
-						websocket.FormatCloseMessage(websocket.CloseNormalClosure, "service finished streaming"),
+					msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "service finished streaming")
+					if se, ok := s.(StreamErrorReporter); ok {
+						if err := se.StreamError(outChan); err != nil {
+							code := websocket.CloseInternalServerErr
+							if xerrors.Is(err, ErrStreamOverflow) {
+								code = StreamOverflowCloseCode
+							}
+							msg = websocket.FormatCloseMessage(code, err.Error())
+						}
+					}
+					ws.WriteControl(websocket.CloseMessage, msg,
 						time.Now().Add(time.Millisecond*500))
 					close(clientInputs)
 					return
 				}
+				if sequenced && !numbered {
+					seq++
+					reply = append(encodeSeq(seq), reply...)
+				}
 				tx += len(reply)
 
 				err = ws.SetWriteDeadline(time.Now().Add(5 * time.Minute))
@@ -382,7 +837,84 @@ outerReadLoop:
 	return
 }
 
+// checkSlowHandler logs a warning if the duration of the request is above the
+// threshold of the websocket.
+func (t wsHandler) checkSlowHandler(path string, d time.Duration) {
+	threshold := t.webSocket.getSlowHandlerThreshold()
+	if threshold > 0 && d > threshold {
+		log.Warnf("slow handler: request %s/%s took %s", t.serviceName, path, d)
+	}
+}
+
+// processBatch decodes a frame of batched requests, passes each one to the
+// service and returns the frame with all the replies.
+func (t wsHandler) processBatch(r *http.Request, path string, buf []byte) ([]byte, error) {
+	requests, err := decodeBatch(buf)
+	if err != nil {
+		return nil, xerrors.Errorf("decoding batch: %v", err)
+	}
+	replies := make([][]byte, len(requests))
+	for i, req := range requests {
+		start := time.Now()
+		reply, _, err := t.service.ProcessClientRequest(r, path, req)
+		t.checkSlowHandler(path, time.Since(start))
+		if err != nil {
+			log.Errorf("Got an error while executing %s/%s: %+v",
+				t.serviceName, path, err)
+			replies[i] = append([]byte{batchReplyError}, err.Error()...)
+			continue
+		}
+		replies[i] = append([]byte{batchReplyOK}, reply...)
+	}
+	return encodeBatch(replies), nil
+}
+
+// encodeBatch packs the messages in one frame, prefixing each of them with
+// its length.
+func encodeBatch(msgs [][]byte) []byte {
+	size := 0
+	for _, m := range msgs {
+		size += 4 + len(m)
+	}
+	buf := make([]byte, 0, size)
+	for _, m := range msgs {
+		buf = append(buf, 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(buf[len(buf)-4:], uint32(len(m)))
+		buf = append(buf, m...)
+	}
+	return buf
+}
+
+// decodeBatch splits a frame created by encodeBatch.
+func decodeBatch(buf []byte) ([][]byte, error) {
+	var msgs [][]byte
+	for len(buf) > 0 {
+		if len(buf) < 4 {
+			return nil, xerrors.New("truncated length prefix")
+		}
+		l := binary.BigEndian.Uint32(buf)
+		buf = buf[4:]
+		if uint64(len(buf)) < uint64(l) {
+			return nil, xerrors.Errorf("message of length %d doesn't fit "+
+				"in the %d remaining bytes", l, len(buf))
+		}
+		msgs = append(msgs, buf[:l])
+		buf = buf[l:]
+	}
+	return msgs, nil
+}
+
+// encodeSeq returns the sequence number as prefixed to the frames of the
+// SequencedStreamSubprotocol.
+func encodeSeq(seq uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, seq)
+	return b
+}
+
 type destination struct {
 	si   *network.ServerIdentity
 	path string
+	// the subprotocol negotiated by the connection, if any
+	subprotocol string
 }
@@ -1,7 +1,10 @@
 package onet
 
 import (
+	"context"
+	"crypto/sha256"
 	"crypto/tls"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"math/rand"
@@ -32,12 +35,24 @@ type Client struct {
 	TLSClientConfig *tls.Config
 	// whether to keep the connection
 	keep bool
-	rx   uint64
-	tx   uint64
+	// bytes read and written on the network
+	rx safeAdder
+	tx safeAdder
+	// EnableCompression asks the servers to compress the messages, which
+	// is only done if the server allows it, see WebSocket.SetCompression.
+	EnableCompression bool
 	// How long to wait for a reply
 	ReadTimeout time.Duration
 	// How long to wait to open a connection
 	HandshakeTimeout time.Duration
+	// Reconnect is how many times Send dials again a kept connection that
+	// turned out to be broken, before returning the error.
+	Reconnect int
+	// Codec encodes the messages of SendProtobuf and Stream, ProtobufCodec
+	// if nil. The servers must have registered it with RegisterCodec.
+	Codec Codec
+	// last time sending to a node failed, used by SendProtobufParallel
+	failures map[network.ServerIdentityID]time.Time
 	sync.Mutex
 }
 
@@ -48,9 +63,11 @@ func NewClient(suite network.Suite, s string) *Client {
 		service:          s,
 		connections:      make(map[destination]*websocket.Conn),
 		connectionsLock:  make(map[destination]*sync.Mutex),
+		failures:         make(map[network.ServerIdentityID]time.Time),
 		suite:            suite,
 		ReadTimeout:      time.Second * 60,
 		HandshakeTimeout: time.Second * 5,
+		Reconnect:        1,
 	}
 }
 
@@ -67,8 +84,7 @@ func (c *Client) Suite() network.Suite {
 	return c.suite
 }
 
-func (c *Client) closeSingleUseConn(dst *network.ServerIdentity, path string) {
-	dest := destination{dst, path}
+func (c *Client) closeSingleUseConn(dest destination) {
 	if !c.keep {
 		if err := c.closeConn(dest); err != nil {
 			log.Errorf("error while closing the connection to %v : %+v\n",
@@ -77,13 +93,20 @@ func (c *Client) closeSingleUseConn(dst *network.ServerIdentity, path string) {
 	}
 }
 
-func (c *Client) newConnIfNotExist(dst *network.ServerIdentity, path string) (*websocket.Conn, *sync.Mutex, error) {
+func (c *Client) newConnIfNotExist(dest destination) (*websocket.Conn, *sync.Mutex, error) {
+	conn, connLock, _, err := c.getConn(dest)
+	return conn, connLock, err
+}
+
+// getConn works like newConnIfNotExist, and also returns whether the
+// connection has just been dialed.
+func (c *Client) getConn(dest destination) (*websocket.Conn, *sync.Mutex, bool, error) {
 	var err error
+	dst, path := dest.si, dest.path
 
 	// c.Lock protects the connections and connectionsLock map
 	// c.connectionsLock is held as long as the connection is in use - to avoid that two
 	// processes send data over the same websocket concurrently.
-	dest := destination{dst, path}
 	c.Lock()
 	connLock, exists := c.connectionsLock[dest]
 	if !exists {
@@ -102,6 +125,18 @@ func (c *Client) newConnIfNotExist(dst *network.ServerIdentity, path string) (*w
 	if !connected {
 		d := &websocket.Dialer{}
 		d.TLSClientConfig = c.TLSClientConfig
+		d.EnableCompression = c.EnableCompression
+		d.NetDialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			var nd net.Dialer
+			conn, err := nd.DialContext(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			return countingConn{Conn: conn, cl: c}, nil
+		}
+		if dest.subprotocol != "" {
+			d.Subprotocols = []string{dest.subprotocol}
+		}
 
 		var serverURL string
 		var header http.Header
@@ -111,7 +146,7 @@ func (c *Client) newConnIfNotExist(dst *network.ServerIdentity, path string) (*w
 			u, err := url.Parse(dst.URL)
 			if err != nil {
 				connLock.Unlock()
-				return nil, nil, xerrors.Errorf("parsing url: %v", err)
+				return nil, nil, false, xerrors.Errorf("parsing url: %v", err)
 			}
 			if u.Scheme == "https" {
 				u.Scheme = "wss"
@@ -129,7 +164,7 @@ func (c *Client) newConnIfNotExist(dst *network.ServerIdentity, path string) (*w
 			hp, err := getWSHostPort(dst, false)
 			if err != nil {
 				connLock.Unlock()
-				return nil, nil, xerrors.Errorf("parsing port: %v", err)
+				return nil, nil, false, xerrors.Errorf("parsing port: %v", err)
 			}
 
 			var wsProtocol string
@@ -149,6 +184,10 @@ func (c *Client) newConnIfNotExist(dst *network.ServerIdentity, path string) (*w
 			header = http.Header{"Origin": []string{protocol + "://" + hp}}
 		}
 
+		if codec := c.codec(); codec != ProtobufCodec {
+			header.Set(CodecHeader, codec.Name())
+		}
+
 		// Re-try to connect in case the websocket is just about to start
 		d.HandshakeTimeout = c.HandshakeTimeout
 		for a := 0; a < network.MaxRetryConnect; a++ {
@@ -160,13 +199,19 @@ func (c *Client) newConnIfNotExist(dst *network.ServerIdentity, path string) (*w
 		}
 		if err != nil {
 			connLock.Unlock()
-			return nil, nil, xerrors.Errorf("dial: %v", err)
+			return nil, nil, false, xerrors.Errorf("dial: %v", err)
+		}
+		if conn.Subprotocol() != dest.subprotocol {
+			conn.Close()
+			connLock.Unlock()
+			return nil, nil, false, xerrors.Errorf("server doesn't support the %s subprotocol",
+				dest.subprotocol)
 		}
 		c.Lock()
 		c.connections[dest] = conn
 		c.Unlock()
 	}
-	return conn, connLock, nil
+	return conn, connLock, !connected, nil
 }
 
 // Send will marshal the message into a ClientRequest message and send it. It has a
@@ -174,22 +219,125 @@ func (c *Client) newConnIfNotExist(dst *network.ServerIdentity, path string) (*w
 // idle connection, the message is sent right away. If the current connection is busy,
 // it waits for it to be free.
 func (c *Client) Send(dst *network.ServerIdentity, path string, buf []byte) ([]byte, error) {
-	conn, connLock, err := c.newConnIfNotExist(dst, path)
+	return c.SendWithContext(context.Background(), dst, path, buf)
+}
+
+// SendWithContext does the same as Send, but stops waiting for the reply
+// once ctx is done. The connection is then closed and ctx.Err() is returned.
+// If a kept connection is found broken, it is dialed again up to
+// c.Reconnect times.
+func (c *Client) SendWithContext(ctx context.Context, dst *network.ServerIdentity, path string, buf []byte) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	dest := destination{si: dst, path: path}
+	for attempt := 0; ; attempt++ {
+		rcv, stale, err := c.sendOnce(ctx, dest, buf)
+		if err == nil || !stale || attempt >= c.Reconnect {
+			return rcv, err
+		}
+		log.Lvl3("Reconnecting to", dst.Address, "after:", err)
+	}
+}
+
+// sendOnce sends buf over the connection to dest and waits for the reply.
+// If it fails, the connection is dropped, and stale tells whether the error
+// comes from a connection kept from a previous call that was already broken.
+func (c *Client) sendOnce(ctx context.Context, dest destination, buf []byte) (rcv []byte, stale bool, err error) {
+	conn, connLock, dialed, err := c.getConn(dest)
+	if err != nil {
+		return nil, false, xerrors.Errorf("new connection: %v", err)
+	}
+	defer connLock.Unlock()
+	defer func() {
+		if err != nil {
+			c.Lock()
+			if c.connections[dest] == conn {
+				delete(c.connections, dest)
+			}
+			c.Unlock()
+			conn.Close()
+		}
+	}()
+
+	// Closing the connection is the only way to stop a blocking read.
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.Lock()
+			if c.connections[dest] == conn {
+				delete(c.connections, dest)
+			}
+			c.Unlock()
+			conn.Close()
+		case <-stop:
+		}
+	}()
+
+	defer func() {
+		c.Lock()
+		c.closeSingleUseConn(dest)
+		c.Unlock()
+	}()
+
+	log.Lvlf4("Sending %x to %s/%s", buf, c.service, dest.path)
+	if err := conn.WriteMessage(websocket.BinaryMessage, buf); err != nil {
+		return nil, !dialed, xerrors.Errorf("connection write: %v", err)
+	}
+
+	if err := conn.SetReadDeadline(time.Now().Add(c.ReadTimeout)); err != nil {
+		return nil, false, xerrors.Errorf("read deadline: %v", err)
+	}
+	_, rcv, err = conn.ReadMessage()
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, false, ctx.Err()
+		}
+		return nil, !dialed && isBrokenConn(err),
+			xerrors.Errorf("connection read: %v", err)
+	}
+	return rcv, false, nil
+}
+
+// isBrokenConn returns true if the read error comes from a connection that
+// was lost, and not from a timeout or the server closing it on purpose, in
+// which case the request must not be sent again.
+func isBrokenConn(err error) bool {
+	var closeErr *websocket.CloseError
+	if xerrors.As(err, &closeErr) {
+		return closeErr.Code == websocket.CloseAbnormalClosure ||
+			closeErr.Code == websocket.CloseGoingAway
+	}
+	var netErr net.Error
+	if xerrors.As(err, &netErr) && netErr.Timeout() {
+		return false
+	}
+	return true
+}
+
+// SendBatch sends all requests to the given path in one websocket frame and
+// returns the replies in the same order. The connection uses the
+// BatchSubprotocol, so it is not shared with Send. If some of the requests
+// fail, their reply is nil and the returned error lists them.
+func (c *Client) SendBatch(dst *network.ServerIdentity, path string, bufs [][]byte) ([][]byte, error) {
+	dest := destination{si: dst, path: path, subprotocol: BatchSubprotocol}
+	conn, connLock, err := c.newConnIfNotExist(dest)
 	if err != nil {
 		return nil, xerrors.Errorf("new connection: %v", err)
 	}
 	defer connLock.Unlock()
 
+	buf := encodeBatch(bufs)
 	var rcv []byte
 	defer func() {
 		c.Lock()
-		c.closeSingleUseConn(dst, path)
-		c.rx += uint64(len(rcv))
-		c.tx += uint64(len(buf))
+		c.closeSingleUseConn(dest)
 		c.Unlock()
 	}()
 
-	log.Lvlf4("Sending %x to %s/%s", buf, c.service, path)
+	log.Lvlf4("Sending batch of %d to %s/%s", len(bufs), c.service, path)
 	if err := conn.WriteMessage(websocket.BinaryMessage, buf); err != nil {
 		return nil, xerrors.Errorf("connection write: %v", err)
 	}
@@ -201,7 +349,31 @@ func (c *Client) Send(dst *network.ServerIdentity, path string, buf []byte) ([]b
 	if err != nil {
 		return nil, xerrors.Errorf("connection read: %v", err)
 	}
-	return rcv, nil
+	replies, err := decodeBatch(rcv)
+	if err != nil {
+		return nil, xerrors.Errorf("decoding batch: %v", err)
+	}
+	if len(replies) != len(bufs) {
+		return nil, xerrors.Errorf("got %d replies for %d requests",
+			len(replies), len(bufs))
+	}
+
+	var errstrs []string
+	for i, r := range replies {
+		if len(r) == 0 {
+			return nil, xerrors.Errorf("empty reply for request %d", i)
+		}
+		if r[0] == batchReplyOK {
+			replies[i] = r[1:]
+			continue
+		}
+		replies[i] = nil
+		errstrs = append(errstrs, fmt.Sprintf("request %d: %s", i, r[1:]))
+	}
+	if len(errstrs) > 0 {
+		return replies, xerrors.New(strings.Join(errstrs, "\n"))
+	}
+	return replies, nil
 }
 
 // SendProtobuf wraps protobuf.(En|De)code over the Client.Send-function. It
@@ -211,7 +383,13 @@ func (c *Client) Send(dst *network.ServerIdentity, path string, buf []byte) ([]b
 // client. If there is no error, the ret-structure is filled with the
 // data from the service.
 func (c *Client) SendProtobuf(dst *network.ServerIdentity, msg interface{}, ret interface{}) error {
-	buf, err := protobuf.Encode(msg)
+	return c.sendWithCodec(dst, c.codec(), msg, ret)
+}
+
+// sendWithCodec does the same as SendProtobuf, encoding msg and decoding ret
+// with codec.
+func (c *Client) sendWithCodec(dst *network.ServerIdentity, codec Codec, msg interface{}, ret interface{}) error {
+	buf, err := codec.Marshal(msg)
 	if err != nil {
 		return xerrors.Errorf("encoding: %v", err)
 	}
@@ -221,7 +399,7 @@ func (c *Client) SendProtobuf(dst *network.ServerIdentity, msg interface{}, ret
 		return xerrors.Errorf("sending: %v", err)
 	}
 	if ret != nil {
-		err := protobuf.DecodeWithConstructors(reply, ret, network.DefaultConstructors(c.suite))
+		err := codec.Unmarshal(reply, ret, network.DefaultConstructors(c.suite))
 		if err != nil {
 			return xerrors.Errorf("decoding: %v", err)
 		}
@@ -229,6 +407,14 @@ func (c *Client) SendProtobuf(dst *network.ServerIdentity, msg interface{}, ret
 	return nil
 }
 
+// codec returns the codec of the messages sent by the client.
+func (c *Client) codec() Codec {
+	if c.Codec == nil {
+		return ProtobufCodec
+	}
+	return c.Codec
+}
+
 // ParallelOptions defines how SendProtobufParallel behaves. Each field has a default
 // value that will be used if 'nil' is passed to SendProtobufParallel. For integers,
 // the default will also be used if the integer = 0.
@@ -254,6 +440,22 @@ type ParallelOptions struct {
 	// StartNode will be applied before shuffling.
 	//   Default: false
 	DontShuffle bool
+	// FailedNodesTimeout - if > 0, the nodes that failed to answer this client during the
+	// last FailedNodesTimeout are contacted after all the other nodes.
+	//   Default: 0
+	FailedNodesTimeout time.Duration
+	// SkipFailedNodes - if true, the nodes that failed during the last FailedNodesTimeout are
+	// not contacted at all. Like IgnoreNodes, they are counted towards AskNodes.
+	//   Default: false
+	SkipFailedNodes bool
+	// MaxAttempts - if > 0, at most this number of nodes are contacted in total. Unlike
+	// AskNodes, ignored and skipped nodes are not counted.
+	//   Default: 0
+	MaxAttempts int
+	// Quorum - if > 1, the request only succeeds once this number of nodes returned the
+	// same reply, byte for byte. This protects read requests against a single malicious node.
+	//   Default: 0, the first reply is returned
+	Quorum int
 }
 
 // GetList returns how many requests to start in parallel and a channel of nodes to be used.
@@ -318,6 +520,19 @@ func (po *ParallelOptions) Quit() bool {
 	return po.QuitError
 }
 
+// limitAttempts keeps only the first MaxAttempts nodes of nodesChan, if
+// po.MaxAttempts is set.
+func (po *ParallelOptions) limitAttempts(nodesChan chan *network.ServerIdentity) chan *network.ServerIdentity {
+	if po == nil || po.MaxAttempts <= 0 || len(nodesChan) <= po.MaxAttempts {
+		return nodesChan
+	}
+	limited := make(chan *network.ServerIdentity, po.MaxAttempts)
+	for i := 0; i < po.MaxAttempts; i++ {
+		limited <- <-nodesChan
+	}
+	return limited
+}
+
 // Decoder is a function that takes the data and the interface to fill in
 // as input and decodes the message.
 type Decoder func(data []byte, ret interface{}) error
@@ -326,20 +541,36 @@ type Decoder func(data []byte, ret interface{}) error
 // answer. If all nodes return an error, only the first error is returned.
 // The behaviour of this method can be changed using the ParallelOptions argument. It is kept
 // as a structure for future enhancements. If opt is nil, then standard values will be taken.
+// The msg is encoded with the codec of the client, and the replies are decoded
+// with decoder.
 func (c *Client) SendProtobufParallelWithDecoder(nodes []*network.ServerIdentity, msg interface{}, ret interface{},
 	opt *ParallelOptions, decoder Decoder) (*network.ServerIdentity, error) {
-	buf, err := protobuf.Encode(msg)
+	buf, err := c.codec().Marshal(msg)
 	if err != nil {
-		return nil, xerrors.Errorf("decoding: %v", err)
+		return nil, xerrors.Errorf("encoding: %v", err)
 	}
 	path := strings.Split(reflect.TypeOf(msg).String(), ".")[1]
 
 	parallel, nodesChan := opt.GetList(nodes)
+	nodesChan = c.sortFailedNodes(nodesChan, opt)
+	nodesChan = opt.limitAttempts(nodesChan)
 	nodesNbr := len(nodesChan)
+	if nodesNbr == 0 {
+		return nil, xerrors.New("no node left to contact")
+	}
 	errChan := make(chan error, nodesNbr)
 	decodedChan := make(chan *network.ServerIdentity, 1)
 	var decoding sync.Mutex
 	done := make(chan bool)
+	quorum := 0
+	if opt != nil {
+		quorum = opt.Quorum
+	}
+	type nodeReply struct {
+		node  *network.ServerIdentity
+		reply []byte
+	}
+	replyChan := make(chan nodeReply, nodesNbr)
 
 	contactNode := func() bool {
 		select {
@@ -350,9 +581,12 @@ func (c *Client) SendProtobufParallelWithDecoder(nodes []*network.ServerIdentity
 			case node := <-nodesChan:
 				log.Lvlf3("Asking %T from: %v - %v", msg, node.Address, node.URL)
 				reply, err := c.Send(node, path, buf)
+				c.setFailed(node, err != nil)
 				if err != nil {
 					log.Lvl2("Error while sending to node:", node, err)
 					errChan <- err
+				} else if quorum > 1 {
+					replyChan <- nodeReply{node, reply}
 				} else {
 					log.Lvl3("Done asking node", node, len(reply))
 					decoding.Lock()
@@ -390,10 +624,30 @@ func (c *Client) SendProtobufParallelWithDecoder(nodes []*network.ServerIdentity
 	}
 
 	var errs []error
-	for len(errs) < nodesNbr {
+	replies := make(map[string][]*network.ServerIdentity)
+	var answers []string
+	nbrReplies := 0
+	for len(errs)+nbrReplies < nodesNbr {
 		select {
 		case node := <-decodedChan:
 			return node, nil
+		case nr := <-replyChan:
+			nbrReplies++
+			key := string(nr.reply)
+			if replies[key] == nil {
+				answers = append(answers, key)
+			}
+			replies[key] = append(replies[key], nr.node)
+			if len(replies[key]) < quorum {
+				continue
+			}
+			close(done)
+			if ret != nil {
+				if err := decoder(nr.reply, ret); err != nil {
+					return nil, xerrors.Errorf("decoding: %v", err)
+				}
+			}
+			return replies[key][0], nil
 		case err := <-errChan:
 			if opt.Quit() {
 				close(done)
@@ -403,16 +657,73 @@ func (c *Client) SendProtobufParallelWithDecoder(nodes []*network.ServerIdentity
 		}
 	}
 
+	if quorum > 1 && nbrReplies > 0 {
+		var divergent []string
+		for _, a := range answers {
+			var nodes []string
+			for _, node := range replies[a] {
+				nodes = append(nodes, node.Address.String())
+			}
+			divergent = append(divergent, fmt.Sprintf("%x from %s", sha256.Sum256([]byte(a)),
+				strings.Join(nodes, ", ")))
+		}
+		return nil, xerrors.Errorf("no quorum of %d replies with %d errors, got: %s",
+			quorum, len(errs), strings.Join(divergent, "; "))
+	}
 	return nil, errs[0]
 }
 
+// setFailed records whether the last message sent to the node failed.
+func (c *Client) setFailed(node *network.ServerIdentity, failed bool) {
+	c.Lock()
+	defer c.Unlock()
+	if failed {
+		c.failures[node.ID] = time.Now()
+	} else {
+		delete(c.failures, node.ID)
+	}
+}
+
+// sortFailedNodes returns a channel with the nodes of nodesChan, where the nodes that
+// failed recently are put at the end, or removed if opt.SkipFailedNodes is set.
+func (c *Client) sortFailedNodes(nodesChan chan *network.ServerIdentity,
+	opt *ParallelOptions) chan *network.ServerIdentity {
+	if opt == nil || opt.FailedNodesTimeout <= 0 {
+		return nodesChan
+	}
+	var healthy, failed []*network.ServerIdentity
+	c.Lock()
+	for len(nodesChan) > 0 {
+		node := <-nodesChan
+		if t, ok := c.failures[node.ID]; ok && time.Since(t) < opt.FailedNodesTimeout {
+			failed = append(failed, node)
+		} else {
+			healthy = append(healthy, node)
+		}
+	}
+	c.Unlock()
+	if opt.SkipFailedNodes {
+		failed = nil
+	}
+
+	sorted := make(chan *network.ServerIdentity, len(healthy)+len(failed))
+	for _, node := range append(healthy, failed...) {
+		sorted <- node
+	}
+	return sorted
+}
+
 // SendProtobufParallel sends the msg to a set of nodes in parallel and returns the first successful
 // answer. If all nodes return an error, only the first error is returned.
 // The behaviour of this method can be changed using the ParallelOptions argument. It is kept
 // as a structure for future enhancements. If opt is nil, then standard values will be taken.
 func (c *Client) SendProtobufParallel(nodes []*network.ServerIdentity, msg interface{}, ret interface{},
 	opt *ParallelOptions) (*network.ServerIdentity, error) {
-	si, err := c.SendProtobufParallelWithDecoder(nodes, msg, ret, opt, protobuf.Decode)
+	codec := c.codec()
+	decoder := func(data []byte, ret interface{}) error {
+		return codec.Unmarshal(data, ret, network.DefaultConstructors(c.suite))
+	}
+	si, err := c.SendProtobufParallelWithDecoder(nodes, msg, ret, opt, decoder)
 	if err != nil {
 		return nil, xerrors.Errorf("sending: %v", err)
 	}
@@ -424,6 +735,10 @@ func (c *Client) SendProtobufParallel(nodes []*network.ServerIdentity, msg inter
 type StreamingConn struct {
 	conn  *websocket.Conn
 	suite network.Suite
+	codec Codec
+	// whether the replies are numbered, and the number of the last one
+	sequenced bool
+	seq       uint64
 }
 
 // StreamingReadOpts contains options for the ReadMessageWithOpts. It allows us
@@ -433,7 +748,8 @@ type StreamingReadOpts struct {
 }
 
 // ReadMessage read more data from the connection, it will block if there are
-// no messages.
+// no messages. If ret is a *network.Message, the reply of a handler
+// registered with RegisterTypedStreamingHandler is decoded as its own type.
 func (c *StreamingConn) ReadMessage(ret interface{}) error {
 	opts := StreamingReadOpts{
 		Deadline: time.Now().Add(5 * time.Minute),
@@ -457,13 +773,39 @@ func (c *StreamingConn) readMsg(ret interface{}, opts StreamingReadOpts) error {
 	if err != nil {
 		return xerrors.Errorf("connection read: %w", err)
 	}
-	err = protobuf.DecodeWithConstructors(buf, ret, network.DefaultConstructors(c.suite))
+	if c.sequenced {
+		if len(buf) < 8 {
+			return xerrors.New("missing sequence number")
+		}
+		c.seq = binary.BigEndian.Uint64(buf)
+		buf = buf[8:]
+	}
+	// The replies of a typed streaming handler are decoded as their type.
+	if msg, ok := ret.(*network.Message); ok {
+		_, *msg, err = network.Unmarshal(buf, c.suite)
+		if err != nil {
+			return xerrors.Errorf("decoding: %v", err)
+		}
+		return nil
+	}
+	codec := c.codec
+	if codec == nil {
+		codec = ProtobufCodec
+	}
+	err = codec.Unmarshal(buf, ret, network.DefaultConstructors(c.suite))
 	if err != nil {
 		return xerrors.Errorf("decoding: %v", err)
 	}
 	return nil
 }
 
+// LastSeq returns the sequence number of the last reply read from a stream
+// opened with StreamFrom. It is the one to give to StreamFrom to resume the
+// stream.
+func (c *StreamingConn) LastSeq() uint64 {
+	return c.seq
+}
+
 // Ping sends a ping message. Data can be nil.
 func (c *StreamingConn) Ping(data []byte, deadline time.Time) error {
 	return c.conn.WriteControl(websocket.PingMessage, data, deadline)
@@ -472,13 +814,13 @@ func (c *StreamingConn) Ping(data []byte, deadline time.Time) error {
 // Stream will send a request to start streaming, it returns a connection where
 // the client can continue to read values from it.
 func (c *Client) Stream(dst *network.ServerIdentity, msg interface{}) (StreamingConn, error) {
-	buf, err := protobuf.Encode(msg)
+	buf, err := c.codec().Marshal(msg)
 	if err != nil {
 		return StreamingConn{}, err
 	}
 	path := strings.Split(reflect.TypeOf(msg).String(), ".")[1]
 
-	conn, connLock, err := c.newConnIfNotExist(dst, path)
+	conn, connLock, err := c.newConnIfNotExist(destination{si: dst, path: path})
 	if err != nil {
 		return StreamingConn{}, err
 	}
@@ -487,10 +829,56 @@ func (c *Client) Stream(dst *network.ServerIdentity, msg interface{}) (Streaming
 	if err != nil {
 		return StreamingConn{}, err
 	}
+	return StreamingConn{conn: conn, suite: c.Suite(), codec: c.codec()}, nil
+}
+
+// StreamFrom does the same as Stream, but the replies are numbered so that
+// the stream can be resumed if the connection breaks. seq is the number of
+// the last reply received, as given by StreamingConn.LastSeq, or 0 to start a
+// new stream. Resuming a stream requires the service to support it, see
+// ResumableRequest.
+func (c *Client) StreamFrom(dst *network.ServerIdentity, msg interface{}, seq uint64) (StreamingConn, error) {
+	buf, err := c.codec().Marshal(msg)
+	if err != nil {
+		return StreamingConn{}, err
+	}
+	path := strings.Split(reflect.TypeOf(msg).String(), ".")[1]
+
+	dest := destination{si: dst, path: path, subprotocol: SequencedStreamSubprotocol}
+	// The connection of the stream to resume is most probably broken.
+	if seq > 0 {
+		c.dropConn(dest)
+	}
+	conn, connLock, err := c.newConnIfNotExist(dest)
+	if err != nil {
+		return StreamingConn{}, err
+	}
+	defer connLock.Unlock()
+	buf = append(encodeSeq(seq), buf...)
+	err = conn.WriteMessage(websocket.BinaryMessage, buf)
+	if err != nil {
+		return StreamingConn{}, err
+	}
+	return StreamingConn{conn: conn, suite: c.Suite(), codec: c.codec(), sequenced: true, seq: seq}, nil
+}
+
+// dropConn closes the connection to the destination, if any, without
+// telling the server.
+func (c *Client) dropConn(dest destination) {
 	c.Lock()
-	c.tx += uint64(len(buf))
+	connLock, exists := c.connectionsLock[dest]
 	c.Unlock()
-	return StreamingConn{conn, c.Suite()}, nil
+	if !exists {
+		return
+	}
+	connLock.Lock()
+	defer connLock.Unlock()
+	c.Lock()
+	defer c.Unlock()
+	if conn, ok := c.connections[dest]; ok {
+		conn.Close()
+		delete(c.connections, dest)
+	}
 }
 
 // SendToAll sends a message to all ServerIdentities of the Roster and returns
@@ -512,6 +900,146 @@ func (c *Client) SendToAll(dst *Roster, path string, buf []byte) ([][]byte, erro
 	return msgs, err
 }
 
+// VerifyRoster asks dst if it knows the roster with the ID of ro and if its
+// list of servers is the same, to catch configuration drifts before
+// starting a protocol. It returns false if the roster is unknown to dst or if
+// the lists differ. Like ReachableRoster, the request goes through the
+// service of the client, so dst needs to run it.
+func (c *Client) VerifyRoster(dst *network.ServerIdentity, ro *Roster) (bool, error) {
+	id, err := ro.GetID()
+	if err != nil {
+		return false, xerrors.Errorf("roster id: %v", err)
+	}
+	buf, err := protobuf.Encode(&VerifyRoster{RosterID: ro.ID, ListID: id})
+	if err != nil {
+		return false, xerrors.Errorf("encoding: %v", err)
+	}
+	rcv, err := c.Send(dst, verifyRosterPath, buf)
+	if err != nil {
+		return false, xerrors.Errorf("sending: %v", err)
+	}
+	reply := &VerifyRosterReply{}
+	if err := protobuf.Decode(rcv, reply); err != nil {
+		return false, xerrors.Errorf("decoding: %v", err)
+	}
+	return reply.Known && reply.Matching, nil
+}
+
+// StreamLogs asks dst to stream its log lines up to the given level, which
+// must have been enabled with WebSocket.SetLogStream using the same token.
+// The server never sends the lines it doesn't log itself, whatever the level.
+// The lines are read from the returned connection as LogStreamReply. Like
+// VerifyRoster, the request goes through the service of the client.
+func (c *Client) StreamLogs(dst *network.ServerIdentity, token string, level int) (StreamingConn, error) {
+	buf, err := protobuf.Encode(&LogStream{Token: token, Level: level})
+	if err != nil {
+		return StreamingConn{}, xerrors.Errorf("encoding: %v", err)
+	}
+	conn, connLock, err := c.newConnIfNotExist(destination{si: dst, path: logStreamPath})
+	if err != nil {
+		return StreamingConn{}, xerrors.Errorf("connecting: %v", err)
+	}
+	defer connLock.Unlock()
+	err = conn.WriteMessage(websocket.BinaryMessage, buf)
+	if err != nil {
+		return StreamingConn{}, xerrors.Errorf("sending: %v", err)
+	}
+	return StreamingConn{conn: conn, suite: c.Suite()}, nil
+}
+
+// ReachableRoster pings all members of the roster in parallel and returns a
+// new roster with the members that answered within the timeout, in the same
+// order. It returns nil if no member answered. The members are pinged through
+// the service of the client, so they need to run it.
+func (c *Client) ReachableRoster(ro *Roster, timeout time.Duration) *Roster {
+	list, err := c.CheckConnectivity(ro, timeout)
+	if err != nil {
+		log.Lvl2("Couldn't ping:", err)
+	}
+	return NewRoster(list)
+}
+
+// CheckConnectivity pings all members of the roster in parallel, each over a
+// new connection closed afterwards, and returns the members that answered
+// within the timeout, in the order of the roster. The returned error lists
+// the members that didn't answer with the reason, if any. Like for
+// ReachableRoster, the members need to run the service of the client.
+func (c *Client) CheckConnectivity(ro *Roster, timeout time.Duration) ([]*network.ServerIdentity, error) {
+	deadline := time.Now().Add(timeout)
+	type answer struct {
+		i   int
+		err error
+	}
+	answers := make(chan answer, len(ro.List))
+	for i, si := range ro.List {
+		go func(i int, si *network.ServerIdentity) {
+			answers <- answer{i, c.ping(si, deadline)}
+		}(i, si)
+	}
+
+	errs := make([]error, len(ro.List))
+	for i := range errs {
+		errs[i] = xerrors.New("no answer within the timeout")
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+wait:
+	for n := 0; n < len(ro.List); n++ {
+		select {
+		case a := <-answers:
+			errs[a.i] = a.err
+		case <-timer.C:
+			break wait
+		}
+	}
+
+	var list []*network.ServerIdentity
+	var errstrs []string
+	for i, si := range ro.List {
+		if errs[i] == nil {
+			list = append(list, si)
+		} else {
+			errstrs = append(errstrs, fmt.Sprintf("%v: %v", si, errs[i]))
+		}
+	}
+	if len(errstrs) > 0 {
+		return list, xerrors.New(strings.Join(errstrs, "\n"))
+	}
+	return list, nil
+}
+
+// ping opens a new connection to the service on dst and waits for the answer
+// to a websocket ping until the deadline.
+func (c *Client) ping(dst *network.ServerIdentity, deadline time.Time) error {
+	dest := destination{si: dst, path: "ping"}
+	conn, connLock, err := c.newConnIfNotExist(dest)
+	if err != nil {
+		return xerrors.Errorf("connecting: %v", err)
+	}
+	connLock.Unlock()
+	defer c.dropConn(dest)
+
+	// The pong handler is only called while reading from the connection.
+	done := make(chan error, 2)
+	conn.SetPongHandler(func(string) error {
+		done <- nil
+		return nil
+	})
+	if err := conn.SetReadDeadline(deadline); err != nil {
+		return xerrors.Errorf("read deadline: %v", err)
+	}
+	go func() {
+		_, _, err := conn.ReadMessage()
+		done <- xerrors.Errorf("connection read: %v", err)
+	}()
+
+	sc := StreamingConn{conn: conn, suite: c.suite}
+	if err := sc.Ping(nil, deadline); err != nil {
+		return xerrors.Errorf("sending ping: %v", err)
+	}
+	return <-done
+}
+
 // Close sends a close-command to all open connections and returns nil if no
 // errors occurred or all errors encountered concatenated together as a string.
 func (c *Client) Close() error {
@@ -554,17 +1082,33 @@ func (c *Client) closeConn(dst destination) error {
 // Tx returns the number of bytes transmitted by this Client. It implements
 // the monitor.CounterIOMeasure interface.
 func (c *Client) Tx() uint64 {
-	c.Lock()
-	defer c.Unlock()
-	return c.tx
+	return c.tx.get()
 }
 
 // Rx returns the number of bytes read by this Client. It implements
 // the monitor.CounterIOMeasure interface.
 func (c *Client) Rx() uint64 {
-	c.Lock()
-	defer c.Unlock()
-	return c.rx
+	return c.rx.get()
+}
+
+// countingConn counts the bytes going through the connection in the Rx and Tx
+// of the client, so that they include the framing and the compression of the
+// websockets.
+type countingConn struct {
+	net.Conn
+	cl *Client
+}
+
+func (cc countingConn) Read(b []byte) (int, error) {
+	n, err := cc.Conn.Read(b)
+	cc.cl.rx.add(uint64(n))
+	return n, err
+}
+
+func (cc countingConn) Write(b []byte) (int, error) {
+	n, err := cc.Conn.Write(b)
+	cc.cl.tx.add(uint64(n))
+	return n, err
 }
 
 // schemeToPort returns the port corresponding to the given scheme, much like netdb.
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/binary"
 	"io/ioutil"
 	"net/http"
 	"os"
@@ -50,6 +51,168 @@ func TestClient_Send(t *testing.T) {
 	require.True(t, client.Tx() > client.Rx())
 }
 
+// reversedCodec encodes the messages with protobuf, in reverse order, so that
+// they can't be decoded as protobuf.
+type reversedCodec struct{}
+
+func (reversedCodec) Name() string {
+	return "reversed"
+}
+
+func (reversedCodec) Marshal(msg interface{}) ([]byte, error) {
+	buf, err := protobuf.Encode(msg)
+	return reverseBytes(buf), err
+}
+
+func (reversedCodec) Unmarshal(buf []byte, msg interface{}, cons protobuf.Constructors) error {
+	return protobuf.DecodeWithConstructors(reverseBytes(append([]byte{}, buf...)), msg, cons)
+}
+
+func reverseBytes(buf []byte) []byte {
+	for i, j := 0, len(buf)-1; i < j; i, j = i+1, j-1 {
+		buf[i], buf[j] = buf[j], buf[i]
+	}
+	return buf
+}
+
+type unknownCodec struct {
+	reversedCodec
+}
+
+func (unknownCodec) Name() string {
+	return "unknown"
+}
+
+func init() {
+	if err := RegisterCodec(reversedCodec{}); err != nil {
+		panic(err)
+	}
+}
+
+const codecServiceName = "codecService"
+
+// codecService replies with the number of nodes of the roster of the
+// request.
+type codecService struct {
+	*ServiceProcessor
+}
+
+func newCodecService(c *Context) (Service, error) {
+	s := &codecService{ServiceProcessor: NewServiceProcessor(c)}
+	if err := s.RegisterHandler(s.CountNodes); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *codecService) CountNodes(req *SimpleRequest) (*SimpleResponse, error) {
+	return &SimpleResponse{Val: int64(len(req.ServerIdentities.List))}, nil
+}
+
+func TestClient_Codec(t *testing.T) {
+	local := NewTCPTest(tSuite)
+	defer local.CloseAll()
+
+	_, err := RegisterNewService(codecServiceName, newCodecService)
+	require.NoError(t, err)
+	defer ServiceFactory.Unregister(codecServiceName)
+
+	require.Error(t, RegisterCodec(ProtobufCodec))
+
+	servers, el, _ := local.GenTree(2, false)
+	// The roster of the request has points to decode with the constructors.
+	r := &SimpleRequest{ServerIdentities: el}
+
+	client := local.NewClient(codecServiceName)
+	client.Codec = reversedCodec{}
+	sr := &SimpleResponse{}
+	require.NoError(t, client.SendProtobuf(servers[0].ServerIdentity, r, sr))
+	require.Equal(t, int64(2), sr.Val)
+
+	client = local.NewClient(codecServiceName)
+	client.Codec = unknownCodec{}
+	err = client.SendProtobuf(servers[0].ServerIdentity, r, sr)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "unknown codec")
+}
+
+// TestClient_Codec_parallelAndStream makes sure SendProtobufParallel and
+// StreamFrom use the codec of the client too.
+func TestClient_Codec_parallelAndStream(t *testing.T) {
+	local := NewTCPTest(tSuite)
+	defer local.CloseAll()
+
+	_, err := RegisterNewService(codecServiceName, newCodecService)
+	require.NoError(t, err)
+	defer ServiceFactory.Unregister(codecServiceName)
+	serName := "resumableStreamingService"
+	_, err = RegisterNewService(serName, newResumableStreamingService)
+	require.NoError(t, err)
+	defer UnregisterService(serName)
+
+	servers, el, _ := local.GenTree(2, false)
+	r := &SimpleRequest{ServerIdentities: el}
+
+	client := local.NewClient(codecServiceName)
+	client.Codec = reversedCodec{}
+	sr := &SimpleResponse{}
+	_, err = client.SendProtobufParallel(el.List, r, sr, nil)
+	require.NoError(t, err)
+	require.Equal(t, int64(2), sr.Val)
+
+	client = local.NewClientKeep(serName)
+	defer client.Close()
+	client.Codec = reversedCodec{}
+	conn, err := client.StreamFrom(servers[0].ServerIdentity, &CountRequest{Count: 2}, 0)
+	require.NoError(t, err)
+	for i := 1; i <= 2; i++ {
+		resp := &CountResponse{}
+		require.NoError(t, conn.ReadMessage(resp))
+		require.Equal(t, int64(i), resp.Value)
+	}
+}
+
+func TestClient_SendBatch(t *testing.T) {
+	local := NewTCPTest(tSuite)
+	defer local.CloseAll()
+
+	h := local.GenServers(1)[0]
+	client := local.NewClientKeep(testServiceName)
+
+	const nbr = 10
+	bufs := make([][]byte, nbr)
+	for i := range bufs {
+		buf, err := protobuf.Encode(&testMsg{int64(i)})
+		require.NoError(t, err)
+		bufs[i] = buf
+	}
+	replies, err := client.SendBatch(h.ServerIdentity, "testMsg", bufs)
+	require.NoError(t, err)
+	require.Equal(t, nbr, len(replies))
+	for i, reply := range replies {
+		msg := &testMsg{}
+		require.NoError(t, protobuf.Decode(reply, msg))
+		require.Equal(t, int64(i), msg.I)
+	}
+
+	// A failing request doesn't prevent the others from being answered.
+	log.OutputToBuf()
+	replies, err = client.SendBatch(h.ServerIdentity, "testMsg",
+		[][]byte{bufs[0], {0xff}, bufs[2]})
+	log.OutputToOs()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "request 1:")
+	require.Equal(t, 3, len(replies))
+	require.Nil(t, replies[1])
+	require.Equal(t, bufs[2], replies[2])
+
+	// Clients not using batches are unaffected.
+	msg := &testMsg{}
+	require.NoError(t, client.SendProtobuf(h.ServerIdentity, &testMsg{12}, msg))
+	require.Equal(t, int64(12), msg.I)
+	require.NoError(t, client.Close())
+}
+
 func TestClientTLS_Send(t *testing.T) {
 	cert, key, err := getSelfSignedCertificateAndKey()
 	require.Nil(t, err)
@@ -88,6 +251,33 @@ func TestClientTLS_Send(t *testing.T) {
 	require.True(t, client.Tx() > client.Rx())
 }
 
+func TestClientTLS_MinVersion(t *testing.T) {
+	cert, key, err := getSelfSignedCertificateAndKey()
+	require.NoError(t, err)
+	CAPool := x509.NewCertPool()
+	CAPool.AppendCertsFromPEM(cert)
+	keyPair, err := tls.X509KeyPair(cert, key)
+	require.NoError(t, err)
+
+	local := NewTCPTest(tSuite)
+	defer local.CloseAll()
+	local.webSocketTLSCertificate = cert
+	local.webSocketTLSCertificateKey = key
+	// The options have to be set before the server is started.
+	server := local.newTCPServer(tSuite)
+	server.WebSocket.TLSConfig = &tls.Config{Certificates: []tls.Certificate{keyPair}}
+	server.WebSocket.SetTLSOptions(tls.VersionTLS13, nil)
+	server.StartInBackground()
+
+	send := func(maxVersion uint16) error {
+		client := NewClient(tSuite, serviceWebSocket)
+		client.TLSClientConfig = &tls.Config{RootCAs: CAPool, MaxVersion: maxVersion}
+		return client.SendProtobuf(server.ServerIdentity, &SimpleResponse{}, &SimpleResponse{})
+	}
+	require.Error(t, send(tls.VersionTLS12))
+	require.NoError(t, send(tls.VersionTLS13))
+}
+
 func TestClientTLS_certfile_Send(t *testing.T) {
 	// like TestClientTLSfile_Send, but uses cert and key from a file
 	// to solve issue 583.
@@ -253,6 +443,51 @@ func TestMultiplePath(t *testing.T) {
 	require.Equal(t, path2, string(resp))
 }
 
+func TestClient_Reconnect(t *testing.T) {
+	_, err := RegisterNewService(dummyService3Name, func(c *Context) (Service, error) {
+		ds := &DummyService3{}
+		return ds, nil
+	})
+	require.Nil(t, err)
+	defer UnregisterService(dummyService3Name)
+
+	local := NewTCPTest(tSuite)
+	hs := local.GenServers(1)
+	server := hs[0]
+	defer local.CloseAll()
+	client := NewClientKeep(tSuite, dummyService3Name)
+	defer client.Close()
+	msg, err := protobuf.Encode(&DummyMsg{})
+	require.Nil(t, err)
+	dest := destination{si: server.ServerIdentity, path: "path1"}
+
+	kill := func() {
+		client.Lock()
+		conn := client.connections[dest]
+		client.Unlock()
+		require.NotNil(t, conn)
+		require.NoError(t, conn.UnderlyingConn().Close())
+	}
+
+	_, err = client.Send(server.ServerIdentity, "path1", msg)
+	require.NoError(t, err)
+
+	// The broken connection is replaced by a new one.
+	kill()
+	resp, err := client.Send(server.ServerIdentity, "path1", msg)
+	require.NoError(t, err)
+	require.Equal(t, "path1", string(resp))
+
+	// Without reconnection, the error is returned but the broken connection
+	// is dropped anyway.
+	client.Reconnect = 0
+	kill()
+	_, err = client.Send(server.ServerIdentity, "path1", msg)
+	require.Error(t, err)
+	_, err = client.Send(server.ServerIdentity, "path1", msg)
+	require.NoError(t, err)
+}
+
 func TestMultiplePathTLS(t *testing.T) {
 	cert, key, err := getSelfSignedCertificateAndKey()
 	require.Nil(t, err)
@@ -492,6 +727,249 @@ func TestWebSocket_Streaming_bi_normal(t *testing.T) {
 	time.Sleep(time.Second)
 }
 
+// TestWebSocket_Streaming_shutdown makes sure the client is told when the
+// server closes during a stream.
+func TestWebSocket_Streaming_shutdown(t *testing.T) {
+	local := NewTCPTest(tSuite)
+	defer local.CloseAll()
+
+	serName := "streamingService"
+	serID, err := RegisterNewService(serName, newStreamingService)
+	require.NoError(t, err)
+	defer UnregisterService(serName)
+
+	servers, el, _ := local.GenTree(4, false)
+	client := local.NewClientKeep(serName)
+	defer client.Close()
+	services := local.GetServices(servers, serID)
+	serviceRoot := services[0].(*StreamingService)
+	serviceRoot.gotStopChan = make(chan bool, 1)
+
+	r := &SimpleRequest{
+		ServerIdentities: el,
+		Val:              100,
+	}
+	conn, err := client.Stream(servers[0].ServerIdentity, r)
+	require.NoError(t, err)
+	require.NoError(t, conn.ReadMessage(&SimpleResponse{}))
+
+	require.NoError(t, servers[0].Close())
+
+	for {
+		err = conn.ReadMessage(&SimpleResponse{})
+		if err != nil {
+			break
+		}
+	}
+	var closeErr *websocket.CloseError
+	require.True(t, xerrors.As(err, &closeErr), err.Error())
+	require.Equal(t, websocket.CloseGoingAway, closeErr.Code)
+	require.Equal(t, "server shutting down", closeErr.Text)
+
+	select {
+	case <-serviceRoot.gotStopChan:
+	case <-time.After(time.Second):
+		require.Fail(t, "should have got a stop signal")
+	}
+}
+
+type typedStreamingService struct {
+	*ServiceProcessor
+}
+
+// Events sends alternatively a SimpleResponse and a DummyMsg.
+func (s *typedStreamingService) Events(msg *SimpleRequest) (chan network.Message, chan bool, error) {
+	out := make(chan network.Message)
+	stop := make(chan bool)
+	go func() {
+		defer close(out)
+		for i := int64(0); i < msg.Val; i++ {
+			var m network.Message = &SimpleResponse{Val: i}
+			if i%2 == 1 {
+				m = &DummyMsg{A: i}
+			}
+			select {
+			case out <- m:
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return out, stop, nil
+}
+
+func TestWebSocket_Streaming_typed(t *testing.T) {
+	local := NewTCPTest(tSuite)
+	defer local.CloseAll()
+
+	serName := "typedStreamingService"
+	_, err := RegisterNewService(serName, func(c *Context) (Service, error) {
+		s := &typedStreamingService{NewServiceProcessor(c)}
+		return s, s.RegisterTypedStreamingHandler(s.Events)
+	})
+	require.NoError(t, err)
+	defer UnregisterService(serName)
+
+	servers, el, _ := local.GenTree(1, false)
+	client := local.NewClientKeep(serName)
+	defer client.Close()
+
+	conn, err := client.Stream(servers[0].ServerIdentity,
+		&SimpleRequest{ServerIdentities: el, Val: 4})
+	require.NoError(t, err)
+	for i := int64(0); i < 4; i++ {
+		var msg network.Message
+		require.NoError(t, conn.ReadMessage(&msg))
+		switch m := msg.(type) {
+		case *SimpleResponse:
+			require.Equal(t, int64(0), i%2)
+			require.Equal(t, i, m.Val)
+		case *DummyMsg:
+			require.Equal(t, int64(1), i%2)
+			require.Equal(t, i, m.A)
+		default:
+			require.Fail(t, "unexpected message", "%T", msg)
+		}
+	}
+}
+
+type overflowingService struct {
+	*StreamingService
+}
+
+// ProcessClientStreamRequest closes the stream right away, as if the client
+// fell behind.
+func (s *overflowingService) ProcessClientStreamRequest(req *http.Request, path string,
+	clientInputs chan []byte) (chan []byte, error) {
+	out := make(chan []byte)
+	close(out)
+	return out, nil
+}
+
+func (s *overflowingService) StreamError(out chan []byte) error {
+	return ErrStreamOverflow
+}
+
+// TestWebSocket_Streaming_overflow makes sure the client is told when it
+// fell behind the stream.
+func TestWebSocket_Streaming_overflow(t *testing.T) {
+	local := NewTCPTest(tSuite)
+	defer local.CloseAll()
+
+	serName := "overflowingService"
+	_, err := RegisterNewService(serName, func(c *Context) (Service, error) {
+		s, err := newStreamingService(c)
+		if err != nil {
+			return nil, err
+		}
+		return &overflowingService{s.(*StreamingService)}, nil
+	})
+	require.NoError(t, err)
+	defer UnregisterService(serName)
+
+	servers, el, _ := local.GenTree(1, false)
+	client := local.NewClientKeep(serName)
+	defer client.Close()
+
+	conn, err := client.Stream(servers[0].ServerIdentity,
+		&SimpleRequest{ServerIdentities: el, Val: 10})
+	require.NoError(t, err)
+	err = conn.ReadMessage(&SimpleResponse{})
+	var closeErr *websocket.CloseError
+	require.True(t, xerrors.As(err, &closeErr), err.Error())
+	require.Equal(t, StreamOverflowCloseCode, closeErr.Code)
+	require.Equal(t, ErrStreamOverflow.Error(), closeErr.Text)
+}
+
+// TestWebSocket_Streaming_resume drops the connection during a stream and
+// makes sure the resumed stream continues where it stopped.
+func TestWebSocket_Streaming_resume(t *testing.T) {
+	local := NewTCPTest(tSuite)
+	defer local.CloseAll()
+
+	serName := "resumableStreamingService"
+	_, err := RegisterNewService(serName, newResumableStreamingService)
+	require.NoError(t, err)
+	defer UnregisterService(serName)
+
+	servers, _, _ := local.GenTree(1, false)
+	client := local.NewClientKeep(serName)
+	defer client.Close()
+
+	req := &CountRequest{Count: 6}
+	conn, err := client.StreamFrom(servers[0].ServerIdentity, req, 0)
+	require.NoError(t, err)
+	for i := 1; i <= 3; i++ {
+		resp := &CountResponse{}
+		require.NoError(t, conn.ReadMessage(resp))
+		require.Equal(t, int64(i), resp.Value)
+		require.Equal(t, uint64(i), conn.LastSeq())
+	}
+
+	// Simulate a network failure.
+	require.NoError(t, conn.conn.Close())
+
+	conn, err = client.StreamFrom(servers[0].ServerIdentity, req, conn.LastSeq())
+	require.NoError(t, err)
+	for i := 4; i <= 6; i++ {
+		resp := &CountResponse{}
+		require.NoError(t, conn.ReadMessage(resp))
+		require.Equal(t, int64(i), resp.Value)
+		require.Equal(t, uint64(i), conn.LastSeq())
+	}
+	require.Error(t, conn.ReadMessage(&CountResponse{}))
+
+	// Streams of other handlers can't be resumed.
+	_, err = servers[0].serviceManager.service(serName).(*resumableStreamingService).
+		ProcessClientStreamRequestFrom(nil, "SimpleRequest", 1, make(chan []byte))
+	require.Error(t, err)
+}
+
+// TestWebSocket_Streaming_resume_dropOldest makes sure the replies dropped by
+// StreamDropOldest leave gaps in the sequence numbers, and that the stream
+// resumes after the last reply received.
+func TestWebSocket_Streaming_resume_dropOldest(t *testing.T) {
+	local := NewTCPTest(tSuite)
+	defer local.CloseAll()
+
+	serName := "resumableStreamingService"
+	_, err := RegisterNewService(serName, newResumableStreamingService)
+	require.NoError(t, err)
+	defer UnregisterService(serName)
+
+	servers, _, _ := local.GenTree(1, false)
+	rs := servers[0].serviceManager.service(serName).(*resumableStreamingService)
+	require.NoError(t, rs.SetStreamPolicy("CountRequest", 2, StreamDropOldest))
+
+	buf, err := protobuf.Encode(&CountRequest{Count: 10})
+	require.NoError(t, err)
+	// stream reads the replies after seq once the client had time to fall
+	// behind, and returns their sequence numbers.
+	stream := func(seq uint64) []uint64 {
+		inputChan := make(chan []byte, 1)
+		inputChan <- buf
+		defer close(inputChan)
+		outChan, err := rs.ProcessClientStreamRequestFrom(nil, "CountRequest",
+			seq, inputChan)
+		require.NoError(t, err)
+		time.Sleep(100 * time.Millisecond)
+		var got []uint64
+		for reply := range outChan {
+			require.True(t, len(reply) >= 8)
+			resp := &CountResponse{}
+			require.NoError(t, protobuf.Decode(reply[8:], resp))
+			n := binary.BigEndian.Uint64(reply[:8])
+			require.Equal(t, int64(n), resp.Value)
+			got = append(got, n)
+		}
+		return got
+	}
+
+	require.Equal(t, []uint64{9, 10}, stream(0))
+	require.Equal(t, []uint64{9, 10}, stream(3))
+	require.Equal(t, []uint64{10}, stream(9))
+}
+
 // TestWebSocket_Streaming_early_client makes the client close early.
 func TestWebSocket_Streaming_early_client(t *testing.T) {
 	local := NewTCPTest(tSuite)
@@ -807,6 +1285,192 @@ func TestClient_SendProtobufParallelWithDecoder(t *testing.T) {
 	require.NoError(t, err)
 }
 
+// Tests that nodes which failed recently are contacted last or skipped.
+func TestClient_ReachableRoster(t *testing.T) {
+	l := NewLocalTest(tSuite)
+	defer l.CloseAll()
+
+	servers := l.GenServers(2)
+	down := network.NewServerIdentity(tSuite.Point().Pick(tSuite.RandomStream()),
+		network.NewAddress(network.TLS, "127.0.0.1:2"))
+	ro := NewRoster([]*network.ServerIdentity{servers[0].ServerIdentity, down,
+		servers[1].ServerIdentity})
+
+	cl := NewClient(tSuite, serviceWebSocket)
+	up := cl.ReachableRoster(ro, 5*time.Second)
+	require.NotNil(t, up)
+	require.Equal(t, 2, len(up.List))
+	require.True(t, up.List[0].Equal(servers[0].ServerIdentity))
+	require.True(t, up.List[1].Equal(servers[1].ServerIdentity))
+
+	require.Nil(t, cl.ReachableRoster(NewRoster([]*network.ServerIdentity{down}), time.Second))
+}
+
+func TestClient_CheckConnectivity(t *testing.T) {
+	l := NewLocalTest(tSuite)
+	defer l.CloseAll()
+
+	servers := l.GenServers(2)
+	down := network.NewServerIdentity(tSuite.Point().Pick(tSuite.RandomStream()),
+		network.NewAddress(network.TLS, "127.0.0.1:2"))
+	ro := NewRoster([]*network.ServerIdentity{servers[0].ServerIdentity, down,
+		servers[1].ServerIdentity})
+
+	cl := NewClientKeep(tSuite, serviceWebSocket)
+	up, err := cl.CheckConnectivity(ro, 5*time.Second)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), down.String())
+	require.NotContains(t, err.Error(), servers[0].ServerIdentity.String())
+	require.Equal(t, 2, len(up))
+	require.True(t, up[0].Equal(servers[0].ServerIdentity))
+	require.True(t, up[1].Equal(servers[1].ServerIdentity))
+
+	// The connections are not kept.
+	cl.Lock()
+	require.Equal(t, 0, len(cl.connections))
+	cl.Unlock()
+
+	up, err = cl.CheckConnectivity(NewRoster(up), 5*time.Second)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(up))
+}
+
+func TestClient_VerifyRoster(t *testing.T) {
+	l := NewLocalTest(tSuite)
+	defer l.CloseAll()
+
+	servers := l.GenServers(3)
+	ro := l.GenRosterFromHost(servers...)
+	servers[0].overlay.RegisterTree(ro.GenerateBinaryTree())
+	// The second server has the same roster ID, but in a different order.
+	drift := l.GenRosterFromHost(servers[0], servers[2], servers[1])
+	drift.ID = ro.ID
+	servers[1].overlay.RegisterTree(drift.GenerateBinaryTree())
+
+	cl := NewClient(tSuite, serviceWebSocket)
+	ok, err := cl.VerifyRoster(servers[0].ServerIdentity, ro)
+	require.NoError(t, err)
+	require.True(t, ok)
+	ok, err = cl.VerifyRoster(servers[1].ServerIdentity, ro)
+	require.NoError(t, err)
+	require.False(t, ok)
+	ok, err = cl.VerifyRoster(servers[1].ServerIdentity, drift)
+	require.NoError(t, err)
+	require.True(t, ok)
+	// The third server doesn't know the roster.
+	ok, err = cl.VerifyRoster(servers[2].ServerIdentity, ro)
+	require.NoError(t, err)
+	require.False(t, ok)
+}
+
+func TestClient_SendProtobufParallel_FailedNodes(t *testing.T) {
+	l := NewLocalTest(tSuite)
+	defer l.CloseAll()
+
+	_, roster, _ := l.GenTree(2, false)
+	// A node that is not listening, so all connections to it fail.
+	down := network.NewServerIdentity(tSuite.Point().Pick(tSuite.RandomStream()),
+		network.NewAddress(network.TLS, "127.0.0.1:2"))
+	nodes := append([]*network.ServerIdentity{down}, roster.List...)
+
+	cl := NewClient(tSuite, serviceWebSocket)
+	opt := &ParallelOptions{
+		Parallel:           1,
+		DontShuffle:        true,
+		QuitError:          true,
+		FailedNodesTimeout: time.Minute,
+	}
+	_, err := cl.SendProtobufParallel(nodes, &SimpleResponse{}, nil, opt)
+	require.Error(t, err)
+
+	// The down node is now contacted last, so the request succeeds.
+	for i := 0; i < 3; i++ {
+		si, err := cl.SendProtobufParallel(nodes, &SimpleResponse{}, nil, opt)
+		require.NoError(t, err)
+		require.True(t, si.Equal(roster.List[0]))
+	}
+
+	// When skipping failed nodes, the down node is not contacted anymore.
+	opt.SkipFailedNodes = true
+	opt.QuitError = false
+	_, err = cl.SendProtobufParallel(nodes[0:1], &SimpleResponse{}, nil, opt)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "no node left to contact")
+	for i := 0; i < 3; i++ {
+		_, err := cl.SendProtobufParallel(nodes, &SimpleResponse{}, nil, opt)
+		require.NoError(t, err)
+	}
+
+	// Without timeout, the down node is contacted first again. Not quitting
+	// on error makes sure no request is still in flight when returning.
+	opt.FailedNodesTimeout = 0
+	opt.SkipFailedNodes = false
+	before := time.Now()
+	_, err = cl.SendProtobufParallel(nodes, &SimpleResponse{}, nil, opt)
+	require.NoError(t, err)
+	cl.Lock()
+	require.True(t, cl.failures[down.ID].After(before))
+	cl.Unlock()
+	require.NoError(t, cl.Close())
+}
+
+func TestClient_SendProtobufParallel_MaxAttempts(t *testing.T) {
+	// Nodes that are not listening, so all connections to them fail.
+	var nodes []*network.ServerIdentity
+	for i := 0; i < 20; i++ {
+		nodes = append(nodes, network.NewServerIdentity(tSuite.Point().Pick(tSuite.RandomStream()),
+			network.NewAddress(network.TLS, "127.0.0.1:2")))
+	}
+
+	cl := NewClient(tSuite, serviceWebSocket)
+	defer cl.Close()
+	opt := &ParallelOptions{
+		Parallel:    3,
+		MaxAttempts: 5,
+	}
+	_, err := cl.SendProtobufParallel(nodes, &SimpleResponse{}, nil, opt)
+	require.Error(t, err)
+	cl.Lock()
+	require.Equal(t, 5, len(cl.failures))
+	cl.Unlock()
+}
+
+func TestClient_SendProtobufParallel_Quorum(t *testing.T) {
+	l := NewLocalTest(tSuite)
+	defer l.CloseAll()
+
+	_, roster, _ := l.GenTree(4, false)
+	cl := NewClient(tSuite, serviceWebSocket)
+	opt := &ParallelOptions{
+		Parallel:    4,
+		DontShuffle: true,
+		Quorum:      3,
+	}
+
+	// One lying node can't change the result.
+	var reply SimpleResponse
+	_, err := cl.SendProtobufParallel(roster.List, &LyingRequest{Roster: *roster, Liars: 1},
+		&reply, opt)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), reply.Val)
+
+	// Two lying nodes prevent a quorum.
+	_, err = cl.SendProtobufParallel(roster.List, &LyingRequest{Roster: *roster, Liars: 3},
+		&reply, opt)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "no quorum of 3 replies")
+	for _, si := range roster.List {
+		require.Contains(t, err.Error(), si.Address.String())
+	}
+
+	// Without quorum, the first reply wins.
+	opt.Quorum = 0
+	_, err = cl.SendProtobufParallel(roster.List, &LyingRequest{Roster: *roster, Liars: 3},
+		&reply, opt)
+	require.NoError(t, err)
+	require.NoError(t, cl.Close())
+}
+
 const dummyService3Name = "dummyService3"
 
 type DummyService3 struct {
@@ -866,3 +1530,55 @@ func (ss *StreamingService) StreamValues(msg *SimpleRequest) (chan *SimpleRespon
 	}()
 	return streamingChan, stopChan, nil
 }
+
+type CountRequest struct {
+	Count  int64
+	resume uint64
+}
+
+// ResumeFrom implements ResumableRequest.
+func (cr *CountRequest) ResumeFrom(seq uint64) {
+	cr.resume = seq
+}
+
+type CountResponse struct {
+	Value int64
+}
+
+type resumableStreamingService struct {
+	*ServiceProcessor
+}
+
+func newResumableStreamingService(c *Context) (Service, error) {
+	s := &resumableStreamingService{
+		ServiceProcessor: NewServiceProcessor(c),
+	}
+	if err := s.RegisterStreamingHandlers(s.Count, s.Simple); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Count streams the values from 1 to req.Count, so the reply with sequence
+// number n has the value n.
+func (rs *resumableStreamingService) Count(req *CountRequest) (chan *CountResponse, chan bool, error) {
+	out := make(chan *CountResponse)
+	stop := make(chan bool)
+	go func() {
+		defer close(out)
+		for i := int64(req.resume) + 1; i <= req.Count; i++ {
+			select {
+			case <-stop:
+				return
+			case out <- &CountResponse{Value: i}:
+			}
+		}
+	}()
+	return out, stop, nil
+}
+
+func (rs *resumableStreamingService) Simple(req *SimpleRequest) (chan *SimpleResponse, chan bool, error) {
+	out := make(chan *SimpleResponse)
+	close(out)
+	return out, make(chan bool), nil
+}
@@ -1,6 +1,7 @@
 package onet
 
 import (
+	"context"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
@@ -11,6 +12,7 @@ import (
 	"io/ioutil"
 	"math/big"
 	"net"
+	"net/http"
 	"net/url"
 	"os"
 	"testing"
@@ -144,6 +146,7 @@ func TestNewWebSocket(t *testing.T) {
 	require.Equal(t, len(c.serviceManager.services), len(c.WebSocket.services))
 	require.NotEmpty(t, c.WebSocket.services[serviceWebSocket])
 	cl := NewClientKeep(tSuite, "WebSocket")
+	defer cl.Close()
 	req := &SimpleResponse{}
 	msgTypeID := network.MessageType(req)
 	log.Lvlf1("Sending message Request: %x", msgTypeID[:])
@@ -240,6 +243,215 @@ func TestCertificateReloader(t *testing.T) {
 	require.NotNil(t, cert)
 }
 
+func TestWebSocket_SlowHandlerThreshold(t *testing.T) {
+	l := NewLocalTest(tSuite)
+	defer l.CloseAll()
+
+	log.OutputToBuf()
+	defer log.OutputToOs()
+
+	c := l.NewServer(tSuite, 2050)
+	defer c.Close()
+	cl := NewClient(tSuite, serviceWebSocket)
+
+	err := cl.SendProtobuf(c.ServerIdentity, &SlowRequest{Sleep: 50 * time.Millisecond}, nil)
+	require.NoError(t, err)
+	require.NotContains(t, log.GetStdOut()+log.GetStdErr(), "slow handler")
+
+	c.WebSocket.SetSlowHandlerThreshold(10 * time.Millisecond)
+	err = cl.SendProtobuf(c.ServerIdentity, &SimpleResponse{}, nil)
+	require.NoError(t, err)
+	require.NotContains(t, log.GetStdOut()+log.GetStdErr(), "slow handler")
+
+	err = cl.SendProtobuf(c.ServerIdentity, &SlowRequest{Sleep: 50 * time.Millisecond}, nil)
+	require.NoError(t, err)
+	require.Contains(t, log.GetStdOut()+log.GetStdErr(),
+		"slow handler: request WebSocket/SlowRequest took")
+}
+
+func TestClient_SendWithContext(t *testing.T) {
+	l := NewLocalTest(tSuite)
+	defer l.CloseAll()
+
+	c := l.NewServer(tSuite, 2050)
+	defer c.Close()
+	cl := NewClientKeep(tSuite, serviceWebSocket)
+	defer cl.Close()
+
+	buf, err := protobuf.Encode(&SlowRequest{Sleep: 500 * time.Millisecond})
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = cl.SendWithContext(ctx, c.ServerIdentity, "SlowRequest", buf)
+	require.Equal(t, context.DeadlineExceeded, err)
+	require.True(t, time.Since(start) < 500*time.Millisecond)
+
+	// The closed connection is not used anymore.
+	cl.Lock()
+	require.Equal(t, 0, len(cl.connections))
+	cl.Unlock()
+	require.NoError(t, cl.SendProtobuf(c.ServerIdentity, &SimpleResponse{}, nil))
+
+	_, err = cl.SendWithContext(ctx, c.ServerIdentity, "SlowRequest", buf)
+	require.Equal(t, context.DeadlineExceeded, err)
+}
+
+func TestWebSocket_Compression(t *testing.T) {
+	l := NewLocalTest(tSuite)
+	defer l.CloseAll()
+
+	srv := l.GenServers(1)[0]
+	req := &PaddedRequest{Padding: make([]byte, 64*1024)}
+	send := func(compress bool) uint64 {
+		cl := NewClient(tSuite, serviceWebSocket)
+		cl.EnableCompression = compress
+		var reply PaddedRequest
+		require.NoError(t, cl.SendProtobuf(srv.ServerIdentity, req, &reply))
+		require.Equal(t, req.Padding, reply.Padding)
+		return cl.Tx()
+	}
+
+	// Without support from the server, the messages are not compressed.
+	plain := send(true)
+	require.True(t, plain > uint64(len(req.Padding)))
+	srv.WebSocket.SetCompression(true)
+	require.True(t, send(true) < plain/10)
+	// Only the handshake differs.
+	require.InDelta(t, plain, send(false), 200)
+}
+
+func TestServer_SetRateLimit(t *testing.T) {
+	l := NewLocalTest(tSuite)
+	defer l.CloseAll()
+
+	srv := l.GenServers(1)[0]
+	cl := NewClientKeep(tSuite, serviceWebSocket)
+	defer cl.Close()
+	cl.Reconnect = 0
+	for i := 0; i < 5; i++ {
+		require.NoError(t, cl.SendProtobuf(srv.ServerIdentity, &SimpleResponse{}, nil))
+	}
+
+	srv.SetRateLimit(serviceWebSocket, 0.01, 2)
+	for i := 0; i < 2; i++ {
+		require.NoError(t, cl.SendProtobuf(srv.ServerIdentity, &SimpleResponse{}, nil))
+	}
+	err := cl.SendProtobuf(srv.ServerIdentity, &SimpleResponse{}, nil)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "close 4290: too many requests")
+
+	// Every request of a batch takes a token.
+	buf, err := protobuf.Encode(&SimpleResponse{})
+	require.NoError(t, err)
+	srv.SetRateLimit(serviceWebSocket, 0.01, 3)
+	_, err = NewClient(tSuite, serviceWebSocket).SendBatch(srv.ServerIdentity,
+		"SimpleResponse", [][]byte{buf, buf, buf, buf})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "close 4290: too many requests")
+	_, err = NewClient(tSuite, serviceWebSocket).SendBatch(srv.ServerIdentity,
+		"SimpleResponse", [][]byte{buf, buf, buf})
+	require.NoError(t, err)
+	require.Error(t, cl.SendProtobuf(srv.ServerIdentity, &SimpleResponse{}, nil))
+
+	srv.SetRateLimit(serviceWebSocket, 0, 0)
+	require.NoError(t, cl.SendProtobuf(srv.ServerIdentity, &SimpleResponse{}, nil))
+}
+
+func TestRateLimiter(t *testing.T) {
+	rl := newRateLimiter(2, 3)
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		require.True(t, rl.allow("a", 1, now))
+	}
+	require.False(t, rl.allow("a", 1, now))
+	require.True(t, rl.allow("b", 1, now))
+	// Two requests per second.
+	require.True(t, rl.allow("a", 1, now.Add(500*time.Millisecond)))
+	require.False(t, rl.allow("a", 1, now.Add(500*time.Millisecond)))
+	// The burst is the maximum.
+	for i := 0; i < 3; i++ {
+		require.True(t, rl.allow("a", 1, now.Add(time.Hour)))
+	}
+	require.False(t, rl.allow("a", 1, now.Add(time.Hour)))
+	require.False(t, rl.allow("c", 4, now))
+	require.True(t, rl.allow("c", 3, now))
+	rl.forgetIdle(now.Add(2 * time.Hour))
+	require.Equal(t, 0, len(rl.buckets))
+}
+
+func TestWebSocket_LogStream(t *testing.T) {
+	l := NewLocalTest(tSuite)
+	defer l.CloseAll()
+
+	srv := l.GenServers(1)[0]
+	cl := NewClientKeep(tSuite, serviceWebSocket)
+	defer cl.Close()
+
+	// Disabled by default.
+	conn, err := cl.StreamLogs(srv.ServerIdentity, "", 3)
+	require.NoError(t, err)
+	opts := StreamingReadOpts{Deadline: time.Now().Add(200 * time.Millisecond)}
+	err = conn.ReadMessageWithOpts(&LogStreamReply{}, opts)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "log streaming is disabled")
+	cl.Close()
+
+	srv.WebSocket.SetLogStream("secret")
+	conn, err = cl.StreamLogs(srv.ServerIdentity, "wrong", 3)
+	require.NoError(t, err)
+	opts.Deadline = time.Now().Add(200 * time.Millisecond)
+	err = conn.ReadMessageWithOpts(&LogStreamReply{}, opts)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "wrong log streaming token")
+	cl.Close()
+
+	// The client can't get more than the server logs.
+	log.SetDebugVisiblePackage("onet/v3", 3)
+	defer log.UnsetDebugVisiblePackage("onet/v3")
+	conn, err = cl.StreamLogs(srv.ServerIdentity, "secret", 5)
+	require.NoError(t, err)
+	// The logger is registered asynchronously, so keep logging until the
+	// lines arrive.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(10 * time.Millisecond):
+				log.Lvl4("not streamed")
+				log.Lvl3("streamed line")
+			}
+		}
+	}()
+	for i := 0; i < 2; i++ {
+		var reply LogStreamReply
+		require.NoError(t, conn.ReadMessage(&reply))
+		require.Equal(t, 3, reply.Level)
+		require.Contains(t, reply.Msg, "streamed line")
+	}
+}
+
+func TestClientCertCN(t *testing.T) {
+	_, err := ClientCertCN(&http.Request{})
+	require.Error(t, err)
+
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "client"}}
+	req := &http.Request{TLS: &tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{cert},
+	}}
+	// The certificate has not been verified.
+	_, err = ClientCertCN(req)
+	require.Error(t, err)
+
+	req.TLS.VerifiedChains = [][]*x509.Certificate{{cert}}
+	cn, err := ClientCertCN(req)
+	require.NoError(t, err)
+	require.Equal(t, "client", cn)
+}
+
 func TestGetWebHost(t *testing.T) {
 	url, err := getWSHostPort(&network.ServerIdentity{Address: "tcp://8.8.8.8"}, true)
 	require.Error(t, err)
@@ -300,6 +512,15 @@ func (i *ServiceWebSocket) SimpleResponse(msg *SimpleResponse) (network.Message,
 	return &SimpleResponse{msg.Val + 1}, nil
 }
 
+type SlowRequest struct {
+	Sleep time.Duration
+}
+
+func (i *ServiceWebSocket) SlowRequest(msg *SlowRequest) (network.Message, error) {
+	time.Sleep(msg.Sleep)
+	return &SimpleResponse{}, nil
+}
+
 type ErrorRequest struct {
 	Roster Roster
 	Flags  int
@@ -318,10 +539,34 @@ func (i *ServiceWebSocket) ErrorRequest(msg *ErrorRequest) (network.Message, err
 	return &SimpleResponse{}, nil
 }
 
+// LyingRequest is answered with a different value by the nodes of the roster
+// whose bit is set in Liars.
+type LyingRequest struct {
+	Roster Roster
+	Liars  int
+}
+
+func (i *ServiceWebSocket) LyingRequest(msg *LyingRequest) (network.Message, error) {
+	index, _ := msg.Roster.Search(i.ServerIdentity().ID)
+	if msg.Liars&(1<<uint(index)) > 0 {
+		return &SimpleResponse{Val: 2}, nil
+	}
+	return &SimpleResponse{Val: 1}, nil
+}
+
+type PaddedRequest struct {
+	Padding []byte
+}
+
+func (i *ServiceWebSocket) PaddedRequest(msg *PaddedRequest) (network.Message, error) {
+	return &PaddedRequest{Padding: msg.Padding}, nil
+}
+
 func newServiceWebSocket(c *Context) (Service, error) {
 	s := &ServiceWebSocket{
 		ServiceProcessor: NewServiceProcessor(c),
 	}
-	log.ErrFatal(s.RegisterHandlers(s.SimpleResponse, s.ErrorRequest))
+	log.ErrFatal(s.RegisterHandlers(s.SimpleResponse, s.ErrorRequest,
+		s.SlowRequest, s.LyingRequest, s.PaddedRequest))
 	return s, nil
 }